@@ -0,0 +1,101 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/policy"
+	"github.com/RichardHoa/hack-me/internal/store"
+	"github.com/RichardHoa/hack-me/internal/utils"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+type AdminHandler struct {
+	UserStore store.UserStore
+	Policy    *policy.Engine
+	Logger    *log.Logger
+}
+
+func NewAdminHandler(userStore store.UserStore, policyEngine *policy.Engine, logger *log.Logger) *AdminHandler {
+	return &AdminHandler{
+		UserStore: userStore,
+		Policy:    policyEngine,
+		Logger:    logger,
+	}
+}
+
+var userRoles = []string{constants.RoleUser, constants.RoleModerator, constants.RoleAdmin}
+
+// SetUserRole promotes or demotes a user, the policy keeps admins from changing their own role
+func (handler *AdminHandler) SetUserRole(w http.ResponseWriter, r *http.Request) {
+	user, err := utils.GetAuthenticatedUser(r)
+	if err != nil {
+		handler.Logger.Printf("ERROR: SetUserRole > JWT token checking: %v", err)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
+		return
+	}
+
+	userID := chi.URLParam(r, "userID")
+	if _, err := uuid.Parse(userID); err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("userID must be a valid UUID", constants.MSG_INVALID_REQUEST_DATA, "userID"))
+		return
+	}
+
+	decision := handler.Policy.Authorize(policy.SubjectFromContext(r.Context()), policy.ActionManage, policy.Resource{Type: policy.ResourceUserRole, OwnerID: userID})
+	if !decision.Allowed {
+		utils.WriteJSON(w, http.StatusForbidden, utils.NewMessage(decision.Reason, constants.MSG_INVALID_REQUEST_DATA, "userID"))
+		return
+	}
+
+	var req store.SetUserRoleRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&req)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(constants.StatusInvalidBodyMessage, constants.MSG_MALFORMED_REQUEST_DATA, "request"))
+		return
+	}
+
+	err = utils.ValidateJSONFieldsNotEmpty(w, req)
+	if err != nil {
+		return
+	}
+
+	if !slices.Contains(userRoles, req.Role) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("role must be user, moderator or admin", constants.MSG_INVALID_REQUEST_DATA, "role"))
+		return
+	}
+
+	req.UserID = userID
+
+	err = handler.UserStore.SetUserRole(req)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.ResourceNotFound:
+			utils.WriteJSON(w, http.StatusNotFound, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "userID"))
+		default:
+			handler.Logger.Printf("ERROR: SetUserRole > SetUserRole: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		}
+		return
+	}
+
+	handler.Logger.Printf("SECURITY: admin %s set the role of user %s to %s", user.ID, userID, req.Role)
+	utils.WriteJSON(w, http.StatusOK, utils.NewMessage("Role updated successfully", "", ""))
+}
+
+// GetPasswordHashReport tells how many users still have a password hash with outdated parameters
+func (handler *AdminHandler) GetPasswordHashReport(w http.ResponseWriter, r *http.Request) {
+	report, err := handler.UserStore.GetPasswordHashReport()
+	if err != nil {
+		handler.Logger.Printf("ERROR: GetPasswordHashReport > GetPasswordHashReport: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Message{"data": report})
+}
@@ -0,0 +1,152 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/store"
+	"github.com/RichardHoa/hack-me/internal/utils"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+const avatarKeyPrefix = "avatars/"
+
+type AvatarHandler struct {
+	UserStore store.UserStore
+	BlobStore store.BlobStore
+	Logger    *log.Logger
+}
+
+func NewAvatarHandler(userStore store.UserStore, blobStore store.BlobStore, logger *log.Logger) *AvatarHandler {
+	return &AvatarHandler{
+		UserStore: userStore,
+		BlobStore: blobStore,
+		Logger:    logger,
+	}
+}
+
+/*
+UploadAvatar takes the raw image as the request body. The stored file is the
+re-encoded PNG, never the upload, and it gets a new random name every time so
+it can be cached forever.
+*/
+func (handler *AvatarHandler) UploadAvatar(w http.ResponseWriter, r *http.Request) {
+	user, err := utils.GetAuthenticatedUser(r)
+	if err != nil {
+		handler.Logger.Printf("ERROR: UploadAvatar > JWT token checking: %v", err)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, constants.MaxAvatarUploadBytes)
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			utils.WriteJSON(w, http.StatusRequestEntityTooLarge, utils.NewMessage(fmt.Sprintf("the avatar can be at most %d MB", constants.MaxAvatarUploadBytes/(1024*1024)), constants.MSG_INVALID_REQUEST_DATA, "avatar"))
+			return
+		}
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(constants.StatusInvalidBodyMessage, constants.MSG_MALFORMED_REQUEST_DATA, "avatar"))
+		return
+	}
+	if len(data) == 0 {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("the request body must be the avatar image", constants.MSG_LACKING_MANDATORY_FIELDS, "avatar"))
+		return
+	}
+
+	avatar, err := utils.ProcessAvatar(data)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.InvalidData:
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "avatar"))
+		default:
+			handler.Logger.Printf("ERROR: UploadAvatar > ProcessAvatar: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		}
+		return
+	}
+
+	fileName := uuid.NewString() + ".png"
+	key := avatarKeyPrefix + fileName
+
+	err = handler.BlobStore.Put(key, avatar)
+	if err != nil {
+		handler.Logger.Printf("ERROR: UploadAvatar > Put: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		return
+	}
+
+	imageLink := constants.APIBaseURL + "/v1/avatars/" + fileName
+	previousKey, err := handler.UserStore.SetAvatar(store.SetAvatarRequest{
+		UserID:    user.ID,
+		AvatarKey: key,
+		ImageLink: imageLink,
+	})
+	if err != nil {
+		handler.deleteAvatar(key)
+		switch utils.ClassifyError(err) {
+		case constants.ResourceNotFound:
+			utils.WriteJSON(w, http.StatusNotFound, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "user"))
+		default:
+			handler.Logger.Printf("ERROR: UploadAvatar > SetAvatar: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		}
+		return
+	}
+
+	if previousKey != "" {
+		handler.deleteAvatar(previousKey)
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Message{
+		"message": "Avatar updated successfully",
+		"data":    map[string]string{"imageLink": imageLink},
+	})
+}
+
+// GetAvatar serves an uploaded avatar from our own origin
+func (handler *AvatarHandler) GetAvatar(w http.ResponseWriter, r *http.Request) {
+	fileName := chi.URLParam(r, "fileName")
+
+	// only names we generated, the blob store is not a general file server
+	if _, err := uuid.Parse(strings.TrimSuffix(fileName, ".png")); err != nil || !strings.HasSuffix(fileName, ".png") {
+		utils.WriteJSON(w, http.StatusNotFound, utils.NewMessage("avatar not found", constants.MSG_INVALID_REQUEST_DATA, "fileName"))
+		return
+	}
+
+	avatar, err := handler.BlobStore.Get(avatarKeyPrefix + fileName)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.ResourceNotFound:
+			utils.WriteJSON(w, http.StatusNotFound, utils.NewMessage("avatar not found", constants.MSG_INVALID_REQUEST_DATA, "fileName"))
+		default:
+			handler.Logger.Printf("ERROR: GetAvatar > Get: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		}
+		return
+	}
+
+	header := w.Header()
+	header.Del("Pragma")
+	header.Del("Expires")
+	header.Set("Cache-Control", "public, max-age=31536000, immutable")
+	header.Set("Content-Type", "image/png")
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	w.WriteHeader(http.StatusOK)
+	w.Write(avatar)
+}
+
+// deleteAvatar removes a blob nobody points at anymore, a failure only leaves an orphan file behind
+func (handler *AvatarHandler) deleteAvatar(key string) {
+	err := handler.BlobStore.Delete(key)
+	if err != nil {
+		handler.Logger.Printf("ERROR: deleteAvatar > Delete: %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/store"
+	"github.com/RichardHoa/hack-me/internal/utils"
+)
+
+type BookmarkHandler struct {
+	BookmarkStore store.BookmarkStore
+	Logger        *log.Logger
+}
+
+func NewBookmarkHandler(bookmarkStore store.BookmarkStore, logger *log.Logger) *BookmarkHandler {
+	return &BookmarkHandler{
+		BookmarkStore: bookmarkStore,
+		Logger:        logger,
+	}
+}
+
+func (handler *BookmarkHandler) AddBookmark(w http.ResponseWriter, r *http.Request) {
+	req, ok := handler.decodeBookmarkRequest(w, r, "AddBookmark")
+	if !ok {
+		return
+	}
+
+	err := handler.BookmarkStore.AddBookmark(req)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.InvalidData:
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "targetType and targetID"))
+		case constants.ResourceNotFound:
+			utils.WriteJSON(w, http.StatusNotFound, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "targetID"))
+		default:
+			handler.Logger.Printf("ERROR: AddBookmark > AddBookmark: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		}
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.NewMessage("Bookmark added successfully", "", ""))
+}
+
+func (handler *BookmarkHandler) DeleteBookmark(w http.ResponseWriter, r *http.Request) {
+	req, ok := handler.decodeBookmarkRequest(w, r, "DeleteBookmark")
+	if !ok {
+		return
+	}
+
+	err := handler.BookmarkStore.DeleteBookmark(req)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.InvalidData:
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "targetType"))
+		case constants.ResourceNotFound:
+			utils.WriteJSON(w, http.StatusNotFound, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "targetID"))
+		default:
+			handler.Logger.Printf("ERROR: DeleteBookmark > DeleteBookmark: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		}
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.NewMessage("Bookmark deleted successfully", "", ""))
+}
+
+// GetMyBookmarks lists what the logged in user saved, with a summary of each challenge or response
+func (handler *BookmarkHandler) GetMyBookmarks(w http.ResponseWriter, r *http.Request) {
+	user, err := utils.GetAuthenticatedUser(r)
+	if err != nil {
+		handler.Logger.Printf("ERROR: GetMyBookmarks > JWT token checking: %v", err)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
+		return
+	}
+
+	page, pageSize, errMessage := parsePageQuery(r.URL.Query())
+	if errMessage != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, errMessage)
+		return
+	}
+
+	bookmarks, metaPage, err := handler.BookmarkStore.GetBookmarks(store.GetBookmarksParams{
+		UserID:   user.ID,
+		Page:     page,
+		PageSize: pageSize,
+	})
+	if err != nil {
+		handler.Logger.Printf("ERROR: GetMyBookmarks > GetBookmarks: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Message{
+		"metadata": metaPage,
+		"data":     bookmarks,
+	})
+}
+
+// decodeBookmarkRequest reads the target of the logged in user, it writes the error response itself
+func (handler *BookmarkHandler) decodeBookmarkRequest(w http.ResponseWriter, r *http.Request, caller string) (store.BookmarkRequest, bool) {
+	var req store.BookmarkRequest
+
+	user, err := utils.GetAuthenticatedUser(r)
+	if err != nil {
+		handler.Logger.Printf("ERROR: %s > JWT token checking: %v", caller, err)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
+		return req, false
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&req)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(constants.StatusInvalidBodyMessage, constants.MSG_MALFORMED_REQUEST_DATA, "request"))
+		return req, false
+	}
+
+	err = utils.ValidateJSONFieldsNotEmpty(w, req)
+	if err != nil {
+		return req, false
+	}
+
+	if _, err := strconv.Atoi(req.TargetID); err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("targetID can only be number", constants.MSG_MALFORMED_REQUEST_DATA, "targetID"))
+		return req, false
+	}
+
+	req.UserID = user.ID
+	return req, true
+}
@@ -2,24 +2,34 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 
 	"github.com/RichardHoa/hack-me/internal/constants"
 	"github.com/RichardHoa/hack-me/internal/domains"
+	"github.com/RichardHoa/hack-me/internal/policy"
 	"github.com/RichardHoa/hack-me/internal/store"
 	"github.com/RichardHoa/hack-me/internal/utils"
+	"github.com/go-chi/chi/v5"
 )
 
 type ChallengeHandler struct {
 	ChallengeStore store.ChallengeStore
+	Policy         *policy.Engine
+	Mailer         store.Mailer
 	Logger         *log.Logger
 }
 
-func NewChallengeHandler(challengeStore store.ChallengeStore, logger *log.Logger) *ChallengeHandler {
+func NewChallengeHandler(challengeStore store.ChallengeStore, policyEngine *policy.Engine, mailer store.Mailer, logger *log.Logger) *ChallengeHandler {
 	return &ChallengeHandler{
 		ChallengeStore: challengeStore,
+		Policy:         policyEngine,
+		Mailer:         mailer,
 		Logger:         logger,
 	}
 }
@@ -31,11 +41,14 @@ func (handler *ChallengeHandler) GetChallenges(w http.ResponseWriter, r *http.Re
 	categories := query["category"]
 	nameDTO := query.Get("name")
 	exactNameDTO := query.Get("exactName")
-	pageSize := query.Get("pageSize")
-	page := query.Get("page")
 
 	getChallengeParams := store.GetChallengeParams{}
 
+	// the endpoint is public, the user is only needed to tell whether each challenge is solved
+	if user, err := utils.GetAuthenticatedUser(r); err == nil {
+		getChallengeParams.UserID = &user.ID
+	}
+
 	if nameDTO != "" {
 		name, err := domains.NewChallengeName(nameDTO)
 		if err != nil {
@@ -60,34 +73,13 @@ func (handler *ChallengeHandler) GetChallenges(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	if page != "" {
-		pageNum, err := strconv.Atoi(page)
-		if err != nil {
-			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("page can only be number", constants.MSG_MALFORMED_REQUEST_DATA, "page"))
-			return
-		}
-		if pageNum <= 0 {
-			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("page cannot be negative or 0", constants.MSG_MALFORMED_REQUEST_DATA, "page"))
-			return
-		}
-
-		getChallengeParams.Page = &pageNum
-	}
-
-	if pageSize != "" {
-		pageSizeNum, err := strconv.Atoi(pageSize)
-		if err != nil {
-			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("pageSize can only be number", constants.MSG_MALFORMED_REQUEST_DATA, "pageSize"))
-			return
-		}
-
-		if pageSizeNum <= 0 {
-			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("pageSize cannot be negative or 0", constants.MSG_MALFORMED_REQUEST_DATA, "pageSize"))
-			return
-		}
-
-		getChallengeParams.PageSize = &pageSizeNum
+	pageNum, pageSizeNum, errMessage := parsePageQuery(query)
+	if errMessage != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, errMessage)
+		return
 	}
+	getChallengeParams.Page = pageNum
+	getChallengeParams.PageSize = pageSizeNum
 
 	if popularity != "" {
 		getChallengeParams.Popularity = &popularity
@@ -122,7 +114,7 @@ func (handler *ChallengeHandler) GetChallenges(w http.ResponseWriter, r *http.Re
 }
 
 func (handler *ChallengeHandler) PostChallenge(w http.ResponseWriter, r *http.Request) {
-	result, err := utils.GetValuesFromCookie(r, []string{constants.JWTUserID})
+	user, err := utils.GetAuthenticatedUser(r)
 	if err != nil {
 		handler.Logger.Printf("ERROR: PostChallenge > JWT token checking: %v", err)
 		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
@@ -130,7 +122,7 @@ func (handler *ChallengeHandler) PostChallenge(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	userID := result[0]
+	userID := user.ID
 
 	var dto store.PostChallengeRequest
 
@@ -154,7 +146,29 @@ func (handler *ChallengeHandler) PostChallenge(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	postChallengeParams := store.NewPostChallengeParams(userID, challengeName, dto.Content, dto.Category)
+	flags, err := newChallengeFlags(dto.Flags)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "flags"))
+		return
+	}
+
+	scoring := dto.ChallengeScoring
+	if scoring.InitialPoints == nil {
+		initialPoints := constants.DefaultInitialPoints
+		scoring.InitialPoints = &initialPoints
+	}
+	if scoring.MinimumPoints == nil {
+		minimumPoints := constants.DefaultMinimumPoints
+		scoring.MinimumPoints = &minimumPoints
+	}
+
+	err = validateChallengeScoring(scoring)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "initialPoints, minimumPoints, decay"))
+		return
+	}
+
+	postChallengeParams := store.NewPostChallengeParams(userID, challengeName, dto.Content, dto.Category, flags, scoring)
 
 	err = handler.ChallengeStore.CreateChallenges(postChallengeParams)
 	if err != nil {
@@ -186,14 +200,14 @@ func (handler *ChallengeHandler) PostChallenge(w http.ResponseWriter, r *http.Re
 }
 
 func (handler *ChallengeHandler) DeleteChallege(w http.ResponseWriter, r *http.Request) {
-	result, err := utils.GetValuesFromCookie(r, []string{constants.JWTUserID})
+	user, err := utils.GetAuthenticatedUser(r)
 
 	if err != nil {
 		handler.Logger.Printf("ERROR: DeleteChallenge > JWT token checking: %v", err)
 		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
 		return
 	}
-	userID := result[0]
+	userID := user.ID
 
 	var dto store.DeleteChallengeRequest
 
@@ -212,21 +226,43 @@ func (handler *ChallengeHandler) DeleteChallege(w http.ResponseWriter, r *http.R
 		return
 	}
 
+	if errMessage := validateModerationReason(dto.ModerationReason); errMessage != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, errMessage)
+		return
+	}
+
+	resource, err := handler.ChallengeStore.GetChallengeResource(challengeName)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.ResourceNotFound:
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "name"))
+		default:
+			handler.Logger.Printf("ERROR: DeleteChallenge > store GetChallengeResource: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		}
+		return
+	}
+
+	decision := handler.Policy.Authorize(policy.SubjectFromContext(r.Context()), policy.ActionDelete, resource)
+	if !decision.Allowed {
+		utils.WriteJSON(w, http.StatusForbidden, utils.NewMessage(decision.Reason, constants.MSG_INVALID_REQUEST_DATA, "name"))
+		return
+	}
+
 	deleteChallengeParams := store.DeleteChallengeParams{
-		ChallengeName: challengeName,
-		UserID:        userID,
+		ChallengeName:    challengeName,
+		UserID:           userID,
+		ModerationReason: dto.ModerationReason,
+		Moderated:        decision.Moderated,
 	}
 
-	err = handler.ChallengeStore.DeleteChallenge(deleteChallengeParams)
+	moderationAction, err := handler.ChallengeStore.DeleteChallenge(deleteChallengeParams)
 	if err != nil {
 		handler.Logger.Printf("ERROR: DeleteChallenge > store Delete challenge: %v", err)
 		switch utils.ClassifyError(err) {
 
 		case constants.InvalidData:
 			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_INVALID_REQUEST_DATA, ""))
-
-		case constants.LackingPermission:
-			utils.WriteJSON(w, http.StatusForbidden, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_INVALID_REQUEST_DATA, ""))
 			return
 		default:
 			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
@@ -234,19 +270,21 @@ func (handler *ChallengeHandler) DeleteChallege(w http.ResponseWriter, r *http.R
 		}
 	}
 
+	notifyModeratedOwner(handler.Mailer, handler.Logger, moderationAction)
+
 	utils.WriteJSON(w, http.StatusOK, utils.NewMessage("Challenge deleted", "", ""))
 
 }
 
 func (handler *ChallengeHandler) ModifyChallenge(w http.ResponseWriter, r *http.Request) {
 
-	result, err := utils.GetValuesFromCookie(r, []string{constants.JWTUserID})
+	user, err := utils.GetAuthenticatedUser(r)
 	if err != nil {
 		handler.Logger.Printf("ERROR: ModifyChallenge > JWT token checking: %v", err)
 		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
 		return
 	}
-	userID := result[0]
+	userID := user.ID
 
 	var dto store.ModifyChallengeRequest
 
@@ -287,7 +325,48 @@ func (handler *ChallengeHandler) ModifyChallenge(w http.ResponseWriter, r *http.
 		modifyChallengeParams.Content = &dto.Content
 	}
 
-	err = handler.ChallengeStore.ModifyChallenge(modifyChallengeParams)
+	if dto.Flags != nil {
+		flags, err := newChallengeFlags(*dto.Flags)
+		if err != nil {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "flags"))
+			return
+		}
+		modifyChallengeParams.Flags = &flags
+	}
+
+	err = validateChallengeScoring(dto.ChallengeScoring)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "initialPoints, minimumPoints, decay"))
+		return
+	}
+	modifyChallengeParams.Scoring = dto.ChallengeScoring
+
+	if errMessage := validateModerationReason(dto.ModerationReason); errMessage != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, errMessage)
+		return
+	}
+	modifyChallengeParams.ModerationReason = dto.ModerationReason
+
+	resource, err := handler.ChallengeStore.GetChallengeResource(oldName)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.ResourceNotFound:
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "oldName"))
+		default:
+			handler.Logger.Printf("ERROR: ModifyChallenge > store GetChallengeResource: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		}
+		return
+	}
+
+	decision := handler.Policy.Authorize(policy.SubjectFromContext(r.Context()), policy.ActionEdit, resource)
+	if !decision.Allowed {
+		utils.WriteJSON(w, http.StatusForbidden, utils.NewMessage(decision.Reason, constants.MSG_INVALID_REQUEST_DATA, "oldName"))
+		return
+	}
+	modifyChallengeParams.Moderated = decision.Moderated
+
+	moderationAction, err := handler.ChallengeStore.ModifyChallenge(modifyChallengeParams)
 	if err != nil {
 		handler.Logger.Printf("ERROR: ModifyChallenge > store modify challenge: %v", err)
 		switch utils.ClassifyError(err) {
@@ -300,8 +379,12 @@ func (handler *ChallengeHandler) ModifyChallenge(w http.ResponseWriter, r *http.
 		case constants.PQUniqueViolation:
 			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("new challenge name already exist", constants.MSG_INVALID_REQUEST_DATA, "name"))
 			return
-		case constants.LackingPermission:
-			utils.WriteJSON(w, http.StatusForbidden, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_INVALID_REQUEST_DATA, ""))
+		case constants.PQCheckViolation:
+			// only the scoring columns can fail here, the name is validated by the domain type
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("minimumPoints cannot be greater than initialPoints", constants.MSG_INVALID_REQUEST_DATA, "initialPoints, minimumPoints"))
+			return
+		case constants.ResourceNotFound:
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "oldName"))
 			return
 		default:
 			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
@@ -309,6 +392,158 @@ func (handler *ChallengeHandler) ModifyChallenge(w http.ResponseWriter, r *http.
 		}
 	}
 
+	notifyModeratedOwner(handler.Mailer, handler.Logger, moderationAction)
+
 	utils.WriteJSON(w, http.StatusOK, utils.NewMessage("Challenge has been updated successfully", "", ""))
 
 }
+
+func (handler *ChallengeHandler) SubmitFlag(w http.ResponseWriter, r *http.Request) {
+	user, err := utils.GetAuthenticatedUser(r)
+	if err != nil {
+		handler.Logger.Printf("ERROR: SubmitFlag > JWT token checking: %v", err)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
+		return
+	}
+	userID := user.ID
+
+	challengeID := chi.URLParam(r, "challengeID")
+	if _, err := strconv.Atoi(challengeID); err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("challenge id can only be number", constants.MSG_MALFORMED_REQUEST_DATA, "challengeID"))
+		return
+	}
+
+	var req store.SubmitFlagRequest
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&req)
+	if err != nil {
+		handler.Logger.Printf("ERROR: SubmitFlag > jsonDecoding: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(constants.StatusInvalidBodyMessage, constants.MSG_MALFORMED_REQUEST_DATA, "request"))
+		return
+	}
+
+	err = utils.ValidateJSONFieldsNotEmpty(w, req)
+	if err != nil {
+		return
+	}
+
+	req.UserID = userID
+	req.ChallengeID = challengeID
+
+	resource, err := handler.ChallengeStore.GetChallengeResourceByID(challengeID)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.ResourceNotFound:
+			utils.WriteJSON(w, http.StatusNotFound, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "challengeID"))
+		default:
+			handler.Logger.Printf("ERROR: SubmitFlag > store GetChallengeResourceByID: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		}
+		return
+	}
+
+	decision := handler.Policy.Authorize(policy.SubjectFromContext(r.Context()), policy.ActionSolve, resource)
+	if !decision.Allowed {
+		utils.WriteJSON(w, http.StatusForbidden, utils.NewMessage(decision.Reason, constants.MSG_INVALID_REQUEST_DATA, "challengeID"))
+		return
+	}
+
+	err = handler.ChallengeStore.SubmitFlag(req)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.InvalidData:
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "flag"))
+			return
+		case constants.ResourceNotFound:
+			utils.WriteJSON(w, http.StatusNotFound, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "challengeID"))
+			return
+		case constants.TooManyRequests:
+			utils.WriteJSON(w, http.StatusTooManyRequests, utils.NewMessage(err.Error(), constants.MSG_TOO_MANY_REQUESTS, "flag"))
+			return
+		case constants.PQInvalidByteSequence:
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("input contains null character", constants.MSG_INVALID_REQUEST_DATA, "flag"))
+			return
+		default:
+			handler.Logger.Printf("ERROR: SubmitFlag > store SubmitFlag: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+			return
+		}
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.NewMessage("Correct flag, challenge solved", "", ""))
+}
+
+// newChallengeFlags validates the flags sent by a challenge author.
+func newChallengeFlags(flagsDTO []store.FlagRequest) ([]domains.ChallengeFlag, error) {
+	if len(flagsDTO) > constants.MaxChallengeFlags {
+		return nil, fmt.Errorf("a challenge can have at most %d flags", constants.MaxChallengeFlags)
+	}
+
+	flags := make([]domains.ChallengeFlag, 0, len(flagsDTO))
+	for _, dto := range flagsDTO {
+		if strings.ContainsRune(dto.Flag, 0) {
+			return nil, errors.New("flag contains null character")
+		}
+
+		flag, err := domains.NewChallengeFlag(dto.Flag, dto.MatchMode)
+		if err != nil {
+			return nil, err
+		}
+		flags = append(flags, flag)
+	}
+
+	return flags, nil
+}
+
+// validateChallengeScoring checks the scoring values that are present in the request.
+func validateChallengeScoring(scoring store.ChallengeScoring) error {
+	if scoring.InitialPoints != nil && (*scoring.InitialPoints < 0 || *scoring.InitialPoints > constants.MaxChallengePoints) {
+		return fmt.Errorf("initialPoints must be between 0 and %d", constants.MaxChallengePoints)
+	}
+
+	if scoring.MinimumPoints != nil && (*scoring.MinimumPoints < 0 || *scoring.MinimumPoints > constants.MaxChallengePoints) {
+		return fmt.Errorf("minimumPoints must be between 0 and %d", constants.MaxChallengePoints)
+	}
+
+	if scoring.InitialPoints != nil && scoring.MinimumPoints != nil && *scoring.MinimumPoints > *scoring.InitialPoints {
+		return errors.New("minimumPoints cannot be greater than initialPoints")
+	}
+
+	if scoring.Decay != nil && *scoring.Decay <= 0 {
+		return errors.New("decay must be greater than 0")
+	}
+
+	return nil
+}
+
+/*
+parsePageQuery reads the optional page and pageSize query parameters shared by
+every paginated endpoint. A nil value means the store default is used.
+*/
+func parsePageQuery(query url.Values) (page *int, pageSize *int, errMessage utils.Message) {
+	if pageStr := query.Get("page"); pageStr != "" {
+		pageNum, err := strconv.Atoi(pageStr)
+		if err != nil {
+			return nil, nil, utils.NewMessage("page can only be number", constants.MSG_MALFORMED_REQUEST_DATA, "page")
+		}
+		if pageNum <= 0 {
+			return nil, nil, utils.NewMessage("page cannot be negative or 0", constants.MSG_MALFORMED_REQUEST_DATA, "page")
+		}
+		page = &pageNum
+	}
+
+	if pageSizeStr := query.Get("pageSize"); pageSizeStr != "" {
+		pageSizeNum, err := strconv.Atoi(pageSizeStr)
+		if err != nil {
+			return nil, nil, utils.NewMessage("pageSize can only be number", constants.MSG_MALFORMED_REQUEST_DATA, "pageSize")
+		}
+		if pageSizeNum <= 0 {
+			return nil, nil, utils.NewMessage("pageSize cannot be negative or 0", constants.MSG_MALFORMED_REQUEST_DATA, "pageSize")
+		}
+		pageSize = &pageSizeNum
+	}
+
+	return page, pageSize, nil
+}
@@ -7,30 +7,35 @@ import (
 	"strings"
 
 	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/policy"
 	"github.com/RichardHoa/hack-me/internal/store"
 	"github.com/RichardHoa/hack-me/internal/utils"
 )
 
 type ChallengeResponseHandler struct {
 	ChallengeResponseStore store.ChallengeResponseStore
+	Policy                 *policy.Engine
+	Mailer                 store.Mailer
 	Logger                 *log.Logger
 }
 
-func NewChallengeResponseHandler(store store.ChallengeResponseStore, logger *log.Logger) *ChallengeResponseHandler {
+func NewChallengeResponseHandler(store store.ChallengeResponseStore, policyEngine *policy.Engine, mailer store.Mailer, logger *log.Logger) *ChallengeResponseHandler {
 	return &ChallengeResponseHandler{
 		ChallengeResponseStore: store,
+		Policy:                 policyEngine,
+		Mailer:                 mailer,
 		Logger:                 logger,
 	}
 }
 
 func (handler *ChallengeResponseHandler) PostChallengeResponse(w http.ResponseWriter, r *http.Request) {
-	result, err := utils.GetValuesFromCookie(r, []string{constants.JWTUserID})
+	user, err := utils.GetAuthenticatedUser(r)
 	if err != nil {
 		handler.Logger.Printf("ERROR: PostChallengeResponse > JWT token checking: %v", err)
 		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
 		return
 	}
-	userID := result[0]
+	userID := user.ID
 
 	var req store.PostChallengeResponseRequest
 
@@ -77,13 +82,13 @@ func (handler *ChallengeResponseHandler) PostChallengeResponse(w http.ResponseWr
 }
 
 func (handler *ChallengeResponseHandler) ModifyChallengeResponse(w http.ResponseWriter, r *http.Request) {
-	result, err := utils.GetValuesFromCookie(r, []string{constants.JWTUserID})
+	user, err := utils.GetAuthenticatedUser(r)
 	if err != nil {
 		handler.Logger.Printf("ERROR: ModifyChallengeResponse > JWT token checking: %v", err)
 		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
 		return
 	}
-	userID := result[0]
+	userID := user.ID
 
 	var req store.PutChallengeResponseRequest
 
@@ -108,15 +113,38 @@ func (handler *ChallengeResponseHandler) ModifyChallengeResponse(w http.Response
 		return
 	}
 
-	err = handler.ChallengeResponseStore.ModifyResponse(req)
+	if errMessage := validateModerationReason(req.ModerationReason); errMessage != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, errMessage)
+		return
+	}
+
+	resource, err := handler.ChallengeResponseStore.GetChallengeResponseResource(req.ChallengeResponseID)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.ResourceNotFound:
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "challengeResponseID"))
+		case constants.PQInvalidTextRepresentation:
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("challengeResponseID can only be number", constants.MSG_MALFORMED_REQUEST_DATA, "challengeResponseID"))
+		default:
+			handler.Logger.Printf("ERROR: ModifyChallengeResponse > store GetChallengeResponseResource: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		}
+		return
+	}
+
+	decision := handler.Policy.Authorize(policy.SubjectFromContext(r.Context()), policy.ActionEdit, resource)
+	if !decision.Allowed {
+		utils.WriteJSON(w, http.StatusForbidden, utils.NewMessage(decision.Reason, constants.MSG_INVALID_REQUEST_DATA, "challengeResponseID"))
+		return
+	}
+	req.Moderated = decision.Moderated
+
+	moderationAction, err := handler.ChallengeResponseStore.ModifyResponse(req)
 	if err != nil {
 		switch utils.ClassifyError(err) {
 		case constants.InvalidData:
 			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "unknown"))
 			return
-		case constants.LackingPermission:
-			utils.WriteJSON(w, http.StatusForbidden, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, ""))
-			return
 		default:
 			handler.Logger.Printf("ERROR: ModifyChallengeResponse > store PostResponse: %v", err)
 			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
@@ -125,18 +153,20 @@ func (handler *ChallengeResponseHandler) ModifyChallengeResponse(w http.Response
 
 	}
 
+	notifyModeratedOwner(handler.Mailer, handler.Logger, moderationAction)
+
 	utils.WriteJSON(w, http.StatusOK, utils.NewMessage("Modify challenge successfully", "", ""))
 }
 
 func (handler *ChallengeResponseHandler) DeleteChallengeResponse(w http.ResponseWriter, r *http.Request) {
-	result, err := utils.GetValuesFromCookie(r, []string{constants.JWTUserID})
+	user, err := utils.GetAuthenticatedUser(r)
 	if err != nil {
 		handler.Logger.Printf("ERROR: DeleteChallengeResponse > JWT token checking: %v", err)
 		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
 		return
 	}
 
-	userID := result[0]
+	userID := user.ID
 
 	var req store.DeleteChallengeResponseRequest
 
@@ -156,15 +186,38 @@ func (handler *ChallengeResponseHandler) DeleteChallengeResponse(w http.Response
 		return
 	}
 
-	err = handler.ChallengeResponseStore.DeleteResponse(req)
+	if errMessage := validateModerationReason(req.ModerationReason); errMessage != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, errMessage)
+		return
+	}
+
+	resource, err := handler.ChallengeResponseStore.GetChallengeResponseResource(req.ChallengeResponseID)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.ResourceNotFound:
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "challengeResponseID"))
+		case constants.PQInvalidTextRepresentation:
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("challengeResponseID can only be number", constants.MSG_MALFORMED_REQUEST_DATA, "challengeResponseID"))
+		default:
+			handler.Logger.Printf("ERROR: DeleteChallengeResponse > store GetChallengeResponseResource: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		}
+		return
+	}
+
+	decision := handler.Policy.Authorize(policy.SubjectFromContext(r.Context()), policy.ActionDelete, resource)
+	if !decision.Allowed {
+		utils.WriteJSON(w, http.StatusForbidden, utils.NewMessage(decision.Reason, constants.MSG_INVALID_REQUEST_DATA, "challengeResponseID"))
+		return
+	}
+	req.Moderated = decision.Moderated
+
+	moderationAction, err := handler.ChallengeResponseStore.DeleteResponse(req)
 	if err != nil {
 		switch utils.ClassifyError(err) {
 		case constants.InvalidData:
 			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "unknown"))
 			return
-		case constants.LackingPermission:
-			utils.WriteJSON(w, http.StatusForbidden, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "challengeID"))
-			return
 		default:
 			handler.Logger.Printf("ERROR: DeleteChallengeResponse > store DeleteResponse: %v", err)
 			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
@@ -173,6 +226,8 @@ func (handler *ChallengeResponseHandler) DeleteChallengeResponse(w http.Response
 
 	}
 
+	notifyModeratedOwner(handler.Mailer, handler.Logger, moderationAction)
+
 	utils.WriteJSON(w, http.StatusOK, utils.NewMessage("Challenge response deleted successfully", "", ""))
 }
 
@@ -201,6 +256,11 @@ func (handler *ChallengeResponseHandler) GetChallengeResponse(w http.ResponseWri
 		ChallengeResponseID: trimmedChallengeResponseID,
 	}
 
+	// the endpoint is public, the user is only needed to tell whether each response is bookmarked
+	if user, err := utils.GetAuthenticatedUser(r); err == nil {
+		req.UserID = user.ID
+	}
+
 	responses, err := handler.ChallengeResponseStore.GetResponses(req)
 	if err != nil {
 		switch utils.ClassifyError(err) {
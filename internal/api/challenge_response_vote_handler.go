@@ -6,6 +6,7 @@ import (
 	"net/http"
 
 	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/policy"
 	"github.com/RichardHoa/hack-me/internal/store"
 	"github.com/RichardHoa/hack-me/internal/utils"
 )
@@ -13,22 +14,25 @@ import (
 type ChallengeResponseVoteHandler struct {
 	Logger *log.Logger
 	Store  store.VoteStore
+	// ResponseStore tells the policy who wrote the response and whether it is hidden
+	ResponseStore store.ChallengeResponseStore
+	Policy        *policy.Engine
 }
 
-func NewChallengeResponseVoteHandler(store store.VoteStore, logger *log.Logger) *ChallengeResponseVoteHandler {
-	return &ChallengeResponseVoteHandler{Logger: logger, Store: store}
+func NewChallengeResponseVoteHandler(store store.VoteStore, responseStore store.ChallengeResponseStore, policyEngine *policy.Engine, logger *log.Logger) *ChallengeResponseVoteHandler {
+	return &ChallengeResponseVoteHandler{Logger: logger, Store: store, ResponseStore: responseStore, Policy: policyEngine}
 }
 
 func (handler *ChallengeResponseVoteHandler) PostVote(w http.ResponseWriter, r *http.Request) {
 
-	result, err := utils.GetValuesFromCookie(r, []string{constants.JWTUserID})
+	user, err := utils.GetAuthenticatedUser(r)
 	if err != nil {
 		handler.Logger.Printf("ERROR: PostChallengeResponseVote > JWT token checking: %v", err)
 		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
 		return
 	}
 
-	userID := result[0]
+	userID := user.ID
 
 	var req store.PostVoteRequest
 
@@ -55,6 +59,26 @@ func (handler *ChallengeResponseVoteHandler) PostVote(w http.ResponseWriter, r *
 
 	}
 
+	resource, err := handler.ResponseStore.GetChallengeResponseResource(req.ChallengeResponseID)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.ResourceNotFound:
+			utils.WriteJSON(w, http.StatusNotFound, utils.NewMessage("challengeResponseID not found", constants.MSG_INVALID_REQUEST_DATA, "challengeResponseID"))
+		case constants.PQInvalidTextRepresentation:
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("invalid data type", constants.MSG_MALFORMED_REQUEST_DATA, "request body"))
+		default:
+			handler.Logger.Printf("ERROR: PostChallengeResponseVote > GetChallengeResponseResource error: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		}
+		return
+	}
+
+	decision := handler.Policy.Authorize(policy.SubjectFromContext(r.Context()), policy.ActionVote, resource)
+	if !decision.Allowed {
+		utils.WriteJSON(w, http.StatusForbidden, utils.NewMessage(decision.Reason, constants.MSG_INVALID_REQUEST_DATA, "challengeResponseID"))
+		return
+	}
+
 	err = handler.Store.PostVote(req)
 	if err != nil {
 		switch utils.ClassifyError(err) {
@@ -79,14 +103,14 @@ func (handler *ChallengeResponseVoteHandler) PostVote(w http.ResponseWriter, r *
 
 func (handler *ChallengeResponseVoteHandler) DeleteVote(w http.ResponseWriter, r *http.Request) {
 
-	result, err := utils.GetValuesFromCookie(r, []string{constants.JWTUserID})
+	user, err := utils.GetAuthenticatedUser(r)
 	if err != nil {
 		handler.Logger.Printf("ERROR: DeleteChallengeResponseVote > JWT token checking: %v", err)
 		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
 		return
 	}
 
-	userID := result[0]
+	userID := user.ID
 
 	var req store.DeleteVoteRequest
 
@@ -7,22 +7,25 @@ import (
 	"strings"
 
 	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/policy"
 	"github.com/RichardHoa/hack-me/internal/store"
 	"github.com/RichardHoa/hack-me/internal/utils"
 )
 
 type CommentHandler struct {
 	Store  store.CommentStore
+	Policy *policy.Engine
+	Mailer store.Mailer
 	Logger *log.Logger
 }
 
-func NewCommentHandler(store store.CommentStore, logger *log.Logger) *CommentHandler {
-	return &CommentHandler{Store: store, Logger: logger}
+func NewCommentHandler(store store.CommentStore, policyEngine *policy.Engine, mailer store.Mailer, logger *log.Logger) *CommentHandler {
+	return &CommentHandler{Store: store, Policy: policyEngine, Mailer: mailer, Logger: logger}
 }
 
 func (handler *CommentHandler) PostComment(w http.ResponseWriter, r *http.Request) {
 
-	result, err := utils.GetValuesFromCookie(r, []string{constants.JWTUserID})
+	user, err := utils.GetAuthenticatedUser(r)
 
 	if err != nil {
 		handler.Logger.Printf("ERROR: PostComment > JWT token checking: %v", err)
@@ -30,7 +33,7 @@ func (handler *CommentHandler) PostComment(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	userID := result[0]
+	userID := user.ID
 
 	var req store.PostCommentRequest
 
@@ -77,14 +80,14 @@ func (handler *CommentHandler) PostComment(w http.ResponseWriter, r *http.Reques
 
 func (handler *CommentHandler) ModifyComment(w http.ResponseWriter, r *http.Request) {
 
-	result, err := utils.GetValuesFromCookie(r, []string{constants.JWTUserID})
+	user, err := utils.GetAuthenticatedUser(r)
 	if err != nil {
 		handler.Logger.Printf("ERROR: ModifyComment > JWT token checking: %v", err)
 		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
 		return
 	}
 
-	userID := result[0]
+	userID := user.ID
 
 	var req store.ModifyCommentRequest
 
@@ -102,15 +105,37 @@ func (handler *CommentHandler) ModifyComment(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	if errMessage := validateModerationReason(req.ModerationReason); errMessage != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, errMessage)
+		return
+	}
+
 	req.UserID = userID
 
-	err = handler.Store.ModifyComment(req)
+	resource, err := handler.Store.GetCommentResource(req.CommentID)
 	if err != nil {
 		switch utils.ClassifyError(err) {
+		case constants.ResourceNotFound:
+			utils.WriteJSON(w, http.StatusNotFound, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "commentID"))
+		case constants.PQInvalidTextRepresentation:
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("invalid data type", constants.MSG_MALFORMED_REQUEST_DATA, "commentID"))
+		default:
+			handler.Logger.Printf("ERROR: ModifyComment > store GetCommentResource: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		}
+		return
+	}
 
-		case constants.LackingPermission:
-			utils.WriteJSON(w, http.StatusForbidden, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "commentId"))
-			return
+	decision := handler.Policy.Authorize(policy.SubjectFromContext(r.Context()), policy.ActionEdit, resource)
+	if !decision.Allowed {
+		utils.WriteJSON(w, http.StatusForbidden, utils.NewMessage(decision.Reason, constants.MSG_INVALID_REQUEST_DATA, "commentId"))
+		return
+	}
+	req.Moderated = decision.Moderated
+
+	moderationAction, err := handler.Store.ModifyComment(req)
+	if err != nil {
+		switch utils.ClassifyError(err) {
 		case constants.InvalidData:
 			utils.WriteJSON(w, http.StatusNotFound, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "commentId"))
 			return
@@ -125,20 +150,22 @@ func (handler *CommentHandler) ModifyComment(w http.ResponseWriter, r *http.Requ
 		}
 	}
 
+	notifyModeratedOwner(handler.Mailer, handler.Logger, moderationAction)
+
 	utils.WriteJSON(w, http.StatusOK, utils.NewMessage("comment has been modified", "", ""))
 
 }
 
 func (handler *CommentHandler) DeleteComment(w http.ResponseWriter, r *http.Request) {
 
-	result, err := utils.GetValuesFromCookie(r, []string{constants.JWTUserID})
+	user, err := utils.GetAuthenticatedUser(r)
 	if err != nil {
 		handler.Logger.Printf("ERROR: DeleteComment > JWT token checking: %v", err)
 		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
 		return
 	}
 
-	userID := result[0]
+	userID := user.ID
 
 	var req store.DeleteCommentRequest
 
@@ -156,14 +183,37 @@ func (handler *CommentHandler) DeleteComment(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	if errMessage := validateModerationReason(req.ModerationReason); errMessage != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, errMessage)
+		return
+	}
+
 	req.UserID = userID
 
-	err = handler.Store.DeleteComment(req)
+	resource, err := handler.Store.GetCommentResource(req.CommentID)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.ResourceNotFound:
+			utils.WriteJSON(w, http.StatusNotFound, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "commentID"))
+		case constants.PQInvalidTextRepresentation:
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("invalid data type", constants.MSG_MALFORMED_REQUEST_DATA, "commentID"))
+		default:
+			handler.Logger.Printf("ERROR: DeleteComment > store GetCommentResource: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		}
+		return
+	}
+
+	decision := handler.Policy.Authorize(policy.SubjectFromContext(r.Context()), policy.ActionDelete, resource)
+	if !decision.Allowed {
+		utils.WriteJSON(w, http.StatusForbidden, utils.NewMessage(decision.Reason, constants.MSG_INVALID_REQUEST_DATA, "commentId"))
+		return
+	}
+	req.Moderated = decision.Moderated
+
+	moderationAction, err := handler.Store.DeleteComment(req)
 	if err != nil {
 		switch utils.ClassifyError(err) {
-		case constants.LackingPermission:
-			utils.WriteJSON(w, http.StatusForbidden, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "commentId"))
-			return
 		case constants.InvalidData:
 			utils.WriteJSON(w, http.StatusNotFound, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "commentId"))
 			return
@@ -178,6 +228,8 @@ func (handler *CommentHandler) DeleteComment(w http.ResponseWriter, r *http.Requ
 		}
 	}
 
+	notifyModeratedOwner(handler.Mailer, handler.Logger, moderationAction)
+
 	utils.WriteJSON(w, http.StatusOK, utils.NewMessage("comment has been deleted", "", ""))
 
 }
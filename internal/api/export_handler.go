@@ -0,0 +1,481 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/store"
+	"github.com/RichardHoa/hack-me/internal/utils"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	exportKeyPrefix = "exports/"
+	// exportPageSize is how many bookmarks are read at a time while collecting the export
+	exportPageSize = 100
+)
+
+type ExportHandler struct {
+	ExportStore        store.ExportStore
+	UserStore          store.UserStore
+	BookmarkStore      store.BookmarkStore
+	SecurityEventStore store.SecurityEventStore
+	BlobStore          store.BlobStore
+	Mailer             store.Mailer
+	Logger             *log.Logger
+
+	// builds holds a slot per archive being built, each one keeps the data of a user in memory
+	builds  chan struct{}
+	running sync.WaitGroup
+}
+
+func NewExportHandler(exportStore store.ExportStore, userStore store.UserStore, bookmarkStore store.BookmarkStore, securityEventStore store.SecurityEventStore, blobStore store.BlobStore, mailer store.Mailer, logger *log.Logger) *ExportHandler {
+	return &ExportHandler{
+		ExportStore:        exportStore,
+		UserStore:          userStore,
+		BookmarkStore:      bookmarkStore,
+		SecurityEventStore: securityEventStore,
+		BlobStore:          blobStore,
+		Mailer:             mailer,
+		Logger:             logger,
+		builds:             make(chan struct{}, constants.MaxConcurrentExportBuilds),
+	}
+}
+
+// exportArchive is data.json, README.md in the archive shows the same data for people
+type exportArchive struct {
+	ExportedAt         time.Time                 `json:"exportedAt"`
+	Account            exportAccount             `json:"account"`
+	Challenges         []store.ExportedChallenge `json:"challenges"`
+	ChallengeResponses []store.ExportedResponse  `json:"challengeResponses"`
+	Comments           []store.ExportedComment   `json:"comments"`
+	Votes              []store.ExportedVote      `json:"votes"`
+	Solves             []store.UserSolveSummary  `json:"solves"`
+	Bookmarks          []store.Bookmark          `json:"bookmarks"`
+	SecurityEvents     []store.SecurityEvent     `json:"securityEvents"`
+}
+
+type exportAccount struct {
+	UserName        string     `json:"userName"`
+	Email           string     `json:"email"`
+	EmailVerifiedAt *time.Time `json:"emailVerifiedAt"`
+	ImageLink       string     `json:"imageLink"`
+	Role            string     `json:"role"`
+	TOTPEnabled     bool       `json:"totpEnabled"`
+	JoinedAt        time.Time  `json:"joinedAt"`
+}
+
+/*
+RequestExport starts building an archive of everything we hold about the user.
+It answers right away, the archive is built in the background and the user gets
+an email with the download link once it is ready.
+*/
+func (handler *ExportHandler) RequestExport(w http.ResponseWriter, r *http.Request) {
+	user, err := utils.GetAuthenticatedUser(r)
+	if err != nil {
+		handler.Logger.Printf("ERROR: RequestExport > JWT token checking: %v", err)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
+		return
+	}
+
+	if !handler.startBuild() {
+		w.Header().Set("Retry-After", "60")
+		utils.WriteJSON(w, http.StatusServiceUnavailable, utils.NewMessage("too many exports are being prepared, please try again in a minute", constants.MSG_TOO_MANY_REQUESTS, ""))
+		return
+	}
+
+	export, err := handler.ExportStore.CreateExport(user.ID)
+	if err != nil {
+		handler.finishBuild()
+		switch utils.ClassifyError(err) {
+		case constants.InvalidData:
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, ""))
+		default:
+			handler.Logger.Printf("ERROR: RequestExport > CreateExport: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		}
+		return
+	}
+
+	recordSecurityEvent(handler.SecurityEventStore, handler.Logger, r, store.RecordSecurityEventRequest{
+		UserID:    user.ID,
+		EventType: store.SecurityEventDataExported,
+	})
+
+	go func() {
+		defer handler.finishBuild()
+		handler.buildExport(user.ID, export.ID)
+	}()
+
+	utils.WriteJSON(w, http.StatusAccepted, utils.Message{
+		"message": "Your export is being prepared, we will email you the download link",
+		"data":    export,
+	})
+}
+
+// GetExport tells whether the archive is ready, with the download link once it is
+func (handler *ExportHandler) GetExport(w http.ResponseWriter, r *http.Request) {
+	export, ok := handler.findExport(w, r, "GetExport")
+	if !ok {
+		return
+	}
+
+	if export.Status == store.DataExportReady && !export.Expired(time.Now()) {
+		export.DownloadLink = exportDownloadLink(export.ID)
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Message{"data": export})
+}
+
+// DownloadExport sends the archive, only to its owner and only until the link expires
+func (handler *ExportHandler) DownloadExport(w http.ResponseWriter, r *http.Request) {
+	export, ok := handler.findExport(w, r, "DownloadExport")
+	if !ok {
+		return
+	}
+
+	switch {
+	case export.Status == store.DataExportPending:
+		utils.WriteJSON(w, http.StatusConflict, utils.NewMessage("the export is not ready yet", constants.MSG_INVALID_REQUEST_DATA, "exportID"))
+		return
+	case export.Status == store.DataExportFailed:
+		utils.WriteJSON(w, http.StatusConflict, utils.NewMessage("the export failed, please request a new one", constants.MSG_INVALID_REQUEST_DATA, "exportID"))
+		return
+	case export.Expired(time.Now()):
+		utils.WriteJSON(w, http.StatusGone, utils.NewMessage("the download link expired, please request a new export", constants.MSG_INVALID_REQUEST_DATA, "exportID"))
+		return
+	}
+
+	archive, err := handler.BlobStore.Get(export.BlobKey)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.ResourceNotFound:
+			utils.WriteJSON(w, http.StatusGone, utils.NewMessage("the download link expired, please request a new export", constants.MSG_INVALID_REQUEST_DATA, "exportID"))
+		default:
+			handler.Logger.Printf("ERROR: DownloadExport > Get: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		}
+		return
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", "application/zip")
+	header.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="hack-me-export-%s.zip"`, export.CreatedAt.Format("2006-01-02")))
+	header.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+
+	_, err = w.Write(archive)
+	if err != nil {
+		// the status is already sent, the client sees a cut off download
+		handler.Logger.Printf("ERROR: DownloadExport > Write: %v", err)
+	}
+}
+
+// findExport loads the export of the URL for the logged in user, it writes the error response itself
+func (handler *ExportHandler) findExport(w http.ResponseWriter, r *http.Request, caller string) (*store.DataExport, bool) {
+	user, err := utils.GetAuthenticatedUser(r)
+	if err != nil {
+		handler.Logger.Printf("ERROR: %s > JWT token checking: %v", caller, err)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
+		return nil, false
+	}
+
+	exportID := chi.URLParam(r, "exportID")
+	if _, err := uuid.Parse(exportID); err != nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.NewMessage("export not found", constants.MSG_INVALID_REQUEST_DATA, "exportID"))
+		return nil, false
+	}
+
+	export, err := handler.ExportStore.GetExport(exportID, user.ID)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.ResourceNotFound:
+			utils.WriteJSON(w, http.StatusNotFound, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "exportID"))
+		default:
+			handler.Logger.Printf("ERROR: %s > GetExport: %v", caller, err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		}
+		return nil, false
+	}
+
+	return export, true
+}
+
+func exportDownloadLink(exportID string) string {
+	return constants.APIBaseURL + "/v1/users/me/exports/" + exportID + "/archive"
+}
+
+/*
+exportPageLink is the frontend page of an export, the one the email links to.
+The login cookies are SameSite=Strict, so a click from a webmail on the API link
+itself would arrive logged out. The page is on our own site and downloads the
+archive from there.
+*/
+func exportPageLink(exportID string) string {
+	return constants.FrontendURL + "/data-export?id=" + exportID
+}
+
+// startBuild takes a build slot, it reports false when every slot is in use
+func (handler *ExportHandler) startBuild() bool {
+	select {
+	case handler.builds <- struct{}{}:
+		handler.running.Add(1)
+		return true
+	default:
+		return false
+	}
+}
+
+func (handler *ExportHandler) finishBuild() {
+	<-handler.builds
+	handler.running.Done()
+}
+
+// Shutdown waits for the archives being built until ctx ends, an unfinished one stays pending
+func (handler *ExportHandler) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		handler.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("data exports still being built: %w", ctx.Err())
+	}
+}
+
+// buildExport runs outside of the request, errors are logged and the export is marked as failed
+func (handler *ExportHandler) buildExport(userID, exportID string) {
+	fail := func(step string, err error) {
+		handler.Logger.Printf("ERROR: buildExport > %s: %v", step, err)
+		err = handler.ExportStore.FailExport(exportID)
+		if err != nil {
+			handler.Logger.Printf("ERROR: buildExport > FailExport: %v", err)
+		}
+	}
+
+	archive, err := handler.collectExport(userID)
+	if err != nil {
+		fail("collectExport", err)
+		return
+	}
+
+	data, err := zipExport(archive)
+	if err != nil {
+		fail("zipExport", err)
+		return
+	}
+
+	key := exportKeyPrefix + exportID + ".zip"
+	err = handler.BlobStore.Put(key, data)
+	if err != nil {
+		fail("Put", err)
+		return
+	}
+
+	export, err := handler.ExportStore.CompleteExport(exportID, key)
+	if err != nil {
+		fail("CompleteExport", err)
+		if err := handler.BlobStore.Delete(key); err != nil {
+			handler.Logger.Printf("ERROR: buildExport > Delete: %v", err)
+		}
+		return
+	}
+
+	err = handler.Mailer.SendMail(store.Mail{
+		To:      archive.Account.Email,
+		Subject: "Your Hack-Me data export is ready",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nThe archive of your Hack-Me data is ready. Log in and download it before %s:\n\n%s\n\nIf you did not ask for it, change your password, someone else may be logged in to your account.\n",
+			archive.Account.UserName, export.ExpiresAt.UTC().Format(time.RFC1123), exportPageLink(exportID),
+		),
+	})
+	if err != nil {
+		handler.Logger.Printf("ERROR: buildExport > SendMail: %v", err)
+	}
+}
+
+// collectExport reads the user's data from every store that holds some
+func (handler *ExportHandler) collectExport(userID string) (exportArchive, error) {
+	archive := exportArchive{ExportedAt: time.Now().UTC()}
+
+	activity, err := handler.UserStore.GetUserActivity(userID)
+	if err != nil {
+		return archive, err
+	}
+
+	content, err := handler.ExportStore.GetExportedContent(userID)
+	if err != nil {
+		return archive, err
+	}
+
+	archive.Account = exportAccount{
+		UserName:        activity.User.Username,
+		Email:           content.Email,
+		EmailVerifiedAt: content.EmailVerifiedAt,
+		ImageLink:       activity.User.ImageLink,
+		Role:            activity.User.Role,
+		TOTPEnabled:     activity.User.TOTPEnabled,
+		JoinedAt:        content.JoinedAt,
+	}
+	archive.Challenges = content.Challenges
+	archive.ChallengeResponses = content.ChallengeResponses
+	archive.Comments = content.Comments
+	archive.Votes = content.Votes
+	archive.Solves = activity.Solves
+
+	archive.Bookmarks = []store.Bookmark{}
+	pageSize := exportPageSize
+	for page := constants.DefaultPage; ; page++ {
+		bookmarks, _, err := handler.BookmarkStore.GetBookmarks(store.GetBookmarksParams{UserID: userID, Page: &page, PageSize: &pageSize})
+		if err != nil {
+			return archive, err
+		}
+		archive.Bookmarks = append(archive.Bookmarks, bookmarks...)
+		if len(bookmarks) < pageSize {
+			break
+		}
+	}
+
+	archive.SecurityEvents = []store.SecurityEvent{}
+	for page := constants.DefaultPage; ; page++ {
+		events, err := handler.SecurityEventStore.GetSecurityEvents(store.SecurityEventFilter{UserID: userID, Page: page})
+		if err != nil {
+			return archive, err
+		}
+		archive.SecurityEvents = append(archive.SecurityEvents, events...)
+		if len(events) < constants.DefaultPageSize {
+			break
+		}
+	}
+
+	return archive, nil
+}
+
+// zipExport packs data.json and README.md
+func zipExport(archive exportArchive) ([]byte, error) {
+	data, err := json.MarshalIndent(archive, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	writer := zip.NewWriter(&out)
+
+	for name, content := range map[string][]byte{
+		"data.json": data,
+		"README.md": []byte(renderExportMarkdown(archive)),
+	} {
+		file, err := writer.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: archive.ExportedAt})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := file.Write(content); err != nil {
+			return nil, err
+		}
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+// markdownCell keeps a value from breaking the table it is written in
+func markdownCell(value string) string {
+	value = strings.ReplaceAll(value, "|", `\|`)
+	return strings.Join(strings.Fields(value), " ")
+}
+
+func renderExportMarkdown(archive exportArchive) string {
+	var md strings.Builder
+	date := func(t time.Time) string { return t.UTC().Format("2006-01-02 15:04 MST") }
+	hidden := func(isHidden bool) string {
+		if isHidden {
+			return " (hidden by a moderator)"
+		}
+		return ""
+	}
+
+	fmt.Fprintf(&md, "# Hack-Me data of %s\n\nExported on %s. The same data is in data.json.\n\n", archive.Account.UserName, date(archive.ExportedAt))
+
+	md.WriteString("## Account\n\n")
+	fmt.Fprintf(&md, "- Username: %s\n- Email: %s\n", archive.Account.UserName, archive.Account.Email)
+	if archive.Account.EmailVerifiedAt != nil {
+		fmt.Fprintf(&md, "- Email verified on: %s\n", date(*archive.Account.EmailVerifiedAt))
+	}
+	fmt.Fprintf(&md, "- Avatar: %s\n- Role: %s\n- Authenticator app enabled: %t\n- Joined on: %s\n\n",
+		archive.Account.ImageLink, archive.Account.Role, archive.Account.TOTPEnabled, date(archive.Account.JoinedAt))
+
+	fmt.Fprintf(&md, "## Challenges (%d)\n\n", len(archive.Challenges))
+	for _, challenge := range archive.Challenges {
+		fmt.Fprintf(&md, "### %s%s\n\nCategory %s, posted on %s.\n\n%s\n\n", challenge.Name, hidden(challenge.Hidden), challenge.Category, date(challenge.CreatedAt), challenge.Content)
+	}
+
+	fmt.Fprintf(&md, "## Challenge responses (%d)\n\n", len(archive.ChallengeResponses))
+	for _, response := range archive.ChallengeResponses {
+		fmt.Fprintf(&md, "### %s%s\n\nOn %s, posted on %s, %s up votes and %s down votes.\n\n%s\n\n",
+			response.Name, hidden(response.Hidden), response.ChallengeName, date(response.CreatedAt), response.UpVote, response.DownVote, response.Content)
+	}
+
+	fmt.Fprintf(&md, "## Comments (%d)\n\n", len(archive.Comments))
+	for _, comment := range archive.Comments {
+		on := ""
+		switch {
+		case comment.ChallengeName != nil:
+			on = "the challenge " + *comment.ChallengeName
+		case comment.ChallengeResponseName != nil:
+			on = "the response " + *comment.ChallengeResponseName
+		}
+		fmt.Fprintf(&md, "- On %s, %s%s:\n\n  > %s\n\n", on, date(comment.CreatedAt), hidden(comment.Hidden), strings.ReplaceAll(comment.Content, "\n", "\n  > "))
+	}
+
+	fmt.Fprintf(&md, "## Votes (%d)\n\n", len(archive.Votes))
+	for _, vote := range archive.Votes {
+		fmt.Fprintf(&md, "- %s vote on %s, %s\n", vote.VoteType, vote.ChallengeResponseName, date(vote.CreatedAt))
+	}
+
+	fmt.Fprintf(&md, "\n## Solved challenges (%d)\n\n", len(archive.Solves))
+	for _, solve := range archive.Solves {
+		fmt.Fprintf(&md, "- %s (%s), %s\n", solve.Name, solve.Category, date(solve.SolvedAt))
+	}
+
+	fmt.Fprintf(&md, "\n## Bookmarks (%d)\n\n", len(archive.Bookmarks))
+	for _, bookmark := range archive.Bookmarks {
+		switch {
+		case bookmark.Challenge != nil:
+			fmt.Fprintf(&md, "- Challenge %s, saved on %s\n", bookmark.Challenge.Name, date(bookmark.CreatedAt))
+		case bookmark.ChallengeResponse != nil:
+			fmt.Fprintf(&md, "- Response %s on %s, saved on %s\n", bookmark.ChallengeResponse.Name, bookmark.ChallengeResponse.ChallengeName, date(bookmark.CreatedAt))
+		}
+	}
+
+	fmt.Fprintf(&md, "\n## Security events (%d)\n\n", len(archive.SecurityEvents))
+	if len(archive.SecurityEvents) > 0 {
+		md.WriteString("| Date | Event | IP address | Browser | Detail |\n| --- | --- | --- | --- | --- |\n")
+		for _, event := range archive.SecurityEvents {
+			detail := ""
+			if event.Detail != nil {
+				detail = *event.Detail
+			}
+			fmt.Fprintf(&md, "| %s | %s | %s | %s | %s |\n", date(event.CreatedAt), event.EventType, markdownCell(event.IPAddress), markdownCell(event.UserAgent), markdownCell(detail))
+		}
+	}
+
+	return md.String()
+}
@@ -0,0 +1,37 @@
+package api
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/utils"
+)
+
+type JWKSHandler struct {
+	Logger *log.Logger
+}
+
+func NewJWKSHandler(logger *log.Logger) *JWKSHandler {
+	return &JWKSHandler{
+		Logger: logger,
+	}
+}
+
+/*
+GetJWKS publishes the public keys of the access tokens (RFC 7517) so other
+services can verify them without a shared secret. The set is empty while
+access tokens are signed with HS512.
+*/
+func (handler *JWKSHandler) GetJWKS(w http.ResponseWriter, r *http.Request) {
+	jwks, err := utils.AccessTokenJWKS()
+	if err != nil {
+		handler.Logger.Printf("ERROR: GetJWKS > AccessTokenJWKS: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		return
+	}
+
+	// verifiers refetch the set when they meet an unknown kid, a short cache is enough
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	utils.WriteJSON(w, http.StatusOK, utils.Message{"keys": jwks})
+}
@@ -0,0 +1,217 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/store"
+	"github.com/RichardHoa/hack-me/internal/utils"
+)
+
+type MFAHandler struct {
+	MFAStore           store.MFAStore
+	TokenStore         store.TokenStore
+	SecurityEventStore store.SecurityEventStore
+	Logger             *log.Logger
+}
+
+func NewMFAHandler(mfaStore store.MFAStore, tokenStore store.TokenStore, securityEventStore store.SecurityEventStore, logger *log.Logger) *MFAHandler {
+	return &MFAHandler{
+		MFAStore:           mfaStore,
+		TokenStore:         tokenStore,
+		SecurityEventStore: securityEventStore,
+		Logger:             logger,
+	}
+}
+
+// StartTOTPEnrollment returns a new secret and its otpauth URI for the authenticator app
+func (handler *MFAHandler) StartTOTPEnrollment(w http.ResponseWriter, r *http.Request) {
+	user, err := utils.GetAuthenticatedUser(r)
+	if err != nil {
+		handler.Logger.Printf("ERROR: StartTOTPEnrollment > JWT token checking: %v", err)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
+		return
+	}
+	userID := user.ID
+
+	enrollment, err := handler.MFAStore.StartTOTPEnrollment(userID)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.InvalidData:
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "totp"))
+			return
+		default:
+			handler.Logger.Printf("ERROR: StartTOTPEnrollment > mfaStore.StartTOTPEnrollment: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+			return
+		}
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Message{"data": enrollment})
+}
+
+// ConfirmTOTPEnrollment enables 2FA and returns the recovery codes, they are never shown again
+func (handler *MFAHandler) ConfirmTOTPEnrollment(w http.ResponseWriter, r *http.Request) {
+	req, ok := handler.decodeCodeRequest(w, r, "ConfirmTOTPEnrollment")
+	if !ok {
+		return
+	}
+
+	recoveryCodes, err := handler.MFAStore.ConfirmTOTPEnrollment(req)
+	if err != nil {
+		handler.writeCodeError(w, err, "ConfirmTOTPEnrollment")
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Message{
+		"message": "Two-factor authentication enabled, store the recovery codes somewhere safe",
+		"data":    utils.Message{"recoveryCodes": recoveryCodes},
+	})
+}
+
+func (handler *MFAHandler) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	req, ok := handler.decodeCodeRequest(w, r, "DisableTOTP")
+	if !ok {
+		return
+	}
+
+	err := handler.MFAStore.DisableTOTP(req)
+	if err != nil {
+		handler.writeCodeError(w, err, "DisableTOTP")
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.NewMessage("Two-factor authentication disabled", "", ""))
+}
+
+func (handler *MFAHandler) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	req, ok := handler.decodeCodeRequest(w, r, "RegenerateRecoveryCodes")
+	if !ok {
+		return
+	}
+
+	recoveryCodes, err := handler.MFAStore.RegenerateRecoveryCodes(req)
+	if err != nil {
+		handler.writeCodeError(w, err, "RegenerateRecoveryCodes")
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Message{
+		"message": "Recovery codes replaced, the old codes no longer work",
+		"data":    utils.Message{"recoveryCodes": recoveryCodes},
+	})
+}
+
+// LoginWithMFACode is the second login step, it takes the mfaToken of the password step and a code
+func (handler *MFAHandler) LoginWithMFACode(w http.ResponseWriter, r *http.Request) {
+	var req store.MFALoginRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&req)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(constants.StatusInvalidBodyMessage, constants.MSG_MALFORMED_REQUEST_DATA, "request"))
+		return
+	}
+
+	err = utils.ValidateJSONFieldsNotEmpty(w, req)
+	if err != nil {
+		return
+	}
+
+	accessToken, refreshToken, csrfToken, err := handler.MFAStore.LoginWithMFACode(&req)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.InvalidData, constants.PQInvalidByteSequence:
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "mfaToken and code"))
+		case constants.TooManyRequests:
+			utils.WriteJSON(w, http.StatusTooManyRequests, utils.NewMessage(err.Error(), constants.MSG_TOO_MANY_REQUESTS, "code"))
+		default:
+			handler.Logger.Printf("ERROR: LoginWithMFACode > mfaStore.LoginWithMFACode: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		}
+		return
+	}
+
+	err = handler.TokenStore.AddRefreshToken(refreshToken, req.UserID, sessionMetadata(r))
+	if err != nil {
+		handler.Logger.Printf("ERROR: LoginWithMFACode > AddRefreshToken: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		return
+	}
+
+	err = utils.SendTokens(w, accessToken, refreshToken, csrfToken)
+	if err != nil {
+		handler.Logger.Printf("ERROR: LoginWithMFACode > Send tokens: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		return
+	}
+
+	recordSecurityEvent(handler.SecurityEventStore, handler.Logger, r, store.RecordSecurityEventRequest{UserID: req.UserID, EventType: store.SecurityEventLogin, Detail: "totp"})
+	utils.WriteJSON(w, http.StatusOK, utils.NewMessage("Successful authentication", "", ""))
+}
+
+// decodeCodeRequest reads the code of the logged in user, it writes the error response itself
+func (handler *MFAHandler) decodeCodeRequest(w http.ResponseWriter, r *http.Request, funcName string) (store.MFACodeRequest, bool) {
+	var req store.MFACodeRequest
+
+	user, err := utils.GetAuthenticatedUser(r)
+	if err != nil {
+		handler.Logger.Printf("ERROR: %s > JWT token checking: %v", funcName, err)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
+		return req, false
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&req)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(constants.StatusInvalidBodyMessage, constants.MSG_MALFORMED_REQUEST_DATA, "request"))
+		return req, false
+	}
+
+	err = utils.ValidateJSONFieldsNotEmpty(w, req)
+	if err != nil {
+		return req, false
+	}
+
+	req.UserID = user.ID
+
+	return req, true
+}
+
+func (handler *MFAHandler) writeCodeError(w http.ResponseWriter, err error, funcName string) {
+	switch utils.ClassifyError(err) {
+	case constants.InvalidData, constants.PQInvalidByteSequence:
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "code"))
+	case constants.ResourceNotFound:
+		utils.WriteJSON(w, http.StatusNotFound, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "user"))
+	case constants.TooManyRequests:
+		utils.WriteJSON(w, http.StatusTooManyRequests, utils.NewMessage(err.Error(), constants.MSG_TOO_MANY_REQUESTS, "code"))
+	default:
+		handler.Logger.Printf("ERROR: %s > mfaStore: %v", funcName, err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+	}
+}
+
+/*
+writeMFARequired answers a login whose password or provider step succeeded on an
+account with 2FA. No tokens are issued, the client continues at /v1/users/login/mfa.
+*/
+func writeMFARequired(w http.ResponseWriter, mfaStore store.MFAStore, userID string, logger *log.Logger) {
+	mfaToken, err := mfaStore.CreateMFAChallenge(userID)
+	if err != nil {
+		logger.Printf("ERROR: writeMFARequired > CreateMFAChallenge: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusAccepted, utils.Message{
+		"message": "Two-factor authentication code required",
+		"data": utils.Message{
+			"mfaRequired": true,
+			"mfaToken":    mfaToken,
+		},
+	})
+}
@@ -0,0 +1,191 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/policy"
+	"github.com/RichardHoa/hack-me/internal/store"
+	"github.com/RichardHoa/hack-me/internal/utils"
+)
+
+type ModerationHandler struct {
+	ModerationStore store.ModerationStore
+	Policy          *policy.Engine
+	Mailer          store.Mailer
+	Logger          *log.Logger
+}
+
+func NewModerationHandler(moderationStore store.ModerationStore, policyEngine *policy.Engine, mailer store.Mailer, logger *log.Logger) *ModerationHandler {
+	return &ModerationHandler{
+		ModerationStore: moderationStore,
+		Policy:          policyEngine,
+		Mailer:          mailer,
+		Logger:          logger,
+	}
+}
+
+// ChangeVisibility hides content from every listing, or shows hidden content again
+func (handler *ModerationHandler) ChangeVisibility(w http.ResponseWriter, r *http.Request) {
+	user, err := utils.GetAuthenticatedUser(r)
+	if err != nil {
+		handler.Logger.Printf("ERROR: ChangeVisibility > JWT token checking: %v", err)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
+		return
+	}
+
+	var req store.ChangeVisibilityRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&req)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(constants.StatusInvalidBodyMessage, constants.MSG_MALFORMED_REQUEST_DATA, "request"))
+		return
+	}
+
+	err = utils.ValidateJSONFieldsNotEmpty(w, req)
+	if err != nil {
+		return
+	}
+
+	if _, err := strconv.Atoi(req.TargetID); err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("targetID can only be number", constants.MSG_MALFORMED_REQUEST_DATA, "targetID"))
+		return
+	}
+
+	if errMessage := validateModerationReason(&req.Reason); errMessage != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, errMessage)
+		return
+	}
+
+	resource, err := handler.ModerationStore.GetContentResource(req.TargetType, req.TargetID)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.InvalidData:
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "targetType"))
+		case constants.ResourceNotFound:
+			utils.WriteJSON(w, http.StatusNotFound, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "targetID"))
+		default:
+			handler.Logger.Printf("ERROR: ChangeVisibility > GetContentResource: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		}
+		return
+	}
+
+	decision := handler.Policy.Authorize(policy.SubjectFromContext(r.Context()), policy.ActionHide, resource)
+	if !decision.Allowed {
+		utils.WriteJSON(w, http.StatusForbidden, utils.NewMessage(decision.Reason, constants.MSG_INVALID_REQUEST_DATA, ""))
+		return
+	}
+
+	req.ModeratorID = user.ID
+
+	action, err := handler.ModerationStore.ChangeVisibility(req)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.InvalidData:
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, ""))
+		case constants.ResourceNotFound:
+			utils.WriteJSON(w, http.StatusNotFound, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "targetID"))
+		default:
+			handler.Logger.Printf("ERROR: ChangeVisibility > ChangeVisibility: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		}
+		return
+	}
+
+	notifyModeratedOwner(handler.Mailer, handler.Logger, &action)
+
+	utils.WriteJSON(w, http.StatusOK, utils.Message{"data": action})
+}
+
+// GetModerationActions lists what moderators did, newest first
+func (handler *ModerationHandler) GetModerationActions(w http.ResponseWriter, r *http.Request) {
+	page, _, errMessage := parsePageQuery(r.URL.Query())
+	if errMessage != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, errMessage)
+		return
+	}
+
+	pageNum := constants.DefaultPage
+	if page != nil {
+		pageNum = *page
+	}
+
+	actions, err := handler.ModerationStore.GetModerationActions(pageNum)
+	if err != nil {
+		handler.Logger.Printf("ERROR: GetModerationActions > GetModerationActions: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Message{"data": actions})
+}
+
+// validateModerationReason checks the optional reason a moderator gives to the owner
+func validateModerationReason(reason *string) utils.Message {
+	if reason == nil {
+		return nil
+	}
+
+	*reason = strings.TrimSpace(*reason)
+	if utf8.RuneCountInString(*reason) > constants.MaxModerationReasonLength {
+		return utils.NewMessage(fmt.Sprintf("moderation reason must be at most %d characters", constants.MaxModerationReasonLength), constants.MSG_INVALID_REQUEST_DATA, "moderationReason")
+	}
+
+	return nil
+}
+
+// moderationActionVerbs tells the owner what happened to their content
+var moderationActionVerbs = map[string]string{
+	store.ModerationActionEdit:   "edited",
+	store.ModerationActionHide:   "hid",
+	store.ModerationActionUnhide: "restored",
+	store.ModerationActionDelete: "deleted",
+}
+
+var moderationTargetNames = map[string]string{
+	store.ModerationTargetChallenge:         "challenge",
+	store.ModerationTargetChallengeResponse: "challenge response",
+	store.ModerationTargetComment:           "comment",
+}
+
+/*
+notifyModeratedOwner emails the owner of content a moderator acted on. action is
+nil when the owner made the change. The action is already recorded, so a failed
+email is only logged.
+*/
+func notifyModeratedOwner(mailer store.Mailer, logger *log.Logger, action *store.ModerationAction) {
+	if action == nil || action.OwnerEmail == "" {
+		return
+	}
+
+	reason := "No reason was given."
+	if action.Reason != nil {
+		reason = "Reason: " + *action.Reason
+	}
+
+	// actions without a moderator were taken by Hack-Me itself, like hiding reported content
+	subjectActor, bodyActor := "A moderator", "A Hack-Me moderator"
+	if action.ModeratorName == nil {
+		subjectActor, bodyActor = "Hack-Me", "Hack-Me"
+	}
+
+	err := mailer.SendMail(store.Mail{
+		To:      action.OwnerEmail,
+		Subject: fmt.Sprintf("%s %s your Hack-Me %s", subjectActor, moderationActionVerbs[action.Action], moderationTargetNames[action.TargetType]),
+		Body: fmt.Sprintf(
+			"%s %s your %s \"%s\".\n\n%s\n\nIf you think this is a mistake, reply to this email.\n",
+			bodyActor, moderationActionVerbs[action.Action], moderationTargetNames[action.TargetType], action.TargetTitle, reason,
+		),
+	})
+	if err != nil {
+		logger.Printf("ERROR: notifyModeratedOwner > SendMail: %v", err)
+	}
+}
@@ -0,0 +1,229 @@
+package api
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/store"
+	"github.com/RichardHoa/hack-me/internal/utils"
+	"github.com/go-chi/chi/v5"
+)
+
+const oauthStateCookie = "oauthState"
+
+// error codes the callback hands to the frontend in the error query parameter
+const (
+	oauthErrorUnsupportedProvider = "unsupported_provider"
+	oauthErrorAccessDenied        = "access_denied"
+	oauthErrorInvalidState        = "invalid_state"
+	oauthErrorVerificationFailed  = "verification_failed"
+	oauthErrorEmailNotUsable      = "email_not_usable"
+	oauthErrorServer              = "server_error"
+)
+
+type OAuthHandler struct {
+	// Providers maps the provider name of the URL to its client, tests plug in stand-in providers here
+	Providers          map[string]store.OAuthProvider
+	OAuthStore         store.OAuthStore
+	UserStore          store.UserStore
+	TokenStore         store.TokenStore
+	MFAStore           store.MFAStore
+	SecurityEventStore store.SecurityEventStore
+	Logger             *log.Logger
+}
+
+func NewOAuthHandler(providers map[string]store.OAuthProvider, oauthStore store.OAuthStore, userStore store.UserStore, tokenStore store.TokenStore, mfaStore store.MFAStore, securityEventStore store.SecurityEventStore, logger *log.Logger) *OAuthHandler {
+	return &OAuthHandler{
+		Providers:          providers,
+		OAuthStore:         oauthStore,
+		UserStore:          userStore,
+		TokenStore:         tokenStore,
+		MFAStore:           mfaStore,
+		SecurityEventStore: securityEventStore,
+		Logger:             logger,
+	}
+}
+
+/*
+StartLogin begins the authorization code flow with PKCE: the state, nonce and
+code verifier are kept server side and the browser is redirected to the provider.
+The state is also bound to the browser with a cookie to stop login CSRF.
+*/
+func (handler *OAuthHandler) StartLogin(w http.ResponseWriter, r *http.Request) {
+	providerName := chi.URLParam(r, "provider")
+	provider, ok := handler.Providers[providerName]
+	if !ok {
+		utils.WriteJSON(w, http.StatusNotFound, utils.NewMessage("login provider is not supported", constants.MSG_INVALID_REQUEST_DATA, "provider"))
+		return
+	}
+
+	var values [3]string
+	for i := range values {
+		value, err := utils.GenerateRandomToken(32)
+		if err != nil {
+			handler.Logger.Printf("ERROR: StartLogin > GenerateRandomToken: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+			return
+		}
+		values[i] = value
+	}
+
+	oauthState := store.OAuthState{
+		State:        values[0],
+		Provider:     providerName,
+		CodeVerifier: values[1],
+		Nonce:        values[2],
+	}
+
+	authURL, err := provider.AuthCodeURL(oauthState.State, oauthState.Nonce, utils.CreatePKCEChallenge(oauthState.CodeVerifier))
+	if err != nil {
+		handler.Logger.Printf("ERROR: StartLogin > AuthCodeURL: %v", err)
+		utils.WriteJSON(w, http.StatusBadGateway, utils.NewMessage("login provider is not available", "", ""))
+		return
+	}
+
+	err = handler.OAuthStore.AddOAuthState(oauthState)
+	if err != nil {
+		handler.Logger.Printf("ERROR: StartLogin > AddOAuthState: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		return
+	}
+
+	setOAuthStateCookie(w, oauthState.State, int(constants.OAuthStateTime.Seconds()))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+/*
+Callback finishes the login: it checks the state against the browser cookie,
+redeems the code with the stored PKCE verifier and logs in the verified identity.
+The browser arrives here by a redirect from the provider, so every outcome sends
+it on to the frontend, with the error query parameter when the login failed.
+*/
+func (handler *OAuthHandler) Callback(w http.ResponseWriter, r *http.Request) {
+	providerName := chi.URLParam(r, "provider")
+	provider, ok := handler.Providers[providerName]
+	if !ok {
+		redirectToFrontend(w, r, oauthErrorUnsupportedProvider)
+		return
+	}
+
+	// the state is single use, whatever happens next
+	setOAuthStateCookie(w, "", -1)
+
+	query := r.URL.Query()
+	if providerError := query.Get("error"); providerError != "" {
+		handler.Logger.Printf("ERROR: Callback > provider %s returned error |%s|", providerName, providerError)
+		redirectToFrontend(w, r, oauthErrorAccessDenied)
+		return
+	}
+
+	state := query.Get("state")
+	code := query.Get("code")
+	if state == "" || code == "" {
+		redirectToFrontend(w, r, oauthErrorInvalidState)
+		return
+	}
+
+	stateCookie, err := r.Cookie(oauthStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(stateCookie.Value), []byte(state)) != 1 {
+		redirectToFrontend(w, r, oauthErrorInvalidState)
+		return
+	}
+
+	oauthState, err := handler.OAuthStore.ConsumeOAuthState(state, providerName)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.ResourceNotFound:
+			redirectToFrontend(w, r, oauthErrorInvalidState)
+		default:
+			handler.Logger.Printf("ERROR: Callback > ConsumeOAuthState: %v", err)
+			redirectToFrontend(w, r, oauthErrorServer)
+		}
+		return
+	}
+
+	identity, err := provider.Exchange(r.Context(), code, oauthState.CodeVerifier, oauthState.Nonce)
+	if err != nil {
+		handler.Logger.Printf("ERROR: Callback > %s Exchange: %v", providerName, err)
+		redirectToFrontend(w, r, oauthErrorVerificationFailed)
+		return
+	}
+
+	accessToken, refreshToken, csrfToken, err := handler.UserStore.LoginWithOAuthIdentity(&identity)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.InvalidData:
+			handler.Logger.Printf("ERROR: Callback > LoginWithOAuthIdentity refused %s identity: %v", providerName, err)
+			redirectToFrontend(w, r, oauthErrorEmailNotUsable)
+		case constants.MFARequired:
+			handler.redirectToMFA(w, r, identity.UserID)
+		default:
+			handler.Logger.Printf("ERROR: Callback > LoginWithOAuthIdentity: %v", err)
+			redirectToFrontend(w, r, oauthErrorServer)
+		}
+		return
+	}
+
+	err = handler.TokenStore.AddRefreshToken(refreshToken, identity.UserID, sessionMetadata(r))
+	if err != nil {
+		handler.Logger.Printf("ERROR: Callback > AddRefreshToken: %v", err)
+		redirectToFrontend(w, r, oauthErrorServer)
+		return
+	}
+
+	err = utils.SendTokens(w, accessToken, refreshToken, csrfToken)
+	if err != nil {
+		handler.Logger.Printf("ERROR: Callback > Send tokens: %v", err)
+		redirectToFrontend(w, r, oauthErrorServer)
+		return
+	}
+
+	recordSecurityEvent(handler.SecurityEventStore, handler.Logger, r, store.RecordSecurityEventRequest{UserID: identity.UserID, EventType: store.SecurityEventLogin, Detail: providerName})
+	redirectToFrontend(w, r, "")
+}
+
+// redirectToFrontend ends the social login on the frontend, errorCode is empty when the user is logged in
+func redirectToFrontend(w http.ResponseWriter, r *http.Request, errorCode string) {
+	target := constants.FrontendURL + "/"
+	if errorCode != "" {
+		target += "?" + url.Values{"error": {errorCode}}.Encode()
+	}
+
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+/*
+redirectToMFA sends the browser to the frontend to enter the second factor. The
+MFA token goes in the fragment, which never reaches a server log or a Referer.
+*/
+func (handler *OAuthHandler) redirectToMFA(w http.ResponseWriter, r *http.Request, userID string) {
+	mfaToken, err := handler.MFAStore.CreateMFAChallenge(userID)
+	if err != nil {
+		handler.Logger.Printf("ERROR: Callback > CreateMFAChallenge: %v", err)
+		redirectToFrontend(w, r, oauthErrorServer)
+		return
+	}
+
+	target := constants.FrontendURL + "/?mfaRequired=true#" + url.Values{"mfaToken": {mfaToken}}.Encode()
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+/*
+setOAuthStateCookie binds a pending login to the browser. SameSite must be Lax,
+the provider sends the browser back with a cross site top level navigation.
+*/
+func setOAuthStateCookie(w http.ResponseWriter, state string, maxAge int) {
+	// nosemgrep
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Path:     "/v1/auth",
+		Value:    state,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   !constants.IsDevMode,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
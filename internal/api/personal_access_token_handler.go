@@ -0,0 +1,149 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/store"
+	"github.com/RichardHoa/hack-me/internal/utils"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+type PersonalAccessTokenHandler struct {
+	PersonalAccessTokenStore store.PersonalAccessTokenStore
+	Logger                   *log.Logger
+}
+
+func NewPersonalAccessTokenHandler(personalAccessTokenStore store.PersonalAccessTokenStore, logger *log.Logger) *PersonalAccessTokenHandler {
+	return &PersonalAccessTokenHandler{
+		PersonalAccessTokenStore: personalAccessTokenStore,
+		Logger:                   logger,
+	}
+}
+
+/*
+CreatePersonalAccessToken issues a token for scripts and bots. The token is only
+returned here, the server keeps its hash.
+*/
+func (handler *PersonalAccessTokenHandler) CreatePersonalAccessToken(w http.ResponseWriter, r *http.Request) {
+	user, err := utils.GetAuthenticatedUser(r)
+	if err != nil {
+		handler.Logger.Printf("ERROR: CreatePersonalAccessToken > JWT token checking: %v", err)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
+		return
+	}
+
+	var req store.CreatePersonalAccessTokenRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&req)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(constants.StatusInvalidBodyMessage, constants.MSG_MALFORMED_REQUEST_DATA, "request"))
+		return
+	}
+
+	err = utils.ValidateJSONFieldsNotEmpty(w, req)
+	if err != nil {
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if utf8.RuneCountInString(req.Name) > constants.MaxCredentialNameLength {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(fmt.Sprintf("name must be at most %d characters", constants.MaxCredentialNameLength), constants.MSG_INVALID_REQUEST_DATA, "name"))
+		return
+	}
+
+	if len(req.Scopes) == 0 {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("field 'scopes' is required and cannot be empty", constants.MSG_LACKING_MANDATORY_FIELDS, "scopes"))
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(constants.PersonalAccessTokenScopes, scope) {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(fmt.Sprintf("unknown scope %q, valid scopes are %s", scope, strings.Join(constants.PersonalAccessTokenScopes, ", ")), constants.MSG_INVALID_REQUEST_DATA, "scopes"))
+			return
+		}
+	}
+	slices.Sort(req.Scopes)
+	req.Scopes = slices.Compact(req.Scopes)
+
+	if req.ExpiresInDays < 1 || req.ExpiresInDays > constants.MaxPersonalAccessTokenDays {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(fmt.Sprintf("expiresInDays must be between 1 and %d", constants.MaxPersonalAccessTokenDays), constants.MSG_INVALID_REQUEST_DATA, "expiresInDays"))
+		return
+	}
+
+	req.UserID = user.ID
+
+	token, personalAccessToken, err := handler.PersonalAccessTokenStore.CreatePersonalAccessToken(req)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.InvalidData:
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, ""))
+		default:
+			handler.Logger.Printf("ERROR: CreatePersonalAccessToken > CreatePersonalAccessToken: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		}
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Message{
+		"data": map[string]any{
+			"token":               token,
+			"personalAccessToken": personalAccessToken,
+		},
+	})
+}
+
+func (handler *PersonalAccessTokenHandler) GetPersonalAccessTokens(w http.ResponseWriter, r *http.Request) {
+	user, err := utils.GetAuthenticatedUser(r)
+	if err != nil {
+		handler.Logger.Printf("ERROR: GetPersonalAccessTokens > JWT token checking: %v", err)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
+		return
+	}
+
+	personalAccessTokens, err := handler.PersonalAccessTokenStore.GetPersonalAccessTokens(user.ID)
+	if err != nil {
+		handler.Logger.Printf("ERROR: GetPersonalAccessTokens > GetPersonalAccessTokens: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Message{"data": personalAccessTokens})
+}
+
+// DeletePersonalAccessToken revokes a token, the next request made with it is refused
+func (handler *PersonalAccessTokenHandler) DeletePersonalAccessToken(w http.ResponseWriter, r *http.Request) {
+	user, err := utils.GetAuthenticatedUser(r)
+	if err != nil {
+		handler.Logger.Printf("ERROR: DeletePersonalAccessToken > JWT token checking: %v", err)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
+		return
+	}
+
+	tokenID := chi.URLParam(r, "tokenID")
+	if _, err := uuid.Parse(tokenID); err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("tokenID must be a valid UUID", constants.MSG_INVALID_REQUEST_DATA, "tokenID"))
+		return
+	}
+
+	err = handler.PersonalAccessTokenStore.DeletePersonalAccessToken(user.ID, tokenID)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.ResourceNotFound:
+			utils.WriteJSON(w, http.StatusNotFound, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "tokenID"))
+		default:
+			handler.Logger.Printf("ERROR: DeletePersonalAccessToken > DeletePersonalAccessToken: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		}
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.NewMessage("Access token revoked successfully", "", ""))
+}
@@ -0,0 +1,238 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/policy"
+	"github.com/RichardHoa/hack-me/internal/store"
+	"github.com/RichardHoa/hack-me/internal/utils"
+	"github.com/go-chi/chi/v5"
+)
+
+type ReportHandler struct {
+	ReportStore store.ReportStore
+	// ModerationStore tells the policy who wrote the reported content and whether it is hidden
+	ModerationStore store.ModerationStore
+	Policy          *policy.Engine
+	Mailer          store.Mailer
+	Logger          *log.Logger
+}
+
+func NewReportHandler(reportStore store.ReportStore, moderationStore store.ModerationStore, policyEngine *policy.Engine, mailer store.Mailer, logger *log.Logger) *ReportHandler {
+	return &ReportHandler{
+		ReportStore:     reportStore,
+		ModerationStore: moderationStore,
+		Policy:          policyEngine,
+		Mailer:          mailer,
+		Logger:          logger,
+	}
+}
+
+// CreateReport flags a challenge, response or comment for the moderators
+func (handler *ReportHandler) CreateReport(w http.ResponseWriter, r *http.Request) {
+	user, err := utils.GetAuthenticatedUser(r)
+	if err != nil {
+		handler.Logger.Printf("ERROR: CreateReport > JWT token checking: %v", err)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
+		return
+	}
+
+	var req store.CreateReportRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&req)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(constants.StatusInvalidBodyMessage, constants.MSG_MALFORMED_REQUEST_DATA, "request"))
+		return
+	}
+
+	err = utils.ValidateJSONFieldsNotEmpty(w, req)
+	if err != nil {
+		return
+	}
+
+	if _, err := strconv.Atoi(req.TargetID); err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("targetID can only be number", constants.MSG_MALFORMED_REQUEST_DATA, "targetID"))
+		return
+	}
+
+	if !slices.Contains(store.ReportReasons, req.Reason) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("reason must be one of "+strings.Join(store.ReportReasons, ", "), constants.MSG_INVALID_REQUEST_DATA, "reason"))
+		return
+	}
+
+	if req.Details != nil {
+		*req.Details = strings.TrimSpace(*req.Details)
+		if utf8.RuneCountInString(*req.Details) > constants.MaxReportDetailsLength {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(fmt.Sprintf("details must be at most %d characters", constants.MaxReportDetailsLength), constants.MSG_INVALID_REQUEST_DATA, "details"))
+			return
+		}
+	}
+
+	resource, err := handler.ModerationStore.GetContentResource(req.TargetType, req.TargetID)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.InvalidData:
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "targetType"))
+		case constants.ResourceNotFound:
+			utils.WriteJSON(w, http.StatusNotFound, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "targetID"))
+		default:
+			handler.Logger.Printf("ERROR: CreateReport > GetContentResource: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		}
+		return
+	}
+
+	decision := handler.Policy.Authorize(policy.SubjectFromContext(r.Context()), policy.ActionReport, resource)
+	if !decision.Allowed {
+		utils.WriteJSON(w, http.StatusForbidden, utils.NewMessage(decision.Reason, constants.MSG_INVALID_REQUEST_DATA, "targetID"))
+		return
+	}
+
+	req.UserID = user.ID
+
+	autoHidden, err := handler.ReportStore.CreateReport(req)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.PQUniqueViolation:
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(fmt.Sprintf("you already reported this %s", req.TargetType), constants.MSG_INVALID_REQUEST_DATA, "targetID"))
+		case constants.ResourceNotFound, constants.PQForeignKeyViolation:
+			// deleted between the policy check and the insert
+			utils.WriteJSON(w, http.StatusNotFound, utils.NewMessage(fmt.Sprintf("%s not found", req.TargetType), constants.MSG_INVALID_REQUEST_DATA, "targetID"))
+		default:
+			handler.Logger.Printf("ERROR: CreateReport > CreateReport: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		}
+		return
+	}
+
+	notifyModeratedOwner(handler.Mailer, handler.Logger, autoHidden)
+
+	utils.WriteJSON(w, http.StatusCreated, utils.NewMessage("Report sent, a moderator will look at it", "", ""))
+}
+
+// GetReports is the moderator queue, filtered by status
+func (handler *ReportHandler) GetReports(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	page, _, errMessage := parsePageQuery(query)
+	if errMessage != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, errMessage)
+		return
+	}
+
+	params := store.GetReportsParams{Status: query.Get("status"), Page: constants.DefaultPage}
+	if page != nil {
+		params.Page = *page
+	}
+
+	if params.Status != "" && !slices.Contains(store.ReportStatuses, params.Status) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("status must be open, actioned or dismissed", constants.MSG_INVALID_REQUEST_DATA, "status"))
+		return
+	}
+
+	reports, err := handler.ReportStore.GetReports(params)
+	if err != nil {
+		handler.Logger.Printf("ERROR: GetReports > GetReports: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Message{"data": reports})
+}
+
+/*
+ResolveReport marks a report, and the other open reports on the same content, as
+actioned or dismissed and tells every reporter. Acting on the content itself goes
+through the moderation endpoints, dismissing shows content that reports hid and
+tells its owner.
+*/
+func (handler *ReportHandler) ResolveReport(w http.ResponseWriter, r *http.Request) {
+	user, err := utils.GetAuthenticatedUser(r)
+	if err != nil {
+		handler.Logger.Printf("ERROR: ResolveReport > JWT token checking: %v", err)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
+		return
+	}
+
+	reportID := chi.URLParam(r, "reportID")
+	if _, err := strconv.Atoi(reportID); err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("reportID can only be number", constants.MSG_MALFORMED_REQUEST_DATA, "reportID"))
+		return
+	}
+
+	var req store.ResolveReportRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&req)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(constants.StatusInvalidBodyMessage, constants.MSG_MALFORMED_REQUEST_DATA, "request"))
+		return
+	}
+
+	err = utils.ValidateJSONFieldsNotEmpty(w, req)
+	if err != nil {
+		return
+	}
+
+	req.ReportID = reportID
+	req.ModeratorID = user.ID
+
+	resolved, action, err := handler.ReportStore.ResolveReport(req)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.InvalidData:
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "status"))
+		case constants.ResourceNotFound:
+			utils.WriteJSON(w, http.StatusNotFound, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "reportID"))
+		default:
+			handler.Logger.Printf("ERROR: ResolveReport > ResolveReport: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		}
+		return
+	}
+
+	for _, report := range resolved {
+		notifyReporter(handler.Mailer, handler.Logger, report)
+	}
+	notifyModeratedOwner(handler.Mailer, handler.Logger, action)
+
+	utils.WriteJSON(w, http.StatusOK, utils.Message{
+		"message":  fmt.Sprintf("%d report(s) marked as %s", len(resolved), req.Status),
+		"resolved": len(resolved),
+	})
+}
+
+// reportOutcomes tells the reporter what the moderators decided
+var reportOutcomes = map[string]string{
+	store.ReportStatusActioned:  "agreed with your report and acted on it",
+	store.ReportStatusDismissed: "found that it does not break the rules, so it stays visible",
+}
+
+// notifyReporter emails the outcome of a report, the report is already resolved so a failed email is only logged
+func notifyReporter(mailer store.Mailer, logger *log.Logger, report store.ResolvedReport) {
+	title := report.TargetTitle
+	if utf8.RuneCountInString(title) > 80 {
+		title = string([]rune(title)[:77]) + "..."
+	}
+
+	err := mailer.SendMail(store.Mail{
+		To:      report.ReporterEmail,
+		Subject: fmt.Sprintf("Your report about a Hack-Me %s was reviewed", moderationTargetNames[report.TargetType]),
+		Body: fmt.Sprintf(
+			"Thank you for reporting the %s \"%s\".\n\nA Hack-Me moderator looked at it and %s.\n",
+			moderationTargetNames[report.TargetType], title, reportOutcomes[report.Status],
+		),
+	})
+	if err != nil {
+		logger.Printf("ERROR: notifyReporter > SendMail: %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/store"
+	"github.com/RichardHoa/hack-me/internal/utils"
+)
+
+type ScoreboardHandler struct {
+	ScoreboardStore store.ScoreboardStore
+	Logger          *log.Logger
+}
+
+func NewScoreboardHandler(scoreboardStore store.ScoreboardStore, logger *log.Logger) *ScoreboardHandler {
+	return &ScoreboardHandler{
+		ScoreboardStore: scoreboardStore,
+		Logger:          logger,
+	}
+}
+
+func (handler *ScoreboardHandler) GetScoreboard(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	params := store.GetScoreboardParams{}
+
+	page, pageSize, errMessage := parsePageQuery(query)
+	if errMessage != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, errMessage)
+		return
+	}
+	params.Page = page
+	params.PageSize = pageSize
+
+	if categories := query["category"]; len(categories) != 0 {
+		params.Category = &categories
+	}
+
+	scoreboard, metaPage, err := handler.ScoreboardStore.GetScoreboard(params)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		// invalid category query, nobody can have a score in it
+		case constants.PQInvalidTextRepresentation:
+			utils.WriteJSON(w, http.StatusOK, utils.Message{
+				"metadata": metaPage,
+				"data":     scoreboard,
+			})
+			return
+		default:
+			handler.Logger.Printf("ERROR: GetScoreboard > store GetScoreboard: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+			return
+		}
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Message{
+		"metadata": metaPage,
+		"data":     scoreboard,
+	})
+}
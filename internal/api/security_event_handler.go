@@ -0,0 +1,131 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/store"
+	"github.com/RichardHoa/hack-me/internal/utils"
+	"github.com/google/uuid"
+)
+
+type SecurityEventHandler struct {
+	SecurityEventStore store.SecurityEventStore
+	Logger             *log.Logger
+}
+
+func NewSecurityEventHandler(securityEventStore store.SecurityEventStore, logger *log.Logger) *SecurityEventHandler {
+	return &SecurityEventHandler{
+		SecurityEventStore: securityEventStore,
+		Logger:             logger,
+	}
+}
+
+// GetMySecurityEvents lets the logged in user review what happened to their account
+func (handler *SecurityEventHandler) GetMySecurityEvents(w http.ResponseWriter, r *http.Request) {
+	user, err := utils.GetAuthenticatedUser(r)
+	if err != nil {
+		handler.Logger.Printf("ERROR: GetMySecurityEvents > JWT token checking: %v", err)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
+		return
+	}
+
+	page, _, errMessage := parsePageQuery(r.URL.Query())
+	if errMessage != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, errMessage)
+		return
+	}
+
+	filter := store.SecurityEventFilter{UserID: user.ID, Page: constants.DefaultPage}
+	if page != nil {
+		filter.Page = *page
+	}
+
+	events, err := handler.SecurityEventStore.GetSecurityEvents(filter)
+	if err != nil {
+		handler.Logger.Printf("ERROR: GetMySecurityEvents > GetSecurityEvents: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Message{"data": events})
+}
+
+/*
+GetSecurityEvents searches the security log of every account, by user, event
+type, IP address and an RFC 3339 time range.
+*/
+func (handler *SecurityEventHandler) GetSecurityEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	page, _, errMessage := parsePageQuery(query)
+	if errMessage != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, errMessage)
+		return
+	}
+
+	filter := store.SecurityEventFilter{
+		UserID:    query.Get("userID"),
+		EventType: query.Get("eventType"),
+		IPAddress: query.Get("ipAddress"),
+		Page:      constants.DefaultPage,
+	}
+	if page != nil {
+		filter.Page = *page
+	}
+
+	if filter.UserID != "" {
+		if _, err := uuid.Parse(filter.UserID); err != nil {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("userID must be a valid UUID", constants.MSG_INVALID_REQUEST_DATA, "userID"))
+			return
+		}
+	}
+
+	if filter.EventType != "" && !slices.Contains(store.SecurityEventTypes, filter.EventType) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("eventType is not a known security event", constants.MSG_INVALID_REQUEST_DATA, "eventType"))
+		return
+	}
+
+	for _, bound := range []struct {
+		name   string
+		target **time.Time
+	}{{"from", &filter.From}, {"to", &filter.To}} {
+		value := query.Get(bound.name)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(bound.name+" must be an RFC 3339 time", constants.MSG_MALFORMED_REQUEST_DATA, bound.name))
+			return
+		}
+		*bound.target = &parsed
+	}
+
+	events, err := handler.SecurityEventStore.GetSecurityEvents(filter)
+	if err != nil {
+		handler.Logger.Printf("ERROR: GetSecurityEvents > GetSecurityEvents: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Message{"data": events})
+}
+
+/*
+recordSecurityEvent adds the client of r to the event and appends it to the
+security log. The action it records already happened, so a failed write is
+only logged.
+*/
+func recordSecurityEvent(securityEventStore store.SecurityEventStore, logger *log.Logger, r *http.Request, req store.RecordSecurityEventRequest) {
+	req.IPAddress = utils.ClientIP(r)
+	req.UserAgent = r.UserAgent()
+
+	err := securityEventStore.RecordSecurityEvent(req)
+	if err != nil {
+		logger.Printf("ERROR: recordSecurityEvent > RecordSecurityEvent %s: %v", req.EventType, err)
+	}
+}
@@ -2,39 +2,57 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"math"
 	"net/http"
-	"net/url"
+	"net/mail"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/RichardHoa/hack-me/internal/constants"
 	"github.com/RichardHoa/hack-me/internal/store"
 	"github.com/RichardHoa/hack-me/internal/utils"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
 )
 
 type UserHandler struct {
-	UserStore  store.UserStore
-	TokenStore store.TokenStore
-	Logger     *log.Logger
+	UserStore          store.UserStore
+	TokenStore         store.TokenStore
+	MFAStore           store.MFAStore
+	LoginThrottleStore store.LoginThrottleStore
+	SecurityEventStore store.SecurityEventStore
+	BreachChecker      utils.PasswordBreachChecker
+	BlobStore          store.BlobStore
+	Mailer             store.Mailer
+	Logger             *log.Logger
 }
 
-func NewUserHandler(userStore store.UserStore, tokenStore store.TokenStore, logger *log.Logger) *UserHandler {
+func NewUserHandler(userStore store.UserStore, tokenStore store.TokenStore, mfaStore store.MFAStore, loginThrottleStore store.LoginThrottleStore, securityEventStore store.SecurityEventStore, breachChecker utils.PasswordBreachChecker, blobStore store.BlobStore, mailer store.Mailer, logger *log.Logger) *UserHandler {
 	return &UserHandler{
-		UserStore:  userStore,
-		TokenStore: tokenStore,
-		Logger:     logger,
+		UserStore:          userStore,
+		TokenStore:         tokenStore,
+		MFAStore:           mfaStore,
+		LoginThrottleStore: loginThrottleStore,
+		SecurityEventStore: securityEventStore,
+		BreachChecker:      breachChecker,
+		BlobStore:          blobStore,
+		Mailer:             mailer,
+		Logger:             logger,
 	}
 }
 
 func (handler *UserHandler) GetUserActivity(w http.ResponseWriter, r *http.Request) {
-	result, err := utils.GetValuesFromCookie(r, []string{constants.JWTUserID})
+	user, err := utils.GetAuthenticatedUser(r)
 	if err != nil {
 		handler.Logger.Printf("ERROR: GetUserActivity > JWT token checking: %v", err)
 		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
 		return
 	}
-	userID := result[0]
+	userID := user.ID
 
 	activityData, err := handler.UserStore.GetUserActivity(userID)
 	if err != nil {
@@ -52,6 +70,25 @@ func (handler *UserHandler) GetUserActivity(w http.ResponseWriter, r *http.Reque
 	utils.WriteJSON(w, http.StatusOK, utils.Message{"data": activityData})
 }
 
+// GetPublicProfile shows anyone the public side of an account, logged in or not
+func (handler *UserHandler) GetPublicProfile(w http.ResponseWriter, r *http.Request) {
+	userName := chi.URLParam(r, "userName")
+
+	profile, err := handler.UserStore.GetPublicProfile(userName)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.ResourceNotFound:
+			utils.WriteJSON(w, http.StatusNotFound, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "userName"))
+		default:
+			handler.Logger.Printf("ERROR: GetPublicProfile > GetPublicProfile: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		}
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Message{"data": profile})
+}
+
 func (handler *UserHandler) RegisterNewUser(w http.ResponseWriter, r *http.Request) {
 
 	var User store.User
@@ -65,18 +102,10 @@ func (handler *UserHandler) RegisterNewUser(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	// the avatar is only set by an upload or by the OAuth provider, never from a link in the body
 	if User.ImageLink != "" {
-		u, err := url.Parse(User.ImageLink)
-		if err != nil || u.Scheme == "" || u.Host == "" {
-			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("imageLink must be a valid absolute URL", constants.MSG_INVALID_REQUEST_DATA, "imageLink"))
-			return
-		}
-
-		host := strings.ToLower(u.Hostname())
-		if !strings.HasSuffix(host, "googleusercontent.com") && host != "avatars.githubusercontent.com" {
-			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("External CDN links are not allowed", constants.MSG_INVALID_REQUEST_DATA, "imageLink"))
-			return
-		}
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("imageLink is not accepted at sign up, upload an avatar with PUT /v1/users/me/avatar", constants.MSG_INVALID_REQUEST_DATA, "imageLink"))
+		return
 	}
 
 	if strings.TrimSpace(User.Username) == "" || strings.TrimSpace(User.Email) == "" {
@@ -84,22 +113,36 @@ func (handler *UserHandler) RegisterNewUser(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	if User.Password.PlainText != "" {
-		checkResult := utils.CheckPasswordValid(User.Password.PlainText)
-		if checkResult.Error == nil && checkResult.ErrorMessage != "" {
-			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(checkResult.ErrorMessage, constants.MSG_INVALID_REQUEST_DATA, "password"))
-			return
-		}
+	// provider IDs are only trusted when they come from the provider itself
+	if User.GoogleID != "" || User.GithubID != "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(constants.SocialLoginMessage, constants.MSG_INVALID_REQUEST_DATA, "googleID or githubID"))
+		return
+	}
 
-		if checkResult.Error != nil && checkResult.ErrorMessage == "" {
-			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(checkResult.ErrorMessage, "", ""))
-			return
-		}
+	if User.Password.PlainText == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("password is required", constants.MSG_LACKING_MANDATORY_FIELDS, "password"))
+		return
 	}
 
-	//TODO: We forget to check for email validity here
+	checkResult := utils.CheckPasswordValid(User.Password.PlainText, handler.BreachChecker)
+	if checkResult.Error == nil && checkResult.ErrorMessage != "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(checkResult.ErrorMessage, constants.MSG_INVALID_REQUEST_DATA, "password"))
+		return
+	}
 
-	_, err = handler.UserStore.CreateUser(&User)
+	if checkResult.Error != nil {
+		handler.Logger.Printf("ERROR: RegisterNewUser > CheckPasswordValid: %v", checkResult.Error)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		return
+	}
+
+	address, err := mail.ParseAddress(User.Email)
+	if err != nil || address.Address != User.Email {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("email is not a valid email address", constants.MSG_INVALID_REQUEST_DATA, "email"))
+		return
+	}
+
+	userID, err := handler.UserStore.CreateUser(&User)
 	if err != nil {
 		switch utils.ClassifyError(err) {
 		case constants.PQInvalidByteSequence:
@@ -118,18 +161,24 @@ func (handler *UserHandler) RegisterNewUser(w http.ResponseWriter, r *http.Reque
 		}
 	}
 
+	// the account exists even if the email cannot be sent, the user can ask for a new one
+	err = handler.sendVerificationEmail(userID.String())
+	if err != nil {
+		handler.Logger.Printf("ERROR: RegisterNewUser > sendVerificationEmail: %v", err)
+	}
+
 	utils.WriteJSON(w, http.StatusCreated, utils.NewMessage("Register new user successfully", "", ""))
 
 }
 
 func (handler *UserHandler) ChangeUsername(w http.ResponseWriter, r *http.Request) {
-	result, err := utils.GetValuesFromCookie(r, []string{constants.JWTUserID})
+	user, err := utils.GetAuthenticatedUser(r)
 	if err != nil {
 		handler.Logger.Printf("ERROR: ChangeUsername > JWT token checking: %v", err)
 		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
 		return
 	}
-	userID := result[0]
+	userID := user.ID
 
 	var req store.ChangeUsernameRequest
 	decoder := json.NewDecoder(r.Body)
@@ -165,21 +214,22 @@ func (handler *UserHandler) ChangeUsername(w http.ResponseWriter, r *http.Reques
 		}
 	}
 
+	recordSecurityEvent(handler.SecurityEventStore, handler.Logger, r, store.RecordSecurityEventRequest{UserID: userID, EventType: store.SecurityEventUsernameChanged, Detail: trimmedUsername})
 	utils.WriteJSON(w, http.StatusOK, utils.NewMessage("Username changed successfully", "", ""))
 }
 
 func (handler *UserHandler) DeleteUser(w http.ResponseWriter, r *http.Request) {
-	result, err := utils.GetValuesFromCookie(r, []string{constants.JWTUserID})
+	user, err := utils.GetAuthenticatedUser(r)
 	if err != nil {
 		handler.Logger.Printf("ERROR: DeleteUser > JWT token checking: %v", err)
 		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
 		return
 	}
-	userID := result[0]
+	userID := user.ID
 
 	//NOTE: We need to check for password
 
-	err = handler.UserStore.DeleteUser(userID)
+	avatarKey, err := handler.UserStore.DeleteUser(userID)
 	if err != nil {
 		switch utils.ClassifyError(err) {
 		case constants.ResourceNotFound:
@@ -192,18 +242,27 @@ func (handler *UserHandler) DeleteUser(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// the row is gone, so nothing points at the avatar anymore and a failure only leaves an orphan file behind
+	if avatarKey != "" {
+		err = handler.BlobStore.Delete(avatarKey)
+		if err != nil {
+			handler.Logger.Printf("ERROR: DeleteUser > BlobStore.Delete: %v", err)
+		}
+	}
+
+	recordSecurityEvent(handler.SecurityEventStore, handler.Logger, r, store.RecordSecurityEventRequest{UserID: userID, EventType: store.SecurityEventAccountDeleted})
 	utils.SendEmptyTokens(w)
 	utils.WriteJSON(w, http.StatusOK, utils.NewMessage("User deleted successfully", "", ""))
 }
 
 func (handler *UserHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
-	result, err := utils.GetValuesFromCookie(r, []string{constants.JWTUserID})
+	user, err := utils.GetAuthenticatedUser(r)
 	if err != nil {
 		handler.Logger.Printf("ERROR: ChangePassword > JWT token checking: %v", err)
 		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
 		return
 	}
-	userID := result[0]
+	userID := user.ID
 
 	var req store.ChangePasswordRequest
 	decoder := json.NewDecoder(r.Body)
@@ -223,7 +282,7 @@ func (handler *UserHandler) ChangePassword(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	checkResult := utils.CheckPasswordValid(req.NewPassword)
+	checkResult := utils.CheckPasswordValid(req.NewPassword, handler.BreachChecker)
 	if checkResult.Error == nil && checkResult.ErrorMessage != "" {
 		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(checkResult.ErrorMessage, constants.MSG_INVALID_REQUEST_DATA, "newPassword"))
 		return
@@ -252,6 +311,7 @@ func (handler *UserHandler) ChangePassword(w http.ResponseWriter, r *http.Reques
 		}
 	}
 
+	recordSecurityEvent(handler.SecurityEventStore, handler.Logger, r, store.RecordSecurityEventRequest{UserID: userID, EventType: store.SecurityEventPasswordChanged})
 	utils.WriteJSON(w, http.StatusOK, utils.NewMessage("Password changed successfully", "", ""))
 }
 
@@ -285,44 +345,62 @@ func (handler *UserHandler) LoginUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if user.GoogleID != "" && user.GithubID != "" {
-		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("googleID and githubID cannot coexist", constants.MSG_CONFLICTING_FIELDS, "googleID and githubID"))
+	if user.GoogleID != "" || user.GithubID != "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(constants.SocialLoginMessage, constants.MSG_INVALID_REQUEST_DATA, "googleID or githubID"))
 		return
 	}
 
-	if user.Password.PlainText == "" && user.GoogleID == "" && user.GithubID == "" {
-		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("One of the three fields must exist", constants.MSG_LACKING_MANDATORY_FIELDS, "googleID or githubID or password"))
+	if user.Password.PlainText == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("password must exist", constants.MSG_LACKING_MANDATORY_FIELDS, "password"))
 		return
 	}
 
-	accessToken, refreshToken, csrfToken, err := handler.UserStore.LoginAndIssueTokens(&user)
+	clientIP := utils.ClientIP(r)
+	email := user.Email
+
+	retryAfter, err := handler.LoginThrottleStore.CheckLoginAllowed(email, clientIP)
 	if err != nil {
-		handler.Logger.Printf("ERROR: LoginUser > LoginAndIssueTokens: %v", err)
 		switch utils.ClassifyError(err) {
+		case constants.TooManyRequests, constants.AccountLocked, constants.IPLocked:
+			writeLoginThrottled(w, err, retryAfter)
 		case constants.PQInvalidByteSequence:
 			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("input contains null character", constants.MSG_INVALID_REQUEST_DATA, "email and password"))
-		case constants.InvalidData:
-			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "email and password"))
-		case constants.ResourceNotFound:
-			utils.WriteJSON(w, http.StatusNotFound, utils.NewMessage(err.Error(), "your account is not found", ""))
 		default:
+			handler.Logger.Printf("ERROR: LoginUser > CheckLoginAllowed: %v", err)
 			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
 		}
 		return
 	}
 
-	err = handler.TokenStore.DeleteRefreshToken(user.ID)
+	accessToken, refreshToken, csrfToken, err := handler.UserStore.LoginAndIssueTokens(&user)
 	if err != nil {
+		if utils.ClassifyError(err) != constants.MFARequired {
+			handler.Logger.Printf("ERROR: LoginUser > LoginAndIssueTokens: %v", err)
+		}
 		switch utils.ClassifyError(err) {
+		case constants.PQInvalidByteSequence:
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("input contains null character", constants.MSG_INVALID_REQUEST_DATA, "email and password"))
+		case constants.InvalidData:
+			handler.recordFailedLogin(r, email)
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "email and password"))
+		case constants.ResourceNotFound:
+			utils.WriteJSON(w, http.StatusNotFound, utils.NewMessage(err.Error(), "your account is not found", ""))
+		case constants.MFARequired:
+			// the password was right, the second factor has its own attempt limit
+			handler.resetAccountFailures(email)
+			handler.upgradePasswordHash(user.ID, user.Password.PlainText)
+			writeMFARequired(w, handler.MFAStore, user.ID, handler.Logger)
 		default:
-			handler.Logger.Printf("ERROR: LoginUser > DeleteRefreshToken: %v", err)
 			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
-			return
-
 		}
+		return
 	}
 
-	err = handler.TokenStore.AddRefreshToken(refreshToken, user.ID)
+	handler.resetAccountFailures(email)
+	handler.upgradePasswordHash(user.ID, user.Password.PlainText)
+
+	// every login is its own session, the other devices of the user stay logged in
+	err = handler.TokenStore.AddRefreshToken(refreshToken, user.ID, sessionMetadata(r))
 	if err != nil {
 		switch utils.ClassifyError(err) {
 		default:
@@ -340,12 +418,17 @@ func (handler *UserHandler) LoginUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	recordSecurityEvent(handler.SecurityEventStore, handler.Logger, r, store.RecordSecurityEventRequest{UserID: user.ID, EventType: store.SecurityEventLogin, Detail: "password"})
 	utils.WriteJSON(w, http.StatusOK, utils.NewMessage("Successful authentication", "", ""))
 }
 
 func (handler *UserHandler) LogoutUser(w http.ResponseWriter, r *http.Request) {
 
-	result, err := utils.GetValuesFromCookie(r, []string{constants.JWTUserID, constants.JWTRefreshTokenID})
+	user, err := utils.GetAuthenticatedUser(r)
+	if err == nil && user.SessionID == "" {
+		// a bearer token is not a session, it only expires
+		err = errors.New("logout needs a cookie session")
+	}
 	if err != nil {
 		utils.SendEmptyTokens(w)
 
@@ -353,30 +436,18 @@ func (handler *UserHandler) LogoutUser(w http.ResponseWriter, r *http.Request) {
 		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
 		return
 	}
-	userID := result[0]
-	refreshTokenID := result[1]
+	userID := user.ID
+	refreshTokenID := user.SessionID
 
-	DBRefreshToken, err := handler.TokenStore.GetRefreshToken(userID)
+	// only the session of this browser ends, a session that is already gone is not an error
+	err = handler.TokenStore.DeleteRefreshToken(userID, refreshTokenID)
 	if err != nil {
-		handler.Logger.Printf("ERROR: Logout user > get refresh token : %v", err)
+		handler.Logger.Printf("ERROR: Logout user > delete refresh token : %v", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
 		return
 	}
 
-	// maybe the previous user session logout
-	// so the two IDs may not match
-	if DBRefreshToken.ID != refreshTokenID {
-		handler.Logger.Printf("ABNORMAL: Logout user >  tokenID from browser %s, tokenID from database %s", refreshTokenID, DBRefreshToken.ID)
-	} else {
-		// only empty the db when two IDs are the same
-		err = handler.TokenStore.DeleteRefreshToken(userID)
-		if err != nil {
-			handler.Logger.Printf("ERROR: Logout user > delete refresh token : %v", err)
-			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
-			return
-		}
-	}
-
+	recordSecurityEvent(handler.SecurityEventStore, handler.Logger, r, store.RecordSecurityEventRequest{UserID: userID, EventType: store.SecurityEventLogout})
 	utils.SendEmptyTokens(w)
 	utils.WriteJSON(w, http.StatusOK, utils.NewMessage("log out successful", "", ""))
 }
@@ -400,22 +471,33 @@ func (handler *UserHandler) RefreshTokenRotation(w http.ResponseWriter, r *http.
 		return
 	}
 
-	DBRefreshToken, err := handler.TokenStore.GetRefreshToken(userID)
+	DBRefreshToken, err := handler.TokenStore.GetRefreshToken(refreshTokenID)
 	if err != nil {
-		handler.Logger.Printf("ERROR: Refresh-token-rotation > get refresh token : %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		switch utils.ClassifyError(err) {
+		case constants.ResourceNotFound:
+			// the session was logged out, or the token was already rotated
+			handler.rejectRefreshToken(w, r, refreshTokenID)
+		default:
+			handler.Logger.Printf("ERROR: Refresh-token-rotation > get refresh token : %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		}
 		return
 	}
 
-	if DBRefreshToken.ID != refreshTokenID {
-		handler.Logger.Printf("ERROR: Refresh-token-rotation > tokenID from browser |%s|, tokenID from database |%s|", refreshTokenID, DBRefreshToken.ID)
+	if DBRefreshToken.UserID != userID {
+		handler.Logger.Printf("ERROR: Refresh-token-rotation > session |%s| does not belong to user |%s|", DBRefreshToken.SessionID, userID)
 		utils.WriteJSON(w, http.StatusForbidden, utils.NewMessage(constants.ForbiddenMessage, "", ""))
 		return
 	}
 
 	refreshTokenTimeUntilExpiry := DBRefreshToken.CreatedAt.Add(constants.RefreshTokenTime).Unix()
 
-	accessToken, refreshToken, err := utils.CreateTokens(userID, userName, refreshTokenTimeUntilExpiry)
+	accessToken, refreshToken, err := utils.CreateTokens(userID, userName, DBRefreshToken.SessionID, refreshTokenTimeUntilExpiry)
+	if err != nil {
+		handler.Logger.Printf("ERROR: Refresh-token-rotation > CreateTokens: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		return
+	}
 
 	result, err = utils.ExtractClaimsFromJWT(refreshToken, []string{constants.JWTRefreshTokenID})
 	if err != nil {
@@ -433,11 +515,15 @@ func (handler *UserHandler) RefreshTokenRotation(w http.ResponseWriter, r *http.
 
 	}
 
-	err = handler.TokenStore.AddRefreshToken(refreshToken, userID)
+	err = handler.TokenStore.RotateRefreshToken(refreshTokenID, refreshToken, sessionMetadata(r))
 	if err != nil {
 		switch utils.ClassifyError(err) {
+		case constants.ResourceNotFound:
+			// another request rotated or revoked the session in the meantime
+			handler.rejectRefreshToken(w, r, refreshTokenID)
+			return
 		default:
-			handler.Logger.Printf("ERROR: Refresh-token-rotation > AddRefreshToken: %v", err)
+			handler.Logger.Printf("ERROR: Refresh-token-rotation > RotateRefreshToken: %v", err)
 			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
 			return
 
@@ -451,5 +537,445 @@ func (handler *UserHandler) RefreshTokenRotation(w http.ResponseWriter, r *http.
 		return
 	}
 
+	recordSecurityEvent(handler.SecurityEventStore, handler.Logger, r, store.RecordSecurityEventRequest{UserID: userID, EventType: store.SecurityEventTokenRotated})
 	utils.WriteJSON(w, http.StatusOK, utils.NewMessage("Getting new access token successful", "", ""))
 }
+
+/*
+rejectRefreshToken answers a refresh token that has no session. When the token
+was already rotated, it is being replayed: the whole token family is revoked,
+the user is warned by email and the browser must log in again.
+*/
+func (handler *UserHandler) rejectRefreshToken(w http.ResponseWriter, r *http.Request, refreshTokenID string) {
+	revokedToken, userEmail, err := handler.TokenStore.RevokeReusedRefreshToken(refreshTokenID)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.ResourceNotFound:
+			handler.Logger.Printf("ERROR: Refresh-token-rotation > refresh token has no session")
+			utils.WriteJSON(w, http.StatusForbidden, utils.NewMessage(constants.ForbiddenMessage, "", ""))
+		default:
+			handler.Logger.Printf("ERROR: Refresh-token-rotation > RevokeReusedRefreshToken: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		}
+		return
+	}
+
+	handler.Logger.Printf("SECURITY: Refresh-token-rotation > reuse of a rotated refresh token, revoked session |%s| of user |%s|", revokedToken.SessionID, revokedToken.UserID)
+	recordSecurityEvent(handler.SecurityEventStore, handler.Logger, r, store.RecordSecurityEventRequest{UserID: revokedToken.UserID, EventType: store.SecurityEventRefreshTokenReused, Detail: "revoked session " + revokedToken.SessionID})
+	handler.notifyRefreshTokenReuse(userEmail)
+
+	utils.SendEmptyTokens(w)
+	utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage("Refresh token reuse detected, please log in again", constants.MSG_INVALID_REQUEST_DATA, "refreshToken"))
+}
+
+// notifyRefreshTokenReuse warns the user that one of their sessions was signed out because its token was stolen
+func (handler *UserHandler) notifyRefreshTokenReuse(email string) {
+	err := handler.Mailer.SendMail(store.Mail{
+		To:      email,
+		Subject: "A Hack-Me session was signed out",
+		Body:    "A login token of your Hack-Me account was used again after it had been replaced, which happens when someone copied it. We signed that session out, you will have to log in on that device again.\n\nIf you did not expect this, log in, change your password and end the sessions you do not recognise.\n",
+	})
+	if err != nil {
+		handler.Logger.Printf("ERROR: Refresh-token-rotation > notify user of reuse: %v", err)
+	}
+}
+
+func (handler *UserHandler) GetSessions(w http.ResponseWriter, r *http.Request) {
+	user, err := utils.GetAuthenticatedUser(r)
+	if err != nil {
+		handler.Logger.Printf("ERROR: GetSessions > JWT token checking: %v", err)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
+		return
+	}
+	userID := user.ID
+	refreshTokenID := user.SessionID
+
+	sessions, err := handler.TokenStore.GetSessions(userID, refreshTokenID)
+	if err != nil {
+		handler.Logger.Printf("ERROR: GetSessions > TokenStore.GetSessions: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Message{"data": sessions})
+}
+
+/*
+DeleteSession logs out a single device of the user. Revoking the session of
+the current browser also clears its cookies.
+*/
+func (handler *UserHandler) DeleteSession(w http.ResponseWriter, r *http.Request) {
+	user, err := utils.GetAuthenticatedUser(r)
+	if err != nil {
+		handler.Logger.Printf("ERROR: DeleteSession > JWT token checking: %v", err)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
+		return
+	}
+	userID := user.ID
+	refreshTokenID := user.SessionID
+
+	sessionID := chi.URLParam(r, "sessionID")
+	if _, err := uuid.Parse(sessionID); err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("sessionID must be a valid UUID", constants.MSG_INVALID_REQUEST_DATA, "sessionID"))
+		return
+	}
+
+	isCurrentSession := false
+	currentToken, err := handler.TokenStore.GetRefreshToken(refreshTokenID)
+	if err == nil {
+		isCurrentSession = currentToken.SessionID == sessionID
+	} else if utils.ClassifyError(err) != constants.ResourceNotFound {
+		handler.Logger.Printf("ERROR: DeleteSession > GetRefreshToken: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		return
+	}
+
+	err = handler.TokenStore.DeleteSession(userID, sessionID)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.ResourceNotFound:
+			utils.WriteJSON(w, http.StatusNotFound, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "sessionID"))
+			return
+		default:
+			handler.Logger.Printf("ERROR: DeleteSession > TokenStore.DeleteSession: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+			return
+		}
+	}
+
+	recordSecurityEvent(handler.SecurityEventStore, handler.Logger, r, store.RecordSecurityEventRequest{UserID: userID, EventType: store.SecurityEventSessionRevoked, Detail: sessionID})
+	if isCurrentSession {
+		utils.SendEmptyTokens(w)
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.NewMessage("Session revoked successfully", "", ""))
+}
+
+// DeleteAllSessions logs the user out of every device, including the current one
+func (handler *UserHandler) DeleteAllSessions(w http.ResponseWriter, r *http.Request) {
+	user, err := utils.GetAuthenticatedUser(r)
+	if err != nil {
+		handler.Logger.Printf("ERROR: DeleteAllSessions > JWT token checking: %v", err)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
+		return
+	}
+	userID := user.ID
+
+	err = handler.TokenStore.DeleteAllRefreshTokens(userID)
+	if err != nil {
+		handler.Logger.Printf("ERROR: DeleteAllSessions > DeleteAllRefreshTokens: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		return
+	}
+
+	recordSecurityEvent(handler.SecurityEventStore, handler.Logger, r, store.RecordSecurityEventRequest{UserID: userID, EventType: store.SecurityEventAllSessionsRevoked})
+	utils.SendEmptyTokens(w)
+	utils.WriteJSON(w, http.StatusOK, utils.NewMessage("Logged out of every session", "", ""))
+}
+
+func (handler *UserHandler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req store.VerifyEmailRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&req)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(constants.StatusInvalidBodyMessage, constants.MSG_MALFORMED_REQUEST_DATA, "request"))
+		return
+	}
+
+	err = utils.ValidateJSONFieldsNotEmpty(w, req)
+	if err != nil {
+		return
+	}
+
+	userID, err := handler.UserStore.VerifyEmail(req.Token)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.InvalidData:
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "token"))
+			return
+		default:
+			handler.Logger.Printf("ERROR: VerifyEmail > userStore.VerifyEmail: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+			return
+		}
+	}
+
+	recordSecurityEvent(handler.SecurityEventStore, handler.Logger, r, store.RecordSecurityEventRequest{UserID: userID, EventType: store.SecurityEventEmailVerified})
+	utils.WriteJSON(w, http.StatusOK, utils.NewMessage("Email verified successfully", "", ""))
+}
+
+// ResendVerificationEmail sends a new verification link to the logged in user
+func (handler *UserHandler) ResendVerificationEmail(w http.ResponseWriter, r *http.Request) {
+	user, err := utils.GetAuthenticatedUser(r)
+	if err != nil {
+		handler.Logger.Printf("ERROR: ResendVerificationEmail > JWT token checking: %v", err)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
+		return
+	}
+	userID := user.ID
+
+	err = handler.sendVerificationEmail(userID)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.InvalidData:
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "email"))
+			return
+		case constants.ResourceNotFound:
+			utils.WriteJSON(w, http.StatusNotFound, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "user"))
+			return
+		case constants.TooManyRequests:
+			utils.WriteJSON(w, http.StatusTooManyRequests, utils.NewMessage(err.Error(), constants.MSG_TOO_MANY_REQUESTS, "email"))
+			return
+		default:
+			handler.Logger.Printf("ERROR: ResendVerificationEmail > sendVerificationEmail: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+			return
+		}
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.NewMessage("Verification email sent", "", ""))
+}
+
+func (handler *UserHandler) sendVerificationEmail(userID string) error {
+	token, email, err := handler.UserStore.CreateEmailVerificationToken(userID)
+	if err != nil {
+		return err
+	}
+
+	return handler.Mailer.SendMail(store.Mail{
+		To:      email,
+		Subject: "Verify your Hack-Me email address",
+		Body: fmt.Sprintf(
+			"Welcome to Hack-Me!\n\nConfirm your email address by opening the link below, it expires in %d hours.\n\n%s/verify-email?token=%s\n\nIf you did not create an account, you can ignore this email.\n",
+			int(constants.EmailVerificationTokenTime.Hours()), constants.FrontendURL, token,
+		),
+	})
+}
+
+/*
+ForgotPassword emails a reset link when the account exists. The response and its
+timing are the same either way so the endpoint cannot be used to find emails.
+*/
+func (handler *UserHandler) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+
+	startTime := time.Now()
+	const targetDuration = 400 * time.Millisecond
+
+	defer func() {
+		elapsed := time.Since(startTime)
+		if elapsed < targetDuration {
+			remaining := targetDuration - elapsed
+			if remaining > 0 {
+				time.Sleep(remaining)
+			}
+		}
+	}()
+
+	var req store.ForgotPasswordRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&req)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(constants.StatusInvalidBodyMessage, constants.MSG_MALFORMED_REQUEST_DATA, "request"))
+		return
+	}
+
+	err = utils.ValidateJSONFieldsNotEmpty(w, req)
+	if err != nil {
+		return
+	}
+
+	token, email, err := handler.UserStore.CreatePasswordResetToken(req.Email)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.ResourceNotFound, constants.TooManyRequests, constants.PQInvalidByteSequence:
+			// answered like a known email, the link sent a moment ago still works
+		default:
+			handler.Logger.Printf("ERROR: ForgotPassword > CreatePasswordResetToken: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+			return
+		}
+	} else {
+		// with SMTP the mailer only queues the email, a slow server cannot push known emails past the padding
+		err = handler.Mailer.SendMail(store.Mail{
+			To:      email,
+			Subject: "Reset your Hack-Me password",
+			Body: fmt.Sprintf(
+				"Someone asked to reset the password of your Hack-Me account.\n\nChoose a new password by opening the link below, it expires in %d minutes and works once.\n\n%s/reset-password?token=%s\n\nIf you did not ask for this, you can ignore this email, your password stays the same.\n",
+				int(constants.PasswordResetTokenTime.Minutes()), constants.FrontendURL, token,
+			),
+		})
+		if err != nil {
+			// not surfaced, a failed delivery would tell that the email exists
+			handler.Logger.Printf("ERROR: ForgotPassword > SendMail: %v", err)
+		}
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.NewMessage("If an account exists for this email, a password reset link has been sent", "", ""))
+}
+
+// ResetPassword sets a new password with a reset token and logs out every session of the user
+func (handler *UserHandler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req store.ResetPasswordRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&req)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(constants.StatusInvalidBodyMessage, constants.MSG_MALFORMED_REQUEST_DATA, "request"))
+		return
+	}
+
+	err = utils.ValidateJSONFieldsNotEmpty(w, req)
+	if err != nil {
+		return
+	}
+
+	checkResult := utils.CheckPasswordValid(req.NewPassword, handler.BreachChecker)
+	if checkResult.Error == nil && checkResult.ErrorMessage != "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(checkResult.ErrorMessage, constants.MSG_INVALID_REQUEST_DATA, "newPassword"))
+		return
+	}
+	if checkResult.Error != nil {
+		handler.Logger.Printf("ERROR: ResetPassword > CheckPasswordValid: %v", checkResult.Error)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		return
+	}
+
+	userID, err := handler.UserStore.ResetPassword(req)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.InvalidData, constants.PQInvalidByteSequence:
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("reset token is invalid or expired", constants.MSG_INVALID_REQUEST_DATA, "token"))
+			return
+		default:
+			handler.Logger.Printf("ERROR: ResetPassword > userStore.ResetPassword: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+			return
+		}
+	}
+
+	// whoever knew the old password may still hold a session
+	err = handler.TokenStore.DeleteAllRefreshTokens(userID)
+	if err != nil {
+		handler.Logger.Printf("ERROR: ResetPassword > DeleteAllRefreshTokens: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		return
+	}
+
+	recordSecurityEvent(handler.SecurityEventStore, handler.Logger, r, store.RecordSecurityEventRequest{UserID: userID, EventType: store.SecurityEventPasswordReset})
+	utils.SendEmptyTokens(w)
+	utils.WriteJSON(w, http.StatusOK, utils.NewMessage("Password reset successfully, please log in again", "", ""))
+}
+
+// UnlockAccount lifts the lockout of an account with the token mailed when it was locked
+func (handler *UserHandler) UnlockAccount(w http.ResponseWriter, r *http.Request) {
+	var req store.UnlockAccountRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&req)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(constants.StatusInvalidBodyMessage, constants.MSG_MALFORMED_REQUEST_DATA, "request"))
+		return
+	}
+
+	err = utils.ValidateJSONFieldsNotEmpty(w, req)
+	if err != nil {
+		return
+	}
+
+	email, err := handler.LoginThrottleStore.UnlockAccount(req.Token)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.InvalidData, constants.PQInvalidByteSequence:
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("unlock token is invalid or expired", constants.MSG_INVALID_REQUEST_DATA, "token"))
+		default:
+			handler.Logger.Printf("ERROR: UnlockAccount > LoginThrottleStore.UnlockAccount: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		}
+		return
+	}
+
+	recordSecurityEvent(handler.SecurityEventStore, handler.Logger, r, store.RecordSecurityEventRequest{Email: email, EventType: store.SecurityEventAccountUnlocked})
+	utils.WriteJSON(w, http.StatusOK, utils.NewMessage("Account unlocked, you can log in again", "", ""))
+}
+
+/*
+recordFailedLogin counts a wrong password against the account and the IP. When
+this failure locks the account, its owner gets a link to unlock it. Errors are
+only logged, the caller already answers the failed login.
+*/
+func (handler *UserHandler) recordFailedLogin(r *http.Request, email string) {
+	clientIP := utils.ClientIP(r)
+
+	recordSecurityEvent(handler.SecurityEventStore, handler.Logger, r, store.RecordSecurityEventRequest{Email: email, EventType: store.SecurityEventLoginFailed})
+
+	accountLocked, err := handler.LoginThrottleStore.RecordFailedLogin(email, clientIP)
+	if err != nil {
+		handler.Logger.Printf("ERROR: LoginUser > RecordFailedLogin: %v", err)
+		return
+	}
+	if !accountLocked {
+		return
+	}
+
+	handler.Logger.Printf("SECURITY: account %q locked after too many failed logins, last one from %s", email, clientIP)
+	recordSecurityEvent(handler.SecurityEventStore, handler.Logger, r, store.RecordSecurityEventRequest{Email: email, EventType: store.SecurityEventAccountLocked})
+
+	token, err := handler.LoginThrottleStore.CreateUnlockToken(email)
+	if err != nil {
+		if utils.ClassifyError(err) != constants.ResourceNotFound {
+			handler.Logger.Printf("ERROR: LoginUser > CreateUnlockToken: %v", err)
+		}
+		return
+	}
+
+	err = handler.Mailer.SendMail(store.Mail{
+		To:      email,
+		Subject: "Your Hack-Me account has been locked",
+		Body: fmt.Sprintf(
+			"Your Hack-Me account was locked after too many failed logins. It unlocks by itself in %d minutes.\n\nIf it was you, unlock it now by opening the link below, it expires in %d minutes and works once.\n\n%s/unlock-account?token=%s\n\nIf it was not you, someone is guessing your password, consider resetting it.\n",
+			int(constants.LoginLockoutTime.Minutes()), int(constants.AccountUnlockTokenTime.Minutes()), constants.FrontendURL, token,
+		),
+	})
+	if err != nil {
+		handler.Logger.Printf("ERROR: LoginUser > SendMail: %v", err)
+	}
+}
+
+func (handler *UserHandler) resetAccountFailures(email string) {
+	err := handler.LoginThrottleStore.ResetAccountFailures(email)
+	if err != nil {
+		handler.Logger.Printf("ERROR: LoginUser > ResetAccountFailures: %v", err)
+	}
+}
+
+// upgradePasswordHash rehashes the just verified password, a failure costs the upgrade and not the login
+func (handler *UserHandler) upgradePasswordHash(userID, password string) {
+	err := handler.UserStore.UpgradePasswordHash(userID, password)
+	if err != nil {
+		handler.Logger.Printf("ERROR: LoginUser > UpgradePasswordHash: %v", err)
+	}
+}
+
+// writeLoginThrottled answers a refused login with the wait in the Retry-After header
+func writeLoginThrottled(w http.ResponseWriter, err error, retryAfter time.Duration) {
+	code := constants.MSG_TOO_MANY_REQUESTS
+	switch utils.ClassifyError(err) {
+	case constants.AccountLocked:
+		code = constants.MSG_ACCOUNT_LOCKED
+	case constants.IPLocked:
+		code = constants.MSG_IP_LOCKED
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	utils.WriteJSON(w, http.StatusTooManyRequests, utils.NewMessage(err.Error(), code, "email and password"))
+}
+
+// sessionMetadata collects the device information stored with a session
+func sessionMetadata(r *http.Request) store.SessionMetadata {
+	return store.SessionMetadata{
+		UserAgent: r.UserAgent(),
+		IPAddress: utils.ClientIP(r),
+	}
+}
@@ -0,0 +1,362 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/store"
+	"github.com/RichardHoa/hack-me/internal/utils"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+const webAuthnFailedMessage = "passkey login failed"
+
+type WebAuthnHandler struct {
+	WebAuthnStore      store.WebAuthnStore
+	TokenStore         store.TokenStore
+	SecurityEventStore store.SecurityEventStore
+	Logger             *log.Logger
+}
+
+func NewWebAuthnHandler(webAuthnStore store.WebAuthnStore, tokenStore store.TokenStore, securityEventStore store.SecurityEventStore, logger *log.Logger) *WebAuthnHandler {
+	return &WebAuthnHandler{
+		WebAuthnStore:      webAuthnStore,
+		TokenStore:         tokenStore,
+		SecurityEventStore: securityEventStore,
+		Logger:             logger,
+	}
+}
+
+/*
+StartRegistration returns the options for navigator.credentials.create(). The
+passkey must be discoverable and verify the user, so it can later log in alone.
+*/
+func (handler *WebAuthnHandler) StartRegistration(w http.ResponseWriter, r *http.Request) {
+	user, err := utils.GetAuthenticatedUser(r)
+	if err != nil {
+		handler.Logger.Printf("ERROR: StartRegistration > JWT token checking: %v", err)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
+		return
+	}
+	userID, userName := user.ID, user.UserName
+
+	userHandle, err := uuid.Parse(userID)
+	if err != nil {
+		handler.Logger.Printf("ERROR: StartRegistration > uuid.Parse: %v", err)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_INVALID_REQUEST_DATA, ""))
+		return
+	}
+
+	credentials, err := handler.WebAuthnStore.GetWebAuthnCredentials(userID)
+	if err != nil {
+		handler.Logger.Printf("ERROR: StartRegistration > GetWebAuthnCredentials: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		return
+	}
+
+	// the authenticator refuses to create a second passkey for the same account
+	excludeCredentials := []utils.Message{}
+	for _, credential := range credentials {
+		excludeCredentials = append(excludeCredentials, utils.Message{"type": "public-key", "id": credential.ID})
+	}
+
+	challenge, err := handler.WebAuthnStore.CreateWebAuthnChallenge(userID, store.WebAuthnRegistration)
+	if err != nil {
+		handler.Logger.Printf("ERROR: StartRegistration > CreateWebAuthnChallenge: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Message{"data": utils.Message{"publicKey": utils.Message{
+		"challenge": challenge,
+		"rp": utils.Message{
+			"id":   constants.WebAuthnRPID,
+			"name": constants.WebAuthnRPName,
+		},
+		"user": utils.Message{
+			"id":          base64.RawURLEncoding.EncodeToString(userHandle[:]),
+			"name":        userName,
+			"displayName": userName,
+		},
+		"pubKeyCredParams": []utils.Message{
+			{"type": "public-key", "alg": utils.COSEAlgES256},
+			{"type": "public-key", "alg": utils.COSEAlgEdDSA},
+			{"type": "public-key", "alg": utils.COSEAlgRS256},
+		},
+		"timeout":            constants.WebAuthnChallengeTime.Milliseconds(),
+		"attestation":        "none",
+		"excludeCredentials": excludeCredentials,
+		"authenticatorSelection": utils.Message{
+			"residentKey":        "required",
+			"requireResidentKey": true,
+			"userVerification":   "required",
+		},
+	}}})
+}
+
+// FinishRegistration verifies the new passkey against the registration challenge and stores it
+func (handler *WebAuthnHandler) FinishRegistration(w http.ResponseWriter, r *http.Request) {
+	user, err := utils.GetAuthenticatedUser(r)
+	if err != nil {
+		handler.Logger.Printf("ERROR: FinishRegistration > JWT token checking: %v", err)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
+		return
+	}
+	userID := user.ID
+
+	// unknown fields are allowed, browsers add their own extras to PublicKeyCredential.toJSON()
+	var req store.WebAuthnRegistrationRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(constants.StatusInvalidBodyMessage, constants.MSG_MALFORMED_REQUEST_DATA, "request"))
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		req.Name = "Passkey"
+	}
+	if len([]rune(req.Name)) > constants.MaxCredentialNameLength {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("passkey name is too long", constants.MSG_INVALID_REQUEST_DATA, "name"))
+		return
+	}
+
+	rawID, errID := utils.DecodeBase64URL(req.RawID)
+	clientDataJSON, errClientData := utils.DecodeBase64URL(req.Response.ClientDataJSON)
+	attestationObject, errAttestation := utils.DecodeBase64URL(req.Response.AttestationObject)
+	if req.Type != "public-key" || len(rawID) == 0 || errID != nil || errClientData != nil || errAttestation != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("passkey response is malformed", constants.MSG_MALFORMED_REQUEST_DATA, "response"))
+		return
+	}
+
+	clientData, err := utils.ParseClientData(clientDataJSON, "webauthn.create")
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "clientDataJSON"))
+		return
+	}
+
+	challengeOwner, err := handler.WebAuthnStore.ConsumeWebAuthnChallenge(clientData.Challenge, store.WebAuthnRegistration)
+	if err == nil && challengeOwner != userID {
+		err = utils.NewCustomAppError(constants.InvalidData, "passkey challenge is unknown or expired, please try again")
+	}
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.InvalidData:
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "challenge"))
+		default:
+			handler.Logger.Printf("ERROR: FinishRegistration > ConsumeWebAuthnChallenge: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		}
+		return
+	}
+
+	authData, err := utils.ParseAttestationObject(attestationObject)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "attestationObject"))
+		return
+	}
+	if string(authData.CredentialID) != string(rawID) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("credential ID does not match the attested credential", constants.MSG_INVALID_REQUEST_DATA, "rawId"))
+		return
+	}
+
+	credential := store.WebAuthnCredential{
+		ID:        base64.RawURLEncoding.EncodeToString(authData.CredentialID),
+		UserID:    userID,
+		PublicKey: authData.CredentialPublicKey,
+		SignCount: authData.SignCount,
+		Name:      req.Name,
+	}
+
+	err = handler.WebAuthnStore.AddWebAuthnCredential(credential)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.PQUniqueViolation:
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("passkey is already registered", constants.MSG_INVALID_REQUEST_DATA, "rawId"))
+		case constants.InvalidData:
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "passkey"))
+		case constants.PQInvalidByteSequence:
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("input contains null character", constants.MSG_INVALID_REQUEST_DATA, "name"))
+		default:
+			handler.Logger.Printf("ERROR: FinishRegistration > AddWebAuthnCredential: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		}
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Message{"data": utils.Message{"id": credential.ID, "name": credential.Name}, "message": "Passkey registered successfully"})
+}
+
+/*
+StartLogin returns the options for navigator.credentials.get(). No credentials are
+listed, the browser offers the discoverable passkeys it has for our site.
+*/
+func (handler *WebAuthnHandler) StartLogin(w http.ResponseWriter, r *http.Request) {
+	challenge, err := handler.WebAuthnStore.CreateWebAuthnChallenge("", store.WebAuthnAuthentication)
+	if err != nil {
+		handler.Logger.Printf("ERROR: StartLogin > CreateWebAuthnChallenge: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Message{"data": utils.Message{"publicKey": utils.Message{
+		"challenge":        challenge,
+		"rpId":             constants.WebAuthnRPID,
+		"timeout":          constants.WebAuthnChallengeTime.Milliseconds(),
+		"userVerification": "required",
+		"allowCredentials": []utils.Message{},
+	}}})
+}
+
+/*
+FinishLogin verifies the assertion and starts a session like a password login
+does. A user verifying passkey already is two factors, so TOTP is not asked.
+*/
+func (handler *WebAuthnHandler) FinishLogin(w http.ResponseWriter, r *http.Request) {
+	// unknown fields are allowed, browsers add their own extras to PublicKeyCredential.toJSON()
+	var req store.WebAuthnLoginRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(constants.StatusInvalidBodyMessage, constants.MSG_MALFORMED_REQUEST_DATA, "request"))
+		return
+	}
+
+	rawID, errID := utils.DecodeBase64URL(req.RawID)
+	clientDataJSON, errClientData := utils.DecodeBase64URL(req.Response.ClientDataJSON)
+	authenticatorData, errAuthData := utils.DecodeBase64URL(req.Response.AuthenticatorData)
+	signature, errSignature := utils.DecodeBase64URL(req.Response.Signature)
+	userHandle, errUserHandle := utils.DecodeBase64URL(req.Response.UserHandle)
+	if req.Type != "public-key" || len(rawID) == 0 || errID != nil || errClientData != nil || errAuthData != nil || errSignature != nil || errUserHandle != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage("passkey response is malformed", constants.MSG_MALFORMED_REQUEST_DATA, "response"))
+		return
+	}
+
+	clientData, err := utils.ParseClientData(clientDataJSON, "webauthn.get")
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "clientDataJSON"))
+		return
+	}
+
+	_, err = handler.WebAuthnStore.ConsumeWebAuthnChallenge(clientData.Challenge, store.WebAuthnAuthentication)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.InvalidData:
+			utils.WriteJSON(w, http.StatusBadRequest, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "challenge"))
+		default:
+			handler.Logger.Printf("ERROR: FinishLogin > ConsumeWebAuthnChallenge: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		}
+		return
+	}
+
+	credential, err := handler.WebAuthnStore.GetWebAuthnCredential(base64.RawURLEncoding.EncodeToString(rawID))
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.ResourceNotFound:
+			utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(webAuthnFailedMessage, constants.MSG_INVALID_REQUEST_DATA, "rawId"))
+		default:
+			handler.Logger.Printf("ERROR: FinishLogin > GetWebAuthnCredential: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		}
+		return
+	}
+
+	// the user handle is the user ID we gave the authenticator at registration
+	if len(userHandle) != 0 {
+		owner, err := uuid.Parse(credential.UserID)
+		if err != nil || string(userHandle) != string(owner[:]) {
+			utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(webAuthnFailedMessage, constants.MSG_INVALID_REQUEST_DATA, "userHandle"))
+			return
+		}
+	}
+
+	authData, err := utils.ParseAuthenticatorData(authenticatorData)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(webAuthnFailedMessage, constants.MSG_INVALID_REQUEST_DATA, "authenticatorData"))
+		return
+	}
+
+	err = utils.VerifyWebAuthnSignature(credential.PublicKey, authenticatorData, clientDataJSON, signature)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(webAuthnFailedMessage, constants.MSG_INVALID_REQUEST_DATA, "signature"))
+		return
+	}
+
+	accessToken, refreshToken, csrfToken, err := handler.WebAuthnStore.LoginWithWebAuthnCredential(credential.ID, authData.SignCount)
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.LackingPermission:
+			handler.Logger.Printf("SECURITY: possible cloned passkey %s of user %s, sign count %d", credential.ID, credential.UserID, authData.SignCount)
+			utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "signCount"))
+		case constants.ResourceNotFound:
+			utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(webAuthnFailedMessage, constants.MSG_INVALID_REQUEST_DATA, "rawId"))
+		default:
+			handler.Logger.Printf("ERROR: FinishLogin > LoginWithWebAuthnCredential: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		}
+		return
+	}
+
+	err = handler.TokenStore.AddRefreshToken(refreshToken, credential.UserID, sessionMetadata(r))
+	if err != nil {
+		handler.Logger.Printf("ERROR: FinishLogin > AddRefreshToken: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		return
+	}
+
+	err = utils.SendTokens(w, accessToken, refreshToken, csrfToken)
+	if err != nil {
+		handler.Logger.Printf("ERROR: FinishLogin > Send tokens: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		return
+	}
+
+	recordSecurityEvent(handler.SecurityEventStore, handler.Logger, r, store.RecordSecurityEventRequest{UserID: credential.UserID, EventType: store.SecurityEventLogin, Detail: "passkey"})
+	utils.WriteJSON(w, http.StatusOK, utils.NewMessage("Successful authentication", "", ""))
+}
+
+func (handler *WebAuthnHandler) GetCredentials(w http.ResponseWriter, r *http.Request) {
+	user, err := utils.GetAuthenticatedUser(r)
+	if err != nil {
+		handler.Logger.Printf("ERROR: GetCredentials > JWT token checking: %v", err)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
+		return
+	}
+
+	credentials, err := handler.WebAuthnStore.GetWebAuthnCredentials(user.ID)
+	if err != nil {
+		handler.Logger.Printf("ERROR: GetCredentials > GetWebAuthnCredentials: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Message{"data": credentials})
+}
+
+func (handler *WebAuthnHandler) DeleteCredential(w http.ResponseWriter, r *http.Request) {
+	user, err := utils.GetAuthenticatedUser(r)
+	if err != nil {
+		handler.Logger.Printf("ERROR: DeleteCredential > JWT token checking: %v", err)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(constants.UnauthorizedMessage, constants.MSG_LACKING_MANDATORY_FIELDS, ""))
+		return
+	}
+
+	err = handler.WebAuthnStore.DeleteWebAuthnCredential(user.ID, chi.URLParam(r, "credentialID"))
+	if err != nil {
+		switch utils.ClassifyError(err) {
+		case constants.ResourceNotFound:
+			utils.WriteJSON(w, http.StatusNotFound, utils.NewMessage(err.Error(), constants.MSG_INVALID_REQUEST_DATA, "credentialID"))
+		default:
+			handler.Logger.Printf("ERROR: DeleteCredential > DeleteWebAuthnCredential: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+		}
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.NewMessage("Passkey deleted successfully", "", ""))
+}
@@ -14,11 +14,23 @@ import (
 func CleanDB(db *sql.DB) {
 	// "user" table connects to EVERY other table, so by truncate user we also clean all the other tables
 	db.Exec(`TRUNCATE TABLE "user" RESTART IDENTITY CASCADE`)
+	// failed logins are counted per email and IP, not per user
+	db.Exec(`TRUNCATE TABLE login_throttle`)
+	// the security log keeps no foreign key to the accounts it names
+	db.Exec(`TRUNCATE TABLE security_event`)
+	// the per-IP limits count requests, not users
+	db.Exec(`TRUNCATE TABLE request_rate_limit`)
 }
 
 // MakeRequestAndExpectStatus is a test helper that builds and sends an HTTP request,
 // then asserts that the response status code matches the expected value.
 func MakeRequestAndExpectStatus(t *testing.T, client *http.Client, method, urlStr string, payload map[string]string, expectedStatus int) []byte {
+	return MakeJSONRequestAndExpectStatus(t, client, method, urlStr, payload, expectedStatus)
+}
+
+// MakeJSONRequestAndExpectStatus works like MakeRequestAndExpectStatus but accepts
+// any JSON payload, for request bodies that are not flat string maps.
+func MakeJSONRequestAndExpectStatus(t *testing.T, client *http.Client, method, urlStr string, payload any, expectedStatus int) []byte {
 	body, _ := json.Marshal(payload)
 	req, _ := http.NewRequest(method, urlStr, bytes.NewReader(body))
 	req.Header.Set("Content-Type", "application/json")
@@ -60,6 +72,16 @@ type TestRequest struct {
 	method string
 	path   string
 	body   map[string]string
+	// jsonBody replaces body when the payload contains nested values
+	jsonBody any
+}
+
+// payload returns the body that should be sent for the request.
+func (request TestRequest) payload() any {
+	if request.jsonBody != nil {
+		return request.jsonBody
+	}
+	return request.body
 }
 
 // TestStep represents a single step in a table-driven test scenario.
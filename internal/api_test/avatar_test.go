@@ -0,0 +1,172 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/RichardHoa/hack-me/internal/app"
+	"github.com/RichardHoa/hack-me/internal/routes"
+)
+
+// uploadAvatar sends raw image bytes, MakeRequestAndExpectStatus only sends JSON
+func uploadAvatar(t *testing.T, client *http.Client, serverURL string, data []byte, expectedStatus int) string {
+	req, _ := http.NewRequest("PUT", serverURL+"/v1/users/me/avatar", bytes.NewReader(data))
+	req.Header.Set("Content-Type", "image/jpeg")
+
+	u, _ := url.Parse(serverURL)
+	for _, cookie := range client.Jar.Cookies(u) {
+		if cookie.Name == "csrfToken" {
+			req.Header.Set("X-CSRF-Token", cookie.Value)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	t.Logf("status: %d, body: %s", resp.StatusCode, string(body))
+
+	if resp.StatusCode != expectedStatus {
+		t.Fatalf("Expected status %d, got %v", expectedStatus, resp.Status)
+	}
+
+	var response struct {
+		Data struct {
+			ImageLink string `json:"imageLink"`
+		} `json:"data"`
+	}
+	json.Unmarshal(body, &response)
+	return response.Data.ImageLink
+}
+
+// avatarPath keeps the path of an image link, the tests do not set API_BASE_URL
+func avatarPath(t *testing.T, imageLink string) string {
+	u, err := url.Parse(imageLink)
+	if err != nil || u.Path == "" {
+		t.Fatalf("Expected an avatar link, got %q", imageLink)
+	}
+	return u.Path
+}
+
+func TestAvatarRoute(t *testing.T) {
+	application, err := app.NewApplication(true)
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	defer application.ConnectionPool.Close()
+	defer CleanDB(application.DB)
+
+	router := routes.SetUpRoutes(application)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+
+	MakeRequestAndExpectStatus(t, client, "POST", server.URL+"/v1/users", map[string]string{
+		"userName": "avatarUser",
+		"password": "AvatarUserPasswordThatIsLongEnough",
+		"email":    "avatarUser@test.com",
+	}, http.StatusCreated)
+	MakeRequestAndExpectStatus(t, client, "POST", server.URL+"/v1/users/login", map[string]string{
+		"email":    "avatarUser@test.com",
+		"password": "AvatarUserPasswordThatIsLongEnough",
+	}, http.StatusOK)
+
+	// a wide photo with an EXIF segment, as phones write them with the location inside
+	photo := image.NewRGBA(image.Rect(0, 0, 800, 400))
+	for y := range 400 {
+		for x := range 800 {
+			photo.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 120, A: 255})
+		}
+	}
+	var encoded bytes.Buffer
+	jpeg.Encode(&encoded, photo, nil)
+	exifPayload := []byte("Exif\x00\x00GPS 48.8584 2.29")
+	exif := append([]byte{0xFF, 0xE1, 0x00, byte(len(exifPayload) + 2)}, exifPayload...)
+	upload := append(append(append([]byte{}, encoded.Bytes()[:2]...), exif...), encoded.Bytes()[2:]...)
+
+	var firstLink, secondLink string
+
+	t.Run("Upload a photo", func(t *testing.T) {
+		firstLink = uploadAvatar(t, client, server.URL, upload, http.StatusOK)
+	})
+
+	t.Run("Avatar is served resized and without EXIF", func(t *testing.T) {
+		resp, err := http.Get(server.URL + avatarPath(t, firstLink))
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/png" || resp.Header.Get("X-Content-Type-Options") != "nosniff" {
+			t.Fatalf("Expected a PNG, got %d %v", resp.StatusCode, resp.Header)
+		}
+		if bytes.Contains(body, []byte("GPS")) {
+			t.Errorf("Expected the EXIF data to be stripped")
+		}
+		config, err := png.DecodeConfig(bytes.NewReader(body))
+		if err != nil || config.Width != 256 || config.Height != 256 {
+			t.Errorf("Expected a 256x256 avatar, got %+v %v", config, err)
+		}
+	})
+
+	t.Run("Profile points at the avatar", func(t *testing.T) {
+		body := MakeRequestAndExpectStatus(t, client, "GET", server.URL+"/v1/users/me", nil, http.StatusOK)
+		var response struct {
+			Data struct {
+				User struct {
+					ImageLink string `json:"imageLink"`
+				} `json:"user"`
+			} `json:"data"`
+		}
+		json.Unmarshal(body, &response)
+		if response.Data.User.ImageLink != firstLink {
+			t.Errorf("Expected image link %q, got %q", firstLink, response.Data.User.ImageLink)
+		}
+	})
+
+	t.Run("Reject a file that is not an image", func(t *testing.T) {
+		uploadAvatar(t, client, server.URL, []byte("<svg onload=\"alert(1)\"></svg>"), http.StatusBadRequest)
+	})
+
+	t.Run("Reject a broken image", func(t *testing.T) {
+		uploadAvatar(t, client, server.URL, encoded.Bytes()[:64], http.StatusBadRequest)
+	})
+
+	t.Run("Reject an empty upload", func(t *testing.T) {
+		uploadAvatar(t, client, server.URL, nil, http.StatusBadRequest)
+	})
+
+	t.Run("Replace the avatar", func(t *testing.T) {
+		secondLink = uploadAvatar(t, client, server.URL, encoded.Bytes(), http.StatusOK)
+		if secondLink == firstLink {
+			t.Fatalf("Expected a new link for the new avatar")
+		}
+		MakeRequestAndExpectStatus(t, client, "GET", server.URL+avatarPath(t, firstLink), nil, http.StatusNotFound)
+		MakeRequestAndExpectStatus(t, client, "GET", server.URL+avatarPath(t, secondLink), nil, http.StatusOK)
+	})
+
+	t.Run("Only generated names are served", func(t *testing.T) {
+		MakeRequestAndExpectStatus(t, client, "GET", server.URL+"/v1/avatars/..%2F..%2Fetc%2Fpasswd", nil, http.StatusNotFound)
+		MakeRequestAndExpectStatus(t, client, "GET", server.URL+"/v1/avatars/avatar.png", nil, http.StatusNotFound)
+	})
+
+	t.Run("Deleting the account deletes the avatar", func(t *testing.T) {
+		MakeRequestAndExpectStatus(t, client, "DELETE", server.URL+"/v1/users/me", nil, http.StatusOK)
+		MakeRequestAndExpectStatus(t, client, "GET", server.URL+avatarPath(t, secondLink), nil, http.StatusNotFound)
+	})
+}
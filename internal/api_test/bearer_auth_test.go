@@ -0,0 +1,317 @@
+package api_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/RichardHoa/hack-me/internal/app"
+	"github.com/RichardHoa/hack-me/internal/routes"
+)
+
+// bearerTransport sends every request with the access token in the Authorization header
+type bearerTransport struct {
+	accessToken *string
+}
+
+func (transport bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+*transport.accessToken)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestBearerAuthRoute(t *testing.T) {
+	application, err := app.NewApplication(true)
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	defer application.ConnectionPool.Close()
+	defer CleanDB(application.DB)
+
+	router := routes.SetUpRoutes(application)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	const (
+		email    = "bearerUser@test.com"
+		password = "BearerUserPasswordThatIsLongEnough"
+	)
+
+	jar, _ := cookiejar.New(nil)
+	cookieClient := &http.Client{Jar: jar}
+	serverURL, _ := url.Parse(server.URL)
+
+	// the clients have no cookie jar, so no CSRF token is sent either
+	var accessToken string
+	bearerClient := &http.Client{Transport: bearerTransport{accessToken: &accessToken}}
+
+	invalidToken := "not-a-valid-token"
+	invalidBearerClient := &http.Client{Transport: bearerTransport{accessToken: &invalidToken}}
+
+	tests := []struct {
+		name   string
+		client *http.Client
+		steps  []TestStep
+	}{
+		{
+			name:   "cookie login",
+			client: cookieClient,
+			steps: []TestStep{
+				{
+					name: "Sign up",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users",
+						body: map[string]string{
+							"userName": "bearerUser",
+							"password": password,
+							"email":    email,
+						},
+					},
+					expectStatus: http.StatusCreated,
+				},
+				{
+					name: "Login",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/login",
+						body: map[string]string{
+							"email":    email,
+							"password": password,
+						},
+					},
+					expectStatus: http.StatusOK,
+					validate: func(t *testing.T, body []byte) {
+						for _, cookie := range jar.Cookies(serverURL) {
+							if cookie.Name == "accessToken" {
+								accessToken = cookie.Value
+							}
+						}
+						if accessToken == "" {
+							t.Fatalf("Expected an access token cookie after login")
+						}
+					},
+				},
+			},
+		},
+		{
+			name:   "bearer token",
+			client: bearerClient,
+			steps: []TestStep{
+				{
+					name: "Read own activity",
+					request: TestRequest{
+						method: "GET",
+						path:   "/v1/users/me",
+					},
+					expectStatus: http.StatusOK,
+				},
+				{
+					name: "Post challenge without CSRF token",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/challenges",
+						body: map[string]string{
+							"name":     "Bearer challenge",
+							"content":  "This challenge was posted by an API client",
+							"category": "web hacking",
+						},
+					},
+					expectStatus: http.StatusCreated,
+				},
+				{
+					name: "Session routes get past the CSRF check",
+					request: TestRequest{
+						method: "DELETE",
+						path:   "/v1/auth/sessions/not-a-uuid",
+					},
+					expectStatus: http.StatusBadRequest,
+				},
+				{
+					name: "Access token cannot create a personal access token",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/me/tokens",
+						body:   map[string]string{"name": "long lived"},
+					},
+					expectStatus: http.StatusForbidden,
+				},
+				{
+					name: "Access token cannot revoke a personal access token",
+					request: TestRequest{
+						method: "DELETE",
+						path:   "/v1/users/me/tokens/7c9e6679-7425-40de-944b-e07fc1f90ae7",
+					},
+					expectStatus: http.StatusForbidden,
+				},
+				{
+					name: "Access token cannot register a passkey",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/auth/webauthn/register/start",
+					},
+					expectStatus: http.StatusForbidden,
+				},
+				{
+					name: "Access token cannot delete a passkey",
+					request: TestRequest{
+						method: "DELETE",
+						path:   "/v1/auth/webauthn/credentials/not-a-credential",
+					},
+					expectStatus: http.StatusForbidden,
+				},
+				{
+					name: "Access token cannot enroll TOTP",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/me/mfa/totp",
+					},
+					expectStatus: http.StatusForbidden,
+				},
+				{
+					name: "Access token cannot turn off TOTP",
+					request: TestRequest{
+						method: "DELETE",
+						path:   "/v1/users/me/mfa/totp",
+						body:   map[string]string{"code": "123456"},
+					},
+					expectStatus: http.StatusForbidden,
+				},
+				{
+					name: "Access token cannot export personal data",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/me/export",
+					},
+					expectStatus: http.StatusForbidden,
+				},
+				{
+					name: "Access token cannot change the password",
+					request: TestRequest{
+						method: "PUT",
+						path:   "/v1/users/password",
+						body: map[string]string{
+							"oldPassword": password,
+							"newPassword": "AnotherBearerPasswordThatIsLongEnough",
+						},
+					},
+					expectStatus: http.StatusForbidden,
+				},
+				{
+					name: "Bearer token is not a session to log out of",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/logout",
+					},
+					expectStatus: http.StatusUnauthorized,
+				},
+			},
+		},
+		{
+			name:   "invalid bearer token",
+			client: invalidBearerClient,
+			steps: []TestStep{
+				{
+					name: "Read own activity",
+					request: TestRequest{
+						method: "GET",
+						path:   "/v1/users/me",
+					},
+					expectStatus: http.StatusUnauthorized,
+				},
+				{
+					name: "Post challenge",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/challenges",
+						body: map[string]string{
+							"name":     "Forged challenge",
+							"content":  "This challenge should never be posted",
+							"category": "web hacking",
+						},
+					},
+					expectStatus: http.StatusUnauthorized,
+				},
+			},
+		},
+		{
+			name:   "cookie login without CSRF token",
+			client: &http.Client{Transport: cookieOnlyTransport{jar: jar}},
+			steps: []TestStep{
+				{
+					name: "Post challenge",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/challenges",
+						body: map[string]string{
+							"name":     "Cookie challenge",
+							"content":  "Cookies still need the CSRF token",
+							"category": "web hacking",
+						},
+					},
+					expectStatus: http.StatusUnauthorized,
+				},
+			},
+		},
+		{
+			name:   "cookie logout",
+			client: cookieClient,
+			steps: []TestStep{
+				{
+					name: "Log out",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/logout",
+					},
+					expectStatus: http.StatusOK,
+				},
+			},
+		},
+		{
+			name:   "bearer token after logout",
+			client: bearerClient,
+			steps: []TestStep{
+				{
+					name: "Access token of the ended session is refused",
+					request: TestRequest{
+						method: "GET",
+						path:   "/v1/users/me",
+					},
+					expectStatus: http.StatusUnauthorized,
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			for _, step := range test.steps {
+				t.Run(fmt.Sprintf("%s-%s-%d-%s", step.request.method, step.request.path, step.expectStatus, step.name), func(t *testing.T) {
+					body := MakeRequestAndExpectStatus(t, test.client, step.request.method, server.URL+step.request.path, step.request.body, step.expectStatus)
+
+					if step.validate != nil {
+						step.validate(t, body)
+					}
+				})
+			}
+		})
+	}
+}
+
+// cookieOnlyTransport sends the login cookies but, unlike a client with a jar, no CSRF header
+type cookieOnlyTransport struct {
+	jar http.CookieJar
+}
+
+func (transport cookieOnlyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for _, cookie := range transport.jar.Cookies(req.URL) {
+		req.AddCookie(cookie)
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
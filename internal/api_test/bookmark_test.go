@@ -0,0 +1,210 @@
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/RichardHoa/hack-me/internal/app"
+	"github.com/RichardHoa/hack-me/internal/routes"
+	"github.com/RichardHoa/hack-me/internal/store"
+)
+
+func TestBookmarkRoute(t *testing.T) {
+	application, err := app.NewApplication(true)
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	defer application.ConnectionPool.Close()
+	defer CleanDB(application.DB)
+
+	router := routes.SetUpRoutes(application)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	const challengeName = "Bookmarked challenge"
+
+	bookmark := func(name, method, targetType, targetID string, status int) TestStep {
+		return TestStep{
+			name: name,
+			request: TestRequest{
+				method: method,
+				path:   "/v1/bookmarks",
+				body: map[string]string{
+					"targetType": targetType,
+					"targetID":   targetID,
+				},
+			},
+			expectStatus: status,
+		}
+	}
+
+	expectIsBookmarked := func(expected bool) func(t *testing.T, body []byte) {
+		return func(t *testing.T, body []byte) {
+			var response struct {
+				Data []struct {
+					IsBookmarked bool `json:"isBookmarked"`
+				} `json:"data"`
+			}
+			err := json.Unmarshal(body, &response)
+			if err != nil {
+				t.Fatalf("Failed to decode the response: %v", err)
+			}
+			if len(response.Data) != 1 || response.Data[0].IsBookmarked != expected {
+				t.Errorf("Expected a single result with isBookmarked %v, got %+v", expected, response.Data)
+			}
+		}
+	}
+
+	expectBookmarks := func(expected ...string) func(t *testing.T, body []byte) {
+		return func(t *testing.T, body []byte) {
+			var response struct {
+				Data []store.Bookmark `json:"data"`
+			}
+			err := json.Unmarshal(body, &response)
+			if err != nil {
+				t.Fatalf("Failed to decode the bookmarks: %v", err)
+			}
+			if len(response.Data) != len(expected) {
+				t.Fatalf("Expected %d bookmarks, got %+v", len(expected), response.Data)
+			}
+			for i, bookmark := range response.Data {
+				if bookmark.TargetType != expected[i] {
+					t.Errorf("Expected bookmark %d to be a %s, got %+v", i, expected[i], bookmark)
+				}
+				if bookmark.TargetType == store.BookmarkTargetChallenge && (bookmark.Challenge == nil || bookmark.Challenge.Name != challengeName) {
+					t.Errorf("Expected the challenge summary, got %+v", bookmark.Challenge)
+				}
+				if bookmark.TargetType == store.BookmarkTargetChallengeResponse && (bookmark.ChallengeResponse == nil || bookmark.ChallengeResponse.ChallengeName != challengeName) {
+					t.Errorf("Expected the response summary, got %+v", bookmark.ChallengeResponse)
+				}
+			}
+		}
+	}
+
+	getChallenge := TestRequest{method: "GET", path: "/v1/challenges?exactName=" + url.QueryEscape(challengeName)}
+	getResponses := TestRequest{method: "GET", path: "/v1/challenges/responses?challengeID=1"}
+
+	tests := []struct {
+		name  string
+		steps []TestStep
+	}{
+		{
+			name: "Bookmark owner",
+			steps: []TestStep{
+				{
+					name: "Sign up",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users",
+						body: map[string]string{
+							"userName": "bookmarkUser",
+							"password": "BookmarkUserPasswordThatIsLongEnough",
+							"email":    "bookmarkUser@test.com",
+						},
+					},
+					expectStatus: http.StatusCreated,
+				},
+				{
+					name: "Login",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/login",
+						body: map[string]string{
+							"email":    "bookmarkUser@test.com",
+							"password": "BookmarkUserPasswordThatIsLongEnough",
+						},
+					},
+					expectStatus: http.StatusOK,
+				},
+				{
+					name: "Create challenge",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/challenges",
+						body: map[string]string{
+							"name":     challengeName,
+							"content":  "A challenge worth coming back to",
+							"category": "web hacking",
+						},
+					},
+					expectStatus: http.StatusCreated,
+				},
+				{
+					name: "Create response",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/challenges/responses",
+						body: map[string]string{
+							"challengeID": "1",
+							"name":        "A response worth coming back to",
+							"content":     "content",
+						},
+					},
+					expectStatus: http.StatusCreated,
+				},
+				{name: "Challenge is not bookmarked yet", request: getChallenge, expectStatus: http.StatusOK, validate: expectIsBookmarked(false)},
+				bookmark("Bookmark challenge", "POST", "challenge", "1", http.StatusCreated),
+				bookmark("Bookmark challenge twice", "POST", "challenge", "1", http.StatusBadRequest),
+				bookmark("Bookmark response", "POST", "challenge_response", "1", http.StatusCreated),
+				bookmark("Bookmark missing challenge", "POST", "challenge", "999", http.StatusNotFound),
+				bookmark("Bookmark comment", "POST", "comment", "1", http.StatusBadRequest),
+				bookmark("Bookmark non numeric id", "POST", "challenge", "first", http.StatusBadRequest),
+				{name: "Challenge is bookmarked", request: getChallenge, expectStatus: http.StatusOK, validate: expectIsBookmarked(true)},
+				{name: "Response is bookmarked", request: getResponses, expectStatus: http.StatusOK, validate: expectIsBookmarked(true)},
+				{
+					name:         "List bookmarks",
+					request:      TestRequest{method: "GET", path: "/v1/users/me/bookmarks"},
+					expectStatus: http.StatusOK,
+					validate:     expectBookmarks(store.BookmarkTargetChallengeResponse, store.BookmarkTargetChallenge),
+				},
+				{
+					name:         "List bookmarks page by page",
+					request:      TestRequest{method: "GET", path: "/v1/users/me/bookmarks?pageSize=1&page=2"},
+					expectStatus: http.StatusOK,
+					validate:     expectBookmarks(store.BookmarkTargetChallenge),
+				},
+				bookmark("Remove challenge bookmark", "DELETE", "challenge", "1", http.StatusOK),
+				bookmark("Remove challenge bookmark twice", "DELETE", "challenge", "1", http.StatusNotFound),
+				{
+					name:         "List remaining bookmarks",
+					request:      TestRequest{method: "GET", path: "/v1/users/me/bookmarks"},
+					expectStatus: http.StatusOK,
+					validate:     expectBookmarks(store.BookmarkTargetChallengeResponse),
+				},
+			},
+		},
+		{
+			name: "Anonymous visitor",
+			steps: []TestStep{
+				{name: "Challenge is not bookmarked", request: getChallenge, expectStatus: http.StatusOK, validate: expectIsBookmarked(false)},
+				{name: "Response is not bookmarked", request: getResponses, expectStatus: http.StatusOK, validate: expectIsBookmarked(false)},
+				{name: "No bookmarks to list", request: TestRequest{method: "GET", path: "/v1/users/me/bookmarks"}, expectStatus: http.StatusUnauthorized},
+				bookmark("Cannot bookmark", "POST", "challenge", "1", http.StatusUnauthorized),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		jar, _ := cookiejar.New(nil)
+		client := &http.Client{Jar: jar}
+
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			for _, step := range test.steps {
+				t.Run(fmt.Sprintf("%s-%s-%d-%s", step.request.method, step.request.path, step.expectStatus, step.name), func(t *testing.T) {
+					body := MakeRequestAndExpectStatus(t, client, step.request.method, server.URL+step.request.path, step.request.body, step.expectStatus)
+
+					if step.validate != nil {
+						step.validate(t, body)
+					}
+				})
+			}
+		})
+	}
+}
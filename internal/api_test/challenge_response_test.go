@@ -40,10 +40,9 @@ func TestChallengeResponseRoute(t *testing.T) {
 						method: "POST",
 						path:   "/v1/users",
 						body: map[string]string{
-							"userName":  "Richard Hoa",
-							"password":  "ThisIsAVerySEcurePasswordThatWon'tBeStop",
-							"email":     "testEmail@gmail.com",
-							"imageLink": "https://avatars.githubusercontent.com/u/141636214?v=4",
+							"userName": "Richard Hoa",
+							"password": "ThisIsAVerySEcurePasswordThatWon'tBeStop",
+							"email":    "testEmail@gmail.com",
 						},
 					},
 					expectStatus: http.StatusCreated,
@@ -466,10 +465,9 @@ func TestChallengeResponseRoute(t *testing.T) {
 						method: "POST",
 						path:   "/v1/users",
 						body: map[string]string{
-							"userName":  "User 2",
-							"password":  "ThisIsAVerySEcurePasswordThatWon'tBeStop",
-							"email":     "testEmail2@gmail.com",
-							"imageLink": "https://avatars.githubusercontent.com/u/141636214?v=4",
+							"userName": "User 2",
+							"password": "ThisIsAVerySEcurePasswordThatWon'tBeStop",
+							"email":    "testEmail2@gmail.com",
 						},
 					},
 					expectStatus: http.StatusCreated,
@@ -40,10 +40,9 @@ func TestChallengeResponseVoteRoute(t *testing.T) {
 						method: "POST",
 						path:   "/v1/users",
 						body: map[string]string{
-							"userName":  "Richard Hoa",
-							"password":  "ThisIsAVerySEcurePasswordThatWon'tBeStop",
-							"email":     "testEmail@gmail.com",
-							"imageLink": "https://avatars.githubusercontent.com/u/141636214?v=4",
+							"userName": "Richard Hoa",
+							"password": "ThisIsAVerySEcurePasswordThatWon'tBeStop",
+							"email":    "testEmail@gmail.com",
 						},
 					},
 					expectStatus: http.StatusCreated,
@@ -424,10 +423,9 @@ func TestChallengeResponseVoteRoute(t *testing.T) {
 						method: "POST",
 						path:   "/v1/users",
 						body: map[string]string{
-							"userName":  "Richard Hoa 2",
-							"password":  "ThisIsAVerySEcurePasswordThatWon'tBeStop",
-							"email":     "testEmail2@gmail.com",
-							"imageLink": "https://avatars.githubusercontent.com/u/141636214?v=4",
+							"userName": "Richard Hoa 2",
+							"password": "ThisIsAVerySEcurePasswordThatWon'tBeStop",
+							"email":    "testEmail2@gmail.com",
 						},
 					},
 					expectStatus: http.StatusCreated,
@@ -0,0 +1,442 @@
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/RichardHoa/hack-me/internal/app"
+	"github.com/RichardHoa/hack-me/internal/routes"
+)
+
+func TestChallengeSubmissionRoute(t *testing.T) {
+	application, err := app.NewApplication(true)
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	defer application.ConnectionPool.Close()
+	defer CleanDB(application.DB)
+
+	router := routes.SetUpRoutes(application)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	tests := []struct {
+		name  string
+		steps []TestStep
+	}{
+		{
+			name: "challenge author",
+			steps: []TestStep{
+				{
+					name: "Sign up author",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users",
+						body: map[string]string{
+							"userName": "flagAuthor",
+							"password": "AuthorPasswordThatIsLongEnoughForFlags",
+							"email":    "flagAuthor@test.com",
+						},
+					},
+					expectStatus: http.StatusCreated,
+				},
+				{
+					name: "Login author",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/login",
+						body: map[string]string{
+							"email":    "flagAuthor@test.com",
+							"password": "AuthorPasswordThatIsLongEnoughForFlags",
+						},
+					},
+					expectStatus: http.StatusOK,
+				},
+				{
+					name: "Challenge with exact and case-insensitive flags",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/challenges",
+						jsonBody: map[string]any{
+							"name":     "Flag challenge 1",
+							"content":  "Find the flag",
+							"category": "web hacking",
+							"flags": []map[string]string{
+								{"flag": "flag{exact_flag}"},
+								{"flag": "FLAG{Any_Case}", "matchMode": "case_insensitive"},
+							},
+						},
+					},
+					expectStatus: http.StatusCreated,
+				},
+				{
+					name: "Challenge with regex flag",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/challenges",
+						jsonBody: map[string]any{
+							"name":     "Flag challenge 2",
+							"content":  "Find the numbered flag",
+							"category": "forensics",
+							"flags": []map[string]string{
+								{"flag": `flag\{[0-9]{4}\}`, "matchMode": "regex"},
+							},
+						},
+					},
+					expectStatus: http.StatusCreated,
+				},
+				{
+					name: "Challenge without flag",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/challenges",
+						body: map[string]string{
+							"name":     "Flag challenge 3",
+							"content":  "Discussion only",
+							"category": "forensics",
+						},
+					},
+					expectStatus: http.StatusCreated,
+				},
+				{
+					name: "Invalid regex flag",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/challenges",
+						jsonBody: map[string]any{
+							"name":     "Flag challenge 4",
+							"content":  "Broken regex",
+							"category": "forensics",
+							"flags": []map[string]string{
+								{"flag": `flag\{[0-9`, "matchMode": "regex"},
+							},
+						},
+					},
+					expectStatus: http.StatusBadRequest,
+				},
+				{
+					name: "Invalid match mode",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/challenges",
+						jsonBody: map[string]any{
+							"name":     "Flag challenge 4",
+							"content":  "Unknown mode",
+							"category": "forensics",
+							"flags": []map[string]string{
+								{"flag": "flag{abc}", "matchMode": "fuzzy"},
+							},
+						},
+					},
+					expectStatus: http.StatusBadRequest,
+				},
+				{
+					name: "Empty flag",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/challenges",
+						jsonBody: map[string]any{
+							"name":     "Flag challenge 4",
+							"content":  "Empty flag",
+							"category": "forensics",
+							"flags": []map[string]string{
+								{"flag": "  "},
+							},
+						},
+					},
+					expectStatus: http.StatusBadRequest,
+				},
+				{
+					name: "Author cannot solve own challenge",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/challenges/1/submissions",
+						body: map[string]string{
+							"flag": "flag{exact_flag}",
+						},
+					},
+					expectStatus: http.StatusForbidden,
+				},
+				{
+					name: "Replace flags of challenge 3",
+					request: TestRequest{
+						method: "PUT",
+						path:   "/v1/challenges",
+						jsonBody: map[string]any{
+							"oldName": "Flag challenge 3",
+							"flags": []map[string]string{
+								{"flag": "flag{added_later}"},
+							},
+						},
+					},
+					expectStatus: http.StatusOK,
+				},
+			},
+		},
+		{
+			name: "solver",
+			steps: []TestStep{
+				{
+					name: "Sign up solver",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users",
+						body: map[string]string{
+							"userName": "flagSolver",
+							"password": "SolverPasswordThatIsLongEnoughForFlags",
+							"email":    "flagSolver@test.com",
+						},
+					},
+					expectStatus: http.StatusCreated,
+				},
+				{
+					name: "Login solver",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/login",
+						body: map[string]string{
+							"email":    "flagSolver@test.com",
+							"password": "SolverPasswordThatIsLongEnoughForFlags",
+						},
+					},
+					expectStatus: http.StatusOK,
+				},
+				{
+					name: "Non numeric challenge id",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/challenges/abc/submissions",
+						body: map[string]string{
+							"flag": "flag{exact_flag}",
+						},
+					},
+					expectStatus: http.StatusBadRequest,
+				},
+				{
+					name: "Challenge does not exist",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/challenges/999/submissions",
+						body: map[string]string{
+							"flag": "flag{exact_flag}",
+						},
+					},
+					expectStatus: http.StatusNotFound,
+				},
+				{
+					name: "Empty flag",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/challenges/1/submissions",
+						body: map[string]string{
+							"flag": "",
+						},
+					},
+					expectStatus: http.StatusBadRequest,
+				},
+				{
+					name: "Exact flag with wrong case",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/challenges/1/submissions",
+						body: map[string]string{
+							"flag": "FLAG{EXACT_FLAG}",
+						},
+					},
+					expectStatus: http.StatusBadRequest,
+				},
+				{
+					name: "Exact flag",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/challenges/1/submissions",
+						body: map[string]string{
+							"flag": "flag{exact_flag}",
+						},
+					},
+					expectStatus: http.StatusCreated,
+				},
+				{
+					name: "Already solved",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/challenges/1/submissions",
+						body: map[string]string{
+							"flag": "flag{exact_flag}",
+						},
+					},
+					expectStatus: http.StatusBadRequest,
+				},
+				{
+					name: "Regex flag",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/challenges/2/submissions",
+						body: map[string]string{
+							"flag": "flag{1337}",
+						},
+					},
+					expectStatus: http.StatusCreated,
+				},
+				{
+					name: "Flag added through modify",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/challenges/3/submissions",
+						body: map[string]string{
+							"flag": "flag{added_later}",
+						},
+					},
+					expectStatus: http.StatusCreated,
+				},
+				{
+					name: "Challenge shows solved state",
+					request: TestRequest{
+						method: "GET",
+						path:   "/v1/challenges?exactName=Flag%20challenge%201",
+					},
+					expectStatus: http.StatusOK,
+					validate: func(t *testing.T, body []byte) {
+						var resp struct {
+							Data []struct {
+								HasFlag    bool   `json:"hasFlag"`
+								SolveCount string `json:"solveCount"`
+								IsSolved   bool   `json:"isSolved"`
+							} `json:"data"`
+						}
+						if err := json.Unmarshal(body, &resp); err != nil {
+							t.Fatalf("Failed to parse response: %v", err)
+						}
+						if len(resp.Data) != 1 {
+							t.Fatalf("Expected 1 challenge, got %d", len(resp.Data))
+						}
+						if !resp.Data[0].HasFlag {
+							t.Errorf("Expected hasFlag to be true")
+						}
+						if resp.Data[0].SolveCount != "1" {
+							t.Errorf("Expected solveCount '1', got '%s'", resp.Data[0].SolveCount)
+						}
+						if !resp.Data[0].IsSolved {
+							t.Errorf("Expected isSolved to be true")
+						}
+					},
+				},
+				{
+					name: "Activity lists solves",
+					request: TestRequest{
+						method: "GET",
+						path:   "/v1/users/me",
+					},
+					expectStatus: http.StatusOK,
+					validate: func(t *testing.T, body []byte) {
+						var resp struct {
+							Data struct {
+								Solves []struct {
+									Name string `json:"name"`
+								} `json:"solves"`
+							} `json:"data"`
+						}
+						if err := json.Unmarshal(body, &resp); err != nil {
+							t.Fatalf("Failed to parse response: %v", err)
+						}
+						if len(resp.Data.Solves) != 3 {
+							t.Errorf("Expected 3 solves, got %d", len(resp.Data.Solves))
+						}
+					},
+				},
+			},
+		},
+		{
+			name: "brute forcer",
+			steps: []TestStep{
+				{
+					name: "Sign up brute forcer",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users",
+						body: map[string]string{
+							"userName": "flagGuesser",
+							"password": "GuesserPasswordThatIsLongEnoughForFlags",
+							"email":    "flagGuesser@test.com",
+						},
+					},
+					expectStatus: http.StatusCreated,
+				},
+				{
+					name: "Login brute forcer",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/login",
+						body: map[string]string{
+							"email":    "flagGuesser@test.com",
+							"password": "GuesserPasswordThatIsLongEnoughForFlags",
+						},
+					},
+					expectStatus: http.StatusOK,
+				},
+				{
+					name: "Case-insensitive flag",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/challenges/1/submissions",
+						body: map[string]string{
+							"flag": "flag{any_case}",
+						},
+					},
+					expectStatus: http.StatusCreated,
+				},
+				{
+					name:         "Wrong guess 1",
+					request:      TestRequest{method: "POST", path: "/v1/challenges/2/submissions", body: map[string]string{"flag": "flag{1}"}},
+					expectStatus: http.StatusBadRequest,
+				},
+				{
+					name:         "Wrong guess 2",
+					request:      TestRequest{method: "POST", path: "/v1/challenges/2/submissions", body: map[string]string{"flag": "flag{12}"}},
+					expectStatus: http.StatusBadRequest,
+				},
+				{
+					name:         "Wrong guess 3",
+					request:      TestRequest{method: "POST", path: "/v1/challenges/2/submissions", body: map[string]string{"flag": "flag{123}"}},
+					expectStatus: http.StatusBadRequest,
+				},
+				{
+					name:         "Wrong guess 4",
+					request:      TestRequest{method: "POST", path: "/v1/challenges/2/submissions", body: map[string]string{"flag": "flag{12345}"}},
+					expectStatus: http.StatusBadRequest,
+				},
+				{
+					name:         "Wrong guess 5",
+					request:      TestRequest{method: "POST", path: "/v1/challenges/2/submissions", body: map[string]string{"flag": "xflag{1234}"}},
+					expectStatus: http.StatusBadRequest,
+				},
+				{
+					name:         "Throttled even with the right flag",
+					request:      TestRequest{method: "POST", path: "/v1/challenges/2/submissions", body: map[string]string{"flag": "flag{1234}"}},
+					expectStatus: http.StatusTooManyRequests,
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		jar, _ := cookiejar.New(nil)
+		client := &http.Client{Jar: jar}
+
+		t.Run(test.name, func(t *testing.T) {
+			for _, step := range test.steps {
+				t.Run(fmt.Sprintf("%s-%s-%d-%s", step.request.method, step.request.path, step.expectStatus, step.name), func(t *testing.T) {
+					body := MakeJSONRequestAndExpectStatus(t, client, step.request.method, server.URL+step.request.path, step.request.payload(), step.expectStatus)
+
+					if step.validate != nil {
+						step.validate(t, body)
+					}
+				})
+			}
+		})
+	}
+}
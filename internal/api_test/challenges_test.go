@@ -53,10 +53,9 @@ func TestChallengesRoutes(t *testing.T) {
 						method: "POST",
 						path:   "/v1/users",
 						body: map[string]string{
-							"userName":  "Richard Hoa",
-							"password":  "ThisIsAVerySEcurePasswordThatWon'tBeStop",
-							"email":     "testEmail@gmail.com",
-							"imageLink": "https://avatars.githubusercontent.com/u/141636214?v=4",
+							"userName": "Richard Hoa",
+							"password": "ThisIsAVerySEcurePasswordThatWon'tBeStop",
+							"email":    "testEmail@gmail.com",
 						},
 					},
 					expectStatus: http.StatusCreated,
@@ -1199,10 +1198,9 @@ func TestChallengesRoutes(t *testing.T) {
 						method: "POST",
 						path:   "/v1/users",
 						body: map[string]string{
-							"userName":  "Second User",
-							"password":  "ThisIsAVerySEcurePasswordThatWon'tBeStopForSecondUser",
-							"email":     "test2@gmail.com",
-							"imageLink": "https://avatars.githubusercontent.com/u/141636214?v=4",
+							"userName": "Second User",
+							"password": "ThisIsAVerySEcurePasswordThatWon'tBeStopForSecondUser",
+							"email":    "test2@gmail.com",
 						},
 					},
 					expectStatus: http.StatusCreated,
@@ -42,10 +42,9 @@ func TestCommentRoute(t *testing.T) {
 						method: "POST",
 						path:   "/v1/users",
 						body: map[string]string{
-							"userName":  "Richard Hoa",
-							"password":  "ThisIsAVerySEcurePasswordThatWon'tBeStop",
-							"email":     "testEmail@gmail.com",
-							"imageLink": "https://avatars.githubusercontent.com/u/141636214?v=4",
+							"userName": "Richard Hoa",
+							"password": "ThisIsAVerySEcurePasswordThatWon'tBeStop",
+							"email":    "testEmail@gmail.com",
 						},
 					},
 					expectStatus: http.StatusCreated,
@@ -56,10 +55,9 @@ func TestCommentRoute(t *testing.T) {
 						method: "POST",
 						path:   "/v1/users",
 						body: map[string]string{
-							"userName":  "Richard Hoa 2",
-							"password":  "ThisIsAVerySEcurePasswordThatWon'tBeStop",
-							"email":     "testEmail2@gmail.com",
-							"imageLink": "https://avatars.githubusercontent.com/u/141636214?v=4",
+							"userName": "Richard Hoa 2",
+							"password": "ThisIsAVerySEcurePasswordThatWon'tBeStop",
+							"email":    "testEmail2@gmail.com",
 						},
 					},
 					expectStatus: http.StatusCreated,
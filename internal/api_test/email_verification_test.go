@@ -0,0 +1,265 @@
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RichardHoa/hack-me/internal/app"
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/routes"
+	"github.com/RichardHoa/hack-me/internal/store"
+)
+
+func TestEmailVerificationRoute(t *testing.T) {
+	application, err := app.NewApplication(true)
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	defer application.ConnectionPool.Close()
+	defer CleanDB(application.DB)
+
+	application.Policy.RequireVerifiedEmail = true
+
+	router := routes.SetUpRoutes(application)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	mailer, ok := application.UserHandler.Mailer.(*store.MemoryMailer)
+	if !ok {
+		t.Fatalf("expected the memory mailer in tests")
+	}
+
+	// filled with the tokens of the emails as they are sent
+	verifyBody := map[string]string{}
+	oldVerifyBody := map[string]string{}
+
+	readToken := func(t *testing.T, body map[string]string) {
+		mail, ok := mailer.LastMailTo("verifyUser@test.com")
+		if !ok {
+			t.Fatalf("Expected a verification email")
+		}
+
+		_, token, found := strings.Cut(mail.Body, "token=")
+		if !found {
+			t.Fatalf("Expected a token in the email, got %s", mail.Body)
+		}
+		token, _, _ = strings.Cut(token, "\n")
+
+		if previous, ok := verifyBody["token"]; ok {
+			oldVerifyBody["token"] = previous
+		}
+		body["token"] = token
+	}
+
+	expectVerified := func(verified bool) func(t *testing.T, body []byte) {
+		return func(t *testing.T, body []byte) {
+			var resp struct {
+				Data struct {
+					User struct {
+						EmailVerified bool `json:"emailVerified"`
+					} `json:"user"`
+				} `json:"data"`
+			}
+			if err := json.Unmarshal(body, &resp); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			if resp.Data.User.EmailVerified != verified {
+				t.Errorf("Expected emailVerified %v, got %v", verified, resp.Data.User.EmailVerified)
+			}
+		}
+	}
+
+	challenge := TestRequest{
+		method: "POST",
+		path:   "/v1/challenges",
+		body: map[string]string{
+			"name":     "Verified only challenge",
+			"content":  "Only verified users can post",
+			"category": "web hacking",
+		},
+	}
+
+	tests := []struct {
+		name  string
+		steps []TestStep
+	}{
+		{
+			name: "Invalid email",
+			steps: []TestStep{
+				{
+					name: "Sign up with an invalid email",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users",
+						body: map[string]string{
+							"userName": "invalidEmailUser",
+							"password": "InvalidEmailPasswordThatIsLongEnough",
+							"email":    "not an email",
+						},
+					},
+					expectStatus: http.StatusBadRequest,
+				},
+				{
+					name: "Sign up with a display name",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users",
+						body: map[string]string{
+							"userName": "invalidEmailUser",
+							"password": "InvalidEmailPasswordThatIsLongEnough",
+							"email":    "Someone <someone@test.com>",
+						},
+					},
+					expectStatus: http.StatusBadRequest,
+				},
+			},
+		},
+		{
+			name: "Verify email",
+			steps: []TestStep{
+				{
+					name: "Sign up",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users",
+						body: map[string]string{
+							"userName": "verifyUser",
+							"password": "VerifyUserPasswordThatIsLongEnough",
+							"email":    "verifyUser@test.com",
+						},
+					},
+					expectStatus: http.StatusCreated,
+					validate: func(t *testing.T, body []byte) {
+						readToken(t, verifyBody)
+					},
+				},
+				{
+					name: "Login",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/login",
+						body: map[string]string{
+							"email":    "verifyUser@test.com",
+							"password": "VerifyUserPasswordThatIsLongEnough",
+						},
+					},
+					expectStatus: http.StatusOK,
+				},
+				{
+					name:         "Email is not verified yet",
+					request:      TestRequest{method: "GET", path: "/v1/users/me"},
+					expectStatus: http.StatusOK,
+					validate:     expectVerified(false),
+				},
+				{
+					name:         "Unverified user cannot post a challenge",
+					request:      challenge,
+					expectStatus: http.StatusForbidden,
+				},
+				{
+					name: "Garbage token",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/verify-email",
+						body:   map[string]string{"token": "garbage"},
+					},
+					expectStatus: http.StatusBadRequest,
+				},
+				{
+					name: "Empty token",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/verify-email",
+						body:   map[string]string{"token": ""},
+					},
+					expectStatus: http.StatusBadRequest,
+				},
+				{
+					name:         "Resend right after sign up is throttled",
+					request:      TestRequest{method: "POST", path: "/v1/users/verify-email/resend"},
+					expectStatus: http.StatusTooManyRequests,
+					validate: func(t *testing.T, body []byte) {
+						_, err := application.DB.Exec(`UPDATE email_verification_token SET created_at = $1`, time.Now().Add(-constants.VerificationEmailCooldown))
+						if err != nil {
+							t.Fatalf("Failed to age the verification token: %v", err)
+						}
+					},
+				},
+				{
+					name:         "Resend verification email",
+					request:      TestRequest{method: "POST", path: "/v1/users/verify-email/resend"},
+					expectStatus: http.StatusOK,
+					validate: func(t *testing.T, body []byte) {
+						readToken(t, verifyBody)
+					},
+				},
+				{
+					name: "Token replaced by the resent one",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/verify-email",
+						body:   oldVerifyBody,
+					},
+					expectStatus: http.StatusBadRequest,
+				},
+				{
+					name: "Verify email",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/verify-email",
+						body:   verifyBody,
+					},
+					expectStatus: http.StatusOK,
+				},
+				{
+					name: "Token is single use",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/verify-email",
+						body:   verifyBody,
+					},
+					expectStatus: http.StatusBadRequest,
+				},
+				{
+					name:         "Email is verified",
+					request:      TestRequest{method: "GET", path: "/v1/users/me"},
+					expectStatus: http.StatusOK,
+					validate:     expectVerified(true),
+				},
+				{
+					name:         "Verified user can post a challenge",
+					request:      challenge,
+					expectStatus: http.StatusCreated,
+				},
+				{
+					name:         "Nothing to resend",
+					request:      TestRequest{method: "POST", path: "/v1/users/verify-email/resend"},
+					expectStatus: http.StatusBadRequest,
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		jar, _ := cookiejar.New(nil)
+		client := &http.Client{Jar: jar}
+
+		t.Run(test.name, func(t *testing.T) {
+			for _, step := range test.steps {
+				t.Run(fmt.Sprintf("%s-%s-%d-%s", step.request.method, step.request.path, step.expectStatus, step.name), func(t *testing.T) {
+					body := MakeJSONRequestAndExpectStatus(t, client, step.request.method, server.URL+step.request.path, step.request.payload(), step.expectStatus)
+
+					if step.validate != nil {
+						step.validate(t, body)
+					}
+				})
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package api_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RichardHoa/hack-me/internal/app"
+	"github.com/RichardHoa/hack-me/internal/routes"
+	"github.com/RichardHoa/hack-me/internal/store"
+)
+
+func TestDataExportRoute(t *testing.T) {
+	application, err := app.NewApplication(true)
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	defer application.ConnectionPool.Close()
+	defer CleanDB(application.DB)
+
+	router := routes.SetUpRoutes(application)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	mailer, ok := application.UserHandler.Mailer.(*store.MemoryMailer)
+	if !ok {
+		t.Fatalf("expected the memory mailer in tests")
+	}
+
+	const (
+		password       = "ExportPasswordThatIsLongEnough"
+		exporterEmail  = "exporter@test.com"
+		commentContent = "A comment that belongs in the export"
+	)
+
+	newClient := func(userName, email string) *http.Client {
+		jar, _ := cookiejar.New(nil)
+		client := &http.Client{Jar: jar}
+		MakeRequestAndExpectStatus(t, client, "POST", server.URL+"/v1/users", map[string]string{
+			"userName": userName,
+			"password": password,
+			"email":    email,
+		}, http.StatusCreated)
+		MakeRequestAndExpectStatus(t, client, "POST", server.URL+"/v1/users/login", map[string]string{
+			"email":    email,
+			"password": password,
+		}, http.StatusOK)
+		return client
+	}
+
+	exporter := newClient("exporter", exporterEmail)
+	stranger := newClient("exportStranger", "exportStranger@test.com")
+
+	MakeRequestAndExpectStatus(t, exporter, "POST", server.URL+"/v1/challenges", map[string]string{
+		"name":     "Exported challenge",
+		"content":  "A challenge that belongs in the export",
+		"category": "web hacking",
+	}, http.StatusCreated)
+	MakeRequestAndExpectStatus(t, exporter, "POST", server.URL+"/v1/comments", map[string]string{
+		"challengeID": "1",
+		"content":     commentContent,
+	}, http.StatusCreated)
+	MakeRequestAndExpectStatus(t, exporter, "POST", server.URL+"/v1/bookmarks", map[string]string{
+		"targetType": "challenge",
+		"targetID":   "1",
+	}, http.StatusCreated)
+
+	var export store.DataExport
+
+	t.Run("Request an export", func(t *testing.T) {
+		body := MakeRequestAndExpectStatus(t, exporter, "POST", server.URL+"/v1/users/me/export", nil, http.StatusAccepted)
+		var response struct {
+			Data store.DataExport `json:"data"`
+		}
+		if err := json.Unmarshal(body, &response); err != nil || response.Data.ID == "" {
+			t.Fatalf("Failed to read the export: %v %s", err, body)
+		}
+		export = response.Data
+	})
+
+	t.Run("Export becomes ready", func(t *testing.T) {
+		deadline := time.Now().Add(10 * time.Second)
+		for export.Status != store.DataExportReady {
+			if export.Status == store.DataExportFailed || time.Now().After(deadline) {
+				t.Fatalf("Expected the export to be ready, got %+v", export)
+			}
+			time.Sleep(100 * time.Millisecond)
+
+			body := MakeRequestAndExpectStatus(t, exporter, "GET", server.URL+"/v1/users/me/exports/"+export.ID, nil, http.StatusOK)
+			var response struct {
+				Data store.DataExport `json:"data"`
+			}
+			if err := json.Unmarshal(body, &response); err != nil {
+				t.Fatalf("Failed to read the export: %v", err)
+			}
+			export = response.Data
+		}
+
+		if export.DownloadLink == "" || export.ExpiresAt == nil {
+			t.Errorf("Expected a download link that expires, got %+v", export)
+		}
+
+		mail, ok := mailer.LastMailTo(exporterEmail)
+		if !ok || !strings.Contains(mail.Subject, "export is ready") || !strings.Contains(mail.Body, "/data-export?id="+export.ID) {
+			t.Errorf("Expected the link to the export page by email, got %+v", mail)
+		}
+		// a click from a webmail would not carry the SameSite=Strict cookies to the API
+		if strings.Contains(mail.Body, "/archive") {
+			t.Errorf("Expected no API download link in the email, got %+v", mail)
+		}
+	})
+
+	t.Run("Download the archive", func(t *testing.T) {
+		resp, err := exporter.Get(server.URL + "/v1/users/me/exports/" + export.ID + "/archive")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/zip" {
+			t.Fatalf("Expected the archive, got %d %s", resp.StatusCode, body)
+		}
+
+		archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+		if err != nil {
+			t.Fatalf("Failed to open the archive: %v", err)
+		}
+
+		files := map[string]string{}
+		for _, file := range archive.File {
+			reader, err := file.Open()
+			if err != nil {
+				t.Fatalf("Failed to open %s: %v", file.Name, err)
+			}
+			content, _ := io.ReadAll(reader)
+			reader.Close()
+			files[file.Name] = string(content)
+		}
+
+		var data struct {
+			Account struct {
+				Email string `json:"email"`
+			} `json:"account"`
+			Challenges     []store.ExportedChallenge `json:"challenges"`
+			Comments       []store.ExportedComment   `json:"comments"`
+			Bookmarks      []store.Bookmark          `json:"bookmarks"`
+			SecurityEvents []store.SecurityEvent     `json:"securityEvents"`
+		}
+		if err := json.Unmarshal([]byte(files["data.json"]), &data); err != nil {
+			t.Fatalf("Failed to read data.json: %v", err)
+		}
+
+		if data.Account.Email != exporterEmail {
+			t.Errorf("Expected the email in the export, got %q", data.Account.Email)
+		}
+		if len(data.Challenges) != 1 || len(data.Comments) != 1 || data.Comments[0].Content != commentContent || len(data.Bookmarks) != 1 {
+			t.Errorf("Expected the challenge, comment and bookmark, got %+v %+v %+v", data.Challenges, data.Comments, data.Bookmarks)
+		}
+		if len(data.SecurityEvents) == 0 || data.SecurityEvents[0].EventType != store.SecurityEventDataExported {
+			t.Errorf("Expected the export request in the security events, got %+v", data.SecurityEvents)
+		}
+		if strings.Contains(files["data.json"], "$argon2id$") {
+			t.Errorf("Expected the password hash to stay out of the export")
+		}
+		if !strings.Contains(files["README.md"], "# Hack-Me data of exporter") || !strings.Contains(files["README.md"], commentContent) {
+			t.Errorf("Expected the markdown version of the data, got %s", files["README.md"])
+		}
+	})
+
+	t.Run("Only one export at a time", func(t *testing.T) {
+		_, err := application.DB.Exec(`INSERT INTO data_export (id, user_id) SELECT gen_random_uuid(), id FROM "user" WHERE email = $1`, exporterEmail)
+		if err != nil {
+			t.Fatalf("Failed to queue an export: %v", err)
+		}
+		MakeRequestAndExpectStatus(t, exporter, "POST", server.URL+"/v1/users/me/export", nil, http.StatusBadRequest)
+	})
+
+	t.Run("Someone else cannot see the export", func(t *testing.T) {
+		MakeRequestAndExpectStatus(t, stranger, "GET", server.URL+"/v1/users/me/exports/"+export.ID, nil, http.StatusNotFound)
+		MakeRequestAndExpectStatus(t, stranger, "GET", server.URL+"/v1/users/me/exports/"+export.ID+"/archive", nil, http.StatusNotFound)
+	})
+
+	t.Run("Unknown export", func(t *testing.T) {
+		MakeRequestAndExpectStatus(t, exporter, "GET", server.URL+"/v1/users/me/exports/not-an-export", nil, http.StatusNotFound)
+	})
+
+	t.Run("Link expires", func(t *testing.T) {
+		_, err := application.DB.Exec(`UPDATE data_export SET expires_at = now() - interval '1 minute' WHERE id = $1`, export.ID)
+		if err != nil {
+			t.Fatalf("Failed to expire the export: %v", err)
+		}
+		MakeRequestAndExpectStatus(t, exporter, "GET", server.URL+"/v1/users/me/exports/"+export.ID+"/archive", nil, http.StatusGone)
+	})
+
+	t.Run("Anonymous visitor", func(t *testing.T) {
+		MakeRequestAndExpectStatus(t, &http.Client{}, "GET", server.URL+"/v1/users/me/exports/"+export.ID, nil, http.StatusUnauthorized)
+	})
+}
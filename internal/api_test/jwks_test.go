@@ -0,0 +1,221 @@
+package api_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+
+	"github.com/RichardHoa/hack-me/internal/app"
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/routes"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestJWKSRoute(t *testing.T) {
+	application, err := app.NewApplication(true)
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	defer application.ConnectionPool.Close()
+	defer CleanDB(application.DB)
+
+	router := routes.SetUpRoutes(application)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	// sign access tokens with a fresh Ed25519 key, an ES256 key was rotated out before it
+	_, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate the signing key: %v", err)
+	}
+	signingDER, err := x509.MarshalPKCS8PrivateKey(signingKey)
+	if err != nil {
+		t.Fatalf("failed to encode the signing key: %v", err)
+	}
+	previousKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate the previous key: %v", err)
+	}
+	previousDER, err := x509.MarshalPKIXPublicKey(&previousKey.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to encode the previous key: %v", err)
+	}
+
+	oldAlgorithm, oldPrivateKey, oldPreviousKeys := constants.AccessTokenAlgorithm, constants.AccessTokenPrivateKey, constants.AccessTokenPreviousPublicKeys
+	defer func() {
+		constants.AccessTokenAlgorithm = oldAlgorithm
+		constants.AccessTokenPrivateKey = oldPrivateKey
+		constants.AccessTokenPreviousPublicKeys = oldPreviousKeys
+	}()
+	constants.AccessTokenAlgorithm = constants.AccessTokenAlgorithmEdDSA
+	constants.AccessTokenPrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: signingDER}))
+	constants.AccessTokenPreviousPublicKeys = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: previousDER}))
+
+	const (
+		email    = "jwksUser@test.com"
+		password = "JwksUserPasswordThatIsLongEnough"
+	)
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	serverURL, _ := url.Parse(server.URL)
+
+	// the public key of the signing key, read from the published set
+	var publishedKeys map[string]ed25519.PublicKey
+
+	tests := []struct {
+		name  string
+		steps []TestStep
+	}{
+		{
+			name: "asymmetric access tokens",
+			steps: []TestStep{
+				{
+					name: "Sign up",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users",
+						body: map[string]string{
+							"userName": "jwksUser",
+							"password": password,
+							"email":    email,
+						},
+					},
+					expectStatus: http.StatusCreated,
+				},
+				{
+					name: "Login",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/login",
+						body: map[string]string{
+							"email":    email,
+							"password": password,
+						},
+					},
+					expectStatus: http.StatusOK,
+				},
+				{
+					name: "Published keys",
+					request: TestRequest{
+						method: "GET",
+						path:   "/.well-known/jwks.json",
+					},
+					expectStatus: http.StatusOK,
+					validate: func(t *testing.T, body []byte) {
+						var jwks struct {
+							Keys []map[string]string `json:"keys"`
+						}
+						if err := json.Unmarshal(body, &jwks); err != nil {
+							t.Fatalf("Failed to parse the key set: %v", err)
+						}
+						if len(jwks.Keys) != 2 {
+							t.Fatalf("Expected the signing and the previous key, got %d keys", len(jwks.Keys))
+						}
+						if jwks.Keys[1]["kty"] != "EC" || jwks.Keys[1]["alg"] != "ES256" {
+							t.Errorf("Expected the previous key to be an ES256 key, got %v", jwks.Keys[1])
+						}
+						if _, ok := jwks.Keys[0]["d"]; ok {
+							t.Fatalf("The key set must not contain private keys")
+						}
+
+						publishedKeys = map[string]ed25519.PublicKey{}
+						for _, key := range jwks.Keys {
+							if key["kty"] != "OKP" {
+								continue
+							}
+							x, err := base64.RawURLEncoding.DecodeString(key["x"])
+							if err != nil {
+								t.Fatalf("Failed to decode the public key: %v", err)
+							}
+							publishedKeys[key["kid"]] = ed25519.PublicKey(x)
+						}
+					},
+				},
+				{
+					name: "Access token verifies with the published key",
+					request: TestRequest{
+						method: "GET",
+						path:   "/v1/users/me",
+					},
+					expectStatus: http.StatusOK,
+					validate: func(t *testing.T, body []byte) {
+						var accessToken string
+						for _, cookie := range jar.Cookies(serverURL) {
+							if cookie.Name == "accessToken" {
+								accessToken = cookie.Value
+							}
+						}
+
+						claims := jwt.MapClaims{}
+						_, err := jwt.ParseWithClaims(accessToken, claims, func(token *jwt.Token) (any, error) {
+							kid, _ := token.Header["kid"].(string)
+							key, ok := publishedKeys[kid]
+							if !ok {
+								return nil, fmt.Errorf("kid %q is not published", kid)
+							}
+							return key, nil
+						},
+							jwt.WithValidMethods([]string{"EdDSA"}),
+							jwt.WithIssuer(constants.TokenIssuer),
+							jwt.WithAudience(constants.TokenAudience),
+						)
+						if err != nil {
+							t.Fatalf("Failed to verify the access token: %v", err)
+						}
+
+						subject, _ := claims.GetSubject()
+						audience, _ := claims.GetAudience()
+						if subject == "" || !slices.Contains(audience, constants.TokenAudience) {
+							t.Errorf("Expected sub and aud claims, got %v", claims)
+						}
+					},
+				},
+				{
+					name: "Refreshed tokens are signed with the same key",
+					request: TestRequest{
+						method: "GET",
+						path:   "/v1/auth/tokens",
+					},
+					expectStatus: http.StatusOK,
+				},
+				{
+					name: "Refreshed access token is accepted",
+					request: TestRequest{
+						method: "GET",
+						path:   "/v1/users/me",
+					},
+					expectStatus: http.StatusOK,
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			for _, step := range test.steps {
+				t.Run(fmt.Sprintf("%s-%s-%d-%s", step.request.method, step.request.path, step.expectStatus, step.name), func(t *testing.T) {
+					body := MakeRequestAndExpectStatus(t, client, step.request.method, server.URL+step.request.path, step.request.body, step.expectStatus)
+
+					if step.validate != nil {
+						step.validate(t, body)
+					}
+				})
+			}
+		})
+	}
+}
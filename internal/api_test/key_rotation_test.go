@@ -0,0 +1,164 @@
+package api_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/RichardHoa/hack-me/internal/app"
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/routes"
+)
+
+func TestKeyRotationRoute(t *testing.T) {
+	application, err := app.NewApplication(true)
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	defer application.ConnectionPool.Close()
+	defer CleanDB(application.DB)
+
+	router := routes.SetUpRoutes(application)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	const (
+		email    = "rotationUser@test.com"
+		password = "RotationUserPasswordThatIsLongEnough"
+	)
+
+	secrets := []*string{&constants.AccessTokenSecret, &constants.RefreshTokenSecret, &constants.CSRFTokenSecret}
+	previousSecrets := []*[]string{&constants.AccessTokenPreviousSecrets, &constants.RefreshTokenPreviousSecrets, &constants.CSRFTokenPreviousSecrets}
+
+	originalSecrets := []string{}
+	originalPreviousSecrets := [][]string{}
+	for i := range secrets {
+		originalSecrets = append(originalSecrets, *secrets[i])
+		originalPreviousSecrets = append(originalPreviousSecrets, *previousSecrets[i])
+	}
+	defer func() {
+		for i := range secrets {
+			*secrets[i] = originalSecrets[i]
+			*previousSecrets[i] = originalPreviousSecrets[i]
+		}
+	}()
+
+	// rotate replaces every signing secret, keepPrevious decides whether the replaced ones still verify
+	rotate := func(suffix string, keepPrevious bool) func(t *testing.T, body []byte) {
+		return func(t *testing.T, body []byte) {
+			for i := range secrets {
+				if keepPrevious {
+					*previousSecrets[i] = []string{*secrets[i]}
+				} else {
+					*previousSecrets[i] = nil
+				}
+				*secrets[i] = originalSecrets[i] + suffix
+			}
+		}
+	}
+
+	getProfile := func(name string, status int) TestStep {
+		return TestStep{
+			name: name,
+			request: TestRequest{
+				method: "GET",
+				path:   "/v1/users/me",
+			},
+			expectStatus: status,
+		}
+	}
+
+	// the CSRF token is checked before the session ID, a bad ID answers 400 once the token passed
+	csrfProtected := func(name string, status int) TestStep {
+		return TestStep{
+			name: name,
+			request: TestRequest{
+				method: "DELETE",
+				path:   "/v1/auth/sessions/not-a-uuid",
+			},
+			expectStatus: status,
+		}
+	}
+
+	tests := []struct {
+		name  string
+		steps []TestStep
+	}{
+		{
+			name: "secret rotation",
+			steps: []TestStep{
+				{
+					name: "Sign up",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users",
+						body: map[string]string{
+							"userName": "rotationUser",
+							"password": password,
+							"email":    email,
+						},
+					},
+					expectStatus: http.StatusCreated,
+				},
+				{
+					name: "Login before the rotation",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/login",
+						body: map[string]string{
+							"email":    email,
+							"password": password,
+						},
+					},
+					expectStatus: http.StatusOK,
+					validate:     rotate("-rotated", true),
+				},
+				getProfile("Old tokens still verify", http.StatusOK),
+				csrfProtected("Old CSRF token still verifies", http.StatusBadRequest),
+				{
+					name: "Refresh signs with the new secrets",
+					request: TestRequest{
+						method: "GET",
+						path:   "/v1/auth/tokens",
+					},
+					expectStatus: http.StatusOK,
+					validate:     rotate("-rotated", false),
+				},
+				getProfile("New tokens verify without the previous secrets", http.StatusOK),
+				csrfProtected("New CSRF token verifies without the previous secrets", http.StatusBadRequest),
+				{
+					name: "Rotate again and drop the previous secrets",
+					request: TestRequest{
+						method: "GET",
+						path:   "/v1/users/me",
+					},
+					expectStatus: http.StatusOK,
+					validate:     rotate("-rotated-again", false),
+				},
+				getProfile("Tokens of a dropped secret are refused", http.StatusUnauthorized),
+				csrfProtected("CSRF token of a dropped secret is refused", http.StatusUnauthorized),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		jar, _ := cookiejar.New(nil)
+		client := &http.Client{Jar: jar}
+
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			for _, step := range test.steps {
+				t.Run(fmt.Sprintf("%s-%s-%d-%s", step.request.method, step.request.path, step.expectStatus, step.name), func(t *testing.T) {
+					body := MakeRequestAndExpectStatus(t, client, step.request.method, server.URL+step.request.path, step.request.body, step.expectStatus)
+
+					if step.validate != nil {
+						step.validate(t, body)
+					}
+				})
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RichardHoa/hack-me/internal/app"
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/routes"
+	"github.com/RichardHoa/hack-me/internal/store"
+)
+
+func TestLoginThrottleRoute(t *testing.T) {
+	application, err := app.NewApplication(true)
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	defer application.ConnectionPool.Close()
+	defer CleanDB(application.DB)
+
+	router := routes.SetUpRoutes(application)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	mailer, ok := application.UserHandler.Mailer.(*store.MemoryMailer)
+	if !ok {
+		t.Fatalf("expected the memory mailer in tests")
+	}
+
+	throttleStore, ok := application.UserHandler.LoginThrottleStore.(*store.DBLoginThrottleStore)
+	if !ok {
+		t.Fatalf("expected the database login throttle store")
+	}
+
+	// a tighter policy than production so the test stays short
+	throttleStore.AccountPolicy = store.LoginThrottlePolicy{
+		FreeAttempts:     2,
+		LockoutThreshold: 4,
+		BackoffBase:      time.Second,
+		MaxBackoff:       time.Second,
+		LockoutTime:      time.Hour,
+	}
+	throttleStore.IPPolicy = store.LoginThrottlePolicy{
+		FreeAttempts:     8,
+		LockoutThreshold: 8,
+		BackoffBase:      time.Second,
+		MaxBackoff:       time.Second,
+		LockoutTime:      time.Hour,
+	}
+
+	const (
+		email    = "throttleUser@test.com"
+		password = "ThrottleUserPasswordThatIsLongEnough"
+	)
+
+	// filled with the token of the unlock email once it is sent
+	unlockBody := map[string]string{}
+
+	login := func(name string, email string, password string, status int) TestStep {
+		return TestStep{
+			name: name,
+			request: TestRequest{
+				method: "POST",
+				path:   "/v1/users/login",
+				body: map[string]string{
+					"email":    email,
+					"password": password,
+				},
+			},
+			expectStatus: status,
+		}
+	}
+
+	expectCode := func(code string) func(t *testing.T, body []byte) {
+		return func(t *testing.T, body []byte) {
+			var parsed struct {
+				Errors []struct {
+					Code string `json:"code"`
+				} `json:"errors"`
+			}
+			if err := json.Unmarshal(body, &parsed); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			if len(parsed.Errors) == 0 || parsed.Errors[0].Code != code {
+				t.Errorf("Expected error code %s, got %s", code, string(body))
+			}
+		}
+	}
+
+	waitBackoff := func(t *testing.T, body []byte) {
+		time.Sleep(1100 * time.Millisecond)
+	}
+
+	failedLogin := func(name string) TestStep {
+		step := login(name, email, "NotTheRightPasswordAtAll", http.StatusBadRequest)
+		step.validate = waitBackoff
+		return step
+	}
+
+	lockedLogin := login("Right password on a locked account", email, password, http.StatusTooManyRequests)
+	lockedLogin.validate = expectCode(constants.MSG_ACCOUNT_LOCKED)
+
+	backoffLogin := login("Right password during the backoff", email, password, http.StatusTooManyRequests)
+	backoffLogin.validate = expectCode(constants.MSG_TOO_MANY_REQUESTS)
+
+	tests := []struct {
+		name  string
+		steps []TestStep
+	}{
+		{
+			name: "account lockout",
+			steps: []TestStep{
+				{
+					name: "Sign up",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users",
+						body: map[string]string{
+							"userName": "throttleUser",
+							"password": password,
+							"email":    email,
+						},
+					},
+					expectStatus: http.StatusCreated,
+				},
+				login("Free failure 1", email, "NotTheRightPasswordAtAll", http.StatusBadRequest),
+				login("Free failure 2", email, "NotTheRightPasswordAtAll", http.StatusBadRequest),
+				backoffLogin,
+				{
+					name: "Wait for the backoff",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/login",
+						body:   map[string]string{"email": "", "password": ""},
+					},
+					expectStatus: http.StatusBadRequest,
+					validate:     waitBackoff,
+				},
+				failedLogin("Failure 3"),
+				{
+					name: "Failure 4 locks the account",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/login",
+						body: map[string]string{
+							"email":    email,
+							"password": "NotTheRightPasswordAtAll",
+						},
+					},
+					expectStatus: http.StatusBadRequest,
+					validate: func(t *testing.T, body []byte) {
+						mail, ok := mailer.LastMailTo(email)
+						if !ok || !strings.Contains(mail.Body, "unlock-account?token=") {
+							t.Fatalf("Expected an unlock email")
+						}
+
+						_, token, _ := strings.Cut(mail.Body, "token=")
+						token, _, _ = strings.Cut(token, "\n")
+						unlockBody["token"] = token
+					},
+				},
+				lockedLogin,
+				{
+					name: "Garbage unlock token",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/unlock",
+						body:   map[string]string{"token": "whatever"},
+					},
+					expectStatus: http.StatusBadRequest,
+				},
+				lockedLogin,
+				{
+					name: "Unlock the account",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/unlock",
+						body:   unlockBody,
+					},
+					expectStatus: http.StatusOK,
+				},
+				{
+					name: "Unlock token works once",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/unlock",
+						body:   unlockBody,
+					},
+					expectStatus: http.StatusBadRequest,
+				},
+				login("Login after unlocking", email, password, http.StatusOK),
+			},
+		},
+		{
+			name: "ip lockout",
+			steps: []TestStep{
+				// the 4 failures above were made from the same IP
+				login("Unknown email 5", "nobody5@test.com", "NotTheRightPasswordAtAll", http.StatusBadRequest),
+				login("Unknown email 6", "nobody6@test.com", "NotTheRightPasswordAtAll", http.StatusBadRequest),
+				// longer than the throttle key, and cut by bytes it would end inside a character
+				login("Unknown long email 7", "n"+strings.Repeat("é", 400)+"@test.com", "NotTheRightPasswordAtAll", http.StatusBadRequest),
+				login("Unknown email 8 locks the IP", "nobody8@test.com", "NotTheRightPasswordAtAll", http.StatusBadRequest),
+				{
+					name: "Right password from a locked IP",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/login",
+						body: map[string]string{
+							"email":    email,
+							"password": password,
+						},
+					},
+					expectStatus: http.StatusTooManyRequests,
+					validate:     expectCode(constants.MSG_IP_LOCKED),
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		jar, _ := cookiejar.New(nil)
+		client := &http.Client{Jar: jar}
+
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			for _, step := range test.steps {
+				t.Run(fmt.Sprintf("%s-%s-%d-%s", step.request.method, step.request.path, step.expectStatus, step.name), func(t *testing.T) {
+					body := MakeJSONRequestAndExpectStatus(t, client, step.request.method, server.URL+step.request.path, step.request.payload(), step.expectStatus)
+
+					if step.validate != nil {
+						step.validate(t, body)
+					}
+				})
+			}
+		})
+	}
+}
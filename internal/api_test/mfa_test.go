@@ -0,0 +1,397 @@
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RichardHoa/hack-me/internal/app"
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/routes"
+	"github.com/RichardHoa/hack-me/internal/utils"
+)
+
+func TestTOTPRoute(t *testing.T) {
+	application, err := app.NewApplication(true)
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	defer application.ConnectionPool.Close()
+	defer CleanDB(application.DB)
+
+	router := routes.SetUpRoutes(application)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	/*
+		values fills the {placeholders} of the request bodies, it is written by the
+		steps that receive the secret, the recovery codes and the mfa tokens
+	*/
+	values := map[string]string{}
+	secret := ""
+
+	fill := func(t *testing.T, value string) string {
+		switch value {
+		case "{totpNow}", "{totpNext}":
+			at := time.Now()
+			if value == "{totpNext}" {
+				// still inside the accepted drift, but a later time step than the one just used
+				at = at.Add(30 * time.Second)
+			}
+			code, err := utils.GenerateTOTPCode(secret, at)
+			if err != nil {
+				t.Fatalf("Failed to generate TOTP code: %v", err)
+			}
+			values["{usedCode}"] = code
+			return code
+		}
+		if filled, ok := values[value]; ok {
+			return filled
+		}
+		return value
+	}
+
+	login := TestStep{
+		name: "Login",
+		request: TestRequest{
+			method: "POST",
+			path:   "/v1/users/login",
+			body: map[string]string{
+				"email":    "totpUser@test.com",
+				"password": "TotpUserPasswordThatIsLongEnough",
+			},
+		},
+		expectStatus: http.StatusOK,
+	}
+
+	loginWithMFA := TestStep{
+		name:         "Password step asks for the second factor",
+		request:      login.request,
+		expectStatus: http.StatusAccepted,
+		validate: func(t *testing.T, body []byte) {
+			var resp struct {
+				Data struct {
+					MFARequired bool   `json:"mfaRequired"`
+					MFAToken    string `json:"mfaToken"`
+				} `json:"data"`
+			}
+			if err := json.Unmarshal(body, &resp); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			if !resp.Data.MFARequired || resp.Data.MFAToken == "" {
+				t.Fatalf("Expected an mfa token, got %s", body)
+			}
+			values["{mfaToken}"] = resp.Data.MFAToken
+		},
+	}
+
+	secondStep := func(name, code string, status int) TestStep {
+		return TestStep{
+			name: name,
+			request: TestRequest{
+				method: "POST",
+				path:   "/v1/users/login/mfa",
+				body:   map[string]string{"mfaToken": "{mfaToken}", "code": code},
+			},
+			expectStatus: status,
+		}
+	}
+
+	readRecoveryCodes := func(prefix string) func(t *testing.T, body []byte) {
+		return func(t *testing.T, body []byte) {
+			var resp struct {
+				Data struct {
+					RecoveryCodes []string `json:"recoveryCodes"`
+				} `json:"data"`
+			}
+			if err := json.Unmarshal(body, &resp); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			if len(resp.Data.RecoveryCodes) != 10 {
+				t.Fatalf("Expected 10 recovery codes, got %d", len(resp.Data.RecoveryCodes))
+			}
+			for i, code := range resp.Data.RecoveryCodes {
+				values[fmt.Sprintf("{%s%d}", prefix, i)] = code
+			}
+		}
+	}
+
+	expectTOTPEnabled := func(enabled bool) func(t *testing.T, body []byte) {
+		return func(t *testing.T, body []byte) {
+			var resp struct {
+				Data struct {
+					User struct {
+						TOTPEnabled bool `json:"totpEnabled"`
+					} `json:"user"`
+				} `json:"data"`
+			}
+			if err := json.Unmarshal(body, &resp); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			if resp.Data.User.TOTPEnabled != enabled {
+				t.Errorf("Expected totpEnabled %v, got %v", enabled, resp.Data.User.TOTPEnabled)
+			}
+		}
+	}
+
+	tests := []struct {
+		name   string
+		device string
+		steps  []TestStep
+	}{
+		{
+			name:   "enroll",
+			device: "laptop",
+			steps: []TestStep{
+				{
+					name: "Sign up",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users",
+						body: map[string]string{
+							"userName": "totpUser",
+							"password": "TotpUserPasswordThatIsLongEnough",
+							"email":    "totpUser@test.com",
+						},
+					},
+					expectStatus: http.StatusCreated,
+				},
+				login,
+				{
+					name: "Confirm before starting",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/me/mfa/totp/confirm",
+						body:   map[string]string{"code": "123456"},
+					},
+					expectStatus: http.StatusBadRequest,
+				},
+				{
+					name:         "Start enrollment",
+					request:      TestRequest{method: "POST", path: "/v1/users/me/mfa/totp"},
+					expectStatus: http.StatusOK,
+					validate: func(t *testing.T, body []byte) {
+						var resp struct {
+							Data struct {
+								Secret     string `json:"secret"`
+								OTPAuthURI string `json:"otpauthURI"`
+							} `json:"data"`
+						}
+						if err := json.Unmarshal(body, &resp); err != nil {
+							t.Fatalf("Failed to parse response: %v", err)
+						}
+						if !strings.HasPrefix(resp.Data.OTPAuthURI, "otpauth://totp/") || !strings.Contains(resp.Data.OTPAuthURI, resp.Data.Secret) {
+							t.Errorf("Unexpected otpauth URI %s", resp.Data.OTPAuthURI)
+						}
+						secret = resp.Data.Secret
+					},
+				},
+				{
+					name: "Confirm with a wrong code",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/me/mfa/totp/confirm",
+						body:   map[string]string{"code": "abcdef"},
+					},
+					expectStatus: http.StatusBadRequest,
+				},
+				{
+					name: "Confirm enrollment",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/me/mfa/totp/confirm",
+						body:   map[string]string{"code": "{totpNow}"},
+					},
+					expectStatus: http.StatusOK,
+					validate:     readRecoveryCodes("recovery"),
+				},
+				{
+					name:         "Cannot enroll twice",
+					request:      TestRequest{method: "POST", path: "/v1/users/me/mfa/totp"},
+					expectStatus: http.StatusBadRequest,
+				},
+				{
+					name:         "2FA is enabled",
+					request:      TestRequest{method: "GET", path: "/v1/users/me"},
+					expectStatus: http.StatusOK,
+					validate:     expectTOTPEnabled(true),
+				},
+			},
+		},
+		{
+			name:   "login with a TOTP code",
+			device: "phone",
+			steps: []TestStep{
+				loginWithMFA,
+				{
+					name:         "No tokens before the second step",
+					request:      TestRequest{method: "GET", path: "/v1/users/me"},
+					expectStatus: http.StatusUnauthorized,
+				},
+				secondStep("Wrong code", "abcdef", http.StatusBadRequest),
+				secondStep("Code used for the enrollment is refused", "{usedCode}", http.StatusBadRequest),
+				secondStep("Next code", "{totpNext}", http.StatusOK),
+				secondStep("MFA token is single use", "{recovery9}", http.StatusBadRequest),
+				{
+					name:         "Logged in",
+					request:      TestRequest{method: "GET", path: "/v1/users/me"},
+					expectStatus: http.StatusOK,
+				},
+			},
+		},
+		{
+			name:   "login with a recovery code",
+			device: "tablet",
+			steps: []TestStep{
+				loginWithMFA,
+				secondStep("Recovery code", "{recovery0}", http.StatusOK),
+			},
+		},
+		{
+			name:   "wrong codes end the login attempt",
+			device: "desktop",
+			steps: []TestStep{
+				loginWithMFA,
+				secondStep("Recovery code is single use", "{recovery0}", http.StatusBadRequest),
+				secondStep("Wrong code 2", "abcdef", http.StatusBadRequest),
+				secondStep("Wrong code 3", "abcdef", http.StatusBadRequest),
+				secondStep("Wrong code 4", "abcdef", http.StatusBadRequest),
+				secondStep("Wrong code 5", "abcdef", http.StatusBadRequest),
+				secondStep("Valid code after too many attempts", "{recovery1}", http.StatusBadRequest),
+			},
+		},
+		{
+			name:   "guessed codes lock every code check",
+			device: "laptop",
+			steps: func() []TestStep {
+				// the wrong codes of the desktop still count until a correct code starts over
+				steps := []TestStep{{
+					name: "Correct code starts the count over",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/me/mfa/recovery-codes",
+						body:   map[string]string{"code": "{recovery1}"},
+					},
+					expectStatus: http.StatusOK,
+					validate:     readRecoveryCodes("recovery"),
+				}}
+				for i := range constants.MFALockoutThreshold {
+					steps = append(steps, TestStep{
+						name: fmt.Sprintf("Wrong code %d", i+1),
+						request: TestRequest{
+							method: "DELETE",
+							path:   "/v1/users/me/mfa/totp",
+							body:   map[string]string{"code": "abcdef"},
+						},
+						expectStatus: http.StatusBadRequest,
+					})
+				}
+				return append(steps,
+					TestStep{
+						name: "Valid code is locked out",
+						request: TestRequest{
+							method: "POST",
+							path:   "/v1/users/me/mfa/recovery-codes",
+							body:   map[string]string{"code": "{recovery1}"},
+						},
+						expectStatus: http.StatusTooManyRequests,
+					},
+					loginWithMFA,
+					TestStep{
+						name: "A new login attempt is locked out as well",
+						request: TestRequest{
+							method: "POST",
+							path:   "/v1/users/login/mfa",
+							body:   map[string]string{"mfaToken": "{mfaToken}", "code": "{recovery1}"},
+						},
+						expectStatus: http.StatusTooManyRequests,
+						validate: func(t *testing.T, body []byte) {
+							_, err := application.DB.Exec(`UPDATE "user" SET mfa_locked_until = NULL`)
+							if err != nil {
+								t.Fatalf("Failed to lift the lockout: %v", err)
+							}
+						},
+					},
+				)
+			}(),
+		},
+		{
+			name:   "manage 2FA",
+			device: "laptop",
+			steps: []TestStep{
+				{
+					name: "Regenerate recovery codes",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/me/mfa/recovery-codes",
+						body:   map[string]string{"code": "{recovery1}"},
+					},
+					expectStatus: http.StatusOK,
+					validate:     readRecoveryCodes("newRecovery"),
+				},
+				{
+					name: "Old recovery codes stop working",
+					request: TestRequest{
+						method: "DELETE",
+						path:   "/v1/users/me/mfa/totp",
+						body:   map[string]string{"code": "{recovery2}"},
+					},
+					expectStatus: http.StatusBadRequest,
+				},
+				{
+					name: "Disable 2FA",
+					request: TestRequest{
+						method: "DELETE",
+						path:   "/v1/users/me/mfa/totp",
+						body:   map[string]string{"code": "{newRecovery0}"},
+					},
+					expectStatus: http.StatusOK,
+				},
+				{
+					name:         "2FA is disabled",
+					request:      TestRequest{method: "GET", path: "/v1/users/me"},
+					expectStatus: http.StatusOK,
+					validate:     expectTOTPEnabled(false),
+				},
+			},
+		},
+		{
+			name:   "password is enough again",
+			device: "desktop",
+			steps:  []TestStep{login},
+		},
+	}
+
+	clients := map[string]*http.Client{}
+
+	for _, test := range tests {
+		client, ok := clients[test.device]
+		if !ok {
+			jar, _ := cookiejar.New(nil)
+			client = &http.Client{Jar: jar}
+			clients[test.device] = client
+		}
+
+		t.Run(test.name, func(t *testing.T) {
+			for _, step := range test.steps {
+				t.Run(fmt.Sprintf("%s-%s-%d-%s", step.request.method, step.request.path, step.expectStatus, step.name), func(t *testing.T) {
+					payload := map[string]string{}
+					for key, value := range step.request.body {
+						payload[key] = fill(t, value)
+					}
+
+					body := MakeJSONRequestAndExpectStatus(t, client, step.request.method, server.URL+step.request.path, payload, step.expectStatus)
+
+					if step.validate != nil {
+						step.validate(t, body)
+					}
+				})
+			}
+		})
+	}
+}
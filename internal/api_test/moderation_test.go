@@ -0,0 +1,451 @@
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/RichardHoa/hack-me/internal/app"
+	"github.com/RichardHoa/hack-me/internal/routes"
+	"github.com/RichardHoa/hack-me/internal/store"
+)
+
+func TestModerationRoute(t *testing.T) {
+	application, err := app.NewApplication(true)
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	defer application.ConnectionPool.Close()
+	defer CleanDB(application.DB)
+
+	router := routes.SetUpRoutes(application)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	mailer, ok := application.UserHandler.Mailer.(*store.MemoryMailer)
+	if !ok {
+		t.Fatalf("expected the memory mailer in tests")
+	}
+
+	const (
+		password       = "ModerationPasswordThatIsLongEnough"
+		ownerEmail     = "moderatedOwner@test.com"
+		bystanderEmail = "bystander@test.com"
+		moderatorEmail = "moderator@test.com"
+		adminEmail     = "admin@test.com"
+		challengeName  = "Moderated challenge"
+	)
+
+	newClient := func() *http.Client {
+		jar, _ := cookiejar.New(nil)
+		return &http.Client{Jar: jar}
+	}
+	ownerClient, bystanderClient, moderatorClient, adminClient := newClient(), newClient(), newClient(), newClient()
+
+	// filled as the steps run, and replaced in the paths and bodies
+	ids := map[string]string{}
+
+	signUpAndLogin := func(userName, email, role string) []TestStep {
+		return []TestStep{
+			{
+				name: "Sign up",
+				request: TestRequest{
+					method: "POST",
+					path:   "/v1/users",
+					body: map[string]string{
+						"userName": userName,
+						"password": password,
+						"email":    email,
+					},
+				},
+				expectStatus: http.StatusCreated,
+				validate: func(t *testing.T, body []byte) {
+					// the first moderators and admins are set in the database, like in production
+					var userID string
+					err := application.DB.QueryRow(`UPDATE "user" SET role = $1 WHERE email = $2 RETURNING id`, role, email).Scan(&userID)
+					if err != nil {
+						t.Fatalf("Failed to set the role: %v", err)
+					}
+					ids["{"+userName+"ID}"] = userID
+				},
+			},
+			{
+				name: "Login",
+				request: TestRequest{
+					method: "POST",
+					path:   "/v1/users/login",
+					body: map[string]string{
+						"email":    email,
+						"password": password,
+					},
+				},
+				expectStatus: http.StatusOK,
+			},
+		}
+	}
+
+	expectMail := func(action string) func(t *testing.T, body []byte) {
+		return func(t *testing.T, body []byte) {
+			mail, ok := mailer.LastMailTo(ownerEmail)
+			if !ok {
+				t.Fatalf("Expected the owner to be notified")
+			}
+			if !strings.Contains(mail.Subject, action) {
+				t.Errorf("Expected the owner to be told the content was %s, got %q", action, mail.Subject)
+			}
+		}
+	}
+
+	hideChallenge := func(action string) TestRequest {
+		return TestRequest{
+			method: "POST",
+			path:   "/v1/moderation/actions",
+			body: map[string]string{
+				"targetType": "challenge",
+				"targetID":   "{challengeID}",
+				"action":     action,
+				"reason":     "Spoils another challenge",
+			},
+		}
+	}
+
+	getChallenge := TestRequest{method: "GET", path: "/v1/challenges?exactName=Moderated+challenge"}
+
+	tests := []struct {
+		name   string
+		client *http.Client
+		steps  []TestStep
+	}{
+		{
+			name:   "owner posts content",
+			client: ownerClient,
+			steps: append(signUpAndLogin("moderatedOwner", ownerEmail, "user"),
+				TestStep{
+					name: "Post challenge",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/challenges",
+						body: map[string]string{
+							"name":     challengeName,
+							"content":  "A challenge that breaks the rules",
+							"category": "web hacking",
+						},
+					},
+					expectStatus: http.StatusCreated,
+				},
+				TestStep{
+					name:         "Get challenge ID",
+					request:      getChallenge,
+					expectStatus: http.StatusOK,
+					validate: func(t *testing.T, body []byte) {
+						var response struct {
+							Data []struct {
+								ID string `json:"id"`
+							} `json:"data"`
+						}
+						if err := json.Unmarshal(body, &response); err != nil || len(response.Data) != 1 {
+							t.Fatalf("Failed to find the challenge: %v %s", err, body)
+						}
+						ids["{challengeID}"] = response.Data[0].ID
+					},
+				},
+				TestStep{
+					name: "Post comment",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/comments",
+						body: map[string]string{
+							"challengeID": "{challengeID}",
+							"content":     "The flag is in the page source",
+						},
+					},
+					expectStatus: http.StatusCreated,
+					validate: func(t *testing.T, body []byte) {
+						var response struct {
+							Data struct {
+								CommentID string `json:"commentID"`
+							} `json:"data"`
+						}
+						if err := json.Unmarshal(body, &response); err != nil {
+							t.Fatalf("Failed to parse the comment: %v", err)
+						}
+						ids["{commentID}"] = response.Data.CommentID
+					},
+				},
+			),
+		},
+		{
+			name:   "users cannot moderate",
+			client: bystanderClient,
+			steps: append(signUpAndLogin("bystander", bystanderEmail, "user"),
+				TestStep{
+					name: "Edit someone else's challenge",
+					request: TestRequest{
+						method: "PUT",
+						path:   "/v1/challenges",
+						body: map[string]string{
+							"oldName": challengeName,
+							"content": "Defaced",
+						},
+					},
+					expectStatus: http.StatusForbidden,
+				},
+				TestStep{
+					name: "Delete someone else's comment",
+					request: TestRequest{
+						method: "DELETE",
+						path:   "/v1/comments",
+						body:   map[string]string{"commentID": "{commentID}"},
+					},
+					expectStatus: http.StatusForbidden,
+				},
+				TestStep{
+					name:         "Hide challenge",
+					request:      hideChallenge("hide"),
+					expectStatus: http.StatusForbidden,
+				},
+				TestStep{
+					name:         "Read moderation log",
+					request:      TestRequest{method: "GET", path: "/v1/moderation/actions"},
+					expectStatus: http.StatusForbidden,
+				},
+			),
+		},
+		{
+			name:   "moderator acts",
+			client: moderatorClient,
+			steps: append(signUpAndLogin("moderator", moderatorEmail, "moderator"),
+				TestStep{
+					name: "Reason too long",
+					request: TestRequest{
+						method: "PUT",
+						path:   "/v1/challenges",
+						body: map[string]string{
+							"oldName":          challengeName,
+							"content":          "Edited by a moderator",
+							"moderationReason": strings.Repeat("a", 1001),
+						},
+					},
+					expectStatus: http.StatusBadRequest,
+				},
+				TestStep{
+					name: "Edit someone else's challenge",
+					request: TestRequest{
+						method: "PUT",
+						path:   "/v1/challenges",
+						body: map[string]string{
+							"oldName":          challengeName,
+							"content":          "Edited by a moderator",
+							"moderationReason": "Removed a link to malware",
+						},
+					},
+					expectStatus: http.StatusOK,
+					validate:     expectMail("edited"),
+				},
+				TestStep{
+					name: "Unknown target type",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/moderation/actions",
+						body: map[string]string{
+							"targetType": "user",
+							"targetID":   "{challengeID}",
+							"action":     "hide",
+							"reason":     "Spam",
+						},
+					},
+					expectStatus: http.StatusBadRequest,
+				},
+				TestStep{
+					name:         "Hide challenge",
+					request:      hideChallenge("hide"),
+					expectStatus: http.StatusOK,
+					validate:     expectMail("hid"),
+				},
+				TestStep{
+					name:         "Hide challenge twice",
+					request:      hideChallenge("hide"),
+					expectStatus: http.StatusBadRequest,
+				},
+				TestStep{
+					name:         "Hidden challenge is not listed",
+					request:      getChallenge,
+					expectStatus: http.StatusOK,
+					validate: func(t *testing.T, body []byte) {
+						if strings.Contains(string(body), challengeName) {
+							t.Errorf("Expected the hidden challenge to be left out, got %s", body)
+						}
+					},
+				},
+				TestStep{
+					name:         "Unhide challenge",
+					request:      hideChallenge("unhide"),
+					expectStatus: http.StatusOK,
+				},
+				TestStep{
+					name: "Delete someone else's comment",
+					request: TestRequest{
+						method: "DELETE",
+						path:   "/v1/comments",
+						body: map[string]string{
+							"commentID":        "{commentID}",
+							"moderationReason": "Spoiler",
+						},
+					},
+					expectStatus: http.StatusOK,
+					validate:     expectMail("deleted"),
+				},
+				TestStep{
+					name:         "Read moderation log",
+					request:      TestRequest{method: "GET", path: "/v1/moderation/actions"},
+					expectStatus: http.StatusOK,
+					validate: func(t *testing.T, body []byte) {
+						var response struct {
+							Data []store.ModerationAction `json:"data"`
+						}
+						if err := json.Unmarshal(body, &response); err != nil {
+							t.Fatalf("Failed to parse the moderation log: %v", err)
+						}
+						if len(response.Data) != 4 {
+							t.Fatalf("Expected 4 moderation actions, got %s", body)
+						}
+						if response.Data[0].Action != "delete" || response.Data[0].TargetTitle != "The flag is in the page source" {
+							t.Errorf("Expected the comment deletion first, got %+v", response.Data[0])
+						}
+					},
+				},
+				TestStep{
+					name:         "Password hash report is for admins",
+					request:      TestRequest{method: "GET", path: "/v1/admin/password-hashes"},
+					expectStatus: http.StatusForbidden,
+				},
+			),
+		},
+		{
+			name:   "owner edits own content",
+			client: ownerClient,
+			steps: []TestStep{
+				{
+					name: "Edit own challenge",
+					request: TestRequest{
+						method: "PUT",
+						path:   "/v1/challenges",
+						body: map[string]string{
+							"oldName": challengeName,
+							"content": "A challenge that follows the rules",
+						},
+					},
+					expectStatus: http.StatusOK,
+					validate: func(t *testing.T, body []byte) {
+						var count int
+						application.DB.QueryRow(`SELECT COUNT(*) FROM moderation_action`).Scan(&count)
+						if count != 4 {
+							t.Errorf("Expected the owner's edit to stay out of the moderation log, got %d actions", count)
+						}
+					},
+				},
+			},
+		},
+		{
+			name:   "admin",
+			client: adminClient,
+			steps: append(signUpAndLogin("admin", adminEmail, "admin"),
+				TestStep{
+					name:         "Password hash report",
+					request:      TestRequest{method: "GET", path: "/v1/admin/password-hashes"},
+					expectStatus: http.StatusOK,
+					validate: func(t *testing.T, body []byte) {
+						if !strings.Contains(string(body), `"total":4`) {
+							t.Errorf("Expected 4 password hashes, got %s", body)
+						}
+					},
+				},
+				TestStep{
+					name: "Unknown role",
+					request: TestRequest{
+						method: "PUT",
+						path:   "/v1/admin/users/{moderatorID}/role",
+						body:   map[string]string{"role": "owner"},
+					},
+					expectStatus: http.StatusBadRequest,
+				},
+				TestStep{
+					name: "Change own role",
+					request: TestRequest{
+						method: "PUT",
+						path:   "/v1/admin/users/{adminID}/role",
+						body:   map[string]string{"role": "user"},
+					},
+					expectStatus: http.StatusForbidden,
+				},
+				TestStep{
+					name: "Demote moderator",
+					request: TestRequest{
+						method: "PUT",
+						path:   "/v1/admin/users/{moderatorID}/role",
+						body:   map[string]string{"role": "user"},
+					},
+					expectStatus: http.StatusOK,
+				},
+			),
+		},
+		{
+			name:   "demoted moderator",
+			client: moderatorClient,
+			steps: []TestStep{
+				{
+					name:         "Read moderation log",
+					request:      TestRequest{method: "GET", path: "/v1/moderation/actions"},
+					expectStatus: http.StatusForbidden,
+				},
+				{
+					name: "Edit someone else's challenge",
+					request: TestRequest{
+						method: "PUT",
+						path:   "/v1/challenges",
+						body: map[string]string{
+							"oldName": challengeName,
+							"content": "Edited by a former moderator",
+						},
+					},
+					expectStatus: http.StatusForbidden,
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			for _, step := range test.steps {
+				t.Run(fmt.Sprintf("%s-%s-%d-%s", step.request.method, step.request.path, step.expectStatus, step.name), func(t *testing.T) {
+					replace := func(value string) string {
+						for placeholder, id := range ids {
+							value = strings.ReplaceAll(value, placeholder, id)
+						}
+						return value
+					}
+
+					var payload map[string]string
+					if step.request.body != nil {
+						payload = map[string]string{}
+						for key, value := range step.request.body {
+							payload[key] = replace(value)
+						}
+					}
+
+					body := MakeRequestAndExpectStatus(t, test.client, step.request.method, server.URL+replace(step.request.path), payload, step.expectStatus)
+
+					if step.validate != nil {
+						step.validate(t, body)
+					}
+				})
+			}
+		})
+	}
+}
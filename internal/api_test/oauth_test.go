@@ -0,0 +1,560 @@
+package api_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RichardHoa/hack-me/internal/app"
+	"github.com/RichardHoa/hack-me/internal/routes"
+	"github.com/RichardHoa/hack-me/internal/store"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	standInClientID     = "hack-me-test"
+	standInClientSecret = "stand-in-secret"
+	standInKeyID        = "stand-in-key"
+)
+
+// standInAccount is the account that is "logged in" at the stand-in provider
+type standInAccount struct {
+	subject       string
+	email         string
+	emailVerified bool
+	name          string
+	// signs the ID token with a key that is not published in the JWKS
+	forgeIDToken bool
+}
+
+type standInGrant struct {
+	codeChallenge string
+	nonce         string
+	redirectURI   string
+	account       standInAccount
+}
+
+/*
+standInProvider is a local OpenID Connect provider that also speaks the GitHub
+API, it checks PKCE and issues RS256 ID tokens like the real providers.
+*/
+type standInProvider struct {
+	server    *httptest.Server
+	key       *rsa.PrivateKey
+	forgedKey *rsa.PrivateKey
+
+	mu      sync.Mutex
+	account standInAccount
+	grants  map[string]standInGrant
+	tokens  map[string]standInAccount
+}
+
+func newStandInProvider(t *testing.T) *standInProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	forgedKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	provider := &standInProvider{
+		key:       key,
+		forgedKey: forgedKey,
+		grants:    map[string]standInGrant{},
+		tokens:    map[string]standInAccount{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", provider.discovery)
+	mux.HandleFunc("GET /jwks", provider.jwks)
+	mux.HandleFunc("GET /authorize", provider.authorize)
+	mux.HandleFunc("POST /token", provider.token)
+	mux.HandleFunc("GET /user", provider.githubUser)
+	mux.HandleFunc("GET /user/emails", provider.githubEmails)
+	provider.server = httptest.NewServer(mux)
+
+	return provider
+}
+
+func (provider *standInProvider) setAccount(account standInAccount) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+	provider.account = account
+}
+
+func (provider *standInProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeStandInJSON(w, http.StatusOK, map[string]string{
+		"issuer":                 provider.server.URL,
+		"authorization_endpoint": provider.server.URL + "/authorize",
+		"token_endpoint":         provider.server.URL + "/token",
+		"jwks_uri":               provider.server.URL + "/jwks",
+	})
+}
+
+func (provider *standInProvider) jwks(w http.ResponseWriter, r *http.Request) {
+	writeStandInJSON(w, http.StatusOK, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": standInKeyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(provider.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(provider.key.E)).Bytes()),
+		}},
+	})
+}
+
+// authorize logs the current account in right away and sends the browser back with a code
+func (provider *standInProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != standInClientID || query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+
+	code := rand.Text()
+
+	provider.mu.Lock()
+	provider.grants[code] = standInGrant{
+		codeChallenge: query.Get("code_challenge"),
+		nonce:         query.Get("nonce"),
+		redirectURI:   query.Get("redirect_uri"),
+		account:       provider.account,
+	}
+	provider.mu.Unlock()
+
+	redirect, _ := url.Parse(query.Get("redirect_uri"))
+	redirectQuery := redirect.Query()
+	redirectQuery.Set("code", code)
+	redirectQuery.Set("state", query.Get("state"))
+	redirect.RawQuery = redirectQuery.Encode()
+
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (provider *standInProvider) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeStandInJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	provider.mu.Lock()
+	grant, ok := provider.grants[r.PostForm.Get("code")]
+	// codes are single use
+	delete(provider.grants, r.PostForm.Get("code"))
+	provider.mu.Unlock()
+
+	verifierHash := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	switch {
+	case !ok,
+		r.PostForm.Get("client_id") != standInClientID,
+		r.PostForm.Get("client_secret") != standInClientSecret,
+		r.PostForm.Get("redirect_uri") != grant.redirectURI,
+		base64.RawURLEncoding.EncodeToString(verifierHash[:]) != grant.codeChallenge:
+		writeStandInJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	signingKey := provider.key
+	if grant.account.forgeIDToken {
+		signingKey = provider.forgedKey
+	}
+
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":            provider.server.URL,
+		"aud":            standInClientID,
+		"sub":            grant.account.subject,
+		"email":          grant.account.email,
+		"email_verified": grant.account.emailVerified,
+		"name":           grant.account.name,
+		"nonce":          grant.nonce,
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(time.Minute).Unix(),
+	})
+	idToken.Header["kid"] = standInKeyID
+	signedIDToken, err := idToken.SignedString(signingKey)
+	if err != nil {
+		writeStandInJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+
+	accessToken := rand.Text()
+	provider.mu.Lock()
+	provider.tokens[accessToken] = grant.account
+	provider.mu.Unlock()
+
+	writeStandInJSON(w, http.StatusOK, map[string]string{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"id_token":     signedIDToken,
+	})
+}
+
+func (provider *standInProvider) accountFromBearer(r *http.Request) (standInAccount, bool) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if len(header) <= len(prefix) {
+		return standInAccount{}, false
+	}
+
+	account, ok := provider.tokens[header[len(prefix):]]
+	return account, ok
+}
+
+func (provider *standInProvider) githubUser(w http.ResponseWriter, r *http.Request) {
+	account, ok := provider.accountFromBearer(r)
+	if !ok {
+		writeStandInJSON(w, http.StatusUnauthorized, map[string]string{"message": "Bad credentials"})
+		return
+	}
+
+	id, _ := strconv.ParseInt(account.subject, 10, 64)
+	writeStandInJSON(w, http.StatusOK, map[string]any{
+		"id":         id,
+		"login":      account.name,
+		"avatar_url": "https://avatars.githubusercontent.com/u/" + account.subject,
+	})
+}
+
+func (provider *standInProvider) githubEmails(w http.ResponseWriter, r *http.Request) {
+	account, ok := provider.accountFromBearer(r)
+	if !ok {
+		writeStandInJSON(w, http.StatusUnauthorized, map[string]string{"message": "Bad credentials"})
+		return
+	}
+
+	writeStandInJSON(w, http.StatusOK, []map[string]any{
+		{"email": "secondary@test.com", "primary": false, "verified": true},
+		{"email": account.email, "primary": true, "verified": account.emailVerified},
+	})
+}
+
+func writeStandInJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func TestOAuthRoute(t *testing.T) {
+	application, err := app.NewApplication(true)
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	defer application.ConnectionPool.Close()
+	defer CleanDB(application.DB)
+
+	router := routes.SetUpRoutes(application)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	provider := newStandInProvider(t)
+	defer provider.server.Close()
+
+	github := store.NewGithubProvider(store.OAuthProviderConfig{
+		ClientID:     standInClientID,
+		ClientSecret: standInClientSecret,
+		RedirectURL:  server.URL + "/v1/auth/github/callback",
+	})
+	github.AuthURL = provider.server.URL + "/authorize"
+	github.TokenURL = provider.server.URL + "/token"
+	github.APIURL = provider.server.URL
+
+	application.OAuthHandler.Providers = map[string]store.OAuthProvider{
+		"google": store.NewOIDCProvider("google", provider.server.URL, store.OAuthProviderConfig{
+			ClientID:     standInClientID,
+			ClientSecret: standInClientSecret,
+			RedirectURL:  server.URL + "/v1/auth/google/callback",
+		}),
+		"github": github,
+	}
+
+	mailer, ok := application.UserHandler.Mailer.(*store.MemoryMailer)
+	if !ok {
+		t.Fatalf("expected the memory mailer in tests")
+	}
+
+	// filled with the token of the verification email of the linked account
+	verifyBody := map[string]string{}
+
+	expectUserName := func(userName string) func(t *testing.T, body []byte) {
+		return func(t *testing.T, body []byte) {
+			var resp struct {
+				Data struct {
+					User struct {
+						UserName string `json:"userName"`
+					} `json:"user"`
+				} `json:"data"`
+			}
+			if err := json.Unmarshal(body, &resp); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			if resp.Data.User.UserName != userName {
+				t.Errorf("Expected userName '%s', got '%s'", userName, resp.Data.User.UserName)
+			}
+		}
+	}
+
+	providerURL, _ := url.Parse(provider.server.URL)
+
+	// the callback sends the browser on to the frontend, the client stops there and keeps the URL
+	var landing *url.URL
+	expectLanding := func(errorCode string) func(t *testing.T, body []byte) {
+		return func(t *testing.T, body []byte) {
+			if landing == nil {
+				t.Fatalf("Expected a redirect to the frontend")
+			}
+			if got := landing.Query().Get("error"); got != errorCode {
+				t.Errorf("Expected error '%s' on the frontend, got '%s'", errorCode, got)
+			}
+		}
+	}
+
+	googleAccount := standInAccount{
+		subject:       "google-subject-1",
+		email:         "oauthGoogle@test.com",
+		emailVerified: true,
+		name:          "Oauth Google",
+	}
+
+	tests := []struct {
+		name    string
+		account standInAccount
+		steps   []TestStep
+	}{
+		{
+			name:    "new google user",
+			account: googleAccount,
+			steps: []TestStep{
+				{
+					name:         "Login through google",
+					request:      TestRequest{method: "GET", path: "/v1/auth/google/start"},
+					expectStatus: http.StatusFound,
+					validate:     expectLanding(""),
+				},
+				{
+					name:         "Account is created from the ID token",
+					request:      TestRequest{method: "GET", path: "/v1/users/me"},
+					expectStatus: http.StatusOK,
+					validate:     expectUserName("Oauth Google"),
+				},
+				{
+					name: "Set password for social user",
+					request: TestRequest{
+						method: "PUT",
+						path:   "/v1/users/password",
+						body: map[string]string{
+							"oldPassword": "",
+							"newPassword": "PasswordForSocialUser",
+						},
+					},
+					expectStatus: http.StatusOK,
+				},
+				{
+					name: "Login with newly set password",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/login",
+						body: map[string]string{
+							"email":    "oauthGoogle@test.com",
+							"password": "PasswordForSocialUser",
+						},
+					},
+					expectStatus: http.StatusOK,
+				},
+			},
+		},
+		{
+			name:    "returning google user",
+			account: googleAccount,
+			steps: []TestStep{
+				{
+					name:         "Login through google again",
+					request:      TestRequest{method: "GET", path: "/v1/auth/google/start"},
+					expectStatus: http.StatusFound,
+					validate:     expectLanding(""),
+				},
+				{
+					name:         "Same account",
+					request:      TestRequest{method: "GET", path: "/v1/users/me"},
+					expectStatus: http.StatusOK,
+					validate:     expectUserName("Oauth Google"),
+				},
+			},
+		},
+		{
+			name: "github links an existing account",
+			account: standInAccount{
+				subject:       "4242",
+				email:         "oauthLinked@test.com",
+				emailVerified: true,
+				name:          "octocat",
+			},
+			steps: []TestStep{
+				{
+					name: "Sign up with password",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users",
+						body: map[string]string{
+							"userName": "oauthLinked",
+							"password": "OauthLinkedPasswordThatIsLongEnough",
+							"email":    "oauthLinked@test.com",
+						},
+					},
+					expectStatus: http.StatusCreated,
+					validate: func(t *testing.T, body []byte) {
+						mail, ok := mailer.LastMailTo("oauthLinked@test.com")
+						if !ok {
+							t.Fatalf("Expected a verification email")
+						}
+						_, token, _ := strings.Cut(mail.Body, "token=")
+						token, _, _ = strings.Cut(token, "\n")
+						verifyBody["token"] = token
+					},
+				},
+				{
+					name:         "Account with an unverified email is not linked",
+					request:      TestRequest{method: "GET", path: "/v1/auth/github/start"},
+					expectStatus: http.StatusFound,
+					validate:     expectLanding("email_not_usable"),
+				},
+				{
+					name: "Owner verifies the email",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/verify-email",
+						body:   verifyBody,
+					},
+					expectStatus: http.StatusOK,
+				},
+				{
+					name:         "Login through github",
+					request:      TestRequest{method: "GET", path: "/v1/auth/github/start"},
+					expectStatus: http.StatusFound,
+					validate:     expectLanding(""),
+				},
+				{
+					name:         "Github is linked to the existing account",
+					request:      TestRequest{method: "GET", path: "/v1/users/me"},
+					expectStatus: http.StatusOK,
+					validate:     expectUserName("oauthLinked"),
+				},
+			},
+		},
+		{
+			name: "unverified email",
+			account: standInAccount{
+				subject: "google-subject-2",
+				email:   "oauthLinked@test.com",
+				name:    "Not The Owner",
+			},
+			steps: []TestStep{
+				{
+					name:         "Unverified email cannot log in",
+					request:      TestRequest{method: "GET", path: "/v1/auth/google/start"},
+					expectStatus: http.StatusFound,
+					validate:     expectLanding("email_not_usable"),
+				},
+			},
+		},
+		{
+			name: "forged id token",
+			account: standInAccount{
+				subject:       "google-subject-1",
+				email:         "oauthGoogle@test.com",
+				emailVerified: true,
+				forgeIDToken:  true,
+			},
+			steps: []TestStep{
+				{
+					name:         "Signature is verified",
+					request:      TestRequest{method: "GET", path: "/v1/auth/google/start"},
+					expectStatus: http.StatusFound,
+					validate:     expectLanding("verification_failed"),
+				},
+			},
+		},
+		{
+			name:    "malicious callbacks",
+			account: googleAccount,
+			steps: []TestStep{
+				{
+					name:         "Unknown provider",
+					request:      TestRequest{method: "GET", path: "/v1/auth/gitlab/start"},
+					expectStatus: http.StatusNotFound,
+				},
+				{
+					name:         "Unknown provider callback",
+					request:      TestRequest{method: "GET", path: "/v1/auth/gitlab/callback?state=abc&code=def"},
+					expectStatus: http.StatusFound,
+					validate:     expectLanding("unsupported_provider"),
+				},
+				{
+					name:         "Callback without a started login",
+					request:      TestRequest{method: "GET", path: "/v1/auth/google/callback?state=abc&code=def"},
+					expectStatus: http.StatusFound,
+					validate:     expectLanding("invalid_state"),
+				},
+				{
+					name:         "Callback without code",
+					request:      TestRequest{method: "GET", path: "/v1/auth/google/callback?state=abc"},
+					expectStatus: http.StatusFound,
+					validate:     expectLanding("invalid_state"),
+				},
+				{
+					name:         "Provider error",
+					request:      TestRequest{method: "GET", path: "/v1/auth/google/callback?error=access_denied"},
+					expectStatus: http.StatusFound,
+					validate:     expectLanding("access_denied"),
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		jar, _ := cookiejar.New(nil)
+		client := &http.Client{
+			Jar: jar,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if req.URL.Host == providerURL.Host || strings.HasPrefix(req.URL.Path, "/v1/") {
+					return nil
+				}
+				landing = req.URL
+				return http.ErrUseLastResponse
+			},
+		}
+
+		t.Run(test.name, func(t *testing.T) {
+			provider.setAccount(test.account)
+
+			for _, step := range test.steps {
+				t.Run(fmt.Sprintf("%s-%s-%d-%s", step.request.method, step.request.path, step.expectStatus, step.name), func(t *testing.T) {
+					landing = nil
+					body := MakeJSONRequestAndExpectStatus(t, client, step.request.method, server.URL+step.request.path, step.request.payload(), step.expectStatus)
+
+					if step.validate != nil {
+						step.validate(t, body)
+					}
+				})
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package api_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/RichardHoa/hack-me/internal/app"
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/routes"
+)
+
+func TestPasswordHashUpgradeRoute(t *testing.T) {
+	application, err := app.NewApplication(true)
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	defer application.ConnectionPool.Close()
+	defer CleanDB(application.DB)
+
+	router := routes.SetUpRoutes(application)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	// the failed upgrade below refuses password updates with a trigger, a failing test must not leave it behind
+	defer application.DB.Exec(`DROP FUNCTION IF EXISTS test_reject_password()`)
+	defer application.DB.Exec(`DROP TRIGGER IF EXISTS trg_test_reject_password ON "user"`)
+
+	const (
+		email    = "hashUser@test.com"
+		password = "HashUserPasswordThatIsLongEnough"
+	)
+
+	oldIterations := constants.Argon2Iterations
+	defer func() { constants.Argon2Iterations = oldIterations }()
+
+	storedHash := func(t *testing.T) string {
+		var hash string
+		err := application.DB.QueryRow(`SELECT password FROM "user" WHERE email = $1`, email).Scan(&hash)
+		if err != nil {
+			t.Fatalf("Failed to read the password hash: %v", err)
+		}
+		return hash
+	}
+
+	expectOutdated := func(outdated int) func(t *testing.T, body []byte) {
+		return func(t *testing.T, body []byte) {
+			report, err := application.UserHandler.UserStore.GetPasswordHashReport()
+			if err != nil {
+				t.Fatalf("Failed to build the password hash report: %v", err)
+			}
+			if report.Outdated != outdated {
+				t.Errorf("Expected %d outdated hashes, got %+v", outdated, report)
+			}
+		}
+	}
+
+	login := func(name string, password string, status int) TestStep {
+		return TestStep{
+			name: name,
+			request: TestRequest{
+				method: "POST",
+				path:   "/v1/users/login",
+				body: map[string]string{
+					"email":    email,
+					"password": password,
+				},
+			},
+			expectStatus: status,
+		}
+	}
+
+	wrongPassword := login("Wrong password does not upgrade the hash", "NotTheRightPasswordAtAll", http.StatusBadRequest)
+	wrongPassword.validate = func(t *testing.T, body []byte) {
+		expectOutdated(1)(t, body)
+
+		for _, query := range []string{
+			`CREATE FUNCTION test_reject_password() RETURNS TRIGGER AS $$
+			BEGIN
+				RAISE EXCEPTION 'password updates are refused in this test';
+			END;
+			$$ LANGUAGE plpgsql`,
+			`CREATE TRIGGER trg_test_reject_password BEFORE UPDATE OF password ON "user" FOR EACH ROW EXECUTE FUNCTION test_reject_password()`,
+		} {
+			_, err := application.DB.Exec(query)
+			if err != nil {
+				t.Fatalf("Failed to refuse password updates: %v", err)
+			}
+		}
+	}
+
+	// the rehash is a side effect of the login, when the update fails the login still goes through
+	failedUpgrade := login("Login when the upgrade fails", password, http.StatusOK)
+	failedUpgrade.validate = func(t *testing.T, body []byte) {
+		expectOutdated(1)(t, body)
+
+		for _, query := range []string{
+			`DROP TRIGGER IF EXISTS trg_test_reject_password ON "user"`,
+			`DROP FUNCTION IF EXISTS test_reject_password()`,
+		} {
+			_, err := application.DB.Exec(query)
+			if err != nil {
+				t.Fatalf("Failed to allow password updates again: %v", err)
+			}
+		}
+	}
+
+	upgrade := login("Login upgrades the hash", password, http.StatusOK)
+	upgrade.validate = func(t *testing.T, body []byte) {
+		if hash := storedHash(t); !strings.Contains(hash, fmt.Sprintf("t=%d,", constants.Argon2Iterations)) {
+			t.Errorf("Expected the hash to use the new iterations, got %s", hash)
+		}
+		expectOutdated(0)(t, body)
+	}
+
+	tests := []struct {
+		name  string
+		steps []TestStep
+	}{
+		{
+			name: "argon2id upgrade",
+			steps: []TestStep{
+				{
+					name: "Sign up",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users",
+						body: map[string]string{
+							"userName": "hashUser",
+							"password": password,
+							"email":    email,
+						},
+					},
+					expectStatus: http.StatusCreated,
+					validate: func(t *testing.T, body []byte) {
+						expectOutdated(0)(t, body)
+						constants.Argon2Iterations = oldIterations + 1
+					},
+				},
+				wrongPassword,
+				failedUpgrade,
+				upgrade,
+				login("Login with the upgraded hash", password, http.StatusOK),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		jar, _ := cookiejar.New(nil)
+		client := &http.Client{Jar: jar}
+
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			for _, step := range test.steps {
+				t.Run(fmt.Sprintf("%s-%s-%d-%s", step.request.method, step.request.path, step.expectStatus, step.name), func(t *testing.T) {
+					body := MakeRequestAndExpectStatus(t, client, step.request.method, server.URL+step.request.path, step.request.body, step.expectStatus)
+
+					if step.validate != nil {
+						step.validate(t, body)
+					}
+				})
+			}
+		})
+	}
+}
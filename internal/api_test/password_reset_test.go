@@ -0,0 +1,285 @@
+package api_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RichardHoa/hack-me/internal/app"
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/routes"
+	"github.com/RichardHoa/hack-me/internal/store"
+)
+
+func TestPasswordResetRoute(t *testing.T) {
+	application, err := app.NewApplication(true)
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	defer application.ConnectionPool.Close()
+	defer CleanDB(application.DB)
+
+	router := routes.SetUpRoutes(application)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	mailer, ok := application.UserHandler.Mailer.(*store.MemoryMailer)
+	if !ok {
+		t.Fatalf("expected the memory mailer in tests")
+	}
+
+	const (
+		email       = "resetUser@test.com"
+		oldPassword = "ResetUserOldPasswordThatIsLongEnough"
+		newPassword = "ResetUserNewPasswordThatIsLongEnough"
+	)
+
+	// filled with the tokens of the emails as they are sent
+	resetBody := map[string]string{"newPassword": newPassword}
+	oldResetBody := map[string]string{"newPassword": newPassword}
+
+	// wait for an email with a new token
+	readToken := func(t *testing.T, body []byte) {
+		var token string
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			mail, ok := mailer.LastMailTo(email)
+			if ok && strings.Contains(mail.Body, "reset-password?token=") {
+				_, token, _ = strings.Cut(mail.Body, "token=")
+				token, _, _ = strings.Cut(token, "\n")
+				if token != resetBody["token"] {
+					break
+				}
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected a password reset email")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if previous, ok := resetBody["token"]; ok {
+			oldResetBody["token"] = previous
+		}
+		resetBody["token"] = token
+	}
+
+	login := func(password string, status int) TestStep {
+		return TestStep{
+			name: "Login",
+			request: TestRequest{
+				method: "POST",
+				path:   "/v1/users/login",
+				body: map[string]string{
+					"email":    email,
+					"password": password,
+				},
+			},
+			expectStatus: status,
+		}
+	}
+
+	forgot := TestStep{
+		name: "Ask for a reset link",
+		request: TestRequest{
+			method: "POST",
+			path:   "/v1/users/password/forgot",
+			body:   map[string]string{"email": email},
+		},
+		expectStatus: http.StatusOK,
+		validate:     readToken,
+	}
+
+	// a second request within the cooldown sends nothing, the link on its way stays the one to use
+	forgotAgain := TestStep{
+		name: "Ask again in another case",
+		request: TestRequest{
+			method: "POST",
+			path:   "/v1/users/password/forgot",
+			body:   map[string]string{"email": strings.ToUpper(email)},
+		},
+		expectStatus: http.StatusOK,
+		validate: func(t *testing.T, body []byte) {
+			mail, ok := mailer.LastMailTo(email)
+			if !ok || !strings.Contains(mail.Body, "token="+resetBody["token"]+"\n") {
+				t.Errorf("Expected no new email within the cooldown, got %+v", mail)
+			}
+
+			_, err := application.DB.Exec(`UPDATE password_reset_token SET created_at = $1`, time.Now().Add(-constants.PasswordResetEmailCooldown))
+			if err != nil {
+				t.Fatalf("Failed to move the cooldown along: %v", err)
+			}
+		},
+	}
+
+	ipLimit := TestStep{
+		name: "Too many requests from one IP",
+		request: TestRequest{
+			method: "POST",
+			path:   "/v1/users/password/forgot",
+			body:   map[string]string{"email": "nobody@test.com"},
+		},
+		expectStatus: http.StatusOK,
+		validate: func(t *testing.T, body []byte) {
+			for range constants.PasswordForgotIPLimit {
+				response, err := http.Post(server.URL+"/v1/users/password/forgot", "application/json", strings.NewReader(`{"email":"nobody@test.com"}`))
+				if err != nil {
+					t.Fatalf("Failed to send the request: %v", err)
+				}
+				response.Body.Close()
+
+				if response.StatusCode == http.StatusTooManyRequests {
+					if response.Header.Get("Retry-After") == "" {
+						t.Errorf("Expected a Retry-After header")
+					}
+					return
+				}
+			}
+			t.Errorf("Expected the IP to be limited after %d requests", constants.PasswordForgotIPLimit)
+		},
+	}
+
+	tests := []struct {
+		name   string
+		device string
+		steps  []TestStep
+	}{
+		{
+			name:   "old session",
+			device: "laptop",
+			steps: []TestStep{
+				{
+					name: "Sign up",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users",
+						body: map[string]string{
+							"userName": "resetUser",
+							"password": oldPassword,
+							"email":    email,
+						},
+					},
+					expectStatus: http.StatusCreated,
+				},
+				login(oldPassword, http.StatusOK),
+			},
+		},
+		{
+			name:   "forgot password",
+			device: "phone",
+			steps: []TestStep{
+				{
+					name: "Unknown email looks the same",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/password/forgot",
+						body:   map[string]string{"email": "nobody@test.com"},
+					},
+					expectStatus: http.StatusOK,
+					validate: func(t *testing.T, body []byte) {
+						if _, ok := mailer.LastMailTo("nobody@test.com"); ok {
+							t.Errorf("Expected no email for an unknown account")
+						}
+					},
+				},
+				{
+					name: "Empty email",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/password/forgot",
+						body:   map[string]string{"email": ""},
+					},
+					expectStatus: http.StatusBadRequest,
+				},
+				forgot,
+				forgotAgain,
+				forgot,
+				{
+					name: "Weak new password",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/password/reset",
+						body:   map[string]string{"token": "whatever", "newPassword": "short"},
+					},
+					expectStatus: http.StatusBadRequest,
+				},
+				{
+					name: "Garbage token",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/password/reset",
+						body:   map[string]string{"token": "garbage", "newPassword": newPassword},
+					},
+					expectStatus: http.StatusBadRequest,
+				},
+				{
+					name: "Reset password with the earlier link",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/password/reset",
+						body:   oldResetBody,
+					},
+					expectStatus: http.StatusOK,
+				},
+				{
+					name: "Token is single use",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/password/reset",
+						body:   oldResetBody,
+					},
+					expectStatus: http.StatusBadRequest,
+				},
+				{
+					name: "The newer link is used up too",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/password/reset",
+						body:   resetBody,
+					},
+					expectStatus: http.StatusBadRequest,
+				},
+				login(oldPassword, http.StatusBadRequest),
+				login(newPassword, http.StatusOK),
+				ipLimit,
+			},
+		},
+		{
+			name:   "old session is revoked",
+			device: "laptop",
+			steps: []TestStep{
+				{
+					name:         "Refresh with the old session",
+					request:      TestRequest{method: "GET", path: "/v1/auth/tokens"},
+					expectStatus: http.StatusForbidden,
+				},
+			},
+		},
+	}
+
+	clients := map[string]*http.Client{}
+
+	for _, test := range tests {
+		client, ok := clients[test.device]
+		if !ok {
+			jar, _ := cookiejar.New(nil)
+			client = &http.Client{Jar: jar}
+			clients[test.device] = client
+		}
+
+		t.Run(test.name, func(t *testing.T) {
+			for _, step := range test.steps {
+				t.Run(fmt.Sprintf("%s-%s-%d-%s", step.request.method, step.request.path, step.expectStatus, step.name), func(t *testing.T) {
+					body := MakeJSONRequestAndExpectStatus(t, client, step.request.method, server.URL+step.request.path, step.request.payload(), step.expectStatus)
+
+					if step.validate != nil {
+						step.validate(t, body)
+					}
+				})
+			}
+		})
+	}
+}
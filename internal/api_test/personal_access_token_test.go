@@ -0,0 +1,280 @@
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/RichardHoa/hack-me/internal/app"
+	"github.com/RichardHoa/hack-me/internal/routes"
+)
+
+func TestPersonalAccessTokenRoute(t *testing.T) {
+	application, err := app.NewApplication(true)
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	defer application.ConnectionPool.Close()
+	defer CleanDB(application.DB)
+
+	router := routes.SetUpRoutes(application)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	const (
+		email    = "patUser@test.com"
+		password = "PatUserPasswordThatIsLongEnough"
+	)
+
+	jar, _ := cookiejar.New(nil)
+	cookieClient := &http.Client{Jar: jar}
+
+	var personalAccessToken, tokenID string
+	tokenClient := &http.Client{Transport: bearerTransport{accessToken: &personalAccessToken}}
+
+	challenge := map[string]string{
+		"name":     "Published by CI",
+		"content":  "This challenge was published by a bot with a personal access token",
+		"category": "web hacking",
+	}
+
+	tests := []struct {
+		name   string
+		client *http.Client
+		steps  []TestStep
+	}{
+		{
+			name:   "create tokens",
+			client: cookieClient,
+			steps: []TestStep{
+				{
+					name: "Sign up",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users",
+						body: map[string]string{
+							"userName": "patUser",
+							"password": password,
+							"email":    email,
+						},
+					},
+					expectStatus: http.StatusCreated,
+				},
+				{
+					name: "Login",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/login",
+						body: map[string]string{
+							"email":    email,
+							"password": password,
+						},
+					},
+					expectStatus: http.StatusOK,
+				},
+				{
+					name: "Unknown scope",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/me/tokens",
+						jsonBody: map[string]any{
+							"name":          "ci",
+							"scopes":        []string{"admin"},
+							"expiresInDays": 30,
+						},
+					},
+					expectStatus: http.StatusBadRequest,
+				},
+				{
+					name: "No scope",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/me/tokens",
+						jsonBody: map[string]any{
+							"name":          "ci",
+							"scopes":        []string{},
+							"expiresInDays": 30,
+						},
+					},
+					expectStatus: http.StatusBadRequest,
+				},
+				{
+					name: "Expiry out of range",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/me/tokens",
+						jsonBody: map[string]any{
+							"name":          "ci",
+							"scopes":        []string{"challenges:write"},
+							"expiresInDays": 0,
+						},
+					},
+					expectStatus: http.StatusBadRequest,
+				},
+				{
+					name: "Token to publish challenges",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/me/tokens",
+						jsonBody: map[string]any{
+							"name":          "ci",
+							"scopes":        []string{"challenges:write"},
+							"expiresInDays": 30,
+						},
+					},
+					expectStatus: http.StatusCreated,
+					validate: func(t *testing.T, body []byte) {
+						var response struct {
+							Data struct {
+								Token               string `json:"token"`
+								PersonalAccessToken struct {
+									ID     string   `json:"id"`
+									Scopes []string `json:"scopes"`
+								} `json:"personalAccessToken"`
+							} `json:"data"`
+						}
+						if err := json.Unmarshal(body, &response); err != nil {
+							t.Fatalf("Failed to parse the token: %v", err)
+						}
+						if !strings.HasPrefix(response.Data.Token, "hmpat_") {
+							t.Fatalf("Expected a personal access token, got %q", response.Data.Token)
+						}
+						personalAccessToken = response.Data.Token
+						tokenID = response.Data.PersonalAccessToken.ID
+					},
+				},
+				{
+					name:         "List tokens",
+					request:      TestRequest{method: "GET", path: "/v1/users/me/tokens"},
+					expectStatus: http.StatusOK,
+					validate: func(t *testing.T, body []byte) {
+						if strings.Contains(string(body), personalAccessToken) {
+							t.Fatalf("The token must only be shown when it is created")
+						}
+						if !strings.Contains(string(body), `"lastUsedAt":null`) {
+							t.Errorf("Expected the token to be unused, got %s", body)
+						}
+					},
+				},
+			},
+		},
+		{
+			name:   "use token",
+			client: tokenClient,
+			steps: []TestStep{
+				{
+					name: "Publish challenge without CSRF token",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/challenges",
+						body:   challenge,
+					},
+					expectStatus: http.StatusCreated,
+				},
+				{
+					name:         "Read needs the read scope",
+					request:      TestRequest{method: "GET", path: "/v1/users/me"},
+					expectStatus: http.StatusForbidden,
+				},
+				{
+					name: "Post response needs the responses:write scope",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/challenges/responses",
+						body: map[string]string{
+							"name":        "Writeup",
+							"content":     "The writeup of the bot",
+							"challengeID": "7c9e6679-7425-40de-944b-e07fc1f90ae7",
+						},
+					},
+					expectStatus: http.StatusForbidden,
+				},
+				{
+					name:         "Routes without a scope refuse tokens",
+					request:      TestRequest{method: "GET", path: "/v1/auth/sessions"},
+					expectStatus: http.StatusUnauthorized,
+				},
+				{
+					name: "Tokens cannot create tokens",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/me/tokens",
+						jsonBody: map[string]any{
+							"name":          "escalation",
+							"scopes":        []string{"read"},
+							"expiresInDays": 30,
+						},
+					},
+					expectStatus: http.StatusForbidden,
+				},
+			},
+		},
+		{
+			name:   "revoke token",
+			client: cookieClient,
+			steps: []TestStep{
+				{
+					name:         "Use is recorded",
+					request:      TestRequest{method: "GET", path: "/v1/users/me/tokens"},
+					expectStatus: http.StatusOK,
+					validate: func(t *testing.T, body []byte) {
+						if strings.Contains(string(body), `"lastUsedAt":null`) {
+							t.Errorf("Expected the last use to be recorded, got %s", body)
+						}
+					},
+				},
+				{
+					name:         "Malformed token ID",
+					request:      TestRequest{method: "DELETE", path: "/v1/users/me/tokens/not-a-uuid"},
+					expectStatus: http.StatusBadRequest,
+				},
+				{
+					name:         "Revoke",
+					request:      TestRequest{method: "DELETE", path: "/v1/users/me/tokens/{tokenID}"},
+					expectStatus: http.StatusOK,
+				},
+				{
+					name:         "Revoke twice",
+					request:      TestRequest{method: "DELETE", path: "/v1/users/me/tokens/{tokenID}"},
+					expectStatus: http.StatusNotFound,
+				},
+			},
+		},
+		{
+			name:   "revoked token",
+			client: tokenClient,
+			steps: []TestStep{
+				{
+					name: "Publish challenge",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/challenges",
+						body:   challenge,
+					},
+					expectStatus: http.StatusUnauthorized,
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			for _, step := range test.steps {
+				t.Run(fmt.Sprintf("%s-%s-%d-%s", step.request.method, step.request.path, step.expectStatus, step.name), func(t *testing.T) {
+					path := strings.ReplaceAll(step.request.path, "{tokenID}", tokenID)
+					body := MakeJSONRequestAndExpectStatus(t, test.client, step.request.method, server.URL+path, step.request.payload(), step.expectStatus)
+
+					if step.validate != nil {
+						step.validate(t, body)
+					}
+				})
+			}
+		})
+	}
+}
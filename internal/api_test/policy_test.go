@@ -0,0 +1,128 @@
+package api_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/policy"
+)
+
+func TestPolicy(t *testing.T) {
+	const (
+		ownerID = "owner"
+		otherID = "other"
+	)
+
+	joinedAt := time.Now().Add(-constants.MinReportAccountAge - time.Hour)
+
+	anonymous := policy.Subject{}
+	owner := policy.Subject{UserID: ownerID, Role: constants.RoleUser, EmailVerified: true, JoinedAt: joinedAt}
+	unverified := policy.Subject{UserID: ownerID, Role: constants.RoleUser, JoinedAt: joinedAt}
+	other := policy.Subject{UserID: otherID, Role: constants.RoleUser, EmailVerified: true, JoinedAt: joinedAt}
+	grandfathered := policy.Subject{UserID: otherID, Role: constants.RoleUser, EmailGrandfathered: true, JoinedAt: joinedAt}
+	unverifiedOther := policy.Subject{UserID: otherID, Role: constants.RoleUser, JoinedAt: joinedAt}
+	newcomer := policy.Subject{UserID: otherID, Role: constants.RoleUser, EmailVerified: true, JoinedAt: time.Now()}
+	moderator := policy.Subject{UserID: otherID, Role: constants.RoleModerator, EmailVerified: true, JoinedAt: joinedAt}
+	admin := policy.Subject{UserID: otherID, Role: constants.RoleAdmin, EmailVerified: true, JoinedAt: joinedAt}
+
+	challenge := policy.Resource{Type: policy.ResourceChallenge, OwnerID: ownerID}
+	hiddenChallenge := policy.Resource{Type: policy.ResourceChallenge, OwnerID: ownerID, Hidden: true}
+	response := policy.Resource{Type: policy.ResourceChallengeResponse, OwnerID: ownerID}
+	hiddenResponse := policy.Resource{Type: policy.ResourceChallengeResponse, OwnerID: ownerID, Hidden: true}
+	comment := policy.Resource{Type: policy.ResourceComment, OwnerID: ownerID}
+
+	tests := []struct {
+		name                 string
+		requireVerifiedEmail bool
+		subject              policy.Subject
+		action               policy.Action
+		resource             policy.Resource
+		expectAllowed        bool
+		expectModerated      bool
+	}{
+		{name: "anonymous cannot create", subject: anonymous, action: policy.ActionCreate, resource: policy.Resource{Type: policy.ResourceChallenge}},
+		{name: "anonymous cannot read the moderation log", subject: anonymous, action: policy.ActionRead, resource: policy.Resource{Type: policy.ResourceModerationLog}},
+
+		{name: "unverified user creates when verification is off", subject: unverified, action: policy.ActionCreate, resource: policy.Resource{Type: policy.ResourceComment}, expectAllowed: true},
+		{name: "unverified user cannot create when verification is on", requireVerifiedEmail: true, subject: unverified, action: policy.ActionCreate, resource: policy.Resource{Type: policy.ResourceChallengeResponse}},
+		{name: "grandfathered user creates when verification is on", requireVerifiedEmail: true, subject: grandfathered, action: policy.ActionCreate, resource: policy.Resource{Type: policy.ResourceComment}, expectAllowed: true},
+		{name: "verified user creates when verification is on", requireVerifiedEmail: true, subject: owner, action: policy.ActionCreate, resource: policy.Resource{Type: policy.ResourceChallenge}, expectAllowed: true},
+
+		{name: "owner edits challenge", subject: owner, action: policy.ActionEdit, resource: challenge, expectAllowed: true},
+		{name: "owner deletes response", subject: owner, action: policy.ActionDelete, resource: response, expectAllowed: true},
+		{name: "owner deletes hidden challenge", subject: owner, action: policy.ActionDelete, resource: hiddenChallenge, expectAllowed: true},
+		{name: "other user cannot edit comment", subject: other, action: policy.ActionEdit, resource: comment},
+		{name: "other user cannot delete challenge", subject: other, action: policy.ActionDelete, resource: challenge},
+		{name: "moderator edits someone else's comment", subject: moderator, action: policy.ActionEdit, resource: comment, expectAllowed: true, expectModerated: true},
+		{name: "admin deletes someone else's response", subject: admin, action: policy.ActionDelete, resource: response, expectAllowed: true, expectModerated: true},
+		{name: "moderator edits own content unmoderated", subject: policy.Subject{UserID: ownerID, Role: constants.RoleModerator}, action: policy.ActionEdit, resource: challenge, expectAllowed: true},
+
+		{name: "user cannot hide", subject: owner, action: policy.ActionHide, resource: challenge},
+		{name: "moderator hides", subject: moderator, action: policy.ActionHide, resource: response, expectAllowed: true, expectModerated: true},
+
+		{name: "user votes on response", subject: other, action: policy.ActionVote, resource: response, expectAllowed: true},
+		{name: "owner votes on own response", subject: owner, action: policy.ActionVote, resource: response, expectAllowed: true},
+		{name: "cannot vote on hidden response", subject: other, action: policy.ActionVote, resource: hiddenResponse},
+		{name: "cannot vote on challenge", subject: other, action: policy.ActionVote, resource: challenge},
+
+		{name: "user reports comment", subject: other, action: policy.ActionReport, resource: comment, expectAllowed: true},
+		{name: "owner cannot report own challenge", subject: owner, action: policy.ActionReport, resource: challenge},
+		{name: "cannot report hidden response", subject: other, action: policy.ActionReport, resource: hiddenResponse},
+		{name: "unverified user cannot report", subject: unverifiedOther, action: policy.ActionReport, resource: comment},
+		{name: "grandfathered user cannot report", subject: grandfathered, action: policy.ActionReport, resource: comment},
+		{name: "new account cannot report", subject: newcomer, action: policy.ActionReport, resource: comment},
+		{name: "account of unknown age cannot report", subject: policy.Subject{UserID: otherID, EmailVerified: true}, action: policy.ActionReport, resource: comment},
+
+		{name: "user solves challenge", subject: other, action: policy.ActionSolve, resource: challenge, expectAllowed: true},
+		{name: "author cannot solve own challenge", subject: owner, action: policy.ActionSolve, resource: challenge},
+		{name: "cannot solve hidden challenge", subject: other, action: policy.ActionSolve, resource: hiddenChallenge},
+		{name: "cannot solve comment", subject: other, action: policy.ActionSolve, resource: comment},
+
+		{name: "user cannot read moderation log", subject: other, action: policy.ActionRead, resource: policy.Resource{Type: policy.ResourceModerationLog}},
+		{name: "moderator reads moderation log", subject: moderator, action: policy.ActionRead, resource: policy.Resource{Type: policy.ResourceModerationLog}, expectAllowed: true},
+		{name: "admin reads moderation log", subject: admin, action: policy.ActionRead, resource: policy.Resource{Type: policy.ResourceModerationLog}, expectAllowed: true},
+
+		{name: "user cannot read the report queue", subject: other, action: policy.ActionRead, resource: policy.Resource{Type: policy.ResourceReportQueue}},
+		{name: "moderator resolves reports", subject: moderator, action: policy.ActionManage, resource: policy.Resource{Type: policy.ResourceReportQueue}, expectAllowed: true},
+
+		{name: "moderator cannot read password hash report", subject: moderator, action: policy.ActionRead, resource: policy.Resource{Type: policy.ResourcePasswordHashReport}},
+		{name: "admin reads password hash report", subject: admin, action: policy.ActionRead, resource: policy.Resource{Type: policy.ResourcePasswordHashReport}, expectAllowed: true},
+
+		{name: "moderator cannot read security log", subject: moderator, action: policy.ActionRead, resource: policy.Resource{Type: policy.ResourceSecurityLog}},
+		{name: "admin reads security log", subject: admin, action: policy.ActionRead, resource: policy.Resource{Type: policy.ResourceSecurityLog}, expectAllowed: true},
+
+		{name: "moderator cannot change roles", subject: moderator, action: policy.ActionManage, resource: policy.Resource{Type: policy.ResourceUserRole, OwnerID: ownerID}},
+		{name: "admin changes another user's role", subject: admin, action: policy.ActionManage, resource: policy.Resource{Type: policy.ResourceUserRole, OwnerID: ownerID}, expectAllowed: true},
+		{name: "admin cannot change own role", subject: admin, action: policy.ActionManage, resource: policy.Resource{Type: policy.ResourceUserRole, OwnerID: otherID}},
+		{name: "admin route check without target", subject: admin, action: policy.ActionManage, resource: policy.Resource{Type: policy.ResourceUserRole}, expectAllowed: true},
+
+		{name: "unknown action is denied", subject: admin, action: policy.Action("publish"), resource: challenge},
+		{name: "unknown resource is denied", subject: admin, action: policy.ActionRead, resource: policy.Resource{Type: policy.ResourceType("invoice")}},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			engine := policy.NewEngine(test.requireVerifiedEmail)
+
+			decision := engine.Authorize(test.subject, test.action, test.resource)
+
+			if decision.Allowed != test.expectAllowed {
+				t.Fatalf("expected allowed %v, got %v (reason: %q)", test.expectAllowed, decision.Allowed, decision.Reason)
+			}
+
+			if decision.Moderated != test.expectModerated {
+				t.Fatalf("expected moderated %v, got %v", test.expectModerated, decision.Moderated)
+			}
+
+			if !decision.Allowed && decision.Reason == "" {
+				t.Fatalf("expected a reason for the denial")
+			}
+
+			if (decision.Err() == nil) != decision.Allowed {
+				t.Fatalf("expected Err to match the decision, got %v", decision.Err())
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/RichardHoa/hack-me/internal/app"
+	"github.com/RichardHoa/hack-me/internal/routes"
+	"github.com/RichardHoa/hack-me/internal/store"
+)
+
+func TestPublicProfileRoute(t *testing.T) {
+	application, err := app.NewApplication(true)
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	defer application.ConnectionPool.Close()
+	defer CleanDB(application.DB)
+
+	router := routes.SetUpRoutes(application)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	const ownerEmail = "profileOwner@test.com"
+
+	createChallenge := func(name string) TestStep {
+		return TestStep{
+			name: "Create " + name,
+			request: TestRequest{
+				method: "POST",
+				path:   "/v1/challenges",
+				body: map[string]string{
+					"name":     name,
+					"content":  "A challenge shown on the profile",
+					"category": "web hacking",
+				},
+			},
+			expectStatus: http.StatusCreated,
+		}
+	}
+
+	hideSecondChallenge := createChallenge("Hidden profile challenge")
+	hideSecondChallenge.validate = func(t *testing.T, body []byte) {
+		_, err := application.DB.Exec(`UPDATE challenge SET hidden_at = now() WHERE name = 'Hidden profile challenge'`)
+		if err != nil {
+			t.Fatalf("Failed to hide the challenge: %v", err)
+		}
+	}
+
+	expectProfile := func(t *testing.T, body []byte) {
+		for _, private := range []string{ownerEmail, "email", "google", "github", "role", "totp"} {
+			if strings.Contains(strings.ToLower(string(body)), strings.ToLower(private)) {
+				t.Errorf("Expected %q to stay out of the public profile, got %s", private, body)
+			}
+		}
+
+		var response struct {
+			Data store.PublicProfile `json:"data"`
+		}
+		err := json.Unmarshal(body, &response)
+		if err != nil {
+			t.Fatalf("Failed to decode the profile: %v", err)
+		}
+
+		profile := response.Data
+		if profile.Username != "profileOwner" || profile.JoinedAt.IsZero() {
+			t.Errorf("Expected the name and join date, got %+v", profile)
+		}
+		if profile.Stats.ChallengeCount != "1" || len(profile.Challenges) != 1 || profile.Challenges[0].Name != "Public profile challenge" {
+			t.Errorf("Expected only the visible challenge, got %+v %+v", profile.Stats, profile.Challenges)
+		}
+		if profile.Stats.ResponseCount != "1" || len(profile.ChallengeResponses) != 1 {
+			t.Errorf("Expected the writeup, got %+v %+v", profile.Stats, profile.ChallengeResponses)
+		}
+		if profile.Stats.SolveCount != "0" || profile.Stats.Score != "0" {
+			t.Errorf("Expected no solves yet, got %+v", profile.Stats)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		steps []TestStep
+	}{
+		{
+			name: "profile owner",
+			steps: []TestStep{
+				{
+					name: "Sign up",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users",
+						body: map[string]string{
+							"userName": "profileOwner",
+							"password": "ProfileOwnerPasswordThatIsLongEnough",
+							"email":    ownerEmail,
+						},
+					},
+					expectStatus: http.StatusCreated,
+				},
+				{
+					name: "Login",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/login",
+						body: map[string]string{
+							"email":    ownerEmail,
+							"password": "ProfileOwnerPasswordThatIsLongEnough",
+						},
+					},
+					expectStatus: http.StatusOK,
+				},
+				createChallenge("Public profile challenge"),
+				hideSecondChallenge,
+				{
+					name: "Write a response",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/challenges/responses",
+						body: map[string]string{
+							"challengeID": "1",
+							"name":        "Profile writeup",
+							"content":     "content",
+						},
+					},
+					expectStatus: http.StatusCreated,
+				},
+				{
+					name:         "Own activity still served",
+					request:      TestRequest{method: "GET", path: "/v1/users/me"},
+					expectStatus: http.StatusOK,
+				},
+			},
+		},
+		{
+			name: "anonymous visitor",
+			steps: []TestStep{
+				{
+					name:         "Read the profile",
+					request:      TestRequest{method: "GET", path: "/v1/users/profileOwner"},
+					expectStatus: http.StatusOK,
+					validate:     expectProfile,
+				},
+				{
+					name:         "Unknown user",
+					request:      TestRequest{method: "GET", path: "/v1/users/nobodyHere"},
+					expectStatus: http.StatusNotFound,
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		jar, _ := cookiejar.New(nil)
+		client := &http.Client{Jar: jar}
+
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			for _, step := range test.steps {
+				t.Run(fmt.Sprintf("%s-%s-%d-%s", step.request.method, step.request.path, step.expectStatus, step.name), func(t *testing.T) {
+					body := MakeRequestAndExpectStatus(t, client, step.request.method, server.URL+step.request.path, step.request.body, step.expectStatus)
+
+					if step.validate != nil {
+						step.validate(t, body)
+					}
+				})
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/RichardHoa/hack-me/internal/app"
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/routes"
+)
+
+func TestRateLimitRoute(t *testing.T) {
+	application, err := app.NewApplication(true)
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	defer application.ConnectionPool.Close()
+	defer CleanDB(application.DB)
+
+	router := routes.SetUpRoutes(application)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	tests := []struct {
+		name  string
+		path  string
+		body  string
+		limit int
+	}{
+		{
+			name:  "Resending the verification email",
+			path:  "/v1/users/verify-email/resend",
+			body:  `{}`,
+			limit: constants.VerificationResendIPLimit,
+		},
+		{
+			name:  "Guessing password reset tokens",
+			path:  "/v1/users/password/reset",
+			body:  `{"token":"not-a-real-token","newPassword":"GuessedPasswordThatIsLongEnough"}`,
+			limit: constants.PasswordResetIPLimit,
+		},
+		{
+			name:  "Guessing unlock tokens",
+			path:  "/v1/users/unlock",
+			body:  `{"token":"not-a-real-token"}`,
+			limit: constants.UnlockIPLimit,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// the requests are refused by the handlers, they still count towards the limit
+			for range test.limit {
+				response, err := http.Post(server.URL+test.path, "application/json", strings.NewReader(test.body))
+				if err != nil {
+					t.Fatalf("Failed to send the request: %v", err)
+				}
+				response.Body.Close()
+
+				if response.StatusCode == http.StatusTooManyRequests {
+					t.Fatalf("Expected the IP to be limited only after %d requests", test.limit)
+				}
+			}
+
+			body := MakeJSONRequestAndExpectStatus(t, http.DefaultClient, "POST", server.URL+test.path, nil, http.StatusTooManyRequests)
+			if !strings.Contains(string(body), constants.MSG_TOO_MANY_REQUESTS) {
+				t.Errorf("Expected %s, got %s", constants.MSG_TOO_MANY_REQUESTS, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,411 @@
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RichardHoa/hack-me/internal/app"
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/routes"
+	"github.com/RichardHoa/hack-me/internal/store"
+)
+
+func TestReportRoute(t *testing.T) {
+	application, err := app.NewApplication(true)
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	defer application.ConnectionPool.Close()
+	defer CleanDB(application.DB)
+
+	router := routes.SetUpRoutes(application)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	mailer, ok := application.UserHandler.Mailer.(*store.MemoryMailer)
+	if !ok {
+		t.Fatalf("expected the memory mailer in tests")
+	}
+
+	const (
+		password   = "ReportPasswordThatIsLongEnough"
+		ownerEmail = "reportedOwner@test.com"
+	)
+	reporterEmails := []string{"reporterOne@test.com", "reporterTwo@test.com", "reporterThree@test.com"}
+
+	login := func(email string) TestStep {
+		return TestStep{
+			name: "Login",
+			request: TestRequest{
+				method: "POST",
+				path:   "/v1/users/login",
+				body: map[string]string{
+					"email":    email,
+					"password": password,
+				},
+			},
+			expectStatus: http.StatusOK,
+		}
+	}
+
+	// established accounts have a verified email and are old enough to report content
+	signUpAndLogin := func(userName, email, role string, established bool) []TestStep {
+		return []TestStep{
+			{
+				name: "Sign up",
+				request: TestRequest{
+					method: "POST",
+					path:   "/v1/users",
+					body: map[string]string{
+						"userName": userName,
+						"password": password,
+						"email":    email,
+					},
+				},
+				expectStatus: http.StatusCreated,
+				validate: func(t *testing.T, body []byte) {
+					_, err := application.DB.Exec(`UPDATE "user" SET role = $1 WHERE email = $2`, role, email)
+					if err != nil {
+						t.Fatalf("Failed to set the role: %v", err)
+					}
+					if !established {
+						return
+					}
+					_, err = application.DB.Exec(
+						`UPDATE "user" SET email_verified_at = now(), created_at = $1 WHERE email = $2`,
+						time.Now().Add(-constants.MinReportAccountAge-time.Hour), email,
+					)
+					if err != nil {
+						t.Fatalf("Failed to age the account: %v", err)
+					}
+				},
+			},
+			login(email),
+		}
+	}
+
+	expectVisible := func(table string, id string) func(t *testing.T, body []byte) {
+		return func(t *testing.T, body []byte) {
+			var hidden bool
+			// nosemgrep
+			err := application.DB.QueryRow(fmt.Sprintf(`SELECT hidden_at IS NOT NULL FROM %s WHERE id = $1`, table), id).Scan(&hidden)
+			if err != nil {
+				t.Fatalf("Failed to read the %s: %v", table, err)
+			}
+			if hidden {
+				t.Errorf("Expected %s %s to stay visible", table, id)
+			}
+		}
+	}
+
+	report := func(name, targetType, targetID, reason string, status int) TestStep {
+		return TestStep{
+			name: name,
+			request: TestRequest{
+				method: "POST",
+				path:   "/v1/reports",
+				body: map[string]string{
+					"targetType": targetType,
+					"targetID":   targetID,
+					"reason":     reason,
+					"details":    "Posted the flag of another challenge",
+				},
+			},
+			expectStatus: status,
+		}
+	}
+
+	resolve := func(name, reportID, status string, expectStatus int) TestStep {
+		return TestStep{
+			name: name,
+			request: TestRequest{
+				method: "PUT",
+				path:   "/v1/reports/" + reportID,
+				body:   map[string]string{"status": status},
+			},
+			expectStatus: expectStatus,
+		}
+	}
+
+	expectReports := func(expected int, check func(t *testing.T, reports []store.Report)) func(t *testing.T, body []byte) {
+		return func(t *testing.T, body []byte) {
+			var response struct {
+				Data []store.Report `json:"data"`
+			}
+			err := json.Unmarshal(body, &response)
+			if err != nil {
+				t.Fatalf("Failed to decode the reports: %v", err)
+			}
+			if len(response.Data) != expected {
+				t.Fatalf("Expected %d reports, got %+v", expected, response.Data)
+			}
+			if check != nil {
+				check(t, response.Data)
+			}
+		}
+	}
+
+	thirdReport := report("Third report hides the challenge", "challenge", "1", "spam", http.StatusCreated)
+	thirdReport.validate = func(t *testing.T, body []byte) {
+		var hidden bool
+		err := application.DB.QueryRow(`SELECT hidden_at IS NOT NULL FROM challenge WHERE id = 1`).Scan(&hidden)
+		if err != nil {
+			t.Fatalf("Failed to read the challenge: %v", err)
+		}
+		if !hidden {
+			t.Errorf("Expected the challenge to be hidden after three reports")
+		}
+
+		mail, ok := mailer.LastMailTo(ownerEmail)
+		if !ok || !strings.Contains(mail.Subject, "hid") {
+			t.Errorf("Expected the owner to be told the challenge was hidden, got %+v", mail)
+		}
+	}
+
+	dismiss := resolve("Dismiss the challenge reports", "1", "dismissed", http.StatusOK)
+	dismiss.validate = func(t *testing.T, body []byte) {
+		for _, email := range reporterEmails {
+			mail, ok := mailer.LastMailTo(email)
+			if !ok || !strings.Contains(mail.Subject, "reviewed") || !strings.Contains(mail.Body, "does not break the rules") {
+				t.Errorf("Expected %s to be told the report was dismissed, got %+v", email, mail)
+			}
+		}
+
+		expectVisible("challenge", "1")(t, body)
+
+		mail, ok := mailer.LastMailTo(ownerEmail)
+		if !ok || !strings.Contains(mail.Subject, "restored") {
+			t.Errorf("Expected the owner to be told the challenge was restored, got %+v", mail)
+		}
+
+		var actions int
+		err := application.DB.QueryRow(`SELECT COUNT(*) FROM moderation_action WHERE target_type = 'challenge' AND target_id = 1 AND action = 'unhide'`).Scan(&actions)
+		if err != nil {
+			t.Fatalf("Failed to read the moderation log: %v", err)
+		}
+		if actions != 1 {
+			t.Errorf("Expected the dismissal to be logged once, got %d", actions)
+		}
+	}
+
+	const moderatorEmail = "reportModerator@test.com"
+
+	reportModeratorChallenge := report("Report the challenge of a moderator", "challenge", "2", "spam", http.StatusCreated)
+	thirdModeratorReport := reportModeratorChallenge
+	thirdModeratorReport.validate = expectVisible("challenge", "2")
+
+	// only reports made after the dismissal count, three of them hide the challenge again
+	reportAgain := report("Report the cleared challenge", "challenge", "1", "spam", http.StatusCreated)
+	lastReportAgain := reportAgain
+	lastReportAgain.validate = func(t *testing.T, body []byte) {
+		var hidden bool
+		err := application.DB.QueryRow(`SELECT hidden_at IS NOT NULL FROM challenge WHERE id = 1`).Scan(&hidden)
+		if err != nil {
+			t.Fatalf("Failed to read the challenge: %v", err)
+		}
+		if !hidden {
+			t.Errorf("Expected three new reports to hide the challenge again")
+		}
+	}
+
+	tests := []struct {
+		name  string
+		steps []TestStep
+	}{
+		{
+			name: "content owner",
+			steps: append(signUpAndLogin("reportedOwner", ownerEmail, "user", true),
+				TestStep{
+					name: "Post challenge",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/challenges",
+						body: map[string]string{
+							"name":     "Reported challenge",
+							"content":  "A challenge with the flag of another one",
+							"category": "web hacking",
+						},
+					},
+					expectStatus: http.StatusCreated,
+				},
+				TestStep{
+					name: "Post comment",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/comments",
+						body: map[string]string{
+							"challengeID": "1",
+							"content":     "The flag is in the page source",
+						},
+					},
+					expectStatus: http.StatusCreated,
+				},
+				report("Report own challenge", "challenge", "1", "spam", http.StatusForbidden),
+			),
+		},
+		{
+			name: "moderator posts",
+			steps: append(signUpAndLogin("reportModerator", moderatorEmail, "moderator", true),
+				TestStep{
+					name: "Post challenge",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/challenges",
+						body: map[string]string{
+							"name":     "Moderator challenge",
+							"content":  "A challenge posted by a moderator",
+							"category": "web hacking",
+						},
+					},
+					expectStatus: http.StatusCreated,
+				},
+			),
+		},
+		{
+			name: "new account",
+			steps: append(signUpAndLogin("reporterNew", "reporterNew@test.com", "user", false),
+				report("New accounts cannot report", "challenge", "1", "spam", http.StatusForbidden),
+			),
+		},
+		{
+			name: "first reporter",
+			steps: append(signUpAndLogin("reporterOne", reporterEmails[0], "user", true),
+				report("Unknown reason", "challenge", "1", "boring", http.StatusBadRequest),
+				report("Unknown target type", "scoreboard", "1", "spam", http.StatusBadRequest),
+				report("Missing challenge", "challenge", "999", "spam", http.StatusNotFound),
+				report("Report challenge", "challenge", "1", "spoiler", http.StatusCreated),
+				report("Report challenge twice", "challenge", "1", "spam", http.StatusBadRequest),
+				report("Report comment", "comment", "1", "spoiler", http.StatusCreated),
+				reportModeratorChallenge,
+				TestStep{
+					name:         "Read the report queue",
+					request:      TestRequest{method: "GET", path: "/v1/reports"},
+					expectStatus: http.StatusForbidden,
+				},
+				resolve("Resolve a report", "1", "dismissed", http.StatusForbidden),
+			),
+		},
+		{
+			name: "second reporter",
+			steps: append(signUpAndLogin("reporterTwo", reporterEmails[1], "user", true),
+				report("Report challenge", "challenge", "1", "spam", http.StatusCreated),
+				reportModeratorChallenge,
+			),
+		},
+		{
+			name: "third reporter",
+			steps: append(signUpAndLogin("reporterThree", reporterEmails[2], "user", true),
+				thirdReport,
+				report("Report comment", "comment", "1", "harassment", http.StatusCreated),
+				thirdModeratorReport,
+			),
+		},
+		{
+			name: "moderator",
+			steps: []TestStep{
+				login(moderatorEmail),
+				report("Report hidden challenge", "challenge", "1", "spam", http.StatusForbidden),
+				{
+					name:         "Unknown status",
+					request:      TestRequest{method: "GET", path: "/v1/reports?status=closed"},
+					expectStatus: http.StatusBadRequest,
+				},
+				{
+					name:         "List open reports",
+					request:      TestRequest{method: "GET", path: "/v1/reports?status=open"},
+					expectStatus: http.StatusOK,
+					validate: expectReports(8, func(t *testing.T, reports []store.Report) {
+						first := reports[0]
+						if first.TargetType != "challenge" || first.Reason != "spoiler" || first.ReporterName != "reporterOne" {
+							t.Errorf("Expected the oldest report first, got %+v", first)
+						}
+						if !first.TargetHidden || first.OpenReports != 3 {
+							t.Errorf("Expected a hidden challenge with 3 open reports, got %+v", first)
+						}
+					}),
+				},
+				resolve("Reopen a report", "1", "open", http.StatusBadRequest),
+				resolve("Resolve missing report", "999", "dismissed", http.StatusNotFound),
+				dismiss,
+				resolve("Dismiss the challenge reports again", "5", "dismissed", http.StatusBadRequest),
+				// the duplicate report of the first reporter used up ID 2
+				resolve("Act on the comment reports", "3", "actioned", http.StatusOK),
+				{
+					name:         "List dismissed reports",
+					request:      TestRequest{method: "GET", path: "/v1/reports?status=dismissed"},
+					expectStatus: http.StatusOK,
+					validate: expectReports(3, func(t *testing.T, reports []store.Report) {
+						for _, report := range reports {
+							if report.ResolvedByName == nil || *report.ResolvedByName != "reportModerator" || report.ResolvedAt == nil {
+								t.Errorf("Expected the moderator to be recorded, got %+v", report)
+							}
+						}
+					}),
+				},
+				{
+					name:         "Only the reports on the moderator challenge are left",
+					request:      TestRequest{method: "GET", path: "/v1/reports?status=open"},
+					expectStatus: http.StatusOK,
+					validate: expectReports(3, func(t *testing.T, reports []store.Report) {
+						for _, report := range reports {
+							if report.TargetTitle != "Moderator challenge" || report.TargetHidden {
+								t.Errorf("Expected the visible moderator challenge, got %+v", report)
+							}
+						}
+					}),
+				},
+				{
+					name: "Restore the dismissed challenge",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/moderation/actions",
+						body: map[string]string{
+							"targetType": "challenge",
+							"targetID":   "1",
+							"action":     "unhide",
+							"reason":     "The reports were dismissed",
+						},
+					},
+					expectStatus: http.StatusBadRequest,
+				},
+			},
+		},
+		{
+			name:  "fourth reporter",
+			steps: append(signUpAndLogin("reporterFour", "reporterFour@test.com", "user", true), reportAgain),
+		},
+		{
+			name:  "fifth reporter",
+			steps: append(signUpAndLogin("reporterFive", "reporterFive@test.com", "user", true), reportAgain),
+		},
+		{
+			name:  "sixth reporter",
+			steps: append(signUpAndLogin("reporterSix", "reporterSix@test.com", "user", true), lastReportAgain),
+		},
+	}
+
+	for _, test := range tests {
+		jar, _ := cookiejar.New(nil)
+		client := &http.Client{Jar: jar}
+
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			for _, step := range test.steps {
+				t.Run(fmt.Sprintf("%s-%s-%d-%s", step.request.method, step.request.path, step.expectStatus, step.name), func(t *testing.T) {
+					body := MakeRequestAndExpectStatus(t, client, step.request.method, server.URL+step.request.path, step.request.body, step.expectStatus)
+
+					if step.validate != nil {
+						step.validate(t, body)
+					}
+				})
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package api_test
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/RichardHoa/hack-me/internal/app"
+	"github.com/RichardHoa/hack-me/internal/store"
+	"github.com/google/uuid"
+)
+
+// TestRowLevelSecurity skips the stores and runs raw queries, like an injected query would
+func TestRowLevelSecurity(t *testing.T) {
+	application, err := app.NewApplication(true)
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	defer application.ConnectionPool.Close()
+	defer CleanDB(application.DB)
+
+	db := application.DB
+	rowSecurity := application.RowSecurity
+
+	ownerID := insertRowSecurityUser(t, db, "rlsOwner", "user")
+	otherID := insertRowSecurityUser(t, db, "rlsOther", "user")
+	moderatorID := insertRowSecurityUser(t, db, "rlsModerator", "moderator")
+
+	var challengeID, responseID, commentID int
+	runAsUser(t, rowSecurity, ownerID, func(tx *sql.Tx) {
+		err := tx.QueryRow(`
+			INSERT INTO challenge (name, content, user_id, category)
+			VALUES ('row security challenge', 'content', $1, 'web hacking')
+			RETURNING id
+		`, ownerID).Scan(&challengeID)
+		if err != nil {
+			t.Fatalf("owner could not create a challenge: %v", err)
+		}
+
+		err = tx.QueryRow(`
+			INSERT INTO challenge_response (challenge_id, user_id, name, content)
+			VALUES ($1, $2, 'response', 'content')
+			RETURNING id
+		`, challengeID, ownerID).Scan(&responseID)
+		if err != nil {
+			t.Fatalf("owner could not create a response: %v", err)
+		}
+
+		err = tx.QueryRow(`
+			INSERT INTO comment (challenge_id, user_id, content)
+			VALUES ($1, $2, 'comment')
+			RETURNING id
+		`, challengeID, ownerID).Scan(&commentID)
+		if err != nil {
+			t.Fatalf("owner could not create a comment: %v", err)
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO challenge_response_votes (user_id, challenge_response_id, vote_type)
+			VALUES ($1, $2, 1)
+		`, ownerID, responseID)
+		if err != nil {
+			t.Fatalf("owner could not vote: %v", err)
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO challenge_flag (challenge_id, match_mode, flag_hash)
+			VALUES ($1, 'exact', 'not a real hash')
+		`, challengeID)
+		if err != nil {
+			t.Fatalf("owner could not add a flag: %v", err)
+		}
+	})
+
+	changes := []struct {
+		name  string
+		query string
+		arg   any
+	}{
+		{"update challenge", `UPDATE challenge SET content = 'defaced' WHERE id = $1`, challengeID},
+		{"delete challenge", `DELETE FROM challenge WHERE id = $1`, challengeID},
+		{"update response", `UPDATE challenge_response SET content = 'defaced' WHERE id = $1`, responseID},
+		{"delete response", `DELETE FROM challenge_response WHERE id = $1`, responseID},
+		{"update comment", `UPDATE comment SET content = 'defaced' WHERE id = $1`, commentID},
+		{"delete comment", `DELETE FROM comment WHERE id = $1`, commentID},
+		{"update vote", `UPDATE challenge_response_votes SET vote_type = -1 WHERE challenge_response_id = $1`, responseID},
+		{"delete vote", `DELETE FROM challenge_response_votes WHERE challenge_response_id = $1`, responseID},
+		{"delete flags", `DELETE FROM challenge_flag WHERE challenge_id = $1`, challengeID},
+	}
+
+	for _, change := range changes {
+		t.Run("other user cannot "+change.name, func(t *testing.T) {
+			runAsUser(t, rowSecurity, otherID, func(tx *sql.Tx) {
+				result, err := tx.Exec(change.query, change.arg)
+				if err != nil {
+					t.Fatalf("query failed: %v", err)
+				}
+				rows, _ := result.RowsAffected()
+				if rows != 0 {
+					t.Fatalf("expected no rows to change, %d did", rows)
+				}
+			})
+		})
+	}
+
+	t.Run("other user cannot post in the name of the owner", func(t *testing.T) {
+		rejectAsUser(t, rowSecurity, otherID, `
+			INSERT INTO comment (challenge_id, user_id, content)
+			VALUES ($1, $2, 'impersonated')
+		`, challengeID, ownerID)
+	})
+
+	t.Run("other user cannot switch to the owner with set_config", func(t *testing.T) {
+		runAsUser(t, rowSecurity, otherID, func(tx *sql.Tx) {
+			_, err := tx.Exec(`SELECT set_config('app.user_id', $1, true), set_config('app.row_security_grant', 'guessed grant', true)`, ownerID)
+			if err != nil {
+				t.Fatalf("query failed: %v", err)
+			}
+			result, err := tx.Exec(`UPDATE comment SET content = 'defaced' WHERE id = $1`, commentID)
+			if err != nil {
+				t.Fatalf("query failed: %v", err)
+			}
+			rows, _ := result.RowsAffected()
+			if rows != 0 {
+				t.Fatalf("expected no rows to change, %d did", rows)
+			}
+		})
+	})
+
+	t.Run("user cannot change a role", func(t *testing.T) {
+		rejectAsUser(t, rowSecurity, otherID, `UPDATE "user" SET role = 'admin' WHERE id = $1`, otherID)
+	})
+
+	t.Run("RESET ROLE does not lead back to the owner", func(t *testing.T) {
+		rejectAsUser(t, rowSecurity, otherID, `RESET ROLE; UPDATE "user" SET role = 'admin' WHERE id = '`+otherID+`'`)
+	})
+
+	t.Run("user cannot read the grants", func(t *testing.T) {
+		rejectAsUser(t, rowSecurity, otherID, `SELECT user_id FROM row_security_grant`)
+	})
+
+	t.Run("user cannot read password hashes", func(t *testing.T) {
+		rejectAsUser(t, rowSecurity, otherID, `SELECT password FROM "user"`)
+	})
+
+	t.Run("other user votes on the response of the owner", func(t *testing.T) {
+		runAsUser(t, rowSecurity, otherID, func(tx *sql.Tx) {
+			_, err := tx.Exec(`
+				INSERT INTO challenge_response_votes (user_id, challenge_response_id, vote_type)
+				VALUES ($1, $2, 1)
+			`, otherID, responseID)
+			if err != nil {
+				t.Fatalf("vote failed: %v", err)
+			}
+
+			var upVotes int
+			err = tx.QueryRow(`SELECT up_vote FROM challenge_response WHERE id = $1`, responseID).Scan(&upVotes)
+			if err != nil {
+				t.Fatalf("read votes: %v", err)
+			}
+			if upVotes != 2 {
+				t.Fatalf("expected the trigger to count 2 up votes, got %d", upVotes)
+			}
+		})
+	})
+
+	t.Run("moderator hides the comment of the owner", func(t *testing.T) {
+		runAsUser(t, rowSecurity, moderatorID, func(tx *sql.Tx) {
+			result, err := tx.Exec(`UPDATE comment SET hidden_at = now() WHERE id = $1`, commentID)
+			if err != nil {
+				t.Fatalf("query failed: %v", err)
+			}
+			rows, _ := result.RowsAffected()
+			if rows != 1 {
+				t.Fatalf("expected the comment to be hidden, %d rows changed", rows)
+			}
+		})
+	})
+
+	t.Run("owner cannot show what a moderator hid", func(t *testing.T) {
+		rejectAsUser(t, rowSecurity, ownerID, `UPDATE comment SET hidden_at = NULL WHERE id = $1`, commentID)
+	})
+
+	t.Run("moderator cannot remove the vote of the owner", func(t *testing.T) {
+		runAsUser(t, rowSecurity, moderatorID, func(tx *sql.Tx) {
+			result, err := tx.Exec(`DELETE FROM challenge_response_votes WHERE user_id = $1`, ownerID)
+			if err != nil {
+				t.Fatalf("query failed: %v", err)
+			}
+			rows, _ := result.RowsAffected()
+			if rows != 0 {
+				t.Fatalf("expected no votes to be removed, %d were", rows)
+			}
+		})
+	})
+}
+
+func insertRowSecurityUser(t *testing.T, db *sql.DB, userName string, role string) string {
+	t.Helper()
+
+	userID := uuid.NewString()
+	_, err := db.Exec(`
+		INSERT INTO "user" (id, username, email, password, role)
+		VALUES ($1, $2, $3, 'not a real hash', $4)
+	`, userID, userName, userName+"@test.com", role)
+	if err != nil {
+		t.Fatalf("failed to insert user %s: %v", userName, err)
+	}
+
+	return userID
+}
+
+// runAsUser commits the changes of fn only when the test did not fail inside it
+func runAsUser(t *testing.T, rowSecurity *store.RowSecurityDB, userID string, fn func(tx *sql.Tx)) {
+	t.Helper()
+
+	tx, err := rowSecurity.BeginAsUser(userID)
+	if err != nil {
+		t.Fatalf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	fn(tx)
+
+	if t.Failed() {
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+}
+
+// rejectAsUser expects Postgres to refuse the query, the transaction is then rolled back
+func rejectAsUser(t *testing.T, rowSecurity *store.RowSecurityDB, userID string, query string, args ...any) {
+	t.Helper()
+
+	tx, err := rowSecurity.BeginAsUser(userID)
+	if err != nil {
+		t.Fatalf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(query, args...)
+	if err == nil {
+		t.Fatalf("expected the query to be refused")
+	}
+}
@@ -0,0 +1,288 @@
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/RichardHoa/hack-me/internal/app"
+	"github.com/RichardHoa/hack-me/internal/routes"
+)
+
+type scoreboardResponse struct {
+	Metadata struct {
+		MaxPage     string `json:"maxPage"`
+		CurrentPage string `json:"currentPage"`
+	} `json:"metadata"`
+	Data []struct {
+		Rank            string `json:"rank"`
+		UserName        string `json:"userName"`
+		Score           string `json:"score"`
+		SolveCount      string `json:"solveCount"`
+		FirstBloodCount string `json:"firstBloodCount"`
+	} `json:"data"`
+}
+
+func TestScoreboardRoute(t *testing.T) {
+	application, err := app.NewApplication(true)
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	defer application.ConnectionPool.Close()
+	defer CleanDB(application.DB)
+
+	router := routes.SetUpRoutes(application)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	solverSteps := func(userName, email, password string, challengeIDs ...string) []TestStep {
+		steps := []TestStep{
+			{
+				name: "Sign up " + userName,
+				request: TestRequest{
+					method: "POST",
+					path:   "/v1/users",
+					body: map[string]string{
+						"userName": userName,
+						"password": password,
+						"email":    email,
+					},
+				},
+				expectStatus: http.StatusCreated,
+			},
+			{
+				name: "Login " + userName,
+				request: TestRequest{
+					method: "POST",
+					path:   "/v1/users/login",
+					body: map[string]string{
+						"email":    email,
+						"password": password,
+					},
+				},
+				expectStatus: http.StatusOK,
+			},
+		}
+
+		for _, challengeID := range challengeIDs {
+			steps = append(steps, TestStep{
+				name: "Solve challenge " + challengeID,
+				request: TestRequest{
+					method: "POST",
+					path:   "/v1/challenges/" + challengeID + "/submissions",
+					body: map[string]string{
+						"flag": "flag{score_" + challengeID + "}",
+					},
+				},
+				expectStatus: http.StatusCreated,
+			})
+		}
+
+		return steps
+	}
+
+	tests := []struct {
+		name  string
+		steps []TestStep
+	}{
+		{
+			name: "challenge author",
+			steps: append(solverSteps("scoreAuthor", "scoreAuthor@test.com", "ScoreAuthorPasswordThatIsLongEnough"),
+				TestStep{
+					name: "Empty scoreboard",
+					request: TestRequest{
+						method: "GET",
+						path:   "/v1/scoreboard",
+					},
+					expectStatus: http.StatusOK,
+					validate: func(t *testing.T, body []byte) {
+						var resp scoreboardResponse
+						if err := json.Unmarshal(body, &resp); err != nil {
+							t.Fatalf("Failed to parse response: %v", err)
+						}
+						if len(resp.Data) != 0 {
+							t.Errorf("Expected empty scoreboard, got %d entries", len(resp.Data))
+						}
+						if resp.Metadata.MaxPage != "0" {
+							t.Errorf("Expected maxPage '0', got '%s'", resp.Metadata.MaxPage)
+						}
+					},
+				},
+				TestStep{
+					name: "Minimum points above initial points",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/challenges",
+						jsonBody: map[string]any{
+							"name":          "Score challenge invalid",
+							"content":       "Invalid scoring",
+							"category":      "web hacking",
+							"initialPoints": 100,
+							"minimumPoints": 200,
+						},
+					},
+					expectStatus: http.StatusBadRequest,
+				},
+				TestStep{
+					name: "Zero decay",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/challenges",
+						jsonBody: map[string]any{
+							"name":     "Score challenge invalid",
+							"content":  "Invalid scoring",
+							"category": "web hacking",
+							"decay":    0,
+						},
+					},
+					expectStatus: http.StatusBadRequest,
+				},
+				TestStep{
+					name: "Fast decaying web challenge",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/challenges",
+						jsonBody: map[string]any{
+							"name":          "Score challenge 1",
+							"content":       "Loses value quickly",
+							"category":      "web hacking",
+							"initialPoints": 300,
+							"minimumPoints": 100,
+							"decay":         2,
+							"flags":         []map[string]string{{"flag": "flag{score_1}"}},
+						},
+					},
+					expectStatus: http.StatusCreated,
+				},
+				TestStep{
+					name: "Crypto challenge with default scoring",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/challenges",
+						jsonBody: map[string]any{
+							"name":     "Score challenge 2",
+							"content":  "Default scoring",
+							"category": "crypto challenge",
+							"flags":    []map[string]string{{"flag": "flag{score_2}"}},
+						},
+					},
+					expectStatus: http.StatusCreated,
+				},
+			),
+		},
+		{
+			name:  "first solver",
+			steps: solverSteps("scoreFirst", "scoreFirst@test.com", "ScoreFirstPasswordThatIsLongEnough", "1", "2"),
+		},
+		{
+			name: "second solver",
+			steps: append(solverSteps("scoreSecond", "scoreSecond@test.com", "ScoreSecondPasswordThatIsLongEnough", "1"),
+				TestStep{
+					name: "Full scoreboard",
+					request: TestRequest{
+						method: "GET",
+						path:   "/v1/scoreboard",
+					},
+					expectStatus: http.StatusOK,
+					validate: func(t *testing.T, body []byte) {
+						var resp scoreboardResponse
+						if err := json.Unmarshal(body, &resp); err != nil {
+							t.Fatalf("Failed to parse response: %v", err)
+						}
+						if len(resp.Data) != 2 {
+							t.Fatalf("Expected 2 entries, got %d", len(resp.Data))
+						}
+
+						// challenge 1 is worth 250 after two solves, challenge 2 is worth 500, first blood adds 50
+						first, second := resp.Data[0], resp.Data[1]
+						if first.UserName != "scoreFirst" || first.Rank != "1" || first.Score != "850" {
+							t.Errorf("Expected scoreFirst ranked 1 with 850, got %s ranked %s with %s", first.UserName, first.Rank, first.Score)
+						}
+						if first.FirstBloodCount != "2" || first.SolveCount != "2" {
+							t.Errorf("Expected 2 solves and 2 first bloods, got %s and %s", first.SolveCount, first.FirstBloodCount)
+						}
+						if second.UserName != "scoreSecond" || second.Rank != "2" || second.Score != "250" {
+							t.Errorf("Expected scoreSecond ranked 2 with 250, got %s ranked %s with %s", second.UserName, second.Rank, second.Score)
+						}
+					},
+				},
+				TestStep{
+					name: "Scoreboard filtered by category",
+					request: TestRequest{
+						method: "GET",
+						path:   "/v1/scoreboard?category=crypto%20challenge",
+					},
+					expectStatus: http.StatusOK,
+					validate: func(t *testing.T, body []byte) {
+						var resp scoreboardResponse
+						if err := json.Unmarshal(body, &resp); err != nil {
+							t.Fatalf("Failed to parse response: %v", err)
+						}
+						if len(resp.Data) != 1 {
+							t.Fatalf("Expected 1 entry, got %d", len(resp.Data))
+						}
+						if resp.Data[0].UserName != "scoreFirst" || resp.Data[0].Score != "550" {
+							t.Errorf("Expected scoreFirst with 550, got %s with %s", resp.Data[0].UserName, resp.Data[0].Score)
+						}
+					},
+				},
+				TestStep{
+					name: "Second page",
+					request: TestRequest{
+						method: "GET",
+						path:   "/v1/scoreboard?pageSize=1&page=2",
+					},
+					expectStatus: http.StatusOK,
+					validate: func(t *testing.T, body []byte) {
+						var resp scoreboardResponse
+						if err := json.Unmarshal(body, &resp); err != nil {
+							t.Fatalf("Failed to parse response: %v", err)
+						}
+						if resp.Metadata.MaxPage != "2" {
+							t.Errorf("Expected maxPage '2', got '%s'", resp.Metadata.MaxPage)
+						}
+						if len(resp.Data) != 1 || resp.Data[0].UserName != "scoreSecond" {
+							t.Errorf("Expected scoreSecond on the second page, got %+v", resp.Data)
+						}
+					},
+				},
+				TestStep{
+					name: "Invalid category",
+					request: TestRequest{
+						method: "GET",
+						path:   "/v1/scoreboard?category=not%20a%20category",
+					},
+					expectStatus: http.StatusOK,
+				},
+				TestStep{
+					name: "Invalid page",
+					request: TestRequest{
+						method: "GET",
+						path:   "/v1/scoreboard?page=abc",
+					},
+					expectStatus: http.StatusBadRequest,
+				},
+			),
+		},
+	}
+
+	for _, test := range tests {
+		jar, _ := cookiejar.New(nil)
+		client := &http.Client{Jar: jar}
+
+		t.Run(test.name, func(t *testing.T) {
+			for _, step := range test.steps {
+				t.Run(fmt.Sprintf("%s-%s-%d-%s", step.request.method, step.request.path, step.expectStatus, step.name), func(t *testing.T) {
+					body := MakeJSONRequestAndExpectStatus(t, client, step.request.method, server.URL+step.request.path, step.request.payload(), step.expectStatus)
+
+					if step.validate != nil {
+						step.validate(t, body)
+					}
+				})
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+
+	"github.com/RichardHoa/hack-me/internal/app"
+	"github.com/RichardHoa/hack-me/internal/routes"
+	"github.com/RichardHoa/hack-me/internal/store"
+)
+
+func TestSecurityEvents(t *testing.T) {
+	application, err := app.NewApplication(true)
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	defer application.ConnectionPool.Close()
+	defer CleanDB(application.DB)
+
+	router := routes.SetUpRoutes(application)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	const (
+		email    = "securityEventUser@test.com"
+		password = "SecurityEventPasswordThatIsLongEnough"
+	)
+
+	var userID string
+
+	eventTypes := func(t *testing.T, body []byte) []string {
+		var response struct {
+			Data []store.SecurityEvent `json:"data"`
+		}
+		err := json.Unmarshal(body, &response)
+		if err != nil {
+			t.Fatalf("Failed to decode the security events: %v", err)
+		}
+
+		types := []string{}
+		for _, event := range response.Data {
+			if event.UserID == nil || *event.UserID != userID {
+				t.Errorf("Expected every event to belong to %s, got %+v", userID, event)
+			}
+			types = append(types, event.EventType)
+		}
+		return types
+	}
+
+	login := func(name string, password string, status int) TestStep {
+		return TestStep{
+			name: name,
+			request: TestRequest{
+				method: "POST",
+				path:   "/v1/users/login",
+				body: map[string]string{
+					"email":    email,
+					"password": password,
+				},
+			},
+			expectStatus: status,
+		}
+	}
+
+	steps := []TestStep{
+		{
+			name: "Sign up",
+			request: TestRequest{
+				method: "POST",
+				path:   "/v1/users",
+				body: map[string]string{
+					"userName": "securityEventUser",
+					"password": password,
+					"email":    email,
+				},
+			},
+			expectStatus: http.StatusCreated,
+			validate: func(t *testing.T, body []byte) {
+				err := application.DB.QueryRow(`SELECT id FROM "user" WHERE email = $1`, email).Scan(&userID)
+				if err != nil {
+					t.Fatalf("Failed to read the user id: %v", err)
+				}
+			},
+		},
+		login("Wrong password", "NotTheRightPasswordAtAll", http.StatusBadRequest),
+		login("Login", password, http.StatusOK),
+		{
+			name: "Change username",
+			request: TestRequest{
+				method: "PUT",
+				path:   "/v1/users/username",
+				body: map[string]string{
+					"newUsername": "securityEventRenamed",
+				},
+			},
+			expectStatus: http.StatusOK,
+		},
+		{
+			name:         "User reads their own events",
+			request:      TestRequest{method: "GET", path: "/v1/users/me/security-events"},
+			expectStatus: http.StatusOK,
+			validate: func(t *testing.T, body []byte) {
+				types := eventTypes(t, body)
+				expected := []string{store.SecurityEventUsernameChanged, store.SecurityEventLogin, store.SecurityEventLoginFailed}
+				if !slices.Equal(types, expected) {
+					t.Errorf("Expected events %v newest first, got %v", expected, types)
+				}
+			},
+		},
+		{
+			name:         "User cannot read the security log",
+			request:      TestRequest{method: "GET", path: "/v1/admin/security-events"},
+			expectStatus: http.StatusForbidden,
+			validate: func(t *testing.T, body []byte) {
+				// the first admins are set in the database, like in production
+				_, err := application.DB.Exec(`UPDATE "user" SET role = 'admin' WHERE email = $1`, email)
+				if err != nil {
+					t.Fatalf("Failed to set the role: %v", err)
+				}
+			},
+		},
+		{
+			name:         "Admin filters by event type",
+			request:      TestRequest{method: "GET", path: "/v1/admin/security-events?eventType=login_failed"},
+			expectStatus: http.StatusOK,
+			validate: func(t *testing.T, body []byte) {
+				types := eventTypes(t, body)
+				if !slices.Equal(types, []string{store.SecurityEventLoginFailed}) {
+					t.Errorf("Expected only the failed login, got %v", types)
+				}
+			},
+		},
+		{
+			name:         "Admin filters by time",
+			request:      TestRequest{method: "GET", path: "/v1/admin/security-events?to=" + url.QueryEscape("2000-01-01T00:00:00Z")},
+			expectStatus: http.StatusOK,
+			validate: func(t *testing.T, body []byte) {
+				if types := eventTypes(t, body); len(types) != 0 {
+					t.Errorf("Expected no events before 2000, got %v", types)
+				}
+			},
+		},
+		{
+			name:         "Unknown event type",
+			request:      TestRequest{method: "GET", path: "/v1/admin/security-events?eventType=coffee_break"},
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name:         "Invalid user id",
+			request:      TestRequest{method: "GET", path: "/v1/admin/security-events?userID=me"},
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name:         "Invalid time",
+			request:      TestRequest{method: "GET", path: "/v1/admin/security-events?from=yesterday"},
+			expectStatus: http.StatusBadRequest,
+			validate: func(t *testing.T, body []byte) {
+				_, err := application.DB.Exec(`UPDATE security_event SET event_type = 'login' WHERE user_id = $1`, userID)
+				if err == nil {
+					t.Errorf("Expected the security log to refuse updates")
+				}
+				_, err = application.DB.Exec(`DELETE FROM security_event WHERE user_id = $1`, userID)
+				if err == nil {
+					t.Errorf("Expected the security log to refuse deletes")
+				}
+			},
+		},
+	}
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+
+	for _, step := range steps {
+		t.Run(fmt.Sprintf("%s-%s-%d-%s", step.request.method, step.request.path, step.expectStatus, step.name), func(t *testing.T) {
+			body := MakeRequestAndExpectStatus(t, client, step.request.method, server.URL+step.request.path, step.request.body, step.expectStatus)
+
+			if step.validate != nil {
+				step.validate(t, body)
+			}
+		})
+	}
+}
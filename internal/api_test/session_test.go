@@ -0,0 +1,437 @@
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/RichardHoa/hack-me/internal/app"
+	"github.com/RichardHoa/hack-me/internal/routes"
+	"github.com/RichardHoa/hack-me/internal/store"
+)
+
+type sessionsResponse struct {
+	Data []struct {
+		ID        string `json:"id"`
+		UserAgent string `json:"userAgent"`
+		IsCurrent bool   `json:"isCurrent"`
+	} `json:"data"`
+}
+
+func TestSessionRoute(t *testing.T) {
+	application, err := app.NewApplication(true)
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	defer application.ConnectionPool.Close()
+	defer CleanDB(application.DB)
+
+	router := routes.SetUpRoutes(application)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	// ID of the laptop session, filled in by the phone once it lists the sessions
+	otherSessionID := ""
+
+	login := TestStep{
+		name: "Login",
+		request: TestRequest{
+			method: "POST",
+			path:   "/v1/users/login",
+			body: map[string]string{
+				"email":    "sessionUser@test.com",
+				"password": "SessionUserPasswordThatIsLongEnough",
+			},
+		},
+		expectStatus: http.StatusOK,
+	}
+
+	expectSessions := func(count int) func(t *testing.T, body []byte) {
+		return func(t *testing.T, body []byte) {
+			var resp sessionsResponse
+			if err := json.Unmarshal(body, &resp); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			if len(resp.Data) != count {
+				t.Fatalf("Expected %d sessions, got %d", count, len(resp.Data))
+			}
+
+			currentCount := 0
+			for _, session := range resp.Data {
+				if session.IsCurrent {
+					currentCount++
+				} else {
+					otherSessionID = session.ID
+				}
+			}
+			if currentCount != 1 {
+				t.Errorf("Expected exactly one current session, got %d", currentCount)
+			}
+		}
+	}
+
+	tests := []struct {
+		name   string
+		device string
+		steps  []TestStep
+	}{
+		{
+			name:   "laptop logs in",
+			device: "laptop",
+			steps: []TestStep{
+				{
+					name: "Sign up",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users",
+						body: map[string]string{
+							"userName": "sessionUser",
+							"password": "SessionUserPasswordThatIsLongEnough",
+							"email":    "sessionUser@test.com",
+						},
+					},
+					expectStatus: http.StatusCreated,
+				},
+				login,
+				{
+					name:         "One session",
+					request:      TestRequest{method: "GET", path: "/v1/auth/sessions"},
+					expectStatus: http.StatusOK,
+					validate:     expectSessions(1),
+				},
+			},
+		},
+		{
+			name:   "phone logs in without ending the laptop session",
+			device: "phone",
+			steps: []TestStep{
+				login,
+				{
+					name:         "Two sessions",
+					request:      TestRequest{method: "GET", path: "/v1/auth/sessions"},
+					expectStatus: http.StatusOK,
+					validate:     expectSessions(2),
+				},
+				{
+					name:         "Rotate phone token",
+					request:      TestRequest{method: "GET", path: "/v1/auth/tokens"},
+					expectStatus: http.StatusOK,
+				},
+				{
+					name:         "Rotation keeps both sessions",
+					request:      TestRequest{method: "GET", path: "/v1/auth/sessions"},
+					expectStatus: http.StatusOK,
+					validate:     expectSessions(2),
+				},
+			},
+		},
+		{
+			name:   "laptop session still works",
+			device: "laptop",
+			steps: []TestStep{
+				{
+					name:         "Rotate laptop token",
+					request:      TestRequest{method: "GET", path: "/v1/auth/tokens"},
+					expectStatus: http.StatusOK,
+				},
+			},
+		},
+		{
+			name:   "phone revokes the laptop",
+			device: "phone",
+			steps: []TestStep{
+				{
+					name:         "Invalid session id",
+					request:      TestRequest{method: "DELETE", path: "/v1/auth/sessions/not-a-uuid"},
+					expectStatus: http.StatusBadRequest,
+				},
+				{
+					name:         "Unknown session id",
+					request:      TestRequest{method: "DELETE", path: "/v1/auth/sessions/7c9e6679-7425-40de-944b-e07fc1f90ae7"},
+					expectStatus: http.StatusNotFound,
+				},
+				{
+					name:         "Revoke laptop session",
+					request:      TestRequest{method: "DELETE", path: "/v1/auth/sessions/{otherSessionID}"},
+					expectStatus: http.StatusOK,
+				},
+				{
+					name:         "Only the phone session is left",
+					request:      TestRequest{method: "GET", path: "/v1/auth/sessions"},
+					expectStatus: http.StatusOK,
+					validate:     expectSessions(1),
+				},
+			},
+		},
+		{
+			name:   "revoked laptop",
+			device: "laptop",
+			steps: []TestStep{
+				{
+					name:         "Revoked token cannot be rotated",
+					request:      TestRequest{method: "GET", path: "/v1/auth/tokens"},
+					expectStatus: http.StatusForbidden,
+				},
+				login,
+			},
+		},
+		{
+			name:   "phone logs out everywhere",
+			device: "phone",
+			steps: []TestStep{
+				{
+					name:         "Log out everywhere",
+					request:      TestRequest{method: "DELETE", path: "/v1/auth/sessions"},
+					expectStatus: http.StatusOK,
+				},
+				{
+					name:         "Phone cookies are cleared",
+					request:      TestRequest{method: "GET", path: "/v1/auth/tokens"},
+					expectStatus: http.StatusUnauthorized,
+				},
+			},
+		},
+		{
+			name:   "laptop is logged out",
+			device: "laptop",
+			steps: []TestStep{
+				{
+					name:         "Laptop token is revoked",
+					request:      TestRequest{method: "GET", path: "/v1/auth/tokens"},
+					expectStatus: http.StatusForbidden,
+				},
+			},
+		},
+	}
+
+	clients := map[string]*http.Client{}
+
+	for _, test := range tests {
+		client, ok := clients[test.device]
+		if !ok {
+			jar, _ := cookiejar.New(nil)
+			client = &http.Client{Jar: jar}
+			clients[test.device] = client
+		}
+
+		t.Run(test.name, func(t *testing.T) {
+			for _, step := range test.steps {
+				t.Run(fmt.Sprintf("%s-%s-%d-%s", step.request.method, step.request.path, step.expectStatus, step.name), func(t *testing.T) {
+					path := strings.ReplaceAll(step.request.path, "{otherSessionID}", otherSessionID)
+					body := MakeJSONRequestAndExpectStatus(t, client, step.request.method, server.URL+path, step.request.payload(), step.expectStatus)
+
+					if step.validate != nil {
+						step.validate(t, body)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestRefreshTokenReuseRoute(t *testing.T) {
+	application, err := app.NewApplication(true)
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	defer application.ConnectionPool.Close()
+	defer CleanDB(application.DB)
+
+	router := routes.SetUpRoutes(application)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	clients := map[string]*http.Client{}
+	for _, device := range []string{"victim", "attacker"} {
+		jar, _ := cookiejar.New(nil)
+		clients[device] = &http.Client{Jar: jar}
+	}
+
+	serverURL, _ := url.Parse(server.URL + "/")
+
+	mailer, ok := application.UserHandler.Mailer.(*store.MemoryMailer)
+	if !ok {
+		t.Fatalf("expected the memory mailer in tests")
+	}
+
+	tests := []struct {
+		name   string
+		device string
+		steps  []TestStep
+	}{
+		{
+			name:   "victim logs in",
+			device: "victim",
+			steps: []TestStep{
+				{
+					name: "Sign up",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users",
+						body: map[string]string{
+							"userName": "reuseVictim",
+							"password": "ReuseVictimPasswordThatIsLongEnough",
+							"email":    "reuseVictim@test.com",
+						},
+					},
+					expectStatus: http.StatusCreated,
+				},
+				{
+					name: "Login",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/login",
+						body: map[string]string{
+							"email":    "reuseVictim@test.com",
+							"password": "ReuseVictimPasswordThatIsLongEnough",
+						},
+					},
+					expectStatus: http.StatusOK,
+				},
+				{
+					name:         "Refresh token is stolen",
+					request:      TestRequest{method: "GET", path: "/v1/auth/sessions"},
+					expectStatus: http.StatusOK,
+					validate: func(t *testing.T, body []byte) {
+						clients["attacker"].Jar.SetCookies(serverURL, clients["victim"].Jar.Cookies(serverURL))
+					},
+				},
+				{
+					name:         "Victim rotates the token",
+					request:      TestRequest{method: "GET", path: "/v1/auth/tokens"},
+					expectStatus: http.StatusOK,
+				},
+			},
+		},
+		{
+			name:   "attacker replays the rotated token",
+			device: "attacker",
+			steps: []TestStep{
+				{
+					name:         "Reuse is detected",
+					request:      TestRequest{method: "GET", path: "/v1/auth/tokens"},
+					expectStatus: http.StatusUnauthorized,
+					validate: func(t *testing.T, body []byte) {
+						mail, ok := mailer.LastMailTo("reuseVictim@test.com")
+						if !ok || mail.Subject != "A Hack-Me session was signed out" {
+							t.Fatalf("Expected the victim to be warned by email, got %+v", mail)
+						}
+					},
+				},
+				{
+					name:         "Cookies are cleared",
+					request:      TestRequest{method: "GET", path: "/v1/auth/tokens"},
+					expectStatus: http.StatusUnauthorized,
+				},
+			},
+		},
+		{
+			name:   "victim must log in again",
+			device: "victim",
+			steps: []TestStep{
+				{
+					name:         "Token family is revoked",
+					request:      TestRequest{method: "GET", path: "/v1/auth/tokens"},
+					expectStatus: http.StatusForbidden,
+				},
+				{
+					name: "Login again",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/login",
+						body: map[string]string{
+							"email":    "reuseVictim@test.com",
+							"password": "ReuseVictimPasswordThatIsLongEnough",
+						},
+					},
+					expectStatus: http.StatusOK,
+				},
+				{
+					name:         "Only the new session exists",
+					request:      TestRequest{method: "GET", path: "/v1/auth/sessions"},
+					expectStatus: http.StatusOK,
+					validate: func(t *testing.T, body []byte) {
+						var resp sessionsResponse
+						if err := json.Unmarshal(body, &resp); err != nil {
+							t.Fatalf("Failed to parse response: %v", err)
+						}
+						if len(resp.Data) != 1 {
+							t.Errorf("Expected 1 session, got %d", len(resp.Data))
+						}
+					},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		client := clients[test.device]
+
+		t.Run(test.name, func(t *testing.T) {
+			for _, step := range test.steps {
+				t.Run(fmt.Sprintf("%s-%s-%d-%s", step.request.method, step.request.path, step.expectStatus, step.name), func(t *testing.T) {
+					body := MakeJSONRequestAndExpectStatus(t, client, step.request.method, server.URL+step.request.path, step.request.payload(), step.expectStatus)
+
+					if step.validate != nil {
+						step.validate(t, body)
+					}
+				})
+			}
+		})
+	}
+}
+
+// userAgentTransport sends every request with a fixed User-Agent header
+type userAgentTransport struct {
+	userAgent string
+}
+
+func (transport userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", transport.userAgent)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestSessionLongUserAgentRoute(t *testing.T) {
+	application, err := app.NewApplication(true)
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	defer application.ConnectionPool.Close()
+	defer CleanDB(application.DB)
+
+	router := routes.SetUpRoutes(application)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	// the byte limit falls in the middle of the last "é"
+	userAgent := strings.Repeat("a", 511) + strings.Repeat("é", 10)
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar, Transport: userAgentTransport{userAgent: userAgent}}
+
+	MakeRequestAndExpectStatus(t, client, "POST", server.URL+"/v1/users", map[string]string{
+		"userName": "userAgentUser",
+		"password": "UserAgentUserPasswordThatIsLongEnough",
+		"email":    "userAgentUser@test.com",
+	}, http.StatusCreated)
+	MakeRequestAndExpectStatus(t, client, "POST", server.URL+"/v1/users/login", map[string]string{
+		"email":    "userAgentUser@test.com",
+		"password": "UserAgentUserPasswordThatIsLongEnough",
+	}, http.StatusOK)
+	MakeRequestAndExpectStatus(t, client, "GET", server.URL+"/v1/auth/tokens", nil, http.StatusOK)
+
+	body := MakeRequestAndExpectStatus(t, client, "GET", server.URL+"/v1/auth/sessions", nil, http.StatusOK)
+	var resp sessionsResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if len(resp.Data) != 1 || resp.Data[0].UserAgent != strings.Repeat("a", 511)+"é" {
+		t.Errorf("Expected the user agent cut after 512 characters, got %+v", resp.Data)
+	}
+}
@@ -37,12 +37,11 @@ func TestUserRoutes(t *testing.T) {
 						method: "POST",
 						path:   "/v1/users",
 						body: map[string]string{
-							"userName":  "Richard Hoa",
-							"password":  "StrongSecurePasswordThatWon'tBemarkAsInvalid",
-							"email":     "testEmail@gmail.com",
-							"imageLink": "https://avatars.githubusercontent.com/u/141636214?v=4",
-							"googleID":  "",
-							"githubID":  "",
+							"userName": "Richard Hoa",
+							"password": "StrongSecurePasswordThatWon'tBemarkAsInvalid",
+							"email":    "testEmail@gmail.com",
+							"googleID": "",
+							"githubID": "",
 						},
 					},
 					expectStatus: http.StatusCreated,
@@ -71,10 +70,9 @@ func TestUserRoutes(t *testing.T) {
 						method: "POST",
 						path:   "/v1/users",
 						body: map[string]string{
-							"userName":  "activityUser",
-							"password":  "PasswordForActivityTest",
-							"email":     "activity@test.com",
-							"imageLink": "https://avatars.githubusercontent.com/u/141636214?v=4",
+							"userName": "activityUser",
+							"password": "PasswordForActivityTest",
+							"email":    "activity@test.com",
 						},
 					},
 					expectStatus: http.StatusCreated,
@@ -155,8 +153,8 @@ func TestUserRoutes(t *testing.T) {
 						if resp.Data.User.UserName != "activityUser" {
 							t.Errorf("Expected username 'activityUser', got '%s'", resp.Data.User.UserName)
 						}
-						if resp.Data.User.ImageLink != "https://avatars.githubusercontent.com/u/141636214?v=4" {
-							t.Errorf("Expected image link 'https://avatars.githubusercontent.com/u/141636214?v=4', got '%s'", resp.Data.User.ImageLink)
+						if resp.Data.User.ImageLink != "" {
+							t.Errorf("Expected no image link before an avatar upload, got '%s'", resp.Data.User.ImageLink)
 						}
 
 						// Check challenges
@@ -417,7 +415,7 @@ func TestUserRoutes(t *testing.T) {
 			name: "Social login",
 			steps: []TestStep{
 				{
-					name: "Sign up social user (no password)",
+					name: "Sign up with a raw google ID",
 					request: TestRequest{
 						method: "POST",
 						path:   "/v1/users",
@@ -428,10 +426,10 @@ func TestUserRoutes(t *testing.T) {
 							"imageLink": "https://avatars.githubusercontent.com/u/141636214?v=4",
 						},
 					},
-					expectStatus: http.StatusCreated,
+					expectStatus: http.StatusBadRequest,
 				},
 				{
-					name: "Login social user",
+					name: "Login with a raw google ID",
 					request: TestRequest{
 						method: "POST",
 						path:   "/v1/users/login",
@@ -440,31 +438,19 @@ func TestUserRoutes(t *testing.T) {
 							"googleID": "social-google-id-123",
 						},
 					},
-					expectStatus: http.StatusOK,
-				},
-				{
-					name: "Set password for social user",
-					request: TestRequest{
-						method: "PUT",
-						path:   "/v1/users/password",
-						body: map[string]string{
-							"oldPassword": "", // old password is empty
-							"newPassword": "PasswordForSocialUser",
-						},
-					},
-					expectStatus: http.StatusOK,
+					expectStatus: http.StatusBadRequest,
 				},
 				{
-					name: "Login with newly set password",
+					name: "Login with a raw github ID",
 					request: TestRequest{
 						method: "POST",
 						path:   "/v1/users/login",
 						body: map[string]string{
 							"email":    "social@test.com",
-							"password": "PasswordForSocialUser",
+							"githubID": "social-github-id-123",
 						},
 					},
-					expectStatus: http.StatusOK,
+					expectStatus: http.StatusBadRequest,
 				},
 			},
 		},
@@ -478,12 +464,25 @@ func TestUserRoutes(t *testing.T) {
 						method: "POST",
 						path:   "/v1/users",
 						body: map[string]string{
-							"userName":  "Richard Hoa",
+							"userName": "Richard Hoa",
+							"password": "StrongSecurePasswordThatWon'tBemarkAsInvalid",
+							"email":    "testEmail@gmail.com",
+							"googleID": "",
+							"githubID": "",
+						},
+					},
+					expectStatus: http.StatusBadRequest,
+				},
+				{
+					name: "Image link at sign up",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users",
+						body: map[string]string{
+							"userName":  "imageLinkUser",
 							"password":  "StrongSecurePasswordThatWon'tBemarkAsInvalid",
-							"email":     "testEmail@gmail.com",
-							"imageLink": "https://avatars.githubusercontent.com/u/141636214?v=4",
-							"googleID":  "",
-							"githubID":  "",
+							"email":     "imagelink@test.com",
+							"imageLink": "https://evilgoogleusercontent.com/avatar.png",
 						},
 					},
 					expectStatus: http.StatusBadRequest,
@@ -550,7 +549,7 @@ func TestUserRoutes(t *testing.T) {
 							"githubID":  "",
 						},
 					},
-					expectStatus: http.StatusCreated,
+					expectStatus: http.StatusBadRequest,
 				},
 				{
 					name: "Password and Github ID",
@@ -566,7 +565,7 @@ func TestUserRoutes(t *testing.T) {
 							"githubID":  "github-uid-321",
 						},
 					},
-					expectStatus: http.StatusCreated,
+					expectStatus: http.StatusBadRequest,
 				},
 				{
 					name: "Google ID and GitHub ID",
@@ -582,7 +581,7 @@ func TestUserRoutes(t *testing.T) {
 							"githubID":  "github-uid-654",
 						},
 					},
-					expectStatus: http.StatusCreated,
+					expectStatus: http.StatusBadRequest,
 				},
 				{
 					name: "Password, Google ID and GitHub ID",
@@ -598,6 +597,19 @@ func TestUserRoutes(t *testing.T) {
 							"githubID":  "github-uid-987",
 						},
 					},
+					expectStatus: http.StatusBadRequest,
+				},
+				{
+					name: "Setup user for duplicate checks",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users",
+						body: map[string]string{
+							"userName": "full_user",
+							"password": "StrongSecurePasswordThatWon'tBemarkAsInvalid",
+							"email":    "full_user@gmail.com",
+						},
+					},
 					expectStatus: http.StatusCreated,
 				},
 				{
@@ -664,6 +676,19 @@ func TestUserRoutes(t *testing.T) {
 					},
 					expectStatus: http.StatusBadRequest,
 				},
+				{
+					name: "Sign up with a breached password",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users",
+						body: map[string]string{
+							"userName": "breached_user",
+							"password": "correcthorsebatterystaple",
+							"email":    "breached@test.com",
+						},
+					},
+					expectStatus: http.StatusBadRequest,
+				},
 				{
 					name: "Setup user for malicious tests",
 					request: TestRequest{
@@ -775,6 +800,18 @@ func TestUserRoutes(t *testing.T) {
 					},
 					expectStatus: http.StatusBadRequest,
 				},
+				{
+					name: "breached password",
+					request: TestRequest{
+						method: "PUT",
+						path:   "/v1/users/password",
+						body: map[string]string{
+							"oldPassword": "AValidPassword123",
+							"newPassword": "correcthorsebatterystaple",
+						},
+					},
+					expectStatus: http.StatusBadRequest,
+				},
 				{
 					name: "incorrect old password",
 					request: TestRequest{
@@ -0,0 +1,404 @@
+package api_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/RichardHoa/hack-me/internal/app"
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/routes"
+)
+
+// cborMap keeps the key order of an encoded CBOR map
+type cborMap [][2]any
+
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n <= 0xff:
+		return []byte{major<<5 | 24, byte(n)}
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+	}
+}
+
+func cborEncode(value any) []byte {
+	switch value := value.(type) {
+	case int:
+		if value < 0 {
+			return cborHead(1, uint64(-1-value))
+		}
+		return cborHead(0, uint64(value))
+	case []byte:
+		return append(cborHead(2, uint64(len(value))), value...)
+	case string:
+		return append(cborHead(3, uint64(len(value))), value...)
+	case cborMap:
+		encoded := cborHead(5, uint64(len(value)))
+		for _, pair := range value {
+			encoded = append(encoded, cborEncode(pair[0])...)
+			encoded = append(encoded, cborEncode(pair[1])...)
+		}
+		return encoded
+	}
+	panic(fmt.Sprintf("cborEncode: unsupported type %T", value))
+}
+
+// softAuthenticator plays the part of a platform authenticator with an ES256 passkey
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	credentialID := make([]byte, 16)
+	rand.Read(credentialID)
+
+	return &softAuthenticator{key: key, credentialID: credentialID}
+}
+
+func webAuthnB64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func (authenticator *softAuthenticator) authData(flags byte, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(constants.WebAuthnRPID))
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, authenticator.signCount)
+	return append(data, attested...)
+}
+
+func (authenticator *softAuthenticator) clientData(ceremony, challenge, origin string) []byte {
+	clientData, _ := json.Marshal(map[string]any{"type": ceremony, "challenge": challenge, "origin": origin, "crossOrigin": false})
+	return clientData
+}
+
+// register answers navigator.credentials.create()
+func (authenticator *softAuthenticator) register(challenge, origin string) any {
+	publicKey, _ := authenticator.key.PublicKey.Bytes()
+	coseKey := cborEncode(cborMap{{1, 2}, {3, -7}, {-1, 1}, {-2, publicKey[1:33]}, {-3, publicKey[33:]}})
+
+	attested := make([]byte, 16) // zero aaguid, as sent with "none" attestation
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(authenticator.credentialID)))
+	attested = append(attested, authenticator.credentialID...)
+	attested = append(attested, coseKey...)
+
+	attestationObject := cborEncode(cborMap{
+		{"fmt", "none"},
+		{"attStmt", cborMap{}},
+		{"authData", authenticator.authData(0x45, attested)},
+	})
+
+	return map[string]any{
+		"id":    webAuthnB64(authenticator.credentialID),
+		"rawId": webAuthnB64(authenticator.credentialID),
+		"type":  "public-key",
+		"name":  "Laptop passkey",
+		"response": map[string]any{
+			"clientDataJSON":    webAuthnB64(authenticator.clientData("webauthn.create", challenge, origin)),
+			"attestationObject": webAuthnB64(attestationObject),
+			"transports":        []string{"internal"},
+		},
+		"authenticatorAttachment": "platform",
+		"clientExtensionResults":  map[string]any{},
+	}
+}
+
+// login answers navigator.credentials.get(), signing with the given key
+func (authenticator *softAuthenticator) login(t *testing.T, challenge string, key *ecdsa.PrivateKey) any {
+	authenticator.signCount++
+	authData := authenticator.authData(0x05, nil)
+	clientData := authenticator.clientData("webauthn.get", challenge, constants.WebAuthnOrigin)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+
+	return map[string]any{
+		"id":    webAuthnB64(authenticator.credentialID),
+		"rawId": webAuthnB64(authenticator.credentialID),
+		"type":  "public-key",
+		"response": map[string]any{
+			"clientDataJSON":    webAuthnB64(clientData),
+			"authenticatorData": webAuthnB64(authData),
+			"signature":         webAuthnB64(signature),
+			"userHandle":        webAuthnB64(authenticator.userHandle),
+		},
+	}
+}
+
+func TestWebAuthnRoute(t *testing.T) {
+	application, err := app.NewApplication(true)
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	defer application.ConnectionPool.Close()
+	defer CleanDB(application.DB)
+
+	constants.WebAuthnOrigin = "https://hack-me.test"
+	constants.WebAuthnRPID = "hack-me.test"
+
+	router := routes.SetUpRoutes(application)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	authenticator := newSoftAuthenticator(t)
+	stranger := newSoftAuthenticator(t)
+
+	// filled by the start steps, the finish steps build their body when they run
+	challenge := ""
+	credentialID := webAuthnB64(authenticator.credentialID)
+
+	readOptions := func(t *testing.T, body []byte) {
+		var resp struct {
+			Data struct {
+				PublicKey struct {
+					Challenge string `json:"challenge"`
+					User      struct {
+						ID string `json:"id"`
+					} `json:"user"`
+				} `json:"publicKey"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(body, &resp); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		if resp.Data.PublicKey.Challenge == "" {
+			t.Fatalf("Expected a challenge, got %s", body)
+		}
+		challenge = resp.Data.PublicKey.Challenge
+
+		if resp.Data.PublicKey.User.ID != "" {
+			authenticator.userHandle, _ = base64.RawURLEncoding.DecodeString(resp.Data.PublicKey.User.ID)
+		}
+	}
+
+	expectCredentials := func(count int) func(t *testing.T, body []byte) {
+		return func(t *testing.T, body []byte) {
+			var resp struct {
+				Data []struct {
+					ID   string `json:"id"`
+					Name string `json:"name"`
+				} `json:"data"`
+			}
+			if err := json.Unmarshal(body, &resp); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			if len(resp.Data) != count {
+				t.Fatalf("Expected %d passkeys, got %d", count, len(resp.Data))
+			}
+		}
+	}
+
+	startLogin := TestStep{
+		name:         "Start passkey login",
+		request:      TestRequest{method: "POST", path: "/v1/auth/webauthn/login/start"},
+		expectStatus: http.StatusOK,
+		validate:     readOptions,
+	}
+
+	finishLogin := func(name string, status int, body func(t *testing.T) any) TestStep {
+		return TestStep{
+			name:         name,
+			request:      TestRequest{method: "POST", path: "/v1/auth/webauthn/login/finish", jsonBody: body},
+			expectStatus: status,
+		}
+	}
+
+	startRegistration := TestStep{
+		name:         "Start passkey registration",
+		request:      TestRequest{method: "POST", path: "/v1/auth/webauthn/register/start"},
+		expectStatus: http.StatusOK,
+		validate:     readOptions,
+	}
+
+	finishRegistration := func(name string, status int, origin string) TestStep {
+		return TestStep{
+			name: name,
+			request: TestRequest{
+				method: "POST",
+				path:   "/v1/auth/webauthn/register/finish",
+				jsonBody: func(t *testing.T) any {
+					return authenticator.register(challenge, origin)
+				},
+			},
+			expectStatus: status,
+		}
+	}
+
+	tests := []struct {
+		name   string
+		device string
+		steps  []TestStep
+	}{
+		{
+			name:   "register a passkey",
+			device: "laptop",
+			steps: []TestStep{
+				{
+					name: "Sign up",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users",
+						body: map[string]string{
+							"userName": "passkeyUser",
+							"password": "PasskeyUserPasswordThatIsLongEnough",
+							"email":    "passkeyUser@test.com",
+						},
+					},
+					expectStatus: http.StatusCreated,
+				},
+				{
+					name: "Login",
+					request: TestRequest{
+						method: "POST",
+						path:   "/v1/users/login",
+						body: map[string]string{
+							"email":    "passkeyUser@test.com",
+							"password": "PasskeyUserPasswordThatIsLongEnough",
+						},
+					},
+					expectStatus: http.StatusOK,
+				},
+				{
+					name:         "No passkeys yet",
+					request:      TestRequest{method: "GET", path: "/v1/auth/webauthn/credentials"},
+					expectStatus: http.StatusOK,
+					validate:     expectCredentials(0),
+				},
+				startRegistration,
+				finishRegistration("Phishing origin", http.StatusBadRequest, "https://hack-me.evil"),
+				finishRegistration("Register passkey", http.StatusCreated, "https://hack-me.test"),
+				finishRegistration("Challenge is single use", http.StatusBadRequest, "https://hack-me.test"),
+				startRegistration,
+				finishRegistration("Same passkey twice", http.StatusBadRequest, "https://hack-me.test"),
+				{
+					name:         "One passkey",
+					request:      TestRequest{method: "GET", path: "/v1/auth/webauthn/credentials"},
+					expectStatus: http.StatusOK,
+					validate:     expectCredentials(1),
+				},
+			},
+		},
+		{
+			name:   "anonymous user cannot register",
+			device: "stranger",
+			steps: []TestStep{
+				{
+					name:         "Start registration without a session",
+					request:      TestRequest{method: "POST", path: "/v1/auth/webauthn/register/start"},
+					expectStatus: http.StatusUnauthorized,
+				},
+			},
+		},
+		{
+			name:   "log in with the passkey",
+			device: "phone",
+			steps: []TestStep{
+				startLogin,
+				finishLogin("Signed by another key", http.StatusUnauthorized, func(t *testing.T) any {
+					return authenticator.login(t, challenge, stranger.key)
+				}),
+				finishLogin("Challenge is consumed by a failed attempt", http.StatusBadRequest, func(t *testing.T) any {
+					return authenticator.login(t, challenge, authenticator.key)
+				}),
+				startLogin,
+				finishLogin("Unknown passkey", http.StatusUnauthorized, func(t *testing.T) any {
+					return stranger.login(t, challenge, stranger.key)
+				}),
+				startLogin,
+				finishLogin("Log in", http.StatusOK, func(t *testing.T) any {
+					return authenticator.login(t, challenge, authenticator.key)
+				}),
+				{
+					name:         "Logged in",
+					request:      TestRequest{method: "GET", path: "/v1/users/me"},
+					expectStatus: http.StatusOK,
+				},
+			},
+		},
+		{
+			name:   "cloned passkey",
+			device: "attacker",
+			steps: []TestStep{
+				startLogin,
+				finishLogin("Sign count went backwards", http.StatusUnauthorized, func(t *testing.T) any {
+					authenticator.signCount = 0
+					return authenticator.login(t, challenge, authenticator.key)
+				}),
+			},
+		},
+		{
+			name:   "delete the passkey",
+			device: "laptop",
+			steps: []TestStep{
+				{
+					name:         "Delete unknown passkey",
+					request:      TestRequest{method: "DELETE", path: "/v1/auth/webauthn/credentials/unknown"},
+					expectStatus: http.StatusNotFound,
+				},
+				{
+					name:         "Delete passkey",
+					request:      TestRequest{method: "DELETE", path: "/v1/auth/webauthn/credentials/" + credentialID},
+					expectStatus: http.StatusOK,
+				},
+				startLogin,
+				finishLogin("Deleted passkey cannot log in", http.StatusUnauthorized, func(t *testing.T) any {
+					authenticator.signCount = 100
+					return authenticator.login(t, challenge, authenticator.key)
+				}),
+			},
+		},
+	}
+
+	clients := map[string]*http.Client{}
+
+	for _, test := range tests {
+		client, ok := clients[test.device]
+		if !ok {
+			jar, _ := cookiejar.New(nil)
+			client = &http.Client{Jar: jar}
+			clients[test.device] = client
+		}
+
+		t.Run(test.name, func(t *testing.T) {
+			for _, step := range test.steps {
+				t.Run(fmt.Sprintf("%s-%s-%d-%s", step.request.method, strings.TrimPrefix(step.request.path, "/v1/auth/webauthn"), step.expectStatus, step.name), func(t *testing.T) {
+					payload := step.request.payload()
+					if build, ok := payload.(func(t *testing.T) any); ok {
+						payload = build(t)
+					}
+
+					body := MakeJSONRequestAndExpectStatus(t, client, step.request.method, server.URL+step.request.path, payload, step.expectStatus)
+
+					if step.validate != nil {
+						step.validate(t, body)
+					}
+				})
+			}
+		})
+	}
+}
@@ -1,7 +1,10 @@
 package app
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"time"
@@ -9,7 +12,9 @@ import (
 	"github.com/RichardHoa/hack-me/internal/api"
 	"github.com/RichardHoa/hack-me/internal/constants"
 	"github.com/RichardHoa/hack-me/internal/middleware"
+	"github.com/RichardHoa/hack-me/internal/policy"
 	"github.com/RichardHoa/hack-me/internal/store"
+	"github.com/RichardHoa/hack-me/internal/utils"
 	"github.com/RichardHoa/hack-me/migrations"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
@@ -19,6 +24,10 @@ type Application struct {
 	InfoLogger     *log.Logger
 	DB             *sql.DB
 	ConnectionPool *pgxpool.Pool
+	// RowSecurity opens the transactions that run as one user, on connections of its own
+	RowSecurity *store.RowSecurityDB
+	// MailQueue sends the emails in the background when SMTP is configured, nil otherwise
+	MailQueue *store.QueuedMailer
 
 	/*
 		use pointer for handler to make sure the handler never get copies,
@@ -30,7 +39,22 @@ type Application struct {
 	ChallengeresponseVoteHandler *api.ChallengeResponseVoteHandler
 	CommentHandler               *api.CommentHandler
 	ChatboxHandler               *api.ChatboxHandler
+	ScoreboardHandler            *api.ScoreboardHandler
+	OAuthHandler                 *api.OAuthHandler
+	MFAHandler                   *api.MFAHandler
+	WebAuthnHandler              *api.WebAuthnHandler
+	PersonalAccessTokenHandler   *api.PersonalAccessTokenHandler
+	JWKSHandler                  *api.JWKSHandler
+	ModerationHandler            *api.ModerationHandler
+	AdminHandler                 *api.AdminHandler
+	SecurityEventHandler         *api.SecurityEventHandler
+	BookmarkHandler              *api.BookmarkHandler
+	ReportHandler                *api.ReportHandler
+	AvatarHandler                *api.AvatarHandler
+	ExportHandler                *api.ExportHandler
 	Middleware                   middleware.MiddleWare
+	// Policy is shared by the middleware and every handler, so tests can flip its settings in one place
+	Policy *policy.Engine
 }
 
 func NewApplication(isTesting bool) (*Application, error) {
@@ -76,6 +100,19 @@ func NewApplication(isTesting bool) (*Application, error) {
 		panic(err)
 	}
 
+	if isTesting || constants.IsDevMode {
+		err = store.SetDevRowSecurityPassword(db)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	appDB, _, err := store.OpenRowSecurity(isTesting)
+	if err != nil {
+		panic(err)
+	}
+	rowSecurity := store.NewRowSecurityDB(db, appDB)
+
 	/*
 		all the stores are returned as pointers
 		because we satisfy all interface by functions with pointer receiver
@@ -83,35 +120,103 @@ func NewApplication(isTesting bool) (*Application, error) {
 	//NOTE: store creation
 	userStore := store.NewUserStore(db)
 	tokenStore := store.NewTokenStore(db)
-	challengeResponseVoteStore := store.NewVoteStore(db)
-	commentStore := store.NewCommentStore(db)
-	challengeResponseStore := store.NewChallengeResponseStore(db, commentStore)
-	challengeStore := store.NewChallengeStore(db, commentStore)
+	challengeResponseVoteStore := store.NewVoteStore(db, rowSecurity)
+	commentStore := store.NewCommentStore(db, rowSecurity)
+	challengeResponseStore := store.NewChallengeResponseStore(db, rowSecurity, commentStore)
+	challengeStore := store.NewChallengeStore(db, rowSecurity, commentStore)
+	scoreboardStore := store.NewScoreboardStore(db)
+	oauthStore := store.NewOAuthStore(db)
+	mfaStore := store.NewMFAStore(db)
+	webAuthnStore := store.NewWebAuthnStore(db)
+	loginThrottleStore := store.NewLoginThrottleStore(db)
+	personalAccessTokenStore := store.NewPersonalAccessTokenStore(db)
+	securityEventStore := store.NewSecurityEventStore(db)
+	bookmarkStore := store.NewBookmarkStore(db, rowSecurity)
+	moderationStore := store.NewModerationStore(db, rowSecurity)
+	reportStore := store.NewReportStore(db)
+	exportStore := store.NewExportStore(db)
+	rateLimitStore := store.NewRateLimitStore(db)
+
+	//NOTE: emails only leave the server when SMTP is configured
+	var mailer store.Mailer = store.NewMemoryMailer(infoLogger)
+	var mailQueue *store.QueuedMailer
+	if constants.SMTPHost != "" && !isTesting {
+		smtpMailer := store.NewSMTPMailer(constants.SMTPHost, constants.SMTPPort, constants.SMTPUsername, constants.SMTPPassword, constants.MailFrom)
+		mailQueue = store.NewQueuedMailer(smtpMailer, logger, constants.MailQueueSize, constants.MailQueueWorkers)
+		mailer = mailQueue
+	}
+
+	breachChecker, err := newPasswordBreachChecker(isTesting, logger)
+	if err != nil {
+		panic(err)
+	}
+
+	blobStore, err := newBlobStore(isTesting)
+	if err != nil {
+		panic(err)
+	}
+
+	// a broken access token key would only show up at the first login
+	_, err = utils.AccessTokenKeys()
+	if err != nil {
+		panic(err)
+	}
+
+	policyEngine := policy.NewEngine(constants.RequireVerifiedEmail)
 
 	//NOTE: Handler creation
-	challengeHandler := api.NewChallengeHandler(challengeStore, logger)
-	userHandler := api.NewUserHandler(userStore, tokenStore, logger)
-	challengeResponseHandler := api.NewChallengeResponseHandler(challengeResponseStore, logger)
-	challengeResponseVoteHandler := api.NewChallengeResponseVoteHandler(challengeResponseVoteStore, logger)
-	commentHandler := api.NewCommentHandler(commentStore, logger)
+	challengeHandler := api.NewChallengeHandler(challengeStore, policyEngine, mailer, logger)
+	userHandler := api.NewUserHandler(userStore, tokenStore, mfaStore, loginThrottleStore, securityEventStore, breachChecker, blobStore, mailer, logger)
+	challengeResponseHandler := api.NewChallengeResponseHandler(challengeResponseStore, policyEngine, mailer, logger)
+	challengeResponseVoteHandler := api.NewChallengeResponseVoteHandler(challengeResponseVoteStore, challengeResponseStore, policyEngine, logger)
+	commentHandler := api.NewCommentHandler(commentStore, policyEngine, mailer, logger)
+	scoreboardHandler := api.NewScoreboardHandler(scoreboardStore, logger)
+	oauthHandler := api.NewOAuthHandler(newOAuthProviders(), oauthStore, userStore, tokenStore, mfaStore, securityEventStore, logger)
+	mfaHandler := api.NewMFAHandler(mfaStore, tokenStore, securityEventStore, logger)
+	webAuthnHandler := api.NewWebAuthnHandler(webAuthnStore, tokenStore, securityEventStore, logger)
+	jwksHandler := api.NewJWKSHandler(logger)
+	personalAccessTokenHandler := api.NewPersonalAccessTokenHandler(personalAccessTokenStore, logger)
+	moderationHandler := api.NewModerationHandler(moderationStore, policyEngine, mailer, logger)
+	adminHandler := api.NewAdminHandler(userStore, policyEngine, logger)
+	securityEventHandler := api.NewSecurityEventHandler(securityEventStore, logger)
+	bookmarkHandler := api.NewBookmarkHandler(bookmarkStore, logger)
+	reportHandler := api.NewReportHandler(reportStore, moderationStore, policyEngine, mailer, logger)
+	avatarHandler := api.NewAvatarHandler(userStore, blobStore, logger)
+	exportHandler := api.NewExportHandler(exportStore, userStore, bookmarkStore, securityEventStore, blobStore, mailer, logger)
 	// NOTE: this chatbox handler is currently not used
 	chatboxHandler := api.NewChatboxHandler(logger, AIClient, QdrantClient)
 
 	//NOTE: Middleware creation
-	middleware := middleware.NewMiddleWare(logger)
+	middleware := middleware.NewMiddleWare(logger, userStore, personalAccessTokenStore, tokenStore, securityEventStore, rateLimitStore, policyEngine)
 
 	application := &Application{
 		Logger:                       logger,
 		InfoLogger:                   infoLogger,
 		DB:                           db,
 		ConnectionPool:               connPool,
+		RowSecurity:                  rowSecurity,
+		MailQueue:                    mailQueue,
 		ChallengeHandler:             challengeHandler,
 		ChallengeResponseHandler:     challengeResponseHandler,
 		ChallengeresponseVoteHandler: challengeResponseVoteHandler,
 		CommentHandler:               commentHandler,
 		ChatboxHandler:               chatboxHandler,
+		ScoreboardHandler:            scoreboardHandler,
+		OAuthHandler:                 oauthHandler,
+		MFAHandler:                   mfaHandler,
+		WebAuthnHandler:              webAuthnHandler,
+		PersonalAccessTokenHandler:   personalAccessTokenHandler,
+		JWKSHandler:                  jwksHandler,
+		ModerationHandler:            moderationHandler,
+		AdminHandler:                 adminHandler,
+		SecurityEventHandler:         securityEventHandler,
+		BookmarkHandler:              bookmarkHandler,
+		ReportHandler:                reportHandler,
+		AvatarHandler:                avatarHandler,
+		ExportHandler:                exportHandler,
 		UserHandler:                  userHandler,
 		Middleware:                   middleware,
+		Policy:                       policyEngine,
 	}
 
 	logger.Println("Start clean up jobs")
@@ -120,6 +225,17 @@ func NewApplication(isTesting bool) (*Application, error) {
 	return application, nil
 }
 
+// Shutdown waits for the work that outlives a request, such as queued emails, until ctx ends
+func (a *Application) Shutdown(ctx context.Context) error {
+	// the exports mail their link when done, so they finish before the mail queue closes
+	err := a.ExportHandler.Shutdown(ctx)
+
+	if a.MailQueue != nil {
+		err = errors.Join(err, a.MailQueue.Shutdown(ctx))
+	}
+	return err
+}
+
 func (a *Application) StartTokenCleanupJob() {
 	ticker := time.NewTicker(24 * time.Hour)
 
@@ -137,6 +253,142 @@ func (a *Application) StartTokenCleanupJob() {
 			} else {
 				a.Logger.Printf("Background job finished. Deleted %d stale tokens.", rowsDeleted)
 			}
+
+			rowsDeleted, err = a.OAuthHandler.OAuthStore.DeleteExpiredOAuthStates()
+			if err != nil {
+				a.Logger.Printf("ERROR: failed to clean up expired social logins: %v", err)
+			} else {
+				a.Logger.Printf("Background job finished. Deleted %d stale social logins.", rowsDeleted)
+			}
+
+			rowsDeleted, err = a.WebAuthnHandler.WebAuthnStore.DeleteExpiredWebAuthnChallenges()
+			if err != nil {
+				a.Logger.Printf("ERROR: failed to clean up expired passkey challenges: %v", err)
+			} else {
+				a.Logger.Printf("Background job finished. Deleted %d stale passkey challenges.", rowsDeleted)
+			}
+
+			rowsDeleted, err = a.UserHandler.LoginThrottleStore.DeleteStaleLoginThrottles()
+			if err != nil {
+				a.Logger.Printf("ERROR: failed to clean up stale login throttles: %v", err)
+			} else {
+				a.Logger.Printf("Background job finished. Deleted %d stale login throttles.", rowsDeleted)
+			}
+
+			rowsDeleted, err = a.PersonalAccessTokenHandler.PersonalAccessTokenStore.DeleteExpiredPersonalAccessTokens()
+			if err != nil {
+				a.Logger.Printf("ERROR: failed to clean up expired access tokens: %v", err)
+			} else {
+				a.Logger.Printf("Background job finished. Deleted %d expired access tokens.", rowsDeleted)
+			}
+
+			rowsDeleted, err = a.Middleware.RateLimitStore.DeleteStaleRateLimits()
+			if err != nil {
+				a.Logger.Printf("ERROR: failed to clean up stale rate limits: %v", err)
+			} else {
+				a.Logger.Printf("Background job finished. Deleted %d stale rate limits.", rowsDeleted)
+			}
+
+			rowsDeleted, err = a.RowSecurity.DeleteExpiredGrants()
+			if err != nil {
+				a.Logger.Printf("ERROR: failed to clean up expired row security grants: %v", err)
+			} else {
+				a.Logger.Printf("Background job finished. Deleted %d expired row security grants.", rowsDeleted)
+			}
+
+			exportKeys, err := a.ExportHandler.ExportStore.DeleteExpiredExports()
+			if err != nil {
+				a.Logger.Printf("ERROR: failed to clean up expired data exports: %v", err)
+			} else {
+				for _, key := range exportKeys {
+					if err := a.ExportHandler.BlobStore.Delete(key); err != nil {
+						a.Logger.Printf("ERROR: failed to delete the data export %s: %v", key, err)
+					}
+				}
+				a.Logger.Printf("Background job finished. Deleted %d expired data exports.", len(exportKeys))
+			}
+
+			report, err := a.UserHandler.UserStore.GetPasswordHashReport()
+			if err != nil {
+				a.Logger.Printf("ERROR: failed to report password hash parameters: %v", err)
+			} else {
+				a.Logger.Printf("Password hashes: %d of %d still use argon2id parameters weaker than %s.", report.Outdated, report.Total, report.CurrentParams)
+			}
 		}
 	}()
 }
+
+/*
+newPasswordBreachChecker picks the breach database from the configuration. The
+tests use the small dataset in testdata so they never depend on the network.
+*/
+func newPasswordBreachChecker(isTesting bool, logger *log.Logger) (utils.PasswordBreachChecker, error) {
+	var breachChecker utils.PasswordBreachChecker
+
+	switch {
+	case isTesting:
+		localChecker, err := utils.NewLocalBreachChecker("testdata/pwned-passwords")
+		if err != nil {
+			return nil, err
+		}
+		return localChecker, nil
+	case constants.PasswordBreachChecker == constants.PasswordBreachCheckerLocal:
+		localChecker, err := utils.NewLocalBreachChecker(constants.PasswordBreachDataset)
+		if err != nil {
+			return nil, err
+		}
+		breachChecker = localChecker
+	case constants.PasswordBreachChecker == constants.PasswordBreachCheckerHIBP:
+		breachChecker = utils.NewHIBPBreachChecker()
+	default:
+		return nil, fmt.Errorf("unknown PASSWORD_BREACH_CHECKER %q", constants.PasswordBreachChecker)
+	}
+
+	if constants.PasswordBreachFailOpen {
+		breachChecker = utils.NewFailOpenBreachChecker(breachChecker, logger)
+	}
+
+	return breachChecker, nil
+}
+
+// newBlobStore opens the storage of uploaded files, the tests write to a temporary directory
+func newBlobStore(isTesting bool) (store.BlobStore, error) {
+	switch {
+	case isTesting:
+		dir, err := os.MkdirTemp("", "hack-me-blobs-")
+		if err != nil {
+			return nil, err
+		}
+		return store.NewLocalBlobStore(dir)
+	case constants.BlobStorage == constants.BlobStorageLocal:
+		return store.NewLocalBlobStore(constants.BlobStorageDir)
+	default:
+		return nil, fmt.Errorf("unknown BLOB_STORAGE %q", constants.BlobStorage)
+	}
+}
+
+/*
+newOAuthProviders enables the social login providers that have a client ID
+configured, the callback URLs are built from constants.APIBaseURL.
+*/
+func newOAuthProviders() map[string]store.OAuthProvider {
+	providers := map[string]store.OAuthProvider{}
+
+	if constants.GoogleClientID != "" {
+		providers[constants.OAuthProviderGoogle] = store.NewGoogleProvider(store.OAuthProviderConfig{
+			ClientID:     constants.GoogleClientID,
+			ClientSecret: constants.GoogleClientSecret,
+			RedirectURL:  constants.APIBaseURL + "/v1/auth/google/callback",
+		})
+	}
+
+	if constants.GithubClientID != "" {
+		providers[constants.OAuthProviderGithub] = store.NewGithubProvider(store.OAuthProviderConfig{
+			ClientID:     constants.GithubClientID,
+			ClientSecret: constants.GithubClientSecret,
+			RedirectURL:  constants.APIBaseURL + "/v1/auth/github/callback",
+		})
+	}
+
+	return providers
+}
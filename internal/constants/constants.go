@@ -7,9 +7,15 @@ truth for values like token secrets, error codes, and standard messages.
 package constants
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"math"
+	"net/url"
 	"os"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
@@ -63,6 +69,74 @@ func LoadEnv() error {
 
 	IsDevMode = os.Getenv("DEV_MODE") == "LOCAL"
 
+	// argon2id cost of new password hashes, older hashes are upgraded when their user logs in
+	for key, dst := range map[string]*uint32{"ARGON2_MEMORY_KIB": &Argon2Memory, "ARGON2_ITERATIONS": &Argon2Iterations} {
+		if v := os.Getenv(key); v != "" {
+			n, err := strconv.ParseUint(v, 10, 32)
+			if err != nil || n == 0 {
+				return fmt.Errorf("invalid %s %q", key, v)
+			}
+			*dst = uint32(n)
+		}
+	}
+	if v := os.Getenv("ARGON2_PARALLELISM"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 8)
+		if err != nil || n == 0 {
+			return fmt.Errorf("invalid ARGON2_PARALLELISM %q", v)
+		}
+		Argon2Parallelism = uint8(n)
+	}
+
+	// social login is optional, a provider is only enabled when its client ID is set
+	GoogleClientID = os.Getenv("GOOGLE_CLIENT_ID")
+	GoogleClientSecret = os.Getenv("GOOGLE_CLIENT_SECRET")
+	GithubClientID = os.Getenv("GITHUB_CLIENT_ID")
+	GithubClientSecret = os.Getenv("GITHUB_CLIENT_SECRET")
+	APIBaseURL = strings.TrimSuffix(os.Getenv("API_BASE_URL"), "/")
+	FrontendURL = strings.TrimSuffix(os.Getenv("FRONTEND_URL"), "/")
+
+	// emails are only sent through SMTP when a host is configured
+	SMTPHost = os.Getenv("SMTP_HOST")
+	SMTPPort = os.Getenv("SMTP_PORT")
+	if SMTPPort == "" {
+		SMTPPort = "587"
+	}
+	SMTPUsername = os.Getenv("SMTP_USERNAME")
+	SMTPPassword = os.Getenv("SMTP_PASSWORD")
+	MailFrom = os.Getenv("MAIL_FROM")
+	RequireVerifiedEmail = os.Getenv("REQUIRE_VERIFIED_EMAIL") == "true"
+	EmailTokenSecret = os.Getenv("EMAIL_TOKEN_SECRET")
+
+	// passkeys are bound to the frontend origin unless configured otherwise
+	WebAuthnOrigin = strings.TrimSuffix(os.Getenv("WEBAUTHN_ORIGIN"), "/")
+	if WebAuthnOrigin == "" {
+		WebAuthnOrigin = FrontendURL
+	}
+	WebAuthnRPID = os.Getenv("WEBAUTHN_RP_ID")
+	if WebAuthnRPID == "" {
+		if origin, err := url.Parse(WebAuthnOrigin); err == nil {
+			WebAuthnRPID = origin.Hostname()
+		}
+	}
+
+	// breached passwords are looked up on the HIBP API unless a local dataset is configured
+	PasswordBreachChecker = os.Getenv("PASSWORD_BREACH_CHECKER")
+	if PasswordBreachChecker == "" {
+		PasswordBreachChecker = PasswordBreachCheckerHIBP
+	}
+	PasswordBreachDataset = os.Getenv("PASSWORD_BREACH_DATASET")
+	PasswordBreachFailOpen = os.Getenv("PASSWORD_BREACH_FAIL_OPEN") == "true"
+
+	// uploaded files such as avatars are kept on the local disk unless another storage is configured
+	BlobStorage = os.Getenv("BLOB_STORAGE")
+	if BlobStorage == "" {
+		BlobStorage = BlobStorageLocal
+	}
+	BlobStorageDir = os.Getenv("BLOB_STORAGE_DIR")
+	if BlobStorageDir == "" {
+		BlobStorageDir = "data/blobs"
+	}
+
 	if len(missing) > 0 {
 		fmt.Println("--- DEBUG: Missing required secrets ---")
 		for _, k := range missing {
@@ -72,9 +146,69 @@ func LoadEnv() error {
 		return errors.New("missing required secrets: " + strings.Join(missing, ", "))
 	}
 
+	// rotated out secrets keep verifying the tokens they signed, new tokens use the secrets above
+	AccessTokenPreviousSecrets = splitSecrets(os.Getenv("ACCESS_TOKEN_PREVIOUS_SECRETS"))
+	RefreshTokenPreviousSecrets = splitSecrets(os.Getenv("REFRESH_TOKEN_PREVIOUS_SECRETS"))
+	CSRFTokenPreviousSecrets = splitSecrets(os.Getenv("CSRF_TOKEN_PREVIOUS_SECRETS"))
+	EmailTokenPreviousSecrets = splitSecrets(os.Getenv("EMAIL_TOKEN_PREVIOUS_SECRETS"))
+
+	if v := os.Getenv("TOKEN_KEY_ROTATION_PERIOD"); v != "" {
+		period, err := time.ParseDuration(v)
+		if err != nil || period < time.Minute {
+			return fmt.Errorf("invalid TOKEN_KEY_ROTATION_PERIOD %q, expected a duration of at least 1m", v)
+		}
+		TokenKeyRotationPeriod = period
+	}
+
+	// access tokens can be signed with a private key so other services verify them through the JWKS
+	AccessTokenAlgorithm = os.Getenv("ACCESS_TOKEN_ALGORITHM")
+	switch AccessTokenAlgorithm {
+	case "":
+		AccessTokenAlgorithm = AccessTokenAlgorithmHS512
+	case AccessTokenAlgorithmHS512, AccessTokenAlgorithmEdDSA, AccessTokenAlgorithmES256:
+	default:
+		return fmt.Errorf("invalid ACCESS_TOKEN_ALGORITHM %q", AccessTokenAlgorithm)
+	}
+	AccessTokenPrivateKey = os.Getenv("ACCESS_TOKEN_PRIVATE_KEY")
+	AccessTokenPreviousPublicKeys = os.Getenv("ACCESS_TOKEN_PREVIOUS_PUBLIC_KEYS")
+	TokenIssuer = os.Getenv("TOKEN_ISSUER")
+	if TokenIssuer == "" {
+		TokenIssuer = APIBaseURL
+	}
+	TokenAudience = os.Getenv("TOKEN_AUDIENCE")
+	if TokenAudience == "" {
+		TokenAudience = "hack-me"
+	}
+
+	// the email token secret is optional, without it a key dedicated to email tokens is derived
+	if EmailTokenSecret == "" {
+		EmailTokenSecret = deriveEmailTokenSecret(AccessTokenSecret)
+		EmailTokenPreviousSecrets = nil
+		for _, secret := range AccessTokenPreviousSecrets {
+			EmailTokenPreviousSecrets = append(EmailTokenPreviousSecrets, deriveEmailTokenSecret(secret))
+		}
+	}
+
 	return nil
 }
 
+func deriveEmailTokenSecret(accessTokenSecret string) string {
+	mac := hmac.New(sha256.New, []byte(accessTokenSecret))
+	mac.Write([]byte("email-token"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// splitSecrets reads a comma separated list of secrets
+func splitSecrets(value string) []string {
+	secrets := []string{}
+	for _, secret := range strings.Split(value, ",") {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets
+}
+
 // Global variables holding configuration loaded from the environment.
 var (
 	RefreshTokenSecret   string
@@ -87,6 +221,63 @@ var (
 	VectorHost           string
 	VectorPort           string
 	VectorCollectionName string
+	GoogleClientID       string
+	GoogleClientSecret   string
+	GithubClientID       string
+	GithubClientSecret   string
+	APIBaseURL           string
+	FrontendURL          string
+	SMTPHost             string
+	SMTPPort             string
+	SMTPUsername         string
+	SMTPPassword         string
+	MailFrom             string
+	RequireVerifiedEmail bool
+	EmailTokenSecret     string
+	WebAuthnOrigin       string
+	WebAuthnRPID         string
+	// secrets that were rotated out, they only verify tokens signed before the rotation
+	AccessTokenPreviousSecrets  []string
+	RefreshTokenPreviousSecrets []string
+	CSRFTokenPreviousSecrets    []string
+	EmailTokenPreviousSecrets   []string
+	// AccessTokenAlgorithm is one of the AccessTokenAlgorithm constants, the keys are PEM encoded
+	AccessTokenAlgorithm          string
+	AccessTokenPrivateKey         string
+	AccessTokenPreviousPublicKeys string
+	TokenIssuer                   string
+	TokenAudience                 string
+	// the signing keys derived from the secrets change this often
+	TokenKeyRotationPeriod = 24 * time.Hour
+	// argon2id parameters of new password hashes, the defaults are argon2id.DefaultParams
+	Argon2Memory      uint32 = 64 * 1024
+	Argon2Iterations  uint32 = 1
+	Argon2Parallelism        = uint8(min(runtime.NumCPU(), math.MaxUint8))
+	// PasswordBreachChecker is PasswordBreachCheckerHIBP or PasswordBreachCheckerLocal
+	PasswordBreachChecker  string
+	PasswordBreachDataset  string
+	PasswordBreachFailOpen bool
+	// BlobStorage is one of the BlobStorage constants, BlobStorageDir is only used by the local one
+	BlobStorage    string
+	BlobStorageDir string
+)
+
+// Defines the algorithms access tokens can be signed with.
+const (
+	AccessTokenAlgorithmHS512 = "HS512"
+	AccessTokenAlgorithmEdDSA = "EdDSA"
+	AccessTokenAlgorithmES256 = "ES256"
+)
+
+// Defines where breached passwords are looked up.
+const (
+	PasswordBreachCheckerHIBP  = "hibp"
+	PasswordBreachCheckerLocal = "local"
+)
+
+// Defines where uploaded files are stored.
+const (
+	BlobStorageLocal = "local"
 )
 
 // Defines the keys for standard claims within JSON Web Tokens.
@@ -94,6 +285,44 @@ const (
 	JWTRefreshTokenID = "SomeThing"
 	JWTUserName       = "userName"
 	JWTUserID         = "someOtherThing"
+	JWTEmail          = "email"
+	JWTPurpose        = "purpose"
+	// JWTSessionID ties both tokens to their refresh_token session, a bearer token dies with it
+	JWTSessionID = "sid"
+)
+
+// Defines how the user of a request proved who they are.
+const (
+	AuthMethodCookie              = "cookie"
+	AuthMethodBearer              = "bearer"
+	AuthMethodPersonalAccessToken = "personal-access-token"
+)
+
+// Defines what a personal access token may do, the token itself starts with the prefix.
+const (
+	ScopeRead                 = "read"
+	ScopeChallengesWrite      = "challenges:write"
+	ScopeResponsesWrite       = "responses:write"
+	PersonalAccessTokenPrefix = "hmpat_"
+)
+
+// Defines the roles of users, moderators and admins may moderate the content of everyone.
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// PersonalAccessTokenScopes lists every scope a personal access token can be given.
+var PersonalAccessTokenScopes = []string{ScopeRead, ScopeChallengesWrite, ScopeResponsesWrite}
+
+// Defines the supported social login providers, the names are used in the login URLs.
+const (
+	OAuthProviderGoogle = "google"
+	OAuthProviderGithub = "github"
+	OAuthStateTime      = 10 * time.Minute
+	// leaves room for the random suffix of a taken name
+	MaxGeneratedUsernameLength = 40
 )
 
 // Defines constants for AI related functions.
@@ -150,12 +379,82 @@ const (
 	StatusInvalidBodyMessage   = "Invalid request body > ERROR 100"
 	UnauthorizedMessage        = "Unauthorized"
 	ForbiddenMessage           = "Forbidden"
+	SocialLoginMessage         = "googleID and githubID are not accepted, log in through /v1/auth/{provider}/start"
 	MaxRequestBodySize         = 5 * 1024 * 1024 // 5MB
 	AccessTokenTime            = 15 * time.Minute
 	RefreshTokenTime           = 7 * (24 * time.Hour)
 	CommentNestedLevel         = 5
 	DefaultPageSize            = 10
 	DefaultPage                = 1
+	MaxChallengeFlags          = 10
+	MaxWrongFlagSubmissions    = 5
+	WrongFlagSubmissionWindow  = 5 * time.Minute
+	MaxSessionsPerUser         = 10
+	EmailVerificationTokenTime = 24 * time.Hour
+	VerificationEmailCooldown  = 2 * time.Minute
+	PasswordResetTokenTime     = 30 * time.Minute
+	MFAChallengeTime           = 5 * time.Minute
+	MaxMFAAttempts             = 5
+	MFALockoutThreshold        = 10
+	MFALockoutTime             = 15 * time.Minute
+	TOTPIssuer                 = "Hack-Me"
+	TOTPDigits                 = 6
+	TOTPPeriod                 = 30 * time.Second
+	RecoveryCodeCount          = 10
+	RecoveryCodeLength         = 10
+	WebAuthnRPName             = "Hack-Me"
+	WebAuthnChallengeTime      = 5 * time.Minute
+	MaxWebAuthnCredentials     = 10
+	MaxCredentialNameLength    = 64
+	LoginAttemptWindow         = time.Hour
+	LoginBackoffBase           = time.Second
+	LoginMaxBackoff            = 5 * time.Minute
+	LoginLockoutTime           = time.Hour
+	AccountFreeLoginAttempts   = 3
+	AccountLockoutThreshold    = 10
+	IPFreeLoginAttempts        = 20
+	IPLockoutThreshold         = 100
+	AccountUnlockTokenTime     = time.Hour
+	MaxUserAgentLength         = 512
+	MaxPersonalAccessTokens    = 20
+	MaxPersonalAccessTokenDays = 365
+	MaxModerationReasonLength  = 1000
+	MaxReportDetailsLength     = 1000
+	ReportAutoHideThreshold    = 3
+	MinReportAccountAge        = 24 * time.Hour
+	MaxAvatarUploadBytes       = 2 * 1024 * 1024 // 2MB
+	// MaxAvatarSourceDimension is checked before decoding, a small file can claim a huge image
+	MaxAvatarSourceDimension = 4096
+	AvatarSize               = 256
+	DataExportLinkTime       = 24 * time.Hour
+	// an export still pending after this long was lost, for example in a restart, and a new one may start
+	DataExportBuildTime = time.Hour
+	// MaxConcurrentExportBuilds bounds the archives built at once, a request beyond it gets a 503
+	MaxConcurrentExportBuilds = 4
+	// RowSecurityGrantTime bounds a transaction of BeginAsUser, its grant is useless afterwards
+	RowSecurityGrantTime = time.Minute
+	// a new reset link is refused for this long after the last one, the earlier link still works
+	PasswordResetEmailCooldown = 2 * time.Minute
+	// the counters of every per-IP limit are kept this long, no limit may use a longer window
+	MaxRateLimitWindow = time.Hour
+	// how many requests one IP may send within MaxRateLimitWindow to the endpoints that send emails or take tokens
+	PasswordForgotIPLimit     = 10
+	VerificationResendIPLimit = 10
+	PasswordResetIPLimit      = 20
+	UnlockIPLimit             = 20
+	MailQueueSize             = 100
+	MailQueueWorkers          = 4
+	// ShutdownTimeout is how long a stopping server waits for requests and queued emails
+	ShutdownTimeout = 30 * time.Second
+)
+
+// Defines the dynamic scoring defaults, the point values decay with every solve.
+const (
+	DefaultInitialPoints  = 500
+	DefaultMinimumPoints  = 100
+	DefaultPointsDecay    = 20
+	MaxChallengePoints    = 10000
+	FirstBloodBonusPoints = 50
 )
 
 // Defines standard error codes for API request validation failures.
@@ -164,6 +463,9 @@ const (
 	MSG_MALFORMED_REQUEST_DATA   = "MALFORMED_REQUEST_DATA"
 	MSG_CONFLICTING_FIELDS       = "CONFLICTING_FIELDS"
 	MSG_LACKING_MANDATORY_FIELDS = "LACKING_MANDATORY_FIELDS"
+	MSG_TOO_MANY_REQUESTS        = "TOO_MANY_REQUESTS"
+	MSG_ACCOUNT_LOCKED           = "ACCOUNT_LOCKED"
+	MSG_IP_LOCKED                = "IP_LOCKED"
 )
 
 // Defines enumerated integer codes for classifying various error types.
@@ -185,6 +487,10 @@ const (
 	InvalidData
 	InternalError
 	LackingPermission
+	TooManyRequests
+	MFARequired
+	AccountLocked
+	IPLocked
 )
 
 /*
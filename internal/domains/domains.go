@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"regexp"
 	"strings"
 )
 
@@ -59,3 +60,61 @@ func (c *ChallengeName) Scan(value any) error {
 func (c ChallengeName) MarshalJSON() ([]byte, error) {
 	return json.Marshal(c.value)
 }
+
+// FlagMatchMode decides how a submitted flag is compared against a stored flag.
+type FlagMatchMode string
+
+const (
+	FlagMatchExact           FlagMatchMode = "exact"
+	FlagMatchCaseInsensitive FlagMatchMode = "case_insensitive"
+	FlagMatchRegex           FlagMatchMode = "regex"
+)
+
+type ChallengeFlag struct {
+	value     string
+	matchMode FlagMatchMode
+}
+
+/*
+NewChallengeFlag validates a flag submitted by a challenge author. An empty
+match mode defaults to exact matching, regex flags must compile and are always
+matched against the whole submission.
+*/
+func NewChallengeFlag(flag, matchMode string) (ChallengeFlag, error) {
+	if len(flag) > 256 {
+		return ChallengeFlag{}, fmt.Errorf("flag is too long (%d/256 characters)", len(flag))
+	}
+
+	trimmed := strings.TrimSpace(flag)
+	if trimmed == "" {
+		return ChallengeFlag{}, errors.New("flag cannot be empty")
+	}
+
+	mode := FlagMatchMode(strings.TrimSpace(matchMode))
+	switch mode {
+	case "":
+		mode = FlagMatchExact
+	case FlagMatchExact, FlagMatchCaseInsensitive:
+	case FlagMatchRegex:
+		if _, err := regexp.Compile(AnchorFlagPattern(trimmed)); err != nil {
+			return ChallengeFlag{}, fmt.Errorf("flag is not a valid regular expression: %v", err)
+		}
+	default:
+		return ChallengeFlag{}, fmt.Errorf("matchMode must be one of %s, %s or %s", FlagMatchExact, FlagMatchCaseInsensitive, FlagMatchRegex)
+	}
+
+	return ChallengeFlag{value: trimmed, matchMode: mode}, nil
+}
+
+func (f ChallengeFlag) String() string {
+	return f.value
+}
+
+func (f ChallengeFlag) MatchMode() FlagMatchMode {
+	return f.matchMode
+}
+
+// AnchorFlagPattern forces a regex flag to match the whole submission instead of a substring.
+func AnchorFlagPattern(pattern string) string {
+	return `^(?:` + pattern + `)$`
+}
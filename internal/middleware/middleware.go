@@ -1,20 +1,40 @@
 package middleware
 
 import (
+	"fmt"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/policy"
+	"github.com/RichardHoa/hack-me/internal/store"
 	"github.com/RichardHoa/hack-me/internal/utils"
 )
 
 type MiddleWare struct {
-	Logger *log.Logger
+	Logger                   *log.Logger
+	UserStore                store.UserStore
+	PersonalAccessTokenStore store.PersonalAccessTokenStore
+	TokenStore               store.TokenStore
+	SecurityEventStore       store.SecurityEventStore
+	RateLimitStore           store.RateLimitStore
+	Policy                   *policy.Engine
 }
 
-func NewMiddleWare(logger *log.Logger) MiddleWare {
-	return MiddleWare{Logger: logger}
+func NewMiddleWare(logger *log.Logger, userStore store.UserStore, personalAccessTokenStore store.PersonalAccessTokenStore, tokenStore store.TokenStore, securityEventStore store.SecurityEventStore, rateLimitStore store.RateLimitStore, policyEngine *policy.Engine) MiddleWare {
+	return MiddleWare{
+		Logger:                   logger,
+		UserStore:                userStore,
+		PersonalAccessTokenStore: personalAccessTokenStore,
+		TokenStore:               tokenStore,
+		SecurityEventStore:       securityEventStore,
+		RateLimitStore:           rateLimitStore,
+		Policy:                   policyEngine,
+	}
 }
 
 func (middleware *MiddleWare) LimitSizeMiddleware(next http.Handler) http.Handler {
@@ -76,12 +96,178 @@ func (middleware *MiddleWare) WaitMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+/*
+Authenticate puts the logged in user in the request context. A bearer token in
+the Authorization header wins over cookies and is refused outright when it is
+invalid, the client asked for that identity and should not silently get another.
+Requests without a valid login are passed on, the handlers answer them with 401.
+*/
+func (middleware *MiddleWare) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization := r.Header.Get("Authorization")
+		if authorization != "" {
+			scheme, token, found := strings.Cut(authorization, " ")
+			if !found || !strings.EqualFold(scheme, "Bearer") || token == "" {
+				utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(
+					constants.UnauthorizedMessage,
+					constants.MSG_LACKING_MANDATORY_FIELDS,
+					"Authorization",
+				))
+				return
+			}
+
+			user, err := middleware.bearerUser(token)
+			if err != nil {
+				if utils.ClassifyError(err) != constants.InvalidData {
+					middleware.Logger.Printf("Middleware > Authenticate: failed to check bearer token: %v", err)
+					utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(
+						constants.StatusInternalErrorMessage,
+						"",
+						"",
+					))
+					return
+				}
+
+				middleware.Logger.Printf("Middleware > Authenticate: invalid bearer token: %v", err)
+				utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(
+					constants.UnauthorizedMessage,
+					constants.MSG_LACKING_MANDATORY_FIELDS,
+					"Authorization",
+				))
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(utils.WithAuthenticatedUser(r.Context(), user)))
+			return
+		}
+
+		result, err := utils.GetValuesFromCookie(r, []string{constants.JWTUserID, constants.JWTUserName, constants.JWTRefreshTokenID})
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := utils.WithAuthenticatedUser(r.Context(), utils.AuthenticatedUser{
+			ID:        result[0],
+			UserName:  result[1],
+			SessionID: result[2],
+			Method:    constants.AuthMethodCookie,
+		})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// bearerUser identifies the user of a personal access token or of an access token JWT
+func (middleware *MiddleWare) bearerUser(token string) (utils.AuthenticatedUser, error) {
+	if strings.HasPrefix(token, constants.PersonalAccessTokenPrefix) {
+		owner, err := middleware.PersonalAccessTokenStore.AuthenticatePersonalAccessToken(token)
+		if err != nil {
+			return utils.AuthenticatedUser{}, err
+		}
+
+		return utils.AuthenticatedUser{
+			ID:       owner.UserID,
+			UserName: owner.UserName,
+			Method:   constants.AuthMethodPersonalAccessToken,
+			Scopes:   owner.Scopes,
+		}, nil
+	}
+
+	userID, userName, sessionID, err := utils.ParseBearerToken(token)
+	if err != nil {
+		return utils.AuthenticatedUser{}, utils.NewCustomAppError(constants.InvalidData, err.Error())
+	}
+
+	// a logout or a revoked session has to end its access tokens too, not only the refresh token
+	active, err := middleware.TokenStore.IsSessionActive(userID, sessionID)
+	if err != nil {
+		return utils.AuthenticatedUser{}, err
+	}
+	if !active {
+		return utils.AuthenticatedUser{}, utils.NewCustomAppError(constants.InvalidData, "the session of the access token has ended")
+	}
+
+	return utils.AuthenticatedUser{
+		ID:       userID,
+		UserName: userName,
+		Method:   constants.AuthMethodBearer,
+	}, nil
+}
+
+/*
+RequireScope lets a personal access token through to the route only when it
+holds scope. Routes without it refuse personal access tokens, see
+utils.GetAuthenticatedUser. Other logins may use every route.
+*/
+func (middleware *MiddleWare) RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := utils.LookupAuthenticatedUser(r)
+			if !ok || user.Method != constants.AuthMethodPersonalAccessToken {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if !user.HasScope(scope) {
+				utils.WriteJSON(w, http.StatusForbidden, utils.NewMessage(
+					fmt.Sprintf("This access token lacks the %s scope", scope),
+					constants.MSG_INVALID_REQUEST_DATA,
+					"Authorization",
+				))
+				return
+			}
+
+			user.ScopeChecked = true
+			next.ServeHTTP(w, r.WithContext(utils.WithAuthenticatedUser(r.Context(), user)))
+		})
+	}
+}
+
+/*
+LimitPerIP refuses requests with a 429 once the client IP sent more than the
+limit within its window. It guards the endpoints that send emails or take
+tokens, so that one client cannot flood inboxes or guess tokens without end.
+*/
+func (middleware *MiddleWare) LimitPerIP(limit store.RateLimit) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			retryAfter, err := middleware.RateLimitStore.AllowRequest(limit, utils.ClientIP(r))
+			if err != nil {
+				if utils.ClassifyError(err) == constants.TooManyRequests {
+					w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+					utils.WriteJSON(w, http.StatusTooManyRequests, utils.NewMessage(err.Error(), constants.MSG_TOO_MANY_REQUESTS, "request"))
+					return
+				}
+
+				middleware.Logger.Printf("ERROR: LimitPerIP > AllowRequest %s: %v", limit.Bucket, err)
+				utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(constants.StatusInternalErrorMessage, "", ""))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+/*
+RequireCSRFToken checks the CSRF token of cookie logins. Bearer tokens are never
+sent by the browser on its own, so requests authenticated with one, personal
+access tokens included, skip the check.
+*/
 func (middleware *MiddleWare) RequireCSRFToken(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := utils.LookupAuthenticatedUser(r)
+		if ok && user.Method != constants.AuthMethodCookie {
+			next.ServeHTTP(w, r)
+			return
+		}
 
 		// 1: Get CSRF token from header
 		csrfToken := r.Header.Get("X-CSRF-Token")
 		if csrfToken == "" {
+			if ok {
+				middleware.recordCSRFRejected(r, user.ID, "missing token")
+			}
 			utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(
 				constants.UnauthorizedMessage,
 				constants.MSG_LACKING_MANDATORY_FIELDS,
@@ -90,10 +276,9 @@ func (middleware *MiddleWare) RequireCSRFToken(next http.Handler) http.Handler {
 			return
 		}
 
-		// Step 2: Validate refresh token from cookies
-		result, err := utils.GetValuesFromCookie(r, []string{constants.JWTRefreshTokenID})
-		if err != nil {
-			middleware.Logger.Printf("Middleware > RequireCSRFToken: failed to validate refreshToken: %v", err)
+		// Step 2: The cookie login the CSRF token was issued for
+		if !ok {
+			middleware.Logger.Printf("Middleware > RequireCSRFToken: no valid login cookies")
 			utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(
 				constants.UnauthorizedMessage,
 				constants.MSG_LACKING_MANDATORY_FIELDS,
@@ -102,10 +287,8 @@ func (middleware *MiddleWare) RequireCSRFToken(next http.Handler) http.Handler {
 			return
 		}
 
-		refreshTokenID := result[0]
-
 		// Step 3: Validate CSRF token against refreshTokenID
-		isValid, err := utils.CheckCSRFToken(csrfToken, refreshTokenID)
+		isValid, err := utils.CheckCSRFToken(csrfToken, user.SessionID)
 		if err != nil {
 			middleware.Logger.Printf("Middleware > RequireCSRFToken: error checking CSRF token: %v", err)
 			utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(
@@ -117,6 +300,7 @@ func (middleware *MiddleWare) RequireCSRFToken(next http.Handler) http.Handler {
 		}
 
 		if !isValid {
+			middleware.recordCSRFRejected(r, user.ID, "invalid token")
 			utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(
 				constants.UnauthorizedMessage,
 				constants.MSG_LACKING_MANDATORY_FIELDS,
@@ -129,3 +313,110 @@ func (middleware *MiddleWare) RequireCSRFToken(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+/*
+RequireCookieLogin keeps a route to logins from the browser. A short lived
+bearer access token is refused, so a leaked one cannot be traded for a long
+lived credential. Use it together with RequireCSRFToken.
+*/
+func (middleware *MiddleWare) RequireCookieLogin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := utils.LookupAuthenticatedUser(r)
+		if ok && user.Method != constants.AuthMethodCookie {
+			utils.WriteJSON(w, http.StatusForbidden, utils.NewMessage(
+				"This route is only available to logins from the browser",
+				constants.MSG_INVALID_REQUEST_DATA,
+				"Authorization",
+			))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+/*
+recordCSRFRejected keeps a trace of a cookie login whose request was refused. A
+cross site form posting with the cookies of the user shows up here.
+*/
+func (middleware *MiddleWare) recordCSRFRejected(r *http.Request, userID string, reason string) {
+	err := middleware.SecurityEventStore.RecordSecurityEvent(store.RecordSecurityEventRequest{
+		UserID:    userID,
+		EventType: store.SecurityEventCSRFRejected,
+		IPAddress: utils.ClientIP(r),
+		UserAgent: r.UserAgent(),
+		Detail:    fmt.Sprintf("%s on %s %s", reason, r.Method, r.URL.Path),
+	})
+	if err != nil {
+		middleware.Logger.Printf("ERROR: Middleware > RequireCSRFToken > RecordSecurityEvent: %v", err)
+	}
+}
+
+/*
+LoadSubject reads the role and verification status of the logged in user once
+per request, so the policy answers from the current row rather than from claims
+that outlive a demotion.
+*/
+func (middleware *MiddleWare) LoadSubject(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := utils.LookupAuthenticatedUser(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		subject, err := middleware.UserStore.GetSubject(user.ID)
+		if err != nil {
+			if utils.ClassifyError(err) != constants.ResourceNotFound {
+				middleware.Logger.Printf("Middleware > LoadSubject: failed to load subject: %v", err)
+				utils.WriteJSON(w, http.StatusInternalServerError, utils.NewMessage(
+					constants.StatusInternalErrorMessage,
+					"",
+					"",
+				))
+				return
+			}
+			// the account is gone, the handlers find that out on their own
+			subject = policy.Subject{UserID: user.ID}
+		}
+
+		next.ServeHTTP(w, r.WithContext(policy.WithSubject(r.Context(), subject)))
+	})
+}
+
+/*
+Authorize checks rules that only depend on the subject, like who may post or
+read the moderation log. Rules about a specific row are checked by the handler
+once it has loaded the row.
+*/
+func (middleware *MiddleWare) Authorize(action policy.Action, resourceType policy.ResourceType) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, err := utils.GetAuthenticatedUser(r)
+			if err != nil {
+				utils.WriteJSON(w, http.StatusUnauthorized, utils.NewMessage(
+					constants.UnauthorizedMessage,
+					constants.MSG_LACKING_MANDATORY_FIELDS,
+					"",
+				))
+				return
+			}
+
+			decision := middleware.Policy.Authorize(policy.SubjectFromContext(r.Context()), action, policy.Resource{Type: resourceType})
+			if !decision.Allowed {
+				source := ""
+				if action == policy.ActionCreate {
+					source = "email"
+				}
+				utils.WriteJSON(w, http.StatusForbidden, utils.NewMessage(
+					decision.Reason,
+					constants.MSG_INVALID_REQUEST_DATA,
+					source,
+				))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
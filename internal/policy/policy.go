@@ -0,0 +1,233 @@
+/*
+Package policy decides who may do what. Handlers describe the request as a
+subject, an action and a resource, and Engine.Authorize answers from the
+attributes alone, so every ownership and role rule lives in this file.
+*/
+package policy
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/utils"
+)
+
+type Action string
+
+const (
+	ActionCreate Action = "create"
+	ActionEdit   Action = "edit"
+	ActionDelete Action = "delete"
+	// ActionHide covers hiding content and showing it again
+	ActionHide   Action = "hide"
+	ActionVote   Action = "vote"
+	ActionSolve  Action = "solve"
+	ActionRead   Action = "read"
+	ActionManage Action = "manage"
+	ActionReport Action = "report"
+)
+
+type ResourceType string
+
+const (
+	ResourceChallenge          ResourceType = "challenge"
+	ResourceChallengeResponse  ResourceType = "challenge_response"
+	ResourceComment            ResourceType = "comment"
+	ResourceModerationLog      ResourceType = "moderation_log"
+	ResourceUserRole           ResourceType = "user_role"
+	ResourcePasswordHashReport ResourceType = "password_hash_report"
+	ResourceSecurityLog        ResourceType = "security_log"
+	ResourceReportQueue        ResourceType = "report_queue"
+)
+
+// Subject is who asks, an empty UserID is an anonymous visitor
+type Subject struct {
+	UserID        string
+	Role          string
+	EmailVerified bool
+	// EmailGrandfathered is set on accounts created before email verification existed, their email is still unproven
+	EmailGrandfathered bool
+	// JoinedAt is when the account was created, zero when unknown
+	JoinedAt time.Time
+}
+
+func (subject Subject) IsModerator() bool {
+	return subject.Role == constants.RoleModerator || subject.Role == constants.RoleAdmin
+}
+
+func (subject Subject) IsAdmin() bool {
+	return subject.Role == constants.RoleAdmin
+}
+
+/*
+Resource is what the action is done to. OwnerID is the author of content, or the
+user whose role is changed. Route level checks leave it empty.
+*/
+type Resource struct {
+	Type    ResourceType
+	OwnerID string
+	Hidden  bool
+}
+
+type Decision struct {
+	Allowed bool
+	// Moderated is set when only the role of the subject allows the action, it is then recorded and the owner told
+	Moderated bool
+	Reason    string
+}
+
+// Err turns a denial into the error the stores use for missing permissions
+func (decision Decision) Err() error {
+	if decision.Allowed {
+		return nil
+	}
+	return utils.NewCustomAppError(constants.LackingPermission, decision.Reason)
+}
+
+type Engine struct {
+	// RequireVerifiedEmail blocks unverified users from posting content
+	RequireVerifiedEmail bool
+}
+
+func NewEngine(requireVerifiedEmail bool) *Engine {
+	return &Engine{
+		RequireVerifiedEmail: requireVerifiedEmail,
+	}
+}
+
+func allow() Decision {
+	return Decision{Allowed: true}
+}
+
+func deny(reason string) Decision {
+	return Decision{Reason: reason}
+}
+
+// Authorize denies anything no rule allows
+func (engine *Engine) Authorize(subject Subject, action Action, resource Resource) Decision {
+	if subject.UserID == "" {
+		return deny("You must be logged in")
+	}
+
+	switch resource.Type {
+	case ResourceChallenge, ResourceChallengeResponse, ResourceComment:
+		return engine.authorizeContent(subject, action, resource)
+	case ResourceModerationLog:
+		if action == ActionRead && subject.IsModerator() {
+			return allow()
+		}
+		return deny("Only moderators can read the moderation log")
+	case ResourceReportQueue:
+		if (action == ActionRead || action == ActionManage) && subject.IsModerator() {
+			return allow()
+		}
+		return deny("Only moderators can triage reports")
+	case ResourcePasswordHashReport:
+		if action == ActionRead && subject.IsAdmin() {
+			return allow()
+		}
+		return deny("Only admins can read the password hash report")
+	case ResourceSecurityLog:
+		// users read their own events through their profile, this is the log of everyone
+		if action == ActionRead && subject.IsAdmin() {
+			return allow()
+		}
+		return deny("Only admins can read the security log")
+	case ResourceUserRole:
+		if action != ActionManage || !subject.IsAdmin() {
+			return deny("Only admins can change roles")
+		}
+		// the last admin would otherwise be able to lock everyone out
+		if resource.OwnerID == subject.UserID {
+			return deny("You cannot change your own role")
+		}
+		return allow()
+	}
+
+	return deny(fmt.Sprintf("Unknown resource %q", resource.Type))
+}
+
+func (engine *Engine) authorizeContent(subject Subject, action Action, resource Resource) Decision {
+	switch action {
+	case ActionCreate:
+		if engine.RequireVerifiedEmail && !subject.EmailVerified && !subject.EmailGrandfathered {
+			return deny("Please verify your email before posting")
+		}
+		return allow()
+
+	case ActionEdit, ActionDelete:
+		if resource.OwnerID == subject.UserID {
+			return allow()
+		}
+		if subject.IsModerator() {
+			return Decision{Allowed: true, Moderated: true}
+		}
+		return deny(fmt.Sprintf("You don't have permission to %s this %s", action, contentName(resource.Type)))
+
+	case ActionHide:
+		if subject.IsModerator() {
+			return Decision{Allowed: true, Moderated: true}
+		}
+		return deny("Only moderators can hide content")
+
+	case ActionVote:
+		if resource.Type != ResourceChallengeResponse {
+			return deny(fmt.Sprintf("You cannot vote on a %s", contentName(resource.Type)))
+		}
+		if resource.Hidden {
+			return deny("This challenge response is hidden")
+		}
+		return allow()
+
+	case ActionReport:
+		if resource.OwnerID == subject.UserID {
+			return deny(fmt.Sprintf("You cannot report your own %s", contentName(resource.Type)))
+		}
+		// reports hide content automatically, so throwaway accounts must not be able to file them
+		if !subject.EmailVerified {
+			return deny("Please verify your email before reporting content")
+		}
+		if subject.JoinedAt.IsZero() || time.Since(subject.JoinedAt) < constants.MinReportAccountAge {
+			return deny(fmt.Sprintf("Accounts can report content once they are %d hours old", int(constants.MinReportAccountAge.Hours())))
+		}
+		if resource.Hidden {
+			return deny(fmt.Sprintf("This %s is already hidden", contentName(resource.Type)))
+		}
+		return allow()
+
+	case ActionSolve:
+		if resource.Type != ResourceChallenge {
+			return deny(fmt.Sprintf("You cannot solve a %s", contentName(resource.Type)))
+		}
+		if resource.OwnerID == subject.UserID {
+			return deny("You cannot solve your own challenge")
+		}
+		if resource.Hidden {
+			return deny("This challenge is hidden")
+		}
+		return allow()
+	}
+
+	return deny(fmt.Sprintf("Unknown action %q", action))
+}
+
+func contentName(resourceType ResourceType) string {
+	if resourceType == ResourceChallengeResponse {
+		return "challenge response"
+	}
+	return string(resourceType)
+}
+
+type subjectContextKey struct{}
+
+func WithSubject(ctx context.Context, subject Subject) context.Context {
+	return context.WithValue(ctx, subjectContextKey{}, subject)
+}
+
+// SubjectFromContext returns the subject loaded by the middleware, anonymous when there is none
+func SubjectFromContext(ctx context.Context) Subject {
+	subject, _ := ctx.Value(subjectContextKey{}).(Subject)
+	return subject
+}
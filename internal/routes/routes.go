@@ -6,10 +6,20 @@ import (
 
 	"github.com/RichardHoa/hack-me/internal/app"
 	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/policy"
+	"github.com/RichardHoa/hack-me/internal/store"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 )
 
+// per-IP limits of the endpoints that send emails or take tokens
+var (
+	passwordForgotLimit     = store.RateLimit{Bucket: "password_forgot", Limit: constants.PasswordForgotIPLimit, Window: constants.MaxRateLimitWindow}
+	verificationResendLimit = store.RateLimit{Bucket: "verification_resend", Limit: constants.VerificationResendIPLimit, Window: constants.MaxRateLimitWindow}
+	passwordResetLimit      = store.RateLimit{Bucket: "password_reset", Limit: constants.PasswordResetIPLimit, Window: constants.MaxRateLimitWindow}
+	unlockLimit             = store.RateLimit{Bucket: "unlock", Limit: constants.UnlockIPLimit, Window: constants.MaxRateLimitWindow}
+)
+
 func SetUpRoutes(app *app.Application) *chi.Mux {
 	router := chi.NewRouter()
 
@@ -29,10 +39,14 @@ func SetUpRoutes(app *app.Application) *chi.Mux {
 		fmt.Fprintf(w, "Service is available\n")
 	})
 
+	router.Get("/.well-known/jwks.json", app.JWKSHandler.GetJWKS)
+
 	router.Route("/v1", func(outerRouter chi.Router) {
 		outerRouter.Use(app.Middleware.LimitSizeMiddleware)
 		outerRouter.Use(app.Middleware.NoCacheMiddleware)
 		outerRouter.Use(app.Middleware.NoOptionsMiddleware)
+		outerRouter.Use(app.Middleware.Authenticate)
+		outerRouter.Use(app.Middleware.LoadSubject)
 
 		// use middleware to stimulate the lag in production
 
@@ -47,23 +61,24 @@ func SetUpRoutes(app *app.Application) *chi.Mux {
 		outerRouter.Post("/chatbox", app.ChatboxHandler.HandleChat)
 
 		outerRouter.Route("/challenges", func(r chi.Router) {
-			r.Get("/", app.ChallengeHandler.GetChallenges)
+			r.With(app.Middleware.RequireScope(constants.ScopeRead)).Get("/", app.ChallengeHandler.GetChallenges)
 
 			r.Group(func(csrfRouter chi.Router) {
 				csrfRouter.Use(app.Middleware.RequireCSRFToken)
-				csrfRouter.Post("/", app.ChallengeHandler.PostChallenge)
-				csrfRouter.Put("/", app.ChallengeHandler.ModifyChallenge)
-				csrfRouter.Delete("/", app.ChallengeHandler.DeleteChallege)
+				csrfRouter.With(app.Middleware.RequireScope(constants.ScopeChallengesWrite), app.Middleware.Authorize(policy.ActionCreate, policy.ResourceChallenge)).Post("/", app.ChallengeHandler.PostChallenge)
+				csrfRouter.With(app.Middleware.RequireScope(constants.ScopeChallengesWrite)).Put("/", app.ChallengeHandler.ModifyChallenge)
+				csrfRouter.With(app.Middleware.RequireScope(constants.ScopeChallengesWrite)).Delete("/", app.ChallengeHandler.DeleteChallege)
+				csrfRouter.Post("/{challengeID}/submissions", app.ChallengeHandler.SubmitFlag)
 			})
 
 			r.Route("/responses", func(innerRouter chi.Router) {
-				innerRouter.Get("/", app.ChallengeResponseHandler.GetChallengeResponse)
+				innerRouter.With(app.Middleware.RequireScope(constants.ScopeRead)).Get("/", app.ChallengeResponseHandler.GetChallengeResponse)
 
 				innerRouter.Group(func(csrfRouter chi.Router) {
 					csrfRouter.Use(app.Middleware.RequireCSRFToken)
-					csrfRouter.Post("/", app.ChallengeResponseHandler.PostChallengeResponse)
-					csrfRouter.Put("/", app.ChallengeResponseHandler.ModifyChallengeResponse)
-					csrfRouter.Delete("/", app.ChallengeResponseHandler.DeleteChallengeResponse)
+					csrfRouter.With(app.Middleware.RequireScope(constants.ScopeResponsesWrite), app.Middleware.Authorize(policy.ActionCreate, policy.ResourceChallengeResponse)).Post("/", app.ChallengeResponseHandler.PostChallengeResponse)
+					csrfRouter.With(app.Middleware.RequireScope(constants.ScopeResponsesWrite)).Put("/", app.ChallengeResponseHandler.ModifyChallengeResponse)
+					csrfRouter.With(app.Middleware.RequireScope(constants.ScopeResponsesWrite)).Delete("/", app.ChallengeResponseHandler.DeleteChallengeResponse)
 				})
 
 				innerRouter.Route("/votes", func(router chi.Router) {
@@ -77,28 +92,111 @@ func SetUpRoutes(app *app.Application) *chi.Mux {
 
 		})
 
+		outerRouter.Get("/scoreboard", app.ScoreboardHandler.GetScoreboard)
+		outerRouter.Get("/avatars/{fileName}", app.AvatarHandler.GetAvatar)
+
 		outerRouter.Route("/comments", func(r chi.Router) {
 			r.Use(app.Middleware.RequireCSRFToken)
 			r.Put("/", app.CommentHandler.ModifyComment)
-			r.Post("/", app.CommentHandler.PostComment)
+			r.With(app.Middleware.Authorize(policy.ActionCreate, policy.ResourceComment)).Post("/", app.CommentHandler.PostComment)
 			r.Delete("/", app.CommentHandler.DeleteComment)
 
 		})
 
+		outerRouter.Route("/bookmarks", func(r chi.Router) {
+			r.Use(app.Middleware.RequireCSRFToken)
+			r.Post("/", app.BookmarkHandler.AddBookmark)
+			r.Delete("/", app.BookmarkHandler.DeleteBookmark)
+		})
+
+		outerRouter.Route("/reports", func(r chi.Router) {
+			r.With(app.Middleware.RequireCSRFToken).Post("/", app.ReportHandler.CreateReport)
+			r.With(app.Middleware.Authorize(policy.ActionRead, policy.ResourceReportQueue)).Get("/", app.ReportHandler.GetReports)
+			r.With(app.Middleware.RequireCSRFToken, app.Middleware.Authorize(policy.ActionManage, policy.ResourceReportQueue)).Put("/{reportID}", app.ReportHandler.ResolveReport)
+		})
+
+		outerRouter.Route("/moderation", func(r chi.Router) {
+			r.Use(app.Middleware.Authorize(policy.ActionRead, policy.ResourceModerationLog))
+			r.Get("/actions", app.ModerationHandler.GetModerationActions)
+			r.With(app.Middleware.RequireCSRFToken).Post("/actions", app.ModerationHandler.ChangeVisibility)
+		})
+
+		outerRouter.Route("/admin", func(r chi.Router) {
+			r.With(app.Middleware.Authorize(policy.ActionRead, policy.ResourcePasswordHashReport)).Get("/password-hashes", app.AdminHandler.GetPasswordHashReport)
+			r.With(app.Middleware.Authorize(policy.ActionRead, policy.ResourceSecurityLog)).Get("/security-events", app.SecurityEventHandler.GetSecurityEvents)
+			r.With(app.Middleware.RequireCSRFToken, app.Middleware.Authorize(policy.ActionManage, policy.ResourceUserRole)).Put("/users/{userID}/role", app.AdminHandler.SetUserRole)
+		})
+
 		outerRouter.Route("/auth", func(r chi.Router) {
 			r.Get("/tokens", app.UserHandler.RefreshTokenRotation)
+			r.Get("/sessions", app.UserHandler.GetSessions)
+
+			r.Route("/webauthn", func(webAuthnRouter chi.Router) {
+				webAuthnRouter.Post("/login/start", app.WebAuthnHandler.StartLogin)
+				webAuthnRouter.Post("/login/finish", app.WebAuthnHandler.FinishLogin)
+				webAuthnRouter.Get("/credentials", app.WebAuthnHandler.GetCredentials)
+
+				// a leaked access token must not be able to add a passkey of its own
+				webAuthnRouter.Group(func(csrfRouter chi.Router) {
+					csrfRouter.Use(app.Middleware.RequireCookieLogin, app.Middleware.RequireCSRFToken)
+					csrfRouter.Post("/register/start", app.WebAuthnHandler.StartRegistration)
+					csrfRouter.Post("/register/finish", app.WebAuthnHandler.FinishRegistration)
+					csrfRouter.Delete("/credentials/{credentialID}", app.WebAuthnHandler.DeleteCredential)
+				})
+			})
+
+			r.Get("/{provider}/start", app.OAuthHandler.StartLogin)
+			r.Get("/{provider}/callback", app.OAuthHandler.Callback)
+
+			r.Group(func(csrfRouter chi.Router) {
+				csrfRouter.Use(app.Middleware.RequireCSRFToken)
+				csrfRouter.Delete("/sessions", app.UserHandler.DeleteAllSessions)
+				csrfRouter.Delete("/sessions/{sessionID}", app.UserHandler.DeleteSession)
+			})
 		})
 
 		outerRouter.Route("/users", func(r chi.Router) {
 			r.Post("/", app.UserHandler.RegisterNewUser)
 			r.Post("/login", app.UserHandler.LoginUser)
+			r.Post("/login/mfa", app.MFAHandler.LoginWithMFACode)
 			r.Post("/logout", app.UserHandler.LogoutUser)
+			r.Post("/verify-email", app.UserHandler.VerifyEmail)
+			r.With(app.Middleware.LimitPerIP(verificationResendLimit)).Post("/verify-email/resend", app.UserHandler.ResendVerificationEmail)
 
-			r.Get("/me", app.UserHandler.GetUserActivity)
+			r.With(app.Middleware.RequireScope(constants.ScopeRead)).Get("/me", app.UserHandler.GetUserActivity)
 			r.Delete("/me", app.UserHandler.DeleteUser)
+			r.Get("/me/security-events", app.SecurityEventHandler.GetMySecurityEvents)
+			r.With(app.Middleware.RequireScope(constants.ScopeRead)).Get("/me/bookmarks", app.BookmarkHandler.GetMyBookmarks)
+
+			r.With(app.Middleware.RequireCookieLogin, app.Middleware.RequireCSRFToken).Put("/password", app.UserHandler.ChangePassword)
+			r.With(app.Middleware.LimitPerIP(passwordForgotLimit)).Post("/password/forgot", app.UserHandler.ForgotPassword)
+			r.With(app.Middleware.LimitPerIP(passwordResetLimit)).Post("/password/reset", app.UserHandler.ResetPassword)
+			r.With(app.Middleware.LimitPerIP(unlockLimit)).Post("/unlock", app.UserHandler.UnlockAccount)
 
-			r.Put("/password", app.UserHandler.ChangePassword)
+			// two-factor settings change only from the browser, like passkeys and passwords
+			r.Group(func(csrfRouter chi.Router) {
+				csrfRouter.Use(app.Middleware.RequireCookieLogin, app.Middleware.RequireCSRFToken)
+				csrfRouter.Post("/me/mfa/totp", app.MFAHandler.StartTOTPEnrollment)
+				csrfRouter.Post("/me/mfa/totp/confirm", app.MFAHandler.ConfirmTOTPEnrollment)
+				csrfRouter.Delete("/me/mfa/totp", app.MFAHandler.DisableTOTP)
+				csrfRouter.Post("/me/mfa/recovery-codes", app.MFAHandler.RegenerateRecoveryCodes)
+			})
 			r.Put("/username", app.UserHandler.ChangeUsername)
+			r.With(app.Middleware.RequireCSRFToken).Put("/me/avatar", app.AvatarHandler.UploadAvatar)
+
+			// personal data leaves through cookie logins only, bearer tokens of any kind are refused
+			r.With(app.Middleware.RequireCookieLogin, app.Middleware.RequireCSRFToken).Post("/me/export", app.ExportHandler.RequestExport)
+			r.Get("/me/exports/{exportID}", app.ExportHandler.GetExport)
+			r.Get("/me/exports/{exportID}/archive", app.ExportHandler.DownloadExport)
+			r.Get("/{userName}", app.UserHandler.GetPublicProfile)
+
+			// personal access tokens cannot manage personal access tokens, no route here has a scope
+			r.Get("/me/tokens", app.PersonalAccessTokenHandler.GetPersonalAccessTokens)
+			r.Group(func(csrfRouter chi.Router) {
+				csrfRouter.Use(app.Middleware.RequireCookieLogin, app.Middleware.RequireCSRFToken)
+				csrfRouter.Post("/me/tokens", app.PersonalAccessTokenHandler.CreatePersonalAccessToken)
+				csrfRouter.Delete("/me/tokens/{tokenID}", app.PersonalAccessTokenHandler.DeletePersonalAccessToken)
+			})
 
 		})
 
@@ -0,0 +1,86 @@
+package store
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/utils"
+	"github.com/google/uuid"
+)
+
+// BlobStore keeps uploaded files, a key is a slash separated path such as "avatars/<id>.png"
+type BlobStore interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+}
+
+/*
+LocalBlobStore keeps the files in a directory of the local disk. Every access
+goes through os.Root, so a key cannot reach outside of the directory even with
+".." or a symlink in it.
+*/
+type LocalBlobStore struct {
+	root *os.Root
+}
+
+func NewLocalBlobStore(dir string) (*LocalBlobStore, error) {
+	err := os.MkdirAll(dir, 0o750)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LocalBlobStore{root: root}, nil
+}
+
+// Put writes to a temporary file first, a reader never sees half of a blob
+func (blobStore *LocalBlobStore) Put(key string, data []byte) error {
+	err := blobStore.root.MkdirAll(path.Dir(key), 0o750)
+	if err != nil {
+		return err
+	}
+
+	tmpKey := key + "." + uuid.NewString() + ".tmp"
+	err = blobStore.root.WriteFile(tmpKey, data, 0o640)
+	if err != nil {
+		return err
+	}
+
+	err = blobStore.root.Rename(tmpKey, key)
+	if err != nil {
+		blobStore.root.Remove(tmpKey)
+		return err
+	}
+
+	return nil
+}
+
+func (blobStore *LocalBlobStore) Get(key string) ([]byte, error) {
+	data, err := blobStore.root.ReadFile(key)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, utils.NewCustomAppError(constants.ResourceNotFound, "file not found")
+		}
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// Delete does nothing when the blob is already gone
+func (blobStore *LocalBlobStore) Delete(key string) error {
+	err := blobStore.root.Remove(key)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,257 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/utils"
+)
+
+// Defines what a user can bookmark.
+const (
+	BookmarkTargetChallenge         = "challenge"
+	BookmarkTargetChallengeResponse = "challenge_response"
+)
+
+// bookmarkTargets maps a target type to its table and the bookmark column pointing at it, both static
+var bookmarkTargets = map[string]struct{ table, column string }{
+	BookmarkTargetChallenge:         {"challenge", "challenge_id"},
+	BookmarkTargetChallengeResponse: {"challenge_response", "challenge_response_id"},
+}
+
+type DBBookmarkStore struct {
+	DB          *sql.DB
+	RowSecurity *RowSecurityDB
+}
+
+func NewBookmarkStore(db *sql.DB, rowSecurity *RowSecurityDB) *DBBookmarkStore {
+	return &DBBookmarkStore{
+		DB:          db,
+		RowSecurity: rowSecurity,
+	}
+}
+
+type BookmarkRequest struct {
+	TargetType string `json:"targetType"`
+	TargetID   string `json:"targetID"`
+	UserID     string `json:"-"`
+}
+
+type GetBookmarksParams struct {
+	UserID   string
+	Page     *int
+	PageSize *int
+}
+
+// Bookmark holds a summary of what was saved, only the field of its target type is set
+type Bookmark struct {
+	ID                string                       `json:"id"`
+	TargetType        string                       `json:"targetType"`
+	CreatedAt         time.Time                    `json:"createdAt"`
+	Challenge         *BookmarkedChallenge         `json:"challenge,omitempty"`
+	ChallengeResponse *BookmarkedChallengeResponse `json:"challengeResponse,omitempty"`
+}
+
+type BookmarkedChallenge struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Category string `json:"category"`
+	UserName string `json:"userName"`
+}
+
+type BookmarkedChallengeResponse struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	ChallengeName string `json:"challengeName"`
+	AuthorName    string `json:"authorName"`
+	UpVote        string `json:"upVote"`
+	DownVote      string `json:"downVote"`
+}
+
+type BookmarkStore interface {
+	AddBookmark(req BookmarkRequest) error
+	DeleteBookmark(req BookmarkRequest) error
+	GetBookmarks(params GetBookmarksParams) ([]Bookmark, *MetaDataPage, error)
+}
+
+// AddBookmark saves a challenge or response for the user, hidden content cannot be saved
+func (bookmarkStore *DBBookmarkStore) AddBookmark(req BookmarkRequest) error {
+	target, ok := bookmarkTargets[req.TargetType]
+	if !ok {
+		return utils.NewCustomAppError(constants.InvalidData, "targetType must be challenge or challenge_response")
+	}
+
+	tx, err := bookmarkStore.RowSecurity.BeginAsUser(req.UserID)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	// nosemgrep
+	query := fmt.Sprintf(`SELECT EXISTS (SELECT 1 FROM %s WHERE id = $1 AND hidden_at IS NULL)`, target.table) // #nosec G201 - static table
+	err = tx.QueryRow(query, req.TargetID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return utils.NewCustomAppError(constants.ResourceNotFound, fmt.Sprintf("%s not found", req.TargetType))
+	}
+
+	// nosemgrep
+	query = fmt.Sprintf(`
+		INSERT INTO user_bookmark (user_id, %s) VALUES ($1, $2)
+		ON CONFLICT DO NOTHING
+	`, target.column) // #nosec G201 - static column
+	result, err := tx.Exec(query, req.UserID, req.TargetID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return utils.NewCustomAppError(constants.InvalidData, fmt.Sprintf("%s is already bookmarked", req.TargetType))
+	}
+
+	return tx.Commit()
+}
+
+func (bookmarkStore *DBBookmarkStore) DeleteBookmark(req BookmarkRequest) error {
+	target, ok := bookmarkTargets[req.TargetType]
+	if !ok {
+		return utils.NewCustomAppError(constants.InvalidData, "targetType must be challenge or challenge_response")
+	}
+
+	tx, err := bookmarkStore.RowSecurity.BeginAsUser(req.UserID)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// nosemgrep
+	query := fmt.Sprintf(`DELETE FROM user_bookmark WHERE user_id = $1 AND %s = $2`, target.column) // #nosec G201 - static column
+	result, err := tx.Exec(query, req.UserID, req.TargetID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return utils.NewCustomAppError(constants.ResourceNotFound, "bookmark not found")
+	}
+
+	return tx.Commit()
+}
+
+// GetBookmarks lists the bookmarks of the user, newest first, content hidden since it was saved is left out
+func (bookmarkStore *DBBookmarkStore) GetBookmarks(params GetBookmarksParams) ([]Bookmark, *MetaDataPage, error) {
+	pageSize := constants.DefaultPageSize
+	if params.PageSize != nil {
+		pageSize = *params.PageSize
+	}
+
+	page := constants.DefaultPage
+	if params.Page != nil {
+		page = *params.Page
+	}
+
+	const visibleBookmarks = `
+		FROM user_bookmark b
+		LEFT JOIN challenge c ON c.id = b.challenge_id AND c.hidden_at IS NULL
+		LEFT JOIN "user" cu ON cu.id = c.user_id
+		LEFT JOIN challenge_response cr ON cr.id = b.challenge_response_id AND cr.hidden_at IS NULL
+		LEFT JOIN challenge crc ON crc.id = cr.challenge_id
+		LEFT JOIN "user" cru ON cru.id = cr.user_id
+		WHERE b.user_id = $1 AND (c.id IS NOT NULL OR cr.id IS NOT NULL)
+	`
+
+	var total int
+	err := bookmarkStore.DB.QueryRow(`SELECT COUNT(*) `+visibleBookmarks, params.UserID).Scan(&total)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	metaPage := MetaDataPage{
+		MaxPage:     strconv.Itoa((total + pageSize - 1) / pageSize),
+		PageSize:    strconv.Itoa(pageSize),
+		CurrentPage: strconv.Itoa(page),
+	}
+
+	rows, err := bookmarkStore.DB.Query(`
+		SELECT
+			b.id,
+			b.created_at,
+			c.id,
+			c.name,
+			c.category,
+			cu.username,
+			cr.id,
+			cr.name,
+			crc.name,
+			cru.username,
+			cr.up_vote,
+			cr.down_vote
+		`+visibleBookmarks+`
+		ORDER BY b.created_at DESC, b.id DESC
+		LIMIT $2 OFFSET $3
+	`, params.UserID, pageSize, (page-1)*pageSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	bookmarks := []Bookmark{}
+	for rows.Next() {
+		var (
+			bookmark                                                    Bookmark
+			challengeID, challengeName, category, challengeAuthor       sql.NullString
+			responseID, responseName, responseChallenge, responseAuthor sql.NullString
+			upVote, downVote                                            sql.NullString
+		)
+		err := rows.Scan(
+			&bookmark.ID, &bookmark.CreatedAt,
+			&challengeID, &challengeName, &category, &challengeAuthor,
+			&responseID, &responseName, &responseChallenge, &responseAuthor, &upVote, &downVote,
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if challengeID.Valid {
+			bookmark.TargetType = BookmarkTargetChallenge
+			bookmark.Challenge = &BookmarkedChallenge{
+				ID:       challengeID.String,
+				Name:     challengeName.String,
+				Category: category.String,
+				UserName: challengeAuthor.String,
+			}
+		} else {
+			bookmark.TargetType = BookmarkTargetChallengeResponse
+			bookmark.ChallengeResponse = &BookmarkedChallengeResponse{
+				ID:            responseID.String,
+				Name:          responseName.String,
+				ChallengeName: responseChallenge.String,
+				AuthorName:    responseAuthor.String,
+				UpVote:        upVote.String,
+				DownVote:      downVote.String,
+			}
+		}
+
+		bookmarks = append(bookmarks, bookmark)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return bookmarks, &metaPage, nil
+}
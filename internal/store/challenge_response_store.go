@@ -7,36 +7,45 @@ import (
 	"time"
 
 	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/policy"
 	"github.com/RichardHoa/hack-me/internal/utils"
 )
 
 type DBChallengeResponseStore struct {
 	DB           *sql.DB
+	RowSecurity  *RowSecurityDB
 	CommentStore *DBCommentStore
 }
 
-func NewChallengeResponseStore(db *sql.DB, commentStore *DBCommentStore) *DBChallengeResponseStore {
+func NewChallengeResponseStore(db *sql.DB, rowSecurity *RowSecurityDB, commentStore *DBCommentStore) *DBChallengeResponseStore {
 	return &DBChallengeResponseStore{
 		DB:           db,
+		RowSecurity:  rowSecurity,
 		CommentStore: commentStore,
 	}
 }
 
 type DeleteChallengeResponseRequest struct {
-	ChallengeResponseID string `json:"challengeResponseID"`
-	UserID              string `json:"-"`
+	ChallengeResponseID string  `json:"challengeResponseID"`
+	ModerationReason    *string `json:"moderationReason"`
+	UserID              string  `json:"-"`
+	Moderated           bool    `json:"-"`
 }
 
 type PutChallengeResponseRequest struct {
-	ChallengeResponseID string `json:"challengeResponseID"`
-	UserID              string `json:"-"`
-	Name                string `json:"name"`
-	Content             string `json:"content"`
+	ChallengeResponseID string  `json:"challengeResponseID"`
+	UserID              string  `json:"-"`
+	Name                string  `json:"name"`
+	Content             string  `json:"content"`
+	ModerationReason    *string `json:"moderationReason"`
+	Moderated           bool    `json:"-"`
 }
 
 type GetChallengeResponseRequest struct {
 	ChallengeID         string `json:"challengeID"`
 	ChallengeResponseID string `json:"challengeResponseID"`
+	// UserID is only set when the request is authenticated, it is used to compute isBookmarked
+	UserID string `json:"-"`
 }
 
 type ChallengeResponseOut []DetailChallengeResponse
@@ -49,6 +58,7 @@ type DetailChallengeResponse struct {
 	Content       string    `json:"content"`
 	UpVote        string    `json:"upVote"`
 	DownVote      string    `json:"downVote"`
+	IsBookmarked  bool      `json:"isBookmarked"`
 	CreatedAt     time.Time `json:"createdAt"`
 	UpdatedAt     time.Time `json:"updatedAt"`
 	Comments      []Comment `json:"comments"`
@@ -62,9 +72,10 @@ type PostChallengeResponseRequest struct {
 }
 
 type ChallengeResponseStore interface {
+	GetChallengeResponseResource(challengeResponseID string) (policy.Resource, error)
 	PostResponse(response PostChallengeResponseRequest) (challengeResponseID string, err error)
-	ModifyResponse(response PutChallengeResponseRequest) error
-	DeleteResponse(deleteRequest DeleteChallengeResponseRequest) error
+	ModifyResponse(response PutChallengeResponseRequest) (*ModerationAction, error)
+	DeleteResponse(deleteRequest DeleteChallengeResponseRequest) (*ModerationAction, error)
 	GetResponses(req GetChallengeResponseRequest) (*ChallengeResponseOut, error)
 }
 
@@ -76,10 +87,10 @@ func (store *DBChallengeResponseStore) GetResponses(req GetChallengeResponseRequ
 
 	switch {
 	case req.ChallengeResponseID != "":
-		whereClause = "cr.id = $1"
+		whereClause = "cr.id = $1 AND cr.hidden_at IS NULL"
 		arg = req.ChallengeResponseID
 	case req.ChallengeID != "":
-		whereClause = "cr.challenge_id = $1"
+		whereClause = "cr.challenge_id = $1 AND cr.hidden_at IS NULL"
 		arg = req.ChallengeID
 	default:
 		panic("The handler is supposed to reject if there is no challengeID or challengeResponseID")
@@ -96,7 +107,10 @@ func (store *DBChallengeResponseStore) GetResponses(req GetChallengeResponseRequ
         cr.created_at,
         cr.updated_at,
         u.username,
-        c.name AS challenge_name
+        c.name AS challenge_name,
+        EXISTS (
+            SELECT 1 FROM user_bookmark b WHERE b.challenge_response_id = cr.id AND b.user_id = $2
+        ) AS is_bookmarked
     FROM
         challenge_response AS cr
     JOIN
@@ -107,7 +121,8 @@ func (store *DBChallengeResponseStore) GetResponses(req GetChallengeResponseRequ
     ORDER BY cr.created_at ASC
 `, whereClause) // #nosec G201 - static where clause
 
-	rows, err := store.DB.Query(query, arg)
+	// an anonymous visitor has no bookmarks, NULL matches no user
+	rows, err := store.DB.Query(query, arg, utils.NullIfEmpty(req.UserID))
 	if err != nil {
 		return nil, utils.NewCustomAppError(constants.InternalError, fmt.Sprintf("fail to query challenge_response: %v", err))
 	}
@@ -117,7 +132,7 @@ func (store *DBChallengeResponseStore) GetResponses(req GetChallengeResponseRequ
 
 	for rows.Next() {
 		var r DetailChallengeResponse
-		if err := rows.Scan(&r.ID, &r.Name, &r.Content, &r.UpVote, &r.DownVote, &r.CreatedAt, &r.UpdatedAt, &r.AuthorName, &r.ChallengeName); err != nil {
+		if err := rows.Scan(&r.ID, &r.Name, &r.Content, &r.UpVote, &r.DownVote, &r.CreatedAt, &r.UpdatedAt, &r.AuthorName, &r.ChallengeName, &r.IsBookmarked); err != nil {
 			return nil, utils.NewCustomAppError(constants.InternalError, fmt.Sprintf("fail to scan challenge response: %v", err))
 		}
 
@@ -133,78 +148,100 @@ func (store *DBChallengeResponseStore) GetResponses(req GetChallengeResponseRequ
 }
 
 func (store *DBChallengeResponseStore) PostResponse(request PostChallengeResponseRequest) (challengeResponseID string, err error) {
+	tx, err := store.RowSecurity.BeginAsUser(request.UserID)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
 	query := `
 		INSERT INTO challenge_response (challenge_id, user_id, name, content)
 		VALUES ($1, $2, $3, $4)
 		RETURNING id
 	`
-	err = store.DB.QueryRow(query, request.ChallengeID, request.UserID, request.Name, request.Content).Scan(&challengeResponseID)
+	err = tx.QueryRow(query, request.ChallengeID, request.UserID, request.Name, request.Content).Scan(&challengeResponseID)
 	if err != nil {
 		return "", err
 	}
 
-	return challengeResponseID, err
+	return challengeResponseID, tx.Commit()
+}
+
+// GetChallengeResponseResource reads the attributes the policy needs about a challenge response
+func (store *DBChallengeResponseStore) GetChallengeResponseResource(challengeResponseID string) (policy.Resource, error) {
+	return getContentResource(store.DB, policy.ResourceChallengeResponse, "id", challengeResponseID)
 }
-func (store *DBChallengeResponseStore) DeleteResponse(deleteRequest DeleteChallengeResponseRequest) error {
+
+/*
+DeleteResponse deletes a response, the caller checks the policy first. The
+returned action is set when a moderator deleted someone else's response.
+*/
+func (store *DBChallengeResponseStore) DeleteResponse(deleteRequest DeleteChallengeResponseRequest) (*ModerationAction, error) {
+	tx, err := store.RowSecurity.BeginAsUser(deleteRequest.UserID)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
 	// Check if the challenge response exists
-	var ownerID string
-	checkQuery := `
-	SELECT user_id FROM challenge_response 
-	WHERE id = $1
-`
-	err := store.DB.QueryRow(checkQuery, deleteRequest.ChallengeResponseID).Scan(&ownerID)
+	content, err := lockChallengeResponse(tx, deleteRequest.ChallengeResponseID)
 	if err == sql.ErrNoRows {
-		return utils.NewCustomAppError(constants.InvalidData, "challenge_id does not exist")
+		return nil, utils.NewCustomAppError(constants.InvalidData, "challenge_id does not exist")
 	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Check if the user owns the challenge response
-	if ownerID != deleteRequest.UserID {
-		return utils.NewCustomAppError(constants.LackingPermission, "User does not have permission to delete this challenge response")
+	moderationAction, err := moderateContentChange(tx, deleteRequest.Moderated, deleteRequest.UserID, content, ModerationActionDelete, deleteRequest.ModerationReason)
+	if err != nil {
+		return nil, err
 	}
 
-	deleteQuery := `
-	DELETE FROM challenge_response
-	WHERE id = $1 AND user_id = $2
-	`
-
-	result, err := store.DB.Exec(deleteQuery, deleteRequest.ChallengeResponseID, deleteRequest.UserID)
+	result, err := tx.Exec(`DELETE FROM challenge_response WHERE id = $1`, content.targetID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if rowsAffected == 0 {
-		return utils.NewCustomAppError(constants.InternalError, "Internal server error, valid request but challenge response does not get deleted")
+		return nil, utils.NewCustomAppError(constants.InternalError, "Internal server error, valid request but challenge response does not get deleted")
 	}
 
-	return nil
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
 
+	return moderationAction, nil
 }
-func (store *DBChallengeResponseStore) ModifyResponse(request PutChallengeResponseRequest) error {
+
+/*
+ModifyResponse updates a response, the caller checks the policy first. The
+returned action is set when a moderator edited someone else's response.
+*/
+func (store *DBChallengeResponseStore) ModifyResponse(request PutChallengeResponseRequest) (*ModerationAction, error) {
+	tx, err := store.RowSecurity.BeginAsUser(request.UserID)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
 	// Check if the challenge response exists
-	var ownerID string
-	checkQuery := `
-	SELECT user_id FROM challenge_response 
-	WHERE id = $1
-`
-	err := store.DB.QueryRow(checkQuery, request.ChallengeResponseID).Scan(&ownerID)
+	content, err := lockChallengeResponse(tx, request.ChallengeResponseID)
 	if err == sql.ErrNoRows {
-		return utils.NewCustomAppError(constants.InvalidData, "challenge_id does not exist")
+		return nil, utils.NewCustomAppError(constants.InvalidData, "challenge_id does not exist")
 	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Check if the user owns the challenge response
-	if ownerID != request.UserID {
-		return utils.NewCustomAppError(constants.LackingPermission, "User does not have permission to modify this challenge response")
+	moderationAction, err := moderateContentChange(tx, request.Moderated, request.UserID, content, ModerationActionEdit, request.ModerationReason)
+	if err != nil {
+		return nil, err
 	}
 
 	// Build dynamic update query
@@ -227,22 +264,39 @@ func (store *DBChallengeResponseStore) ModifyResponse(request PutChallengeRespon
 	// Finalize query
 	query = strings.TrimSuffix(query, ", ")
 	query += ", updated_at = now()"
-	query += fmt.Sprintf(" WHERE id = $%d AND user_id = $%d", paramCount, paramCount+1)
+	query += fmt.Sprintf(" WHERE id = $%d", paramCount)
 
-	params = append(params, request.ChallengeResponseID, request.UserID)
+	params = append(params, content.targetID)
 
-	result, err := store.DB.Exec(query, params...)
+	result, err := tx.Exec(query, params...)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if rowsAffected == 0 {
-		return utils.NewCustomAppError(constants.InternalError, "Internal server error, valid request but database does not get updated")
+		return nil, utils.NewCustomAppError(constants.InternalError, "Internal server error, valid request but database does not get updated")
 	}
 
-	return nil
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return moderationAction, nil
+}
+
+// lockChallengeResponse finds a challenge response and locks it until the transaction ends
+func lockChallengeResponse(tx *sql.Tx, challengeResponseID string) (moderatedContent, error) {
+	content := moderatedContent{targetType: ModerationTargetChallengeResponse}
+	err := tx.QueryRow(`
+	SELECT id, user_id, name FROM challenge_response 
+	WHERE id = $1
+	FOR UPDATE
+`, challengeResponseID).Scan(&content.targetID, &content.ownerID, &content.title)
+
+	return content, err
 }
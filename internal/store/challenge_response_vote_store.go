@@ -9,11 +9,12 @@ import (
 )
 
 type DBVoteStore struct {
-	DB *sql.DB
+	DB          *sql.DB
+	RowSecurity *RowSecurityDB
 }
 
-func NewVoteStore(db *sql.DB) *DBVoteStore {
-	return &DBVoteStore{DB: db}
+func NewVoteStore(db *sql.DB, rowSecurity *RowSecurityDB) *DBVoteStore {
+	return &DBVoteStore{DB: db, RowSecurity: rowSecurity}
 }
 
 type DeleteVoteRequest struct {
@@ -33,12 +34,18 @@ type VoteStore interface {
 }
 
 func (store *DBVoteStore) DeleteVote(req DeleteVoteRequest) error {
+	tx, err := store.RowSecurity.BeginAsUser(req.UserID)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	var existingVoteType int
 	query := `
         SELECT vote_type FROM challenge_response_votes 
         WHERE user_id = $1 AND challenge_response_id = $2
     `
-	err := store.DB.QueryRow(query, req.UserID, req.ChallengeResponseID).Scan(&existingVoteType)
+	err = tx.QueryRow(query, req.UserID, req.ChallengeResponseID).Scan(&existingVoteType)
 	if err == sql.ErrNoRows {
 		return utils.NewCustomAppError(constants.InvalidData, "User does not have any vote for this response challenge")
 	}
@@ -48,7 +55,7 @@ func (store *DBVoteStore) DeleteVote(req DeleteVoteRequest) error {
 
 	// The Database Trigger (trg_sync_votes) will automatically decrement
 	// the up_vote or down_vote count in challenge_response after this execution.
-	_, err = store.DB.Exec(`
+	_, err = tx.Exec(`
         DELETE FROM challenge_response_votes 
         WHERE user_id = $1 AND challenge_response_id = $2
     `, req.UserID, req.ChallengeResponseID)
@@ -56,16 +63,22 @@ func (store *DBVoteStore) DeleteVote(req DeleteVoteRequest) error {
 		return err
 	}
 
-	return nil
+	return tx.Commit()
 }
 
 func (store *DBVoteStore) PostVote(req PostVoteRequest) error {
+	tx, err := store.RowSecurity.BeginAsUser(req.UserID)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	var existingVote int
 	query := `
         SELECT vote_type FROM challenge_response_votes
         WHERE user_id = $1 AND challenge_response_id = $2
     `
-	err := store.DB.QueryRow(query, req.UserID, req.ChallengeResponseID).Scan(&existingVote)
+	err = tx.QueryRow(query, req.UserID, req.ChallengeResponseID).Scan(&existingVote)
 
 	var newVoteType int
 	switch req.VoteType {
@@ -84,12 +97,15 @@ func (store *DBVoteStore) PostVote(req PostVoteRequest) error {
 		return err
 	}
 
-	_, err = store.DB.Exec(`
+	_, err = tx.Exec(`
         INSERT INTO challenge_response_votes (user_id, challenge_response_id, vote_type)
         VALUES ($1, $2, $3)
         ON CONFLICT (user_id, challenge_response_id)
         DO UPDATE SET vote_type = EXCLUDED.vote_type, updated_at = now()
     `, req.UserID, req.ChallengeResponseID, newVoteType)
+	if err != nil {
+		return err
+	}
 
-	return err
+	return tx.Commit()
 }
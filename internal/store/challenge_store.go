@@ -4,23 +4,28 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/RichardHoa/hack-me/internal/constants"
 	"github.com/RichardHoa/hack-me/internal/domains"
+	"github.com/RichardHoa/hack-me/internal/policy"
 	"github.com/RichardHoa/hack-me/internal/utils"
+	"github.com/alexedwards/argon2id"
 )
 
 type DBChallengeStore struct {
 	DB           *sql.DB
+	RowSecurity  *RowSecurityDB
 	CommentStore *DBCommentStore
 }
 
-func NewChallengeStore(db *sql.DB, commentStore *DBCommentStore) *DBChallengeStore {
+func NewChallengeStore(db *sql.DB, rowSecurity *RowSecurityDB, commentStore *DBCommentStore) *DBChallengeStore {
 	return &DBChallengeStore{
 		DB:           db,
+		RowSecurity:  rowSecurity,
 		CommentStore: commentStore,
 	}
 }
@@ -30,14 +35,18 @@ type PostChallengeParams struct {
 	name     domains.ChallengeName
 	category string
 	content  string
+	flags    []domains.ChallengeFlag
+	scoring  ChallengeScoring
 }
 
-func NewPostChallengeParams(userID string, name domains.ChallengeName, content, category string) PostChallengeParams {
+func NewPostChallengeParams(userID string, name domains.ChallengeName, content, category string, flags []domains.ChallengeFlag, scoring ChallengeScoring) PostChallengeParams {
 	return PostChallengeParams{
 		userID:   userID,
 		name:     name,
 		content:  content,
 		category: category,
+		flags:    flags,
+		scoring:  scoring,
 	}
 }
 
@@ -45,26 +54,48 @@ func (params *PostChallengeParams) UserID() string {
 	return params.userID
 }
 
+type FlagRequest struct {
+	Flag      string `json:"flag"`
+	MatchMode string `json:"matchMode"`
+}
+
+// ChallengeScoring holds the dynamic scoring values of a challenge, a nil field is left untouched.
+type ChallengeScoring struct {
+	InitialPoints *int `json:"initialPoints"`
+	MinimumPoints *int `json:"minimumPoints"`
+	Decay         *int `json:"decay"`
+}
+
 type PostChallengeRequest struct {
-	Name     string `json:"name"`
-	Category string `json:"category"`
-	Content  string `json:"content"`
+	Name     string        `json:"name"`
+	Category string        `json:"category"`
+	Content  string        `json:"content"`
+	Flags    []FlagRequest `json:"flags"`
+	ChallengeScoring
 }
 
 type DeleteChallengeRequest struct {
-	Name string `json:"name"`
+	Name             string  `json:"name"`
+	ModerationReason *string `json:"moderationReason"`
 }
 
 type DeleteChallengeParams struct {
 	ChallengeName domains.ChallengeName
 	UserID        string
+	// Moderated is set when the policy allowed the deletion because of the role of the user
+	Moderated bool
+	// ModerationReason is told to the owner when a moderator deletes the challenge
+	ModerationReason *string
 }
 
 type ModifyChallengeRequest struct {
-	NewName  string `json:"name"`
-	OldName  string `json:"oldName"`
-	Category string `json:"category"`
-	Content  string `json:"content"`
+	NewName  string         `json:"name"`
+	OldName  string         `json:"oldName"`
+	Category string         `json:"category"`
+	Content  string         `json:"content"`
+	Flags    *[]FlagRequest `json:"flags"`
+	ChallengeScoring
+	ModerationReason *string `json:"moderationReason"`
 }
 
 type ModifyChallengeParams struct {
@@ -72,18 +103,36 @@ type ModifyChallengeParams struct {
 	NewName  *domains.ChallengeName
 	Category *string
 	Content  *string
-	UserID   string
+	// nil keeps the current flags, an empty slice removes all of them
+	Flags   *[]domains.ChallengeFlag
+	Scoring ChallengeScoring
+	UserID  string
+	// Moderated is set when the policy allowed the edit because of the role of the user
+	Moderated bool
+	// ModerationReason is told to the owner when a moderator edits the challenge
+	ModerationReason *string
+}
+
+type SubmitFlagRequest struct {
+	Flag        string `json:"flag"`
+	ChallengeID string `json:"-"`
+	UserID      string `json:"-"`
 }
 
 type Challenge struct {
-	ID        string                `json:"id"`
-	UserName  string                `json:"userName"`
-	Name      domains.ChallengeName `json:"name"`
-	Category  string                `json:"category"`
-	Content   string                `json:"content"`
-	CreatedAt time.Time             `json:"createdAt"`
-	UpdatedAt time.Time             `json:"updatedAt"`
-	Comments  []Comment             `json:"comments"`
+	ID           string                `json:"id"`
+	UserName     string                `json:"userName"`
+	Name         domains.ChallengeName `json:"name"`
+	Category     string                `json:"category"`
+	Content      string                `json:"content"`
+	HasFlag      bool                  `json:"hasFlag"`
+	Points       string                `json:"points"`
+	SolveCount   string                `json:"solveCount"`
+	IsSolved     bool                  `json:"isSolved"`
+	IsBookmarked bool                  `json:"isBookmarked"`
+	CreatedAt    time.Time             `json:"createdAt"`
+	UpdatedAt    time.Time             `json:"updatedAt"`
+	Comments     []Comment             `json:"comments"`
 }
 type Challenges []Challenge
 
@@ -94,6 +143,8 @@ type GetChallengeParams struct {
 	ExactName  *domains.ChallengeName
 	PageSize   *int
 	Page       *int
+	// UserID is only set when the request is authenticated, it is used to compute isSolved and isBookmarked
+	UserID *string
 }
 
 type MetaDataPage struct {
@@ -105,11 +156,15 @@ type MetaDataPage struct {
 type ChallengeStore interface {
 	GetChallenges(params GetChallengeParams) (*Challenges, *MetaDataPage, error)
 	CreateChallenges(params PostChallengeParams) error
-	DeleteChallenge(params DeleteChallengeParams) error
-	ModifyChallenge(params ModifyChallengeParams) error
+	GetChallengeResource(name domains.ChallengeName) (policy.Resource, error)
+	GetChallengeResourceByID(challengeID string) (policy.Resource, error)
+	DeleteChallenge(params DeleteChallengeParams) (*ModerationAction, error)
+	ModifyChallenge(params ModifyChallengeParams) (*ModerationAction, error)
+	SubmitFlag(req SubmitFlagRequest) error
 }
 
 func (Store *DBChallengeStore) GetChallenges(params GetChallengeParams) (*Challenges, *MetaDataPage, error) {
+	// nosemgrep
 	baseQuery := `
 		SELECT 
 			c.id,
@@ -118,13 +173,22 @@ func (Store *DBChallengeStore) GetChallenges(params GetChallengeParams) (*Challe
 			c.content, 
 			c.created_at, 
 			c.updated_at, 
-			u.username
+			u.username,
+			EXISTS (SELECT 1 FROM challenge_flag f WHERE f.challenge_id = c.id) AS has_flag,
+			challenge_points(
+				c.initial_points, c.minimum_points, c.decay,
+				(SELECT COUNT(*) FROM challenge_solve s WHERE s.challenge_id = c.id)
+			) AS points,
+			(SELECT COUNT(*) FROM challenge_solve s WHERE s.challenge_id = c.id) AS solve_count,
+			%s AS is_solved,
+			%s AS is_bookmarked
 		FROM challenge c
 		JOIN "user" u ON c.user_id = u.id
 	`
 	countQuery := `SELECT COUNT(*) FROM challenge c`
 	isExactQuery := false
-	conditions := make([]string, 0, 3)
+	conditions := make([]string, 0, 4)
+	conditions = append(conditions, "c.hidden_at IS NULL")
 	args := []any{}
 	argIndex := 1
 
@@ -154,11 +218,19 @@ func (Store *DBChallengeStore) GetChallenges(params GetChallengeParams) (*Challe
 		conditions = append(conditions, fmt.Sprintf("c.category IN (%s)", strings.Join(placeholders, ", ")))
 	}
 
-	if len(conditions) > 0 {
-		whereClause := " WHERE " + strings.Join(conditions, " AND ")
-		baseQuery += whereClause
-		countQuery += whereClause
+	// the user ID is only used by the select list, so the count query must not receive it
+	baseArgs := args
+	isSolvedColumn, isBookmarkedColumn := "FALSE", "FALSE"
+	if params.UserID != nil {
+		isSolvedColumn = fmt.Sprintf("EXISTS (SELECT 1 FROM challenge_solve s WHERE s.challenge_id = c.id AND s.user_id = $%d)", argIndex)
+		isBookmarkedColumn = fmt.Sprintf("EXISTS (SELECT 1 FROM user_bookmark b WHERE b.challenge_id = c.id AND b.user_id = $%d)", argIndex)
+		baseArgs = append(append([]any{}, args...), *params.UserID)
 	}
+	baseQuery = fmt.Sprintf(baseQuery, isSolvedColumn, isBookmarkedColumn) // #nosec G201 - static column expressions
+
+	whereClause := " WHERE " + strings.Join(conditions, " AND ")
+	baseQuery += whereClause
+	countQuery += whereClause
 
 	if params.Popularity != nil {
 		switch strings.ToLower(*params.Popularity) {
@@ -211,7 +283,7 @@ func (Store *DBChallengeStore) GetChallenges(params GetChallengeParams) (*Challe
 	}
 
 	challenges := make(Challenges, 0, pageSize) // Pre-allocate with capacity
-	rows, err := Store.DB.Query(baseQuery, args...)
+	rows, err := Store.DB.Query(baseQuery, baseArgs...)
 	if err != nil {
 		return &Challenges{}, &MetaDataPage{}, err
 	}
@@ -219,7 +291,7 @@ func (Store *DBChallengeStore) GetChallenges(params GetChallengeParams) (*Challe
 
 	for rows.Next() {
 		var c Challenge
-		err := rows.Scan(&c.ID, &c.Name, &c.Category, &c.Content, &c.CreatedAt, &c.UpdatedAt, &c.UserName)
+		err := rows.Scan(&c.ID, &c.Name, &c.Category, &c.Content, &c.CreatedAt, &c.UpdatedAt, &c.UserName, &c.HasFlag, &c.Points, &c.SolveCount, &c.IsSolved, &c.IsBookmarked)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -244,71 +316,151 @@ func (Store *DBChallengeStore) GetChallenges(params GetChallengeParams) (*Challe
 }
 
 func (challengeStore *DBChallengeStore) CreateChallenges(params PostChallengeParams) error {
+	tx, err := challengeStore.RowSecurity.BeginAsUser(params.userID)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	query := `
 		INSERT INTO challenge (
 			name, 
 			content, 
 			user_id,
-			category
-		) VALUES ($1, $2, $3, $4)
+			category,
+			initial_points,
+			minimum_points,
+			decay
+		) VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
 	`
 
-	_, err := challengeStore.DB.Exec(
+	initialPoints, minimumPoints, decay := constants.DefaultInitialPoints, constants.DefaultMinimumPoints, constants.DefaultPointsDecay
+	if params.scoring.InitialPoints != nil {
+		initialPoints = *params.scoring.InitialPoints
+	}
+	if params.scoring.MinimumPoints != nil {
+		minimumPoints = *params.scoring.MinimumPoints
+	}
+	if params.scoring.Decay != nil {
+		decay = *params.scoring.Decay
+	}
+
+	var challengeID int
+	err = tx.QueryRow(
 		query,
 		params.name,
 		params.content,
 		params.userID,
 		params.category,
-	)
+		initialPoints,
+		minimumPoints,
+		decay,
+	).Scan(&challengeID)
 
 	if err != nil {
 		return err
 	}
 
-	return nil
+	err = insertChallengeFlags(tx, challengeID, params.flags)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 
 }
 
-func (challengeStore *DBChallengeStore) DeleteChallenge(params DeleteChallengeParams) error {
-	var challengeExists bool
+// GetChallengeResource reads the attributes the policy needs about a challenge
+func (challengeStore *DBChallengeStore) GetChallengeResource(name domains.ChallengeName) (policy.Resource, error) {
+	return getContentResource(challengeStore.DB, policy.ResourceChallenge, "name", name.String())
+}
 
-	err := challengeStore.DB.QueryRow(`
-        SELECT EXISTS (SELECT 1 FROM challenge WHERE name = $1)
-    `, params.ChallengeName).Scan(&challengeExists)
+func (challengeStore *DBChallengeStore) GetChallengeResourceByID(challengeID string) (policy.Resource, error) {
+	return getContentResource(challengeStore.DB, policy.ResourceChallenge, "id", challengeID)
+}
+
+/*
+DeleteChallenge deletes a challenge, the caller checks the policy first. The
+returned action is set when a moderator deleted someone else's challenge.
+*/
+func (challengeStore *DBChallengeStore) DeleteChallenge(params DeleteChallengeParams) (*ModerationAction, error) {
+	tx, err := challengeStore.RowSecurity.BeginAsUser(params.UserID)
 	if err != nil {
-		return fmt.Errorf("failed to check challenge existence: %v", err)
+		return nil, err
 	}
+	defer tx.Rollback()
 
-	if !challengeExists {
-		return utils.NewCustomAppError(
+	content, err := lockChallenge(tx, params.ChallengeName)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, utils.NewCustomAppError(
 			constants.InvalidData,
 			"challengeName does not exist",
 		)
 	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to check challenge existence: %v", err)
+	}
 
-	query := `
-        DELETE FROM challenge 
-        WHERE name = $1 AND user_id = $2
-    `
-
-	result, err := challengeStore.DB.Exec(query, params.ChallengeName, params.UserID)
+	moderationAction, err := moderateContentChange(tx, params.Moderated, params.UserID, content, ModerationActionDelete, params.ModerationReason)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	rowsAffected, err := result.RowsAffected()
+	_, err = tx.Exec(`DELETE FROM challenge WHERE id = $1`, content.targetID)
 	if err != nil {
-		return utils.NewCustomAppError(constants.InternalError, fmt.Sprintf("fail to check rows affected %v", err.Error()))
+		return nil, err
 	}
 
-	if rowsAffected == 0 {
-		return utils.NewCustomAppError(constants.LackingPermission, "User don't have permission to delete it")
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	return moderationAction, nil
 }
 
-func (challengeStore *DBChallengeStore) ModifyChallenge(params ModifyChallengeParams) error {
+/*
+ModifyChallenge updates a challenge, the caller checks the policy first. The
+returned action is set when a moderator edited someone else's challenge.
+*/
+func (challengeStore *DBChallengeStore) ModifyChallenge(params ModifyChallengeParams) (*ModerationAction, error) {
+	tx, err := challengeStore.RowSecurity.BeginAsUser(params.UserID)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	content, err := lockChallenge(tx, params.OldName)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, utils.NewCustomAppError(constants.ResourceNotFound, "challenge does not exist")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	moderationAction, err := moderateContentChange(tx, params.Moderated, params.UserID, content, ModerationActionEdit, params.ModerationReason)
+	if err != nil {
+		return nil, err
+	}
+
+	if params.Flags != nil {
+		_, err = tx.Exec(`DELETE FROM challenge_flag WHERE challenge_id = $1`, content.targetID)
+		if err != nil {
+			return nil, err
+		}
+
+		challengeID, err := strconv.Atoi(content.targetID)
+		if err != nil {
+			return nil, err
+		}
+
+		err = insertChallengeFlags(tx, challengeID, *params.Flags)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	query := `UPDATE challenge SET `
 	queryParams := []any{}
 	paramCount := 1
@@ -319,17 +471,17 @@ func (challengeStore *DBChallengeStore) ModifyChallenge(params ModifyChallengePa
 		paramCount++
 
 		var count int
-		err := challengeStore.DB.QueryRow(`
+		err := tx.QueryRow(`
 			SELECT COUNT(*) FROM challenge 
 			 WHERE lower(name) = lower($1)
 			`, params.NewName).Scan(&count)
 
 		if err != nil {
-			return utils.NewCustomAppError(constants.InternalError, fmt.Sprintf("check name conflict failed: %v", err))
+			return nil, utils.NewCustomAppError(constants.InternalError, fmt.Sprintf("check name conflict failed: %v", err))
 		}
 
 		if count > 0 {
-			return utils.NewCustomAppError(constants.InvalidData, "challenge name already exists")
+			return nil, utils.NewCustomAppError(constants.InvalidData, "challenge name already exists")
 		}
 
 	}
@@ -346,28 +498,258 @@ func (challengeStore *DBChallengeStore) ModifyChallenge(params ModifyChallengePa
 		paramCount++
 	}
 
-	if paramCount == 1 {
-		return utils.NewCustomAppError(constants.InvalidData, "No valid field provided for challenge update")
+	if params.Scoring.InitialPoints != nil {
+		query += fmt.Sprintf("initial_points = $%d, ", paramCount)
+		queryParams = append(queryParams, *params.Scoring.InitialPoints)
+		paramCount++
+	}
+
+	if params.Scoring.MinimumPoints != nil {
+		query += fmt.Sprintf("minimum_points = $%d, ", paramCount)
+		queryParams = append(queryParams, *params.Scoring.MinimumPoints)
+		paramCount++
 	}
 
-	query = query[:len(query)-2]
+	if params.Scoring.Decay != nil {
+		query += fmt.Sprintf("decay = $%d, ", paramCount)
+		queryParams = append(queryParams, *params.Scoring.Decay)
+		paramCount++
+	}
 
-	query += fmt.Sprintf(", updated_at = now() WHERE name = $%d AND user_id = $%d", paramCount, paramCount+1)
-	queryParams = append(queryParams, params.OldName, params.UserID)
+	if paramCount == 1 && params.Flags == nil {
+		return nil, utils.NewCustomAppError(constants.InvalidData, "No valid field provided for challenge update")
+	}
 
-	// Execute the update
-	result, err := challengeStore.DB.Exec(query, queryParams...)
+	// every SET clause above ends with ", ", so the timestamp can always be appended,
+	// this also covers requests that only replace the flags
+	query += fmt.Sprintf("updated_at = now() WHERE id = $%d", paramCount)
+	queryParams = append(queryParams, content.targetID)
+
+	_, err = tx.Exec(query, queryParams...)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return moderationAction, nil
+}
+
+// lockChallenge finds a challenge by name and locks it until the transaction ends
+func lockChallenge(tx *sql.Tx, name domains.ChallengeName) (moderatedContent, error) {
+	content := moderatedContent{targetType: ModerationTargetChallenge}
+	err := tx.QueryRow(`SELECT id, user_id, name FROM challenge WHERE name = $1 FOR UPDATE`, name).Scan(&content.targetID, &content.ownerID, &content.title)
+
+	return content, err
+}
+
+/*
+insertChallengeFlags stores the flags of a challenge inside the caller's
+transaction. Exact and case-insensitive flags are hashed like passwords: authors
+pick them, often short or guessable, so a leaked hash must cost as much to crack.
+Regex flags keep their pattern since it has to be evaluated on every submission.
+*/
+func insertChallengeFlags(tx *sql.Tx, challengeID int, flags []domains.ChallengeFlag) error {
+	for _, flag := range flags {
+		var flagHash, flagPattern any
+
+		switch flag.MatchMode() {
+		case domains.FlagMatchRegex:
+			flagPattern = flag.String()
+		case domains.FlagMatchCaseInsensitive:
+			hash, err := utils.HashPassword(strings.ToLower(flag.String()))
+			if err != nil {
+				return err
+			}
+			flagHash = hash
+		default:
+			hash, err := utils.HashPassword(flag.String())
+			if err != nil {
+				return err
+			}
+			flagHash = hash
+		}
+
+		_, err := tx.Exec(`
+			INSERT INTO challenge_flag (challenge_id, match_mode, flag_hash, flag_pattern)
+			VALUES ($1, $2, $3, $4)
+		`, challengeID, flag.MatchMode(), flagHash, flagPattern)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rehashFlag replaces a flag hash made with weaker parameters than the password ones
+func rehashFlag(tx *sql.Tx, flagID int, flag, hash string) error {
+	needsRehash, err := utils.PasswordNeedsRehash(hash)
+	if err != nil || !needsRehash {
+		return err
+	}
+
+	newHash, err := utils.HashPassword(flag)
 	if err != nil {
 		return err
 	}
 
-	rowsAffected, err := result.RowsAffected()
+	_, err = tx.Exec(`UPDATE challenge_flag SET flag_hash = $1 WHERE id = $2`, newHash, flagID)
+	return err
+}
+
+/*
+SubmitFlag checks a flag against every flag of the challenge and records the
+attempt. Wrong guesses are throttled per user, a correct guess records a solve.
+The caller checks the policy first, authors cannot solve their own challenge.
+*/
+func (challengeStore *DBChallengeStore) SubmitFlag(req SubmitFlagRequest) error {
+	tx, err := challengeStore.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// serialize submissions of the same user so parallel guesses cannot bypass the throttle
+	_, err = tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, req.UserID)
 	if err != nil {
-		return utils.NewCustomAppError(constants.InternalError, fmt.Sprintf("fail to check rows affected %v", err.Error()))
+		return err
+	}
+
+	var challengeExists bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM challenge WHERE id = $1)`, req.ChallengeID).Scan(&challengeExists)
+	if err != nil {
+		return err
+	}
+	if !challengeExists {
+		return utils.NewCustomAppError(constants.ResourceNotFound, "challenge does not exist")
+	}
+
+	var alreadySolved bool
+	err = tx.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM challenge_solve WHERE challenge_id = $1 AND user_id = $2)
+	`, req.ChallengeID, req.UserID).Scan(&alreadySolved)
+	if err != nil {
+		return err
+	}
+	if alreadySolved {
+		return utils.NewCustomAppError(constants.InvalidData, "You already solved this challenge")
+	}
+
+	var wrongAttempts int
+	err = tx.QueryRow(`
+		SELECT COUNT(*) FROM challenge_submission
+		WHERE user_id = $1 AND is_correct = FALSE AND created_at > $2
+	`, req.UserID, time.Now().Add(-constants.WrongFlagSubmissionWindow)).Scan(&wrongAttempts)
+	if err != nil {
+		return err
+	}
+	if wrongAttempts >= constants.MaxWrongFlagSubmissions {
+		return utils.NewCustomAppError(constants.TooManyRequests, "Too many wrong submissions, please try again later")
+	}
+
+	rows, err := tx.Query(`
+		SELECT id, match_mode, flag_hash, flag_pattern
+		FROM challenge_flag
+		WHERE challenge_id = $1
+	`, req.ChallengeID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type storedFlag struct {
+		id          int
+		matchMode   domains.FlagMatchMode
+		flagHash    sql.NullString
+		flagPattern sql.NullString
+	}
+
+	var flags []storedFlag
+	for rows.Next() {
+		var flag storedFlag
+		err := rows.Scan(&flag.id, &flag.matchMode, &flag.flagHash, &flag.flagPattern)
+		if err != nil {
+			return err
+		}
+		flags = append(flags, flag)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(flags) == 0 {
+		return utils.NewCustomAppError(constants.InvalidData, "This challenge does not accept flag submissions")
+	}
+
+	submitted := strings.TrimSpace(req.Flag)
+	isCorrect := false
+
+	for _, flag := range flags {
+		var match bool
+		var candidate string
+
+		switch flag.matchMode {
+		case domains.FlagMatchRegex:
+			pattern, err := regexp.Compile(domains.AnchorFlagPattern(flag.flagPattern.String))
+			if err != nil {
+				return err
+			}
+			match = pattern.MatchString(submitted)
+		case domains.FlagMatchCaseInsensitive:
+			candidate = strings.ToLower(submitted)
+			match, err = argon2id.ComparePasswordAndHash(candidate, flag.flagHash.String)
+		default:
+			candidate = submitted
+			match, err = argon2id.ComparePasswordAndHash(candidate, flag.flagHash.String)
+		}
+		if err != nil {
+			return err
+		}
+
+		if match {
+			isCorrect = true
+
+			// flags hashed with weaker parameters, like the light ones used for a while, are replaced by the correct guess
+			if flag.flagHash.Valid {
+				err = rehashFlag(tx, flag.id, candidate, flag.flagHash.String)
+				if err != nil {
+					return err
+				}
+			}
+			break
+		}
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO challenge_submission (challenge_id, user_id, is_correct)
+		VALUES ($1, $2, $3)
+	`, req.ChallengeID, req.UserID, isCorrect)
+	if err != nil {
+		return err
+	}
+
+	if isCorrect {
+		_, err = tx.Exec(`
+			INSERT INTO challenge_solve (challenge_id, user_id)
+			VALUES ($1, $2)
+		`, req.ChallengeID, req.UserID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the wrong attempt must be committed as well, otherwise the throttle never kicks in
+	err = tx.Commit()
+	if err != nil {
+		return err
 	}
 
-	if rowsAffected == 0 {
-		return utils.NewCustomAppError(constants.LackingPermission, "user does not have permission to modify the challenge")
+	if !isCorrect {
+		return utils.NewCustomAppError(constants.InvalidData, "Incorrect flag")
 	}
 
 	return nil
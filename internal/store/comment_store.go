@@ -6,21 +6,24 @@ import (
 	"time"
 
 	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/policy"
 	"github.com/RichardHoa/hack-me/internal/utils"
 )
 
 type DBCommentStore struct {
-	DB *sql.DB
+	DB          *sql.DB
+	RowSecurity *RowSecurityDB
 }
 
-func NewCommentStore(db *sql.DB) *DBCommentStore {
-	return &DBCommentStore{DB: db}
+func NewCommentStore(db *sql.DB, rowSecurity *RowSecurityDB) *DBCommentStore {
+	return &DBCommentStore{DB: db, RowSecurity: rowSecurity}
 }
 
 type CommentStore interface {
+	GetCommentResource(commentID string) (policy.Resource, error)
 	PostComment(req PostCommentRequest) (commentID string, err error)
-	ModifyComment(req ModifyCommentRequest) error
-	DeleteComment(req DeleteCommentRequest) error
+	ModifyComment(req ModifyCommentRequest) (*ModerationAction, error)
+	DeleteComment(req DeleteCommentRequest) (*ModerationAction, error)
 	GetRootComments(foreignKey ForeignKeyType, id string) ([]Comment, error)
 }
 
@@ -42,14 +45,18 @@ type PostCommentRequest struct {
 }
 
 type ModifyCommentRequest struct {
-	CommentID string `json:"commentID"`
-	Content   string `json:"content"`
-	UserID    string `json:"-"`
+	CommentID        string  `json:"commentID"`
+	Content          string  `json:"content"`
+	ModerationReason *string `json:"moderationReason"`
+	UserID           string  `json:"-"`
+	Moderated        bool    `json:"-"`
 }
 
 type DeleteCommentRequest struct {
-	CommentID string `json:"commentID"`
-	UserID    string `json:"-"`
+	CommentID        string  `json:"commentID"`
+	ModerationReason *string `json:"moderationReason"`
+	UserID           string  `json:"-"`
+	Moderated        bool    `json:"-"`
 }
 
 type ForeignKeyType string
@@ -62,13 +69,19 @@ const (
 func (store *DBCommentStore) PostComment(req PostCommentRequest) (commentID string, err error) {
 	// TODO: Implement depth control when posting comment
 
+	tx, err := store.RowSecurity.BeginAsUser(req.UserID)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
 	query := `
 		INSERT INTO comment (parent_id, challenge_id, challenge_response_id, user_id, content)
 		VALUES ($1, $2, $3, $4, $5)
 		RETURNING id
 	`
 
-	err = store.DB.QueryRow(
+	err = tx.QueryRow(
 		query,
 		utils.NullIfEmpty(req.ParentID),
 		utils.NullIfEmpty(req.ChallengeID),
@@ -81,35 +94,40 @@ func (store *DBCommentStore) PostComment(req PostCommentRequest) (commentID stri
 		return "", err
 	}
 
-	return commentID, nil
+	return commentID, tx.Commit()
 }
 
-func (store *DBCommentStore) ModifyComment(req ModifyCommentRequest) error {
-	// First check if the comment exists and belongs to the user
-	checkQuery := `
-        SELECT user_id 
-        FROM comment 
-        WHERE id = $1
-    `
+// GetCommentResource reads the attributes the policy needs about a comment
+func (store *DBCommentStore) GetCommentResource(commentID string) (policy.Resource, error) {
+	return getContentResource(store.DB, policy.ResourceComment, "id", commentID)
+}
+
+/*
+ModifyComment updates a comment, the caller checks the policy first. The
+returned action is set when a moderator edited someone else's comment.
+*/
+func (store *DBCommentStore) ModifyComment(req ModifyCommentRequest) (*ModerationAction, error) {
+	tx, err := store.RowSecurity.BeginAsUser(req.UserID)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
 
-	var commentUserID string
-	err := store.DB.QueryRow(checkQuery, req.CommentID).Scan(&commentUserID)
+	// First check if the comment still exists
+	content, err := lockComment(tx, req.CommentID)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return utils.NewCustomAppError(
+			return nil, utils.NewCustomAppError(
 				constants.InvalidData,
 				"Comment not found or doesn't belong to this resource",
 			)
 		}
-		return err
+		return nil, err
 	}
 
-	// Verify the comment belongs to the requesting user
-	if commentUserID != req.UserID {
-		return utils.NewCustomAppError(
-			constants.LackingPermission,
-			"You don't have permission to modify this comment",
-		)
+	moderationAction, err := moderateContentChange(tx, req.Moderated, req.UserID, content, ModerationActionEdit, req.ModerationReason)
+	if err != nil {
+		return nil, err
 	}
 
 	// Update the comment
@@ -119,80 +137,93 @@ func (store *DBCommentStore) ModifyComment(req ModifyCommentRequest) error {
         WHERE id = $2
     `
 
-	result, err := store.DB.Exec(
+	result, err := tx.Exec(
 		updateQuery,
 		req.Content,
 		req.CommentID,
 	)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if rowsAffected == 0 {
 		panic("No err but the rows affected is 0")
 	}
 
-	return nil
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return moderationAction, nil
 }
 
-func (store *DBCommentStore) DeleteComment(req DeleteCommentRequest) error {
-	// First check if the comment exists and belongs to the user
-	checkQuery := `
-        SELECT user_id 
-        FROM comment 
-        WHERE id = $1
-    `
+/*
+DeleteComment deletes a comment, the caller checks the policy first. The
+returned action is set when a moderator deleted someone else's comment.
+*/
+func (store *DBCommentStore) DeleteComment(req DeleteCommentRequest) (*ModerationAction, error) {
+	tx, err := store.RowSecurity.BeginAsUser(req.UserID)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
 
-	var commentUserID string
-	err := store.DB.QueryRow(checkQuery, req.CommentID).Scan(&commentUserID)
+	// First check if the comment still exists
+	content, err := lockComment(tx, req.CommentID)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return utils.NewCustomAppError(
+			return nil, utils.NewCustomAppError(
 				constants.InvalidData,
 				"Comment not found or doesn't belong to this resource",
 			)
 		}
-		return err
+		return nil, err
 	}
 
-	// Verify the comment belongs to the requesting user
-	if commentUserID != req.UserID {
-		return utils.NewCustomAppError(
-			constants.LackingPermission,
-			"You don't have permission to delete this comment",
-		)
+	moderationAction, err := moderateContentChange(tx, req.Moderated, req.UserID, content, ModerationActionDelete, req.ModerationReason)
+	if err != nil {
+		return nil, err
 	}
 
-	// Update the comment
-	updateQuery := `
-        DELETE FROM comment 
-        WHERE id = $1 AND user_id = $2
-    `
-
-	result, err := store.DB.Exec(
-		updateQuery,
-		req.CommentID,
-		req.UserID,
-	)
+	result, err := tx.Exec(`DELETE FROM comment WHERE id = $1`, req.CommentID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if rowsAffected == 0 {
 		panic("No err but the rows affected is 0")
 	}
 
-	return nil
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return moderationAction, nil
+}
+
+// lockComment finds a comment and locks it until the transaction ends
+func lockComment(tx *sql.Tx, commentID string) (moderatedContent, error) {
+	content := moderatedContent{targetType: ModerationTargetComment}
+	err := tx.QueryRow(`
+        SELECT id, user_id, content 
+        FROM comment 
+        WHERE id = $1
+        FOR UPDATE
+    `, commentID).Scan(&content.targetID, &content.ownerID, &content.title)
+
+	return content, err
 }
 
 func (store *DBCommentStore) GetRootComments(foreignKey ForeignKeyType, id string) ([]Comment, error) {
@@ -204,7 +235,7 @@ func (store *DBCommentStore) GetRootComments(foreignKey ForeignKeyType, id strin
 			c.id, c.content, u.username, c.created_at, c.updated_at
 		FROM comment c
 		JOIN "user" u ON c.user_id = u.id
-		WHERE c.%s = $1 AND c.parent_id IS NULL
+		WHERE c.%s = $1 AND c.parent_id IS NULL AND c.hidden_at IS NULL
 		ORDER BY c.created_at ASC
 	`, foreignKeyStr) // #nosec G201 - predefined foreignKey
 
@@ -244,7 +275,7 @@ func (store *DBCommentStore) getRepliesRecursive(parentID string, depth int) ([]
 			c.id, c.content, u.username, c.created_at, c.updated_at
 		FROM comment c
 		JOIN "user" u ON c.user_id = u.id
-		WHERE c.parent_id = $1
+		WHERE c.parent_id = $1 AND c.hidden_at IS NULL
 		ORDER BY c.created_at ASC
 	`
 
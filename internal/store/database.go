@@ -6,8 +6,10 @@ import (
 	"fmt"
 	"io/fs"
 	"os"
+	"time"
 
 	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/utils"
 	"github.com/pressly/goose/v3"
 
 	// _ "github.com/jackc/pgx/v4/stdlib"
@@ -122,3 +124,121 @@ func Migrate(db *sql.DB, dir string) error {
 
 	return nil
 }
+
+// devRowSecurityPassword is only used with the local databases, like their postgres password
+const devRowSecurityPassword = "hackme_app"
+
+/*
+OpenRowSecurity connects as hackme_app, the login role of the transactions
+opened by RowSecurityDB.BeginAsUser. The role owns nothing and is a member of no
+other role, so a RESET ROLE injected into one of its transactions gets nowhere.
+In production the password comes from DB_APP_PASSWORD.
+*/
+func OpenRowSecurity(isTesting bool) (*sql.DB, *pgxpool.Pool, error) {
+	host := "localhost"
+	port := "5432"
+	password := devRowSecurityPassword
+
+	switch {
+	case isTesting:
+		port = "5433"
+	case !constants.IsDevMode:
+		password = os.Getenv("DB_APP_PASSWORD")
+		if password == "" {
+			return nil, nil, fmt.Errorf("DB_APP_PASSWORD environment variable not set")
+		}
+		host = os.Getenv("DB_HOST")
+	}
+
+	connStr := fmt.Sprintf("host=%s user=hackme_app password=%s dbname=postgres port=%s sslmode=disable", host, password, port)
+
+	dbPool, err := pgxpool.New(context.Background(), connStr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error opening row security connection: %w", err)
+	}
+
+	db := stdlib.OpenDBFromPool(dbPool)
+
+	err = db.Ping()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error opening row security connection: %w", err)
+	}
+	return db, dbPool, nil
+}
+
+/*
+SetDevRowSecurityPassword lets hackme_app log in to a local database. Migrations
+never set a password, in production it is set by hand, see the README.
+*/
+func SetDevRowSecurityPassword(db *sql.DB) error {
+	_, err := db.Exec(fmt.Sprintf(`ALTER ROLE hackme_app PASSWORD '%s'`, devRowSecurityPassword)) // #nosec G201 - constant password
+	return err
+}
+
+/*
+RowSecurityDB opens the transactions that run under the row level security
+policies. OwnerDB is the normal connection, AppDB logs in as hackme_app.
+*/
+type RowSecurityDB struct {
+	OwnerDB *sql.DB
+	AppDB   *sql.DB
+}
+
+func NewRowSecurityDB(ownerDB *sql.DB, appDB *sql.DB) *RowSecurityDB {
+	return &RowSecurityDB{
+		OwnerDB: ownerDB,
+		AppDB:   appDB,
+	}
+}
+
+/*
+BeginAsUser starts a transaction as hackme_app for userID. The row level security
+policies on content tables then apply, so a query that forgot its ownership check
+still cannot change the rows of another user.
+
+The user is not named in the transaction. The owner connection stores a random
+grant for userID first, and the transaction only carries the grant, which
+app_user_id() looks up. An injected query can neither read the grants nor guess
+the grant of someone else, so it cannot switch users with set_config.
+*/
+func (rowSecurity *RowSecurityDB) BeginAsUser(userID string) (*sql.Tx, error) {
+	grant, err := utils.GenerateRandomToken(32)
+	if err != nil {
+		return nil, fmt.Errorf("create row security grant: %w", err)
+	}
+
+	_, err = rowSecurity.OwnerDB.Exec(`
+		INSERT INTO row_security_grant (grant_hash, user_id, expires_at)
+		VALUES ($1, $2, $3)
+	`, utils.HashToken(grant), userID, time.Now().Add(constants.RowSecurityGrantTime))
+	if err != nil {
+		return nil, fmt.Errorf("store row security grant: %w", err)
+	}
+
+	tx, err := rowSecurity.AppDB.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`SELECT set_config('app.row_security_grant', $1, true)`, grant)
+	if err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("set row security grant: %w", err)
+	}
+
+	return tx, nil
+}
+
+// DeleteExpiredGrants removes the grants of transactions that have long ended
+func (rowSecurity *RowSecurityDB) DeleteExpiredGrants() (int, error) {
+	result, err := rowSecurity.OwnerDB.Exec(`DELETE FROM row_security_grant WHERE expires_at < $1;`, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(rowsAffected), nil
+}
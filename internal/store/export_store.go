@@ -0,0 +1,372 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/utils"
+	"github.com/google/uuid"
+)
+
+// Defines where a data export is in its life.
+const (
+	DataExportPending = "pending"
+	DataExportReady   = "ready"
+	DataExportFailed  = "failed"
+)
+
+type DBExportStore struct {
+	DB *sql.DB
+}
+
+func NewExportStore(db *sql.DB) *DBExportStore {
+	return &DBExportStore{
+		DB: db,
+	}
+}
+
+type DataExport struct {
+	ID          string     `json:"id"`
+	Status      string     `json:"status"`
+	ExpiresAt   *time.Time `json:"expiresAt"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	CompletedAt *time.Time `json:"completedAt"`
+	// DownloadLink is only set while the archive can be downloaded
+	DownloadLink string `json:"downloadLink,omitempty"`
+	BlobKey      string `json:"-"`
+}
+
+// Expired reports whether the archive of a ready export was already removed or is about to be
+func (export DataExport) Expired(now time.Time) bool {
+	return export.ExpiresAt != nil && !now.Before(*export.ExpiresAt)
+}
+
+// ExportedContent is what the user wrote, the stores the rest of the API uses only return summaries of it
+type ExportedContent struct {
+	Email              string              `json:"email"`
+	EmailVerifiedAt    *time.Time          `json:"emailVerifiedAt"`
+	JoinedAt           time.Time           `json:"joinedAt"`
+	Challenges         []ExportedChallenge `json:"challenges"`
+	ChallengeResponses []ExportedResponse  `json:"challengeResponses"`
+	Comments           []ExportedComment   `json:"comments"`
+	Votes              []ExportedVote      `json:"votes"`
+}
+
+type ExportedChallenge struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Category  string    `json:"category"`
+	Content   string    `json:"content"`
+	Hidden    bool      `json:"hidden"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type ExportedResponse struct {
+	ID            string    `json:"id"`
+	ChallengeName string    `json:"challengeName"`
+	Name          string    `json:"name"`
+	Content       string    `json:"content"`
+	UpVote        string    `json:"upVote"`
+	DownVote      string    `json:"downVote"`
+	Hidden        bool      `json:"hidden"`
+	CreatedAt     time.Time `json:"createdAt"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
+
+type ExportedComment struct {
+	ID       string  `json:"id"`
+	ParentID *string `json:"parentID"`
+	// ChallengeName is set for comments on a challenge, ChallengeResponseName for comments on a response
+	ChallengeName         *string   `json:"challengeName"`
+	ChallengeResponseName *string   `json:"challengeResponseName"`
+	Content               string    `json:"content"`
+	Hidden                bool      `json:"hidden"`
+	CreatedAt             time.Time `json:"createdAt"`
+	UpdatedAt             time.Time `json:"updatedAt"`
+}
+
+type ExportedVote struct {
+	ChallengeResponseID   string    `json:"challengeResponseID"`
+	ChallengeResponseName string    `json:"challengeResponseName"`
+	VoteType              string    `json:"voteType"`
+	CreatedAt             time.Time `json:"createdAt"`
+}
+
+type ExportStore interface {
+	CreateExport(userID string) (DataExport, error)
+	GetExport(exportID, userID string) (*DataExport, error)
+	CompleteExport(exportID, blobKey string) (DataExport, error)
+	FailExport(exportID string) error
+	GetExportedContent(userID string) (*ExportedContent, error)
+	DeleteExpiredExports() (blobKeys []string, err error)
+}
+
+/*
+CreateExport queues a new export. Only one export per user is built at a time,
+one left pending for longer than DataExportBuildTime is marked as failed first
+so it does not block the user forever.
+*/
+func (exportStore *DBExportStore) CreateExport(userID string) (DataExport, error) {
+	tx, err := exportStore.DB.Begin()
+	if err != nil {
+		return DataExport{}, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE data_export SET status = 'failed', completed_at = now()
+		WHERE user_id = $1 AND status = 'pending' AND created_at < $2
+	`, userID, time.Now().Add(-constants.DataExportBuildTime))
+	if err != nil {
+		return DataExport{}, err
+	}
+
+	export := DataExport{ID: uuid.NewString(), Status: DataExportPending}
+	err = tx.QueryRow(`
+		INSERT INTO data_export (id, user_id) VALUES ($1, $2)
+		RETURNING created_at
+	`, export.ID, userID).Scan(&export.CreatedAt)
+	if err != nil {
+		if utils.ClassifyError(err) == constants.PQUniqueViolation {
+			return DataExport{}, utils.NewCustomAppError(constants.InvalidData, "an export is already being prepared")
+		}
+		return DataExport{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return DataExport{}, err
+	}
+
+	return export, nil
+}
+
+// GetExport finds an export of the user, the export of someone else is reported as not found
+func (exportStore *DBExportStore) GetExport(exportID, userID string) (*DataExport, error) {
+	var (
+		export                 DataExport
+		blobKey                sql.NullString
+		expiresAt, completedAt sql.NullTime
+	)
+	err := exportStore.DB.QueryRow(`
+		SELECT id, status, blob_key, expires_at, created_at, completed_at
+		FROM data_export
+		WHERE id = $1 AND user_id = $2
+	`, exportID, userID).Scan(&export.ID, &export.Status, &blobKey, &expiresAt, &export.CreatedAt, &completedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, utils.NewCustomAppError(constants.ResourceNotFound, "export not found")
+		}
+		return nil, err
+	}
+
+	export.BlobKey = blobKey.String
+	if expiresAt.Valid {
+		export.ExpiresAt = &expiresAt.Time
+	}
+	if completedAt.Valid {
+		export.CompletedAt = &completedAt.Time
+	}
+
+	return &export, nil
+}
+
+// CompleteExport marks the archive as ready, the download link expires DataExportLinkTime from now
+func (exportStore *DBExportStore) CompleteExport(exportID, blobKey string) (DataExport, error) {
+	var (
+		export                 DataExport
+		expiresAt, completedAt time.Time
+	)
+	err := exportStore.DB.QueryRow(`
+		UPDATE data_export
+		SET status = 'ready', blob_key = $1, completed_at = now(), expires_at = $2
+		WHERE id = $3 AND status = 'pending'
+		RETURNING id, status, expires_at, created_at, completed_at
+	`, blobKey, time.Now().Add(constants.DataExportLinkTime), exportID).Scan(&export.ID, &export.Status, &expiresAt, &export.CreatedAt, &completedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return DataExport{}, utils.NewCustomAppError(constants.ResourceNotFound, fmt.Sprintf("pending export %s not found", exportID))
+		}
+		return DataExport{}, err
+	}
+
+	export.BlobKey = blobKey
+	export.ExpiresAt = &expiresAt
+	export.CompletedAt = &completedAt
+
+	return export, nil
+}
+
+func (exportStore *DBExportStore) FailExport(exportID string) error {
+	_, err := exportStore.DB.Exec(`UPDATE data_export SET status = 'failed', completed_at = now() WHERE id = $1 AND status = 'pending'`, exportID)
+	return err
+}
+
+// GetExportedContent reads the account and everything the user wrote in full, hidden content included since it is still theirs
+func (exportStore *DBExportStore) GetExportedContent(userID string) (*ExportedContent, error) {
+	content := ExportedContent{
+		Challenges:         []ExportedChallenge{},
+		ChallengeResponses: []ExportedResponse{},
+		Comments:           []ExportedComment{},
+		Votes:              []ExportedVote{},
+	}
+
+	var emailVerifiedAt sql.NullTime
+	err := exportStore.DB.QueryRow(`SELECT email, email_verified_at, created_at FROM "user" WHERE id = $1`, userID).Scan(&content.Email, &emailVerifiedAt, &content.JoinedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, utils.NewCustomAppError(constants.ResourceNotFound, "user not found")
+		}
+		return nil, err
+	}
+	if emailVerifiedAt.Valid {
+		content.EmailVerifiedAt = &emailVerifiedAt.Time
+	}
+
+	rows, err := exportStore.DB.Query(`
+		SELECT id, name, category, content, hidden_at IS NOT NULL, created_at, updated_at
+		FROM challenge
+		WHERE user_id = $1
+		ORDER BY created_at ASC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var challenge ExportedChallenge
+		err := rows.Scan(&challenge.ID, &challenge.Name, &challenge.Category, &challenge.Content, &challenge.Hidden, &challenge.CreatedAt, &challenge.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		content.Challenges = append(content.Challenges, challenge)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = exportStore.DB.Query(`
+		SELECT cr.id, c.name, cr.name, cr.content, cr.up_vote, cr.down_vote, cr.hidden_at IS NOT NULL, cr.created_at, cr.updated_at
+		FROM challenge_response cr
+		JOIN challenge c ON c.id = cr.challenge_id
+		WHERE cr.user_id = $1
+		ORDER BY cr.created_at ASC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var response ExportedResponse
+		err := rows.Scan(
+			&response.ID, &response.ChallengeName, &response.Name, &response.Content,
+			&response.UpVote, &response.DownVote, &response.Hidden, &response.CreatedAt, &response.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		content.ChallengeResponses = append(content.ChallengeResponses, response)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = exportStore.DB.Query(`
+		SELECT cm.id, cm.parent_id, c.name, cr.name, cm.content, cm.hidden_at IS NOT NULL, cm.created_at, cm.updated_at
+		FROM comment cm
+		LEFT JOIN challenge c ON c.id = cm.challenge_id
+		LEFT JOIN challenge_response cr ON cr.id = cm.challenge_response_id
+		WHERE cm.user_id = $1
+		ORDER BY cm.created_at ASC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			comment                                        ExportedComment
+			parentID, challengeName, challengeResponseName sql.NullString
+		)
+		err := rows.Scan(&comment.ID, &parentID, &challengeName, &challengeResponseName, &comment.Content, &comment.Hidden, &comment.CreatedAt, &comment.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if parentID.Valid {
+			comment.ParentID = &parentID.String
+		}
+		if challengeName.Valid {
+			comment.ChallengeName = &challengeName.String
+		}
+		if challengeResponseName.Valid {
+			comment.ChallengeResponseName = &challengeResponseName.String
+		}
+		content.Comments = append(content.Comments, comment)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = exportStore.DB.Query(`
+		SELECT v.challenge_response_id, cr.name, CASE WHEN v.vote_type = 1 THEN 'up' ELSE 'down' END, v.created_at
+		FROM challenge_response_votes v
+		JOIN challenge_response cr ON cr.id = v.challenge_response_id
+		WHERE v.user_id = $1
+		ORDER BY v.created_at ASC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var vote ExportedVote
+		err := rows.Scan(&vote.ChallengeResponseID, &vote.ChallengeResponseName, &vote.VoteType, &vote.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		content.Votes = append(content.Votes, vote)
+	}
+
+	return &content, rows.Err()
+}
+
+/*
+DeleteExpiredExports forgets the exports whose link expired, the ones of deleted
+accounts and the ones that never finished. It returns the archives to remove
+from the blob storage.
+*/
+func (exportStore *DBExportStore) DeleteExpiredExports() (blobKeys []string, err error) {
+	rows, err := exportStore.DB.Query(`
+		DELETE FROM data_export
+		WHERE expires_at < now()
+		OR user_id IS NULL
+		OR (status <> 'ready' AND created_at < $1)
+		RETURNING blob_key
+	`, time.Now().Add(-constants.DataExportBuildTime))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blobKeys = []string{}
+	for rows.Next() {
+		var blobKey sql.NullString
+		err := rows.Scan(&blobKey)
+		if err != nil {
+			return nil, err
+		}
+		if blobKey.Valid {
+			blobKeys = append(blobKeys, blobKey.String)
+		}
+	}
+
+	return blobKeys, rows.Err()
+}
@@ -0,0 +1,319 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/utils"
+)
+
+const (
+	throttleScopeAccount = "account"
+	throttleScopeIP      = "ip"
+
+	// the longest email address in characters, longer input is still throttled on its prefix
+	maxThrottleSubjectLength = 320
+)
+
+/*
+LoginThrottlePolicy decides how long a subject waits after its failed logins.
+The first FreeAttempts failures cost nothing, then the wait doubles from
+BackoffBase up to MaxBackoff, and at LockoutThreshold the subject is locked out
+for LockoutTime.
+*/
+type LoginThrottlePolicy struct {
+	FreeAttempts     int
+	LockoutThreshold int
+	BackoffBase      time.Duration
+	MaxBackoff       time.Duration
+	LockoutTime      time.Duration
+}
+
+// delay returns how long the subject has to wait after its failedCount-th failure
+func (policy LoginThrottlePolicy) delay(failedCount int) time.Duration {
+	switch {
+	case failedCount >= policy.LockoutThreshold:
+		return policy.LockoutTime
+	case failedCount < policy.FreeAttempts:
+		return 0
+	}
+
+	exponent := failedCount - policy.FreeAttempts
+	if exponent > 30 {
+		return policy.MaxBackoff
+	}
+	backoff := policy.BackoffBase * time.Duration(math.Pow(2, float64(exponent)))
+
+	return min(backoff, policy.MaxBackoff)
+}
+
+type DBLoginThrottleStore struct {
+	DB            *sql.DB
+	AccountPolicy LoginThrottlePolicy
+	IPPolicy      LoginThrottlePolicy
+}
+
+func NewLoginThrottleStore(db *sql.DB) *DBLoginThrottleStore {
+	return &DBLoginThrottleStore{
+		DB: db,
+		AccountPolicy: LoginThrottlePolicy{
+			FreeAttempts:     constants.AccountFreeLoginAttempts,
+			LockoutThreshold: constants.AccountLockoutThreshold,
+			BackoffBase:      constants.LoginBackoffBase,
+			MaxBackoff:       constants.LoginMaxBackoff,
+			LockoutTime:      constants.LoginLockoutTime,
+		},
+		IPPolicy: LoginThrottlePolicy{
+			FreeAttempts:     constants.IPFreeLoginAttempts,
+			LockoutThreshold: constants.IPLockoutThreshold,
+			BackoffBase:      constants.LoginBackoffBase,
+			MaxBackoff:       constants.LoginMaxBackoff,
+			LockoutTime:      constants.LoginLockoutTime,
+		},
+	}
+}
+
+type UnlockAccountRequest struct {
+	Token string `json:"token"`
+}
+
+type LoginThrottleStore interface {
+	CheckLoginAllowed(email string, ip string) (retryAfter time.Duration, err error)
+	RecordFailedLogin(email string, ip string) (accountLocked bool, err error)
+	ResetAccountFailures(email string) error
+	CreateUnlockToken(email string) (token string, err error)
+	UnlockAccount(token string) (email string, err error)
+	DeleteStaleLoginThrottles() (int, error)
+}
+
+// throttleSubject is the account key, unknown emails are throttled like known ones
+func throttleSubject(email string) string {
+	subject := strings.ToLower(strings.TrimSpace(email))
+	// cut on a rune, half of a character is not valid UTF-8 and Postgres refuses it
+	if utf8.RuneCountInString(subject) > maxThrottleSubjectLength {
+		subject = string([]rune(subject)[:maxThrottleSubjectLength])
+	}
+	return subject
+}
+
+/*
+CheckLoginAllowed refuses a login while the account or the IP waits after its
+failed logins. The error tells which one is blocked: TooManyRequests during the
+backoff, AccountLocked or IPLocked once the lockout threshold was reached.
+*/
+func (throttleStore *DBLoginThrottleStore) CheckLoginAllowed(email string, ip string) (retryAfter time.Duration, err error) {
+	query := `
+		SELECT scope, failed_count, locked_until
+		FROM login_throttle
+		WHERE ((scope = $1 AND subject = $2) OR (scope = $3 AND subject = $4)) AND locked_until > now();
+	`
+
+	rows, err := throttleStore.DB.Query(query, throttleScopeAccount, throttleSubject(email), throttleScopeIP, ip)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	errCode := 0
+	for rows.Next() {
+		var (
+			scope       string
+			failedCount int
+			lockedUntil time.Time
+		)
+		err = rows.Scan(&scope, &failedCount, &lockedUntil)
+		if err != nil {
+			return 0, err
+		}
+
+		retryAfter = max(retryAfter, time.Until(lockedUntil))
+
+		// the account lockout wins, it is the one with an unlock path
+		switch {
+		case scope == throttleScopeAccount && failedCount >= throttleStore.AccountPolicy.LockoutThreshold:
+			errCode = constants.AccountLocked
+		case scope == throttleScopeIP && failedCount >= throttleStore.IPPolicy.LockoutThreshold && errCode != constants.AccountLocked:
+			errCode = constants.IPLocked
+		case errCode == 0:
+			errCode = constants.TooManyRequests
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	retryAfter = max(retryAfter, 0)
+	retrySeconds := int(math.Ceil(retryAfter.Seconds()))
+
+	switch errCode {
+	case constants.AccountLocked:
+		return retryAfter, utils.NewCustomAppError(errCode, fmt.Sprintf("This account is locked after too many failed logins, try again in %d seconds or unlock it with the link sent to its email", retrySeconds))
+	case constants.IPLocked:
+		return retryAfter, utils.NewCustomAppError(errCode, fmt.Sprintf("Too many failed logins from your network, try again in %d seconds", retrySeconds))
+	case constants.TooManyRequests:
+		return retryAfter, utils.NewCustomAppError(errCode, fmt.Sprintf("Too many failed logins, try again in %d seconds", retrySeconds))
+	}
+
+	return 0, nil
+}
+
+/*
+RecordFailedLogin counts a failed login against the account and the IP, counts
+older than constants.LoginAttemptWindow start over. accountLocked is true when
+this failure locked the account.
+*/
+func (throttleStore *DBLoginThrottleStore) RecordFailedLogin(email string, ip string) (accountLocked bool, err error) {
+	tx, err := throttleStore.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	subjects := []struct {
+		scope   string
+		subject string
+		policy  LoginThrottlePolicy
+	}{
+		{throttleScopeAccount, throttleSubject(email), throttleStore.AccountPolicy},
+		{throttleScopeIP, ip, throttleStore.IPPolicy},
+	}
+
+	now := time.Now()
+	windowStart := now.Add(-constants.LoginAttemptWindow)
+
+	for _, subject := range subjects {
+		if subject.subject == "" {
+			continue
+		}
+
+		query := `
+			INSERT INTO login_throttle (scope, subject, failed_count, last_failed_at)
+			VALUES ($1, $2, 1, $3)
+			ON CONFLICT (scope, subject) DO UPDATE
+			SET failed_count = CASE
+					WHEN login_throttle.last_failed_at < $4 THEN 1
+					ELSE login_throttle.failed_count + 1
+				END,
+				last_failed_at = $3
+			RETURNING failed_count;
+		`
+
+		var failedCount int
+		err = tx.QueryRow(query, subject.scope, subject.subject, now, windowStart).Scan(&failedCount)
+		if err != nil {
+			return false, err
+		}
+
+		_, err = tx.Exec(`UPDATE login_throttle SET locked_until = $1 WHERE scope = $2 AND subject = $3`, now.Add(subject.policy.delay(failedCount)), subject.scope, subject.subject)
+		if err != nil {
+			return false, err
+		}
+
+		if subject.scope == throttleScopeAccount && failedCount == subject.policy.LockoutThreshold {
+			accountLocked = true
+		}
+	}
+
+	return accountLocked, tx.Commit()
+}
+
+// ResetAccountFailures forgets the failed logins of the account after a correct password
+func (throttleStore *DBLoginThrottleStore) ResetAccountFailures(email string) error {
+	_, err := throttleStore.DB.Exec(`DELETE FROM login_throttle WHERE scope = $1 AND subject = $2`, throttleScopeAccount, throttleSubject(email))
+	return err
+}
+
+/*
+CreateUnlockToken issues the token of the unlock link mailed to a locked account,
+only its hash is stored and earlier tokens stop working.
+*/
+func (throttleStore *DBLoginThrottleStore) CreateUnlockToken(email string) (token string, err error) {
+	var userID string
+	err = throttleStore.DB.QueryRow(`SELECT id FROM "user" WHERE lower(email) = $1`, throttleSubject(email)).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", utils.NewCustomAppError(constants.ResourceNotFound, "user not found")
+		}
+		return "", err
+	}
+
+	token, err = utils.GenerateRandomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := throttleStore.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM account_unlock_token WHERE user_id = $1`, userID)
+	if err != nil {
+		return "", err
+	}
+
+	query := `
+		INSERT INTO account_unlock_token (token_hash, user_id, expires_at)
+		VALUES ($1, $2, $3);
+	`
+	_, err = tx.Exec(query, utils.HashToken(token), userID, time.Now().Add(constants.AccountUnlockTokenTime))
+	if err != nil {
+		return "", err
+	}
+
+	return token, tx.Commit()
+}
+
+// UnlockAccount consumes the unlock token, clears the failed logins of the account and returns its email
+func (throttleStore *DBLoginThrottleStore) UnlockAccount(token string) (email string, err error) {
+	tx, err := throttleStore.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	query := `
+		DELETE FROM account_unlock_token t
+		USING "user" u
+		WHERE t.token_hash = $1 AND t.expires_at > now() AND u.id = t.user_id
+		RETURNING u.email;
+	`
+
+	err = tx.QueryRow(query, utils.HashToken(token)).Scan(&email)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", utils.NewCustomAppError(constants.InvalidData, "unlock token is invalid or expired")
+		}
+		return "", err
+	}
+
+	_, err = tx.Exec(`DELETE FROM login_throttle WHERE scope = $1 AND subject = $2`, throttleScopeAccount, throttleSubject(email))
+	if err != nil {
+		return "", err
+	}
+
+	return email, tx.Commit()
+}
+
+// DeleteStaleLoginThrottles removes the counters that are neither locked nor inside the window
+func (throttleStore *DBLoginThrottleStore) DeleteStaleLoginThrottles() (int, error) {
+	cutoffTime := time.Now().Add(-constants.LoginAttemptWindow)
+
+	result, err := throttleStore.DB.Exec(`DELETE FROM login_throttle WHERE last_failed_at < $1 AND locked_until < now();`, cutoffTime)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(rowsAffected), nil
+}
@@ -0,0 +1,192 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers transactional emails such as verification links
+type Mailer interface {
+	SendMail(mail Mail) error
+}
+
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func NewSMTPMailer(host, port, username, password, from string) *SMTPMailer {
+	return &SMTPMailer{
+		Host:     host,
+		Port:     port,
+		Username: username,
+		Password: password,
+		From:     from,
+	}
+}
+
+/*
+SendMail sends a plain text email. net/smtp upgrades the connection with
+STARTTLS when the server offers it and refuses to send credentials in clear
+text to a remote host.
+*/
+func (mailer *SMTPMailer) SendMail(mail Mail) error {
+	// header injection: a line break would let the value add its own headers
+	for _, value := range []string{mail.To, mail.Subject} {
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("mail header contains a line break")
+		}
+	}
+
+	message := strings.Join([]string{
+		"From: " + mailer.From,
+		"To: " + mail.To,
+		"Subject: " + mail.Subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		strings.ReplaceAll(mail.Body, "\n", "\r\n"),
+	}, "\r\n")
+
+	var auth smtp.Auth
+	if mailer.Username != "" {
+		auth = smtp.PlainAuth("", mailer.Username, mailer.Password, mailer.Host)
+	}
+
+	return smtp.SendMail(net.JoinHostPort(mailer.Host, mailer.Port), auth, mailer.From, []string{mail.To}, []byte(message))
+}
+
+/*
+QueuedMailer hands emails to a fixed number of workers that send them through
+Mailer. A request no longer waits for a slow SMTP server, and a burst of
+requests cannot start a goroutine per email: SendMail fails once the queue is
+full. Delivery errors are only logged, the request is long answered by then.
+*/
+type QueuedMailer struct {
+	Mailer Mailer
+	Logger *log.Logger
+
+	mu      sync.RWMutex
+	closed  bool
+	queue   chan Mail
+	workers sync.WaitGroup
+}
+
+func NewQueuedMailer(mailer Mailer, logger *log.Logger, queueSize int, workerCount int) *QueuedMailer {
+	queuedMailer := &QueuedMailer{
+		Mailer: mailer,
+		Logger: logger,
+		queue:  make(chan Mail, queueSize),
+	}
+
+	for range workerCount {
+		queuedMailer.workers.Add(1)
+		go func() {
+			defer queuedMailer.workers.Done()
+			for mail := range queuedMailer.queue {
+				err := queuedMailer.Mailer.SendMail(mail)
+				if err != nil {
+					queuedMailer.Logger.Printf("ERROR: QueuedMailer > SendMail: %v", err)
+				}
+			}
+		}()
+	}
+
+	return queuedMailer
+}
+
+// SendMail queues the email, it fails when the queue is full or shut down
+func (mailer *QueuedMailer) SendMail(mail Mail) error {
+	mailer.mu.RLock()
+	defer mailer.mu.RUnlock()
+
+	if mailer.closed {
+		return errors.New("mail queue is shut down")
+	}
+
+	select {
+	case mailer.queue <- mail:
+		return nil
+	default:
+		return errors.New("mail queue is full")
+	}
+}
+
+// Shutdown stops taking emails and waits until the queued ones are sent or ctx ends
+func (mailer *QueuedMailer) Shutdown(ctx context.Context) error {
+	mailer.mu.Lock()
+	if !mailer.closed {
+		mailer.closed = true
+		close(mailer.queue)
+	}
+	mailer.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		mailer.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d emails were not sent: %w", len(mailer.queue), ctx.Err())
+	}
+}
+
+/*
+MemoryMailer keeps every email in memory and writes it to the logger instead of
+sending it. It is used by the tests and when no SMTP server is configured.
+*/
+type MemoryMailer struct {
+	Logger *log.Logger
+
+	mu    sync.Mutex
+	mails []Mail
+}
+
+func NewMemoryMailer(logger *log.Logger) *MemoryMailer {
+	return &MemoryMailer{Logger: logger}
+}
+
+func (mailer *MemoryMailer) SendMail(mail Mail) error {
+	mailer.mu.Lock()
+	defer mailer.mu.Unlock()
+
+	mailer.mails = append(mailer.mails, mail)
+	mailer.Logger.Printf("MAIL: to |%s| subject |%s|\n%s", mail.To, mail.Subject, mail.Body)
+
+	return nil
+}
+
+// LastMailTo returns the most recent email sent to the address
+func (mailer *MemoryMailer) LastMailTo(to string) (Mail, bool) {
+	mailer.mu.Lock()
+	defer mailer.mu.Unlock()
+
+	for i := len(mailer.mails) - 1; i >= 0; i-- {
+		if strings.EqualFold(mailer.mails[i].To, to) {
+			return mailer.mails[i], true
+		}
+	}
+
+	return Mail{}, false
+}
@@ -0,0 +1,428 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/utils"
+)
+
+type DBMFAStore struct {
+	DB *sql.DB
+}
+
+func NewMFAStore(db *sql.DB) *DBMFAStore {
+	return &DBMFAStore{
+		DB: db,
+	}
+}
+
+type TOTPEnrollment struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauthURI"`
+}
+
+// MFACodeRequest carries a TOTP code or a recovery code of the logged in user
+type MFACodeRequest struct {
+	Code   string `json:"code"`
+	UserID string `json:"-"`
+}
+
+// MFALoginRequest is the second login step, MFAToken comes from the password step
+type MFALoginRequest struct {
+	MFAToken string `json:"mfaToken"`
+	Code     string `json:"code"`
+	UserID   string `json:"-"`
+}
+
+type MFAStore interface {
+	StartTOTPEnrollment(userID string) (TOTPEnrollment, error)
+	ConfirmTOTPEnrollment(req MFACodeRequest) (recoveryCodes []string, err error)
+	DisableTOTP(req MFACodeRequest) error
+	RegenerateRecoveryCodes(req MFACodeRequest) (recoveryCodes []string, err error)
+	CreateMFAChallenge(userID string) (mfaToken string, err error)
+	LoginWithMFACode(req *MFALoginRequest) (accessToken, refreshToken, csrfToken string, err error)
+}
+
+/*
+StartTOTPEnrollment creates a new secret for the user. 2FA stays off until the
+user proves the authenticator app works with ConfirmTOTPEnrollment, starting
+again simply replaces the pending secret.
+*/
+func (mfaStore *DBMFAStore) StartTOTPEnrollment(userID string) (TOTPEnrollment, error) {
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+
+	query := `
+		UPDATE "user"
+		SET totp_secret = $1
+		WHERE id = $2 AND totp_enabled_at IS NULL
+		RETURNING email;
+	`
+
+	var email string
+	err = mfaStore.DB.QueryRow(query, secret, userID).Scan(&email)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return TOTPEnrollment{}, utils.NewCustomAppError(constants.InvalidData, "two-factor authentication is already enabled")
+		}
+		return TOTPEnrollment{}, err
+	}
+
+	return TOTPEnrollment{
+		Secret:     secret,
+		OTPAuthURI: utils.CreateTOTPURI(email, secret),
+	}, nil
+}
+
+// ConfirmTOTPEnrollment turns 2FA on once the code matches the pending secret
+func (mfaStore *DBMFAStore) ConfirmTOTPEnrollment(req MFACodeRequest) (recoveryCodes []string, err error) {
+	tx, err := mfaStore.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var (
+		secret  sql.NullString
+		enabled bool
+	)
+	query := `SELECT totp_secret, totp_enabled_at IS NOT NULL FROM "user" WHERE id = $1 FOR UPDATE`
+	err = tx.QueryRow(query, req.UserID).Scan(&secret, &enabled)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, utils.NewCustomAppError(constants.ResourceNotFound, "user not found")
+		}
+		return nil, err
+	}
+
+	if enabled {
+		return nil, utils.NewCustomAppError(constants.InvalidData, "two-factor authentication is already enabled")
+	}
+	if !secret.Valid {
+		return nil, utils.NewCustomAppError(constants.InvalidData, "two-factor enrollment has not been started")
+	}
+
+	step, ok := utils.ValidateTOTPCode(secret.String, req.Code, time.Now())
+	if !ok {
+		return nil, utils.NewCustomAppError(constants.InvalidData, "two-factor code is not valid")
+	}
+
+	query = `
+		UPDATE "user"
+		SET totp_enabled_at = now(), totp_last_used_step = $1
+		WHERE id = $2;
+	`
+	_, err = tx.Exec(query, step, req.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	recoveryCodes, err = replaceRecoveryCodes(tx, req.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	return recoveryCodes, tx.Commit()
+}
+
+// DisableTOTP turns 2FA off, it takes a valid code so a stolen session alone cannot do it
+func (mfaStore *DBMFAStore) DisableTOTP(req MFACodeRequest) error {
+	err := chargeMFAAttempt(mfaStore.DB, req.UserID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := mfaStore.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ok, err := verifyMFACode(tx, req.UserID, req.Code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return utils.NewCustomAppError(constants.InvalidData, "two-factor code is not valid")
+	}
+
+	query := `
+		UPDATE "user"
+		SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_used_step = NULL
+		WHERE id = $1;
+	`
+	_, err = tx.Exec(query, req.UserID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM mfa_recovery_code WHERE user_id = $1`, req.UserID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM mfa_challenge WHERE user_id = $1`, req.UserID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RegenerateRecoveryCodes replaces every recovery code of the user, used or not
+func (mfaStore *DBMFAStore) RegenerateRecoveryCodes(req MFACodeRequest) (recoveryCodes []string, err error) {
+	err = chargeMFAAttempt(mfaStore.DB, req.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := mfaStore.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	ok, err := verifyMFACode(tx, req.UserID, req.Code)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, utils.NewCustomAppError(constants.InvalidData, "two-factor code is not valid")
+	}
+
+	recoveryCodes, err = replaceRecoveryCodes(tx, req.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	return recoveryCodes, tx.Commit()
+}
+
+/*
+CreateMFAChallenge records a login that passed the password step. Only the hash
+of the returned token is stored, it expires after constants.MFAChallengeTime.
+*/
+func (mfaStore *DBMFAStore) CreateMFAChallenge(userID string) (mfaToken string, err error) {
+	mfaToken, err = utils.GenerateRandomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = mfaStore.DB.Exec(`DELETE FROM mfa_challenge WHERE user_id = $1 AND expires_at <= now()`, userID)
+	if err != nil {
+		return "", err
+	}
+
+	query := `
+		INSERT INTO mfa_challenge (token_hash, user_id, expires_at)
+		VALUES ($1, $2, $3);
+	`
+	_, err = mfaStore.DB.Exec(query, utils.HashToken(mfaToken), userID, time.Now().Add(constants.MFAChallengeTime))
+	if err != nil {
+		return "", err
+	}
+
+	return mfaToken, nil
+}
+
+/*
+LoginWithMFACode finishes a login with a TOTP or recovery code and issues the
+tokens. A challenge only allows constants.MaxMFAAttempts wrong codes, after that
+the user has to enter the password again. New challenges do not reset the
+per user count of chargeMFAAttempt.
+*/
+func (mfaStore *DBMFAStore) LoginWithMFACode(req *MFALoginRequest) (accessToken, refreshToken, csrfToken string, err error) {
+	tx, err := mfaStore.DB.Begin()
+	if err != nil {
+		return "", "", "", err
+	}
+	defer tx.Rollback()
+
+	var (
+		userID         string
+		userName       string
+		failedAttempts int
+	)
+	query := `
+		SELECT c.user_id, u.username, c.failed_attempts
+		FROM mfa_challenge c
+		JOIN "user" u ON u.id = c.user_id
+		WHERE c.token_hash = $1 AND c.expires_at > now()
+		FOR UPDATE OF c;
+	`
+	err = tx.QueryRow(query, utils.HashToken(req.MFAToken)).Scan(&userID, &userName, &failedAttempts)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", "", "", utils.NewCustomAppError(constants.InvalidData, "login attempt is invalid or expired, please log in again")
+		}
+		return "", "", "", err
+	}
+
+	// charged inside the transaction, the failure path below commits it
+	err = chargeMFAAttempt(tx, userID)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	ok, err := verifyMFACode(tx, userID, req.Code)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	if !ok {
+		if failedAttempts+1 >= constants.MaxMFAAttempts {
+			_, err = tx.Exec(`DELETE FROM mfa_challenge WHERE token_hash = $1`, utils.HashToken(req.MFAToken))
+		} else {
+			_, err = tx.Exec(`UPDATE mfa_challenge SET failed_attempts = failed_attempts + 1 WHERE token_hash = $1`, utils.HashToken(req.MFAToken))
+		}
+		if err != nil {
+			return "", "", "", err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return "", "", "", err
+		}
+
+		return "", "", "", utils.NewCustomAppError(constants.InvalidData, "two-factor code is not valid")
+	}
+
+	_, err = tx.Exec(`DELETE FROM mfa_challenge WHERE token_hash = $1`, utils.HashToken(req.MFAToken))
+	if err != nil {
+		return "", "", "", err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return "", "", "", err
+	}
+
+	req.UserID = userID
+
+	return issueTokens(userID, userName)
+}
+
+// mfaQueryRower is a *sql.DB or a *sql.Tx
+type mfaQueryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+/*
+chargeMFAAttempt counts a code check against the user before the code is looked
+at, verifyMFACode starts the count over when the code is correct. Charging first
+keeps the count when the caller rolls back, and parallel guesses pay as well.
+The check that reaches constants.MFALockoutThreshold locks every code check of
+the user for constants.MFALockoutTime, a new mfaToken does not help.
+*/
+func chargeMFAAttempt(db mfaQueryRower, userID string) error {
+	query := `
+		UPDATE "user"
+		SET mfa_failed_attempts = CASE WHEN mfa_failed_attempts + 1 >= $2 THEN 0 ELSE mfa_failed_attempts + 1 END,
+			mfa_locked_until = CASE WHEN mfa_failed_attempts + 1 >= $2 THEN $3 ELSE mfa_locked_until END
+		WHERE id = $1 AND (mfa_locked_until IS NULL OR mfa_locked_until <= now())
+		RETURNING id;
+	`
+
+	var id string
+	err := db.QueryRow(query, userID, constants.MFALockoutThreshold, time.Now().Add(constants.MFALockoutTime)).Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return utils.NewCustomAppError(constants.TooManyRequests, "too many two-factor codes were tried, please try again later")
+		}
+		return err
+	}
+
+	return nil
+}
+
+/*
+verifyMFACode accepts a TOTP code of the enabled secret or an unused recovery
+code. A TOTP code is refused when its time step was already used, so a code
+seen by someone else cannot be replayed within its 30 seconds.
+*/
+func verifyMFACode(tx *sql.Tx, userID string, code string) (bool, error) {
+	var (
+		secret   string
+		lastStep sql.NullInt64
+	)
+	query := `
+		SELECT totp_secret, totp_last_used_step
+		FROM "user"
+		WHERE id = $1 AND totp_enabled_at IS NOT NULL
+		FOR UPDATE;
+	`
+	err := tx.QueryRow(query, userID).Scan(&secret, &lastStep)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, utils.NewCustomAppError(constants.InvalidData, "two-factor authentication is not enabled")
+		}
+		return false, err
+	}
+
+	if step, ok := utils.ValidateTOTPCode(secret, code, time.Now()); ok {
+		if lastStep.Valid && step <= lastStep.Int64 {
+			return false, nil
+		}
+
+		_, err = tx.Exec(`UPDATE "user" SET totp_last_used_step = $1, mfa_failed_attempts = 0 WHERE id = $2`, step, userID)
+		if err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	query = `
+		UPDATE mfa_recovery_code
+		SET used_at = now()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL;
+	`
+	result, err := tx.Exec(query, userID, utils.HashToken(utils.NormalizeRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if rowsAffected != 1 {
+		return false, nil
+	}
+
+	_, err = tx.Exec(`UPDATE "user" SET mfa_failed_attempts = 0 WHERE id = $1`, userID)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// replaceRecoveryCodes stores the hashes of a new set of recovery codes and returns the codes once
+func replaceRecoveryCodes(tx *sql.Tx, userID string) ([]string, error) {
+	_, err := tx.Exec(`DELETE FROM mfa_recovery_code WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	recoveryCodes := make([]string, 0, constants.RecoveryCodeCount)
+	for range constants.RecoveryCodeCount {
+		code, err := utils.GenerateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = tx.Exec(`INSERT INTO mfa_recovery_code (code_hash, user_id) VALUES ($1, $2)`, utils.HashToken(utils.NormalizeRecoveryCode(code)), userID)
+		if err != nil {
+			return nil, err
+		}
+
+		recoveryCodes = append(recoveryCodes, code)
+	}
+
+	return recoveryCodes, nil
+}
@@ -0,0 +1,306 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/policy"
+	"github.com/RichardHoa/hack-me/internal/utils"
+)
+
+// Defines what moderators act on and what they can do to it.
+const (
+	ModerationTargetChallenge         = "challenge"
+	ModerationTargetChallengeResponse = "challenge_response"
+	ModerationTargetComment           = "comment"
+
+	ModerationActionEdit   = "edit"
+	ModerationActionHide   = "hide"
+	ModerationActionUnhide = "unhide"
+	ModerationActionDelete = "delete"
+)
+
+// moderationTargetTables maps a target type to its table, the names are static so they can go in a query
+var moderationTargetTables = map[string]string{
+	ModerationTargetChallenge:         "challenge",
+	ModerationTargetChallengeResponse: "challenge_response",
+	ModerationTargetComment:           "comment",
+}
+
+// maxModerationTitleLength keeps the title of a comment, which is its content, short in the log
+const maxModerationTitleLength = 80
+
+type DBModerationStore struct {
+	DB          *sql.DB
+	RowSecurity *RowSecurityDB
+}
+
+func NewModerationStore(db *sql.DB, rowSecurity *RowSecurityDB) *DBModerationStore {
+	return &DBModerationStore{
+		DB:          db,
+		RowSecurity: rowSecurity,
+	}
+}
+
+// ModerationAction is one entry of the moderation log
+type ModerationAction struct {
+	ID            string    `json:"id"`
+	ModeratorName *string   `json:"moderatorName"`
+	OwnerName     *string   `json:"ownerName"`
+	TargetType    string    `json:"targetType"`
+	TargetID      string    `json:"targetID"`
+	TargetTitle   string    `json:"targetTitle"`
+	Action        string    `json:"action"`
+	Reason        *string   `json:"reason"`
+	CreatedAt     time.Time `json:"createdAt"`
+	// OwnerEmail is where the owner is told about the action
+	OwnerEmail string `json:"-"`
+}
+
+type ChangeVisibilityRequest struct {
+	TargetType  string `json:"targetType"`
+	TargetID    string `json:"targetID"`
+	Action      string `json:"action"`
+	Reason      string `json:"reason"`
+	ModeratorID string `json:"-"`
+}
+
+type ModerationStore interface {
+	GetContentResource(targetType string, targetID string) (policy.Resource, error)
+	ChangeVisibility(req ChangeVisibilityRequest) (ModerationAction, error)
+	GetModerationActions(page int) ([]ModerationAction, error)
+}
+
+// moderatedContent is a piece of content someone wants to change
+type moderatedContent struct {
+	targetType string
+	targetID   string
+	ownerID    string
+	title      string
+}
+
+// GetContentResource reads the attributes the policy needs about a piece of content
+func (moderationStore *DBModerationStore) GetContentResource(targetType string, targetID string) (policy.Resource, error) {
+	if _, ok := moderationTargetTables[targetType]; !ok {
+		return policy.Resource{}, utils.NewCustomAppError(constants.InvalidData, "targetType must be challenge, challenge_response or comment")
+	}
+
+	return getContentResource(moderationStore.DB, policy.ResourceType(targetType), "id", targetID)
+}
+
+// ChangeVisibility hides content from every listing or shows it again, the caller checks the policy first
+
+func (moderationStore *DBModerationStore) ChangeVisibility(req ChangeVisibilityRequest) (ModerationAction, error) {
+	table, ok := moderationTargetTables[req.TargetType]
+	if !ok {
+		return ModerationAction{}, utils.NewCustomAppError(constants.InvalidData, "targetType must be challenge, challenge_response or comment")
+	}
+
+	tx, err := moderationStore.RowSecurity.BeginAsUser(req.ModeratorID)
+	if err != nil {
+		return ModerationAction{}, err
+	}
+	defer tx.Rollback()
+
+	content, err := lockModeratedContent(tx, req.TargetType, req.TargetID)
+	if err != nil {
+		return ModerationAction{}, err
+	}
+
+	var update string
+	switch req.Action {
+	case ModerationActionHide:
+		update = `UPDATE %s SET hidden_at = now() WHERE id = $1 AND hidden_at IS NULL`
+	case ModerationActionUnhide:
+		update = `UPDATE %s SET hidden_at = NULL WHERE id = $1 AND hidden_at IS NOT NULL`
+	default:
+		return ModerationAction{}, utils.NewCustomAppError(constants.InvalidData, "action must be hide or unhide")
+	}
+
+	// nosemgrep
+	result, err := tx.Exec(fmt.Sprintf(update, table), req.TargetID) // #nosec G201 - static table
+	if err != nil {
+		return ModerationAction{}, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return ModerationAction{}, err
+	}
+	if rowsAffected == 0 {
+		return ModerationAction{}, utils.NewCustomAppError(constants.InvalidData, fmt.Sprintf("the %s is already %s", req.TargetType, map[string]string{ModerationActionHide: "hidden", ModerationActionUnhide: "visible"}[req.Action]))
+	}
+
+	reason := req.Reason
+	action, err := recordModerationAction(tx, req.ModeratorID, content, req.Action, &reason)
+	if err != nil {
+		return ModerationAction{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return ModerationAction{}, err
+	}
+
+	return action, nil
+}
+
+// GetModerationActions lists the moderation log, newest first
+func (moderationStore *DBModerationStore) GetModerationActions(page int) ([]ModerationAction, error) {
+	query := `
+		SELECT
+			ma.id, m.username, o.username, ma.target_type, ma.target_id,
+			ma.target_title, ma.action, ma.reason, ma.created_at
+		FROM moderation_action ma
+		LEFT JOIN "user" m ON m.id = ma.moderator_id
+		LEFT JOIN "user" o ON o.id = ma.owner_id
+		ORDER BY ma.created_at DESC, ma.id DESC
+		LIMIT $1 OFFSET $2;
+	`
+
+	rows, err := moderationStore.DB.Query(query, constants.DefaultPageSize, (page-1)*constants.DefaultPageSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	actions := []ModerationAction{}
+	for rows.Next() {
+		var (
+			action                               ModerationAction
+			moderatorName, ownerName, reasonText sql.NullString
+		)
+		err := rows.Scan(&action.ID, &moderatorName, &ownerName, &action.TargetType, &action.TargetID, &action.TargetTitle, &action.Action, &reasonText, &action.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		if moderatorName.Valid {
+			action.ModeratorName = &moderatorName.String
+		}
+		if ownerName.Valid {
+			action.OwnerName = &ownerName.String
+		}
+		if reasonText.Valid {
+			action.Reason = &reasonText.String
+		}
+
+		actions = append(actions, action)
+	}
+
+	return actions, rows.Err()
+}
+
+/*
+getContentResource reads the owner and the state of a piece of content, column
+is static. A missing row is a ResourceNotFound error.
+*/
+func getContentResource(db *sql.DB, resourceType policy.ResourceType, column string, value any) (policy.Resource, error) {
+	resource := policy.Resource{Type: resourceType}
+
+	// nosemgrep
+	query := fmt.Sprintf(`SELECT user_id, hidden_at IS NOT NULL FROM %s WHERE %s = $1`, moderationTargetTables[string(resourceType)], column) // #nosec G201 - static table and column
+	err := db.QueryRow(query, value).Scan(&resource.OwnerID, &resource.Hidden)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return policy.Resource{}, utils.NewCustomAppError(constants.ResourceNotFound, fmt.Sprintf("%s does not exist", strings.ReplaceAll(string(resourceType), "_", " ")))
+		}
+		return policy.Resource{}, err
+	}
+
+	return resource, nil
+}
+
+/*
+lockModeratedContent reads the owner and title of content and locks its row until
+the transaction ends, targetType must be a key of moderationTargetTables. A
+missing row is a ResourceNotFound error.
+*/
+func lockModeratedContent(tx *sql.Tx, targetType string, targetID string) (moderatedContent, error) {
+	titleColumn := "name"
+	if targetType == ModerationTargetComment {
+		titleColumn = "content"
+	}
+
+	content := moderatedContent{targetType: targetType, targetID: targetID}
+	// nosemgrep
+	query := fmt.Sprintf(`SELECT user_id, %s FROM %s WHERE id = $1 FOR UPDATE`, titleColumn, moderationTargetTables[targetType]) // #nosec G201 - static table and column
+	err := tx.QueryRow(query, targetID).Scan(&content.ownerID, &content.title)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return moderatedContent{}, utils.NewCustomAppError(constants.ResourceNotFound, fmt.Sprintf("%s not found", targetType))
+		}
+		return moderatedContent{}, err
+	}
+
+	return content, nil
+}
+
+/*
+moderateContentChange records the change in the moderation log when the policy
+only allowed it because of the role of the actor, and returns it so the owner
+can be told. Changes by the owner are not recorded.
+*/
+func moderateContentChange(tx *sql.Tx, moderated bool, actorID string, content moderatedContent, action string, reason *string) (*ModerationAction, error) {
+	if !moderated {
+		return nil, nil
+	}
+
+	moderationAction, err := recordModerationAction(tx, actorID, content, action, reason)
+	if err != nil {
+		return nil, err
+	}
+
+	return &moderationAction, nil
+}
+
+// recordModerationAction logs an action, an empty moderatorID is an action the system took on its own
+func recordModerationAction(tx *sql.Tx, moderatorID string, content moderatedContent, action string, reason *string) (ModerationAction, error) {
+	title := content.title
+	if utf8.RuneCountInString(title) > maxModerationTitleLength {
+		title = string([]rune(title)[:maxModerationTitleLength-3]) + "..."
+	}
+
+	query := `
+		INSERT INTO moderation_action (moderator_id, owner_id, target_type, target_id, target_title, action, reason)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING
+			id, created_at,
+			(SELECT username FROM "user" WHERE id = $1),
+			(SELECT username FROM "user" WHERE id = $2),
+			(SELECT email FROM "user" WHERE id = $2);
+	`
+
+	moderationAction := ModerationAction{
+		TargetType:  content.targetType,
+		TargetID:    content.targetID,
+		TargetTitle: title,
+		Action:      action,
+	}
+	var reasonText any
+	if reason != nil && *reason != "" {
+		moderationAction.Reason = reason
+		reasonText = *reason
+	}
+
+	var (
+		moderatorName sql.NullString
+		ownerName     string
+	)
+	err := tx.QueryRow(query, utils.NullIfEmpty(moderatorID), content.ownerID, content.targetType, content.targetID, title, action, reasonText).Scan(
+		&moderationAction.ID, &moderationAction.CreatedAt, &moderatorName, &ownerName, &moderationAction.OwnerEmail,
+	)
+	if err != nil {
+		return ModerationAction{}, err
+	}
+	if moderatorName.Valid {
+		moderationAction.ModeratorName = &moderatorName.String
+	}
+	moderationAction.OwnerName = &ownerName
+
+	return moderationAction, nil
+}
@@ -0,0 +1,443 @@
+package store
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/utils"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// OAuthProviderConfig holds the client registration of the app at a provider
+type OAuthProviderConfig struct {
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+// OAuthIdentity is the verified identity returned by a provider after login
+type OAuthIdentity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	ImageLink     string
+	UserID        string
+}
+
+/*
+OAuthProvider runs the authorization code flow with PKCE against an identity
+provider. Implementations must only return identities they verified themselves,
+the handler trusts the result of Exchange.
+*/
+type OAuthProvider interface {
+	AuthCodeURL(state, nonce, codeChallenge string) (string, error)
+	Exchange(ctx context.Context, code, codeVerifier, nonce string) (OAuthIdentity, error)
+}
+
+var oauthHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+type oauthTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+/*
+exchangeAuthorizationCode redeems the authorization code at the token endpoint
+together with the PKCE code verifier.
+*/
+func exchangeAuthorizationCode(ctx context.Context, client *http.Client, tokenURL string, config OAuthProviderConfig, code, codeVerifier string) (oauthTokenResponse, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {config.RedirectURL},
+		"client_id":     {config.ClientID},
+		"client_secret": {config.ClientSecret},
+		"code_verifier": {codeVerifier},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return oauthTokenResponse{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	var tokenResponse oauthTokenResponse
+	err = doJSONRequest(client, req, &tokenResponse)
+	if err != nil {
+		return oauthTokenResponse{}, err
+	}
+
+	// github answers errors with status 200
+	if tokenResponse.Error != "" {
+		return oauthTokenResponse{}, utils.NewCustomAppError(constants.InvalidData, fmt.Sprintf("token exchange failed: %s %s", tokenResponse.Error, tokenResponse.ErrorDescription))
+	}
+
+	return tokenResponse, nil
+}
+
+// doJSONRequest sends the request and decodes a successful JSON response into dst
+func doJSONRequest(client *http.Client, req *http.Request, dst any) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return utils.NewCustomAppError(constants.InvalidData, fmt.Sprintf("%s %s answered with status %d", req.Method, req.URL.Path, resp.StatusCode))
+	}
+
+	return json.Unmarshal(body, dst)
+}
+
+/*
+OIDCProvider logs users in through an OpenID Connect provider. The endpoints
+come from the discovery document of the issuer and the ID token is verified
+against the keys of the issuer's JWKS.
+*/
+type OIDCProvider struct {
+	Name       string
+	IssuerURL  string
+	Config     OAuthProviderConfig
+	HTTPClient *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func NewOIDCProvider(name, issuerURL string, config OAuthProviderConfig) *OIDCProvider {
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "email", "profile"}
+	}
+
+	return &OIDCProvider{
+		Name:       name,
+		IssuerURL:  strings.TrimSuffix(issuerURL, "/"),
+		Config:     config,
+		HTTPClient: oauthHTTPClient,
+	}
+}
+
+func NewGoogleProvider(config OAuthProviderConfig) *OIDCProvider {
+	return NewOIDCProvider(constants.OAuthProviderGoogle, "https://accounts.google.com", config)
+}
+
+// getDiscovery loads the discovery document once and keeps it for the lifetime of the provider
+func (provider *OIDCProvider) getDiscovery(ctx context.Context) (*oidcDiscovery, error) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	if provider.discovery != nil {
+		return provider.discovery, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, provider.IssuerURL+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var discovery oidcDiscovery
+	err = doJSONRequest(provider.HTTPClient, req, &discovery)
+	if err != nil {
+		return nil, err
+	}
+
+	if discovery.Issuer != provider.IssuerURL {
+		return nil, fmt.Errorf("discovery issuer |%s| does not match |%s|", discovery.Issuer, provider.IssuerURL)
+	}
+
+	provider.discovery = &discovery
+	return provider.discovery, nil
+}
+
+/*
+getKey returns the RSA key with the given key ID. The JWKS is fetched again
+when the key is unknown, providers rotate their keys regularly.
+*/
+func (provider *OIDCProvider) getKey(ctx context.Context, jwksURI, kid string) (*rsa.PublicKey, error) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	if key, ok := provider.keys[kid]; ok {
+		return key, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, jwksURI, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err = doJSONRequest(provider.HTTPClient, req, &jwks)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+
+		key, err := parseRSAJWK(jwk)
+		if err != nil {
+			return nil, err
+		}
+		keys[jwk.Kid] = key
+	}
+	provider.keys = keys
+
+	key, ok := provider.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key |%s|", kid)
+	}
+
+	return key, nil
+}
+
+func parseRSAJWK(jwk jsonWebKey) (*rsa.PublicKey, error) {
+	nBytes, err := base64.RawURLEncoding.DecodeString(jwk.N)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modulus of key |%s|: %w", jwk.Kid, err)
+	}
+
+	eBytes, err := base64.RawURLEncoding.DecodeString(jwk.E)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exponent of key |%s|: %w", jwk.Kid, err)
+	}
+
+	exponent := new(big.Int).SetBytes(eBytes)
+	if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+		return nil, fmt.Errorf("exponent of key |%s| is too large", jwk.Kid)
+	}
+
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(nBytes), E: int(exponent.Int64())}, nil
+}
+
+func (provider *OIDCProvider) AuthCodeURL(state, nonce, codeChallenge string) (string, error) {
+	discovery, err := provider.getDiscovery(context.Background())
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {provider.Config.ClientID},
+		"redirect_uri":          {provider.Config.RedirectURL},
+		"scope":                 {strings.Join(provider.Config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {codeChallenge},
+		"code_challenge_method": {"S256"},
+	}
+
+	return discovery.AuthorizationEndpoint + "?" + query.Encode(), nil
+}
+
+/*
+Exchange redeems the code and verifies the ID token: signature from the
+issuer's JWKS, issuer, audience, expiry and the nonce of this login.
+*/
+func (provider *OIDCProvider) Exchange(ctx context.Context, code, codeVerifier, nonce string) (OAuthIdentity, error) {
+	discovery, err := provider.getDiscovery(ctx)
+	if err != nil {
+		return OAuthIdentity{}, err
+	}
+
+	tokenResponse, err := exchangeAuthorizationCode(ctx, provider.HTTPClient, discovery.TokenEndpoint, provider.Config, code, codeVerifier)
+	if err != nil {
+		return OAuthIdentity{}, err
+	}
+
+	if tokenResponse.IDToken == "" {
+		return OAuthIdentity{}, utils.NewCustomAppError(constants.InvalidData, "token response does not contain an id_token")
+	}
+
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(tokenResponse.IDToken, claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		return provider.getKey(ctx, discovery.JWKSURI, kid)
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}),
+		jwt.WithIssuer(discovery.Issuer),
+		jwt.WithAudience(provider.Config.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
+	if err != nil {
+		return OAuthIdentity{}, utils.NewCustomAppError(constants.InvalidData, fmt.Sprintf("invalid id_token: %v", err))
+	}
+
+	if tokenNonce, _ := claims["nonce"].(string); tokenNonce == "" || tokenNonce != nonce {
+		return OAuthIdentity{}, utils.NewCustomAppError(constants.InvalidData, "id_token nonce does not match")
+	}
+
+	identity := OAuthIdentity{Provider: provider.Name}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	identity.Name, _ = claims["name"].(string)
+	identity.ImageLink, _ = claims["picture"].(string)
+
+	// some providers send email_verified as a string
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		identity.EmailVerified = verified
+	case string:
+		identity.EmailVerified = verified == "true"
+	}
+
+	if identity.Subject == "" {
+		return OAuthIdentity{}, utils.NewCustomAppError(constants.InvalidData, "id_token does not contain a subject")
+	}
+
+	return identity, nil
+}
+
+/*
+GithubProvider logs users in through GitHub. GitHub does not implement OpenID
+Connect, the identity comes from its REST API called with the access token.
+*/
+type GithubProvider struct {
+	AuthURL    string
+	TokenURL   string
+	APIURL     string
+	Config     OAuthProviderConfig
+	HTTPClient *http.Client
+}
+
+func NewGithubProvider(config OAuthProviderConfig) *GithubProvider {
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"read:user", "user:email"}
+	}
+
+	return &GithubProvider{
+		AuthURL:    "https://github.com/login/oauth/authorize",
+		TokenURL:   "https://github.com/login/oauth/access_token",
+		APIURL:     "https://api.github.com",
+		Config:     config,
+		HTTPClient: oauthHTTPClient,
+	}
+}
+
+func (provider *GithubProvider) AuthCodeURL(state, nonce, codeChallenge string) (string, error) {
+	query := url.Values{
+		"client_id":             {provider.Config.ClientID},
+		"redirect_uri":          {provider.Config.RedirectURL},
+		"scope":                 {strings.Join(provider.Config.Scopes, " ")},
+		"state":                 {state},
+		"code_challenge":        {codeChallenge},
+		"code_challenge_method": {"S256"},
+		"allow_signup":          {"false"},
+	}
+
+	return provider.AuthURL + "?" + query.Encode(), nil
+}
+
+func (provider *GithubProvider) getAPI(ctx context.Context, path, accessToken string, dst any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, provider.APIURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	return doJSONRequest(provider.HTTPClient, req, dst)
+}
+
+/*
+Exchange redeems the code, then reads the account and its primary verified
+email from the GitHub API. The nonce is not used, GitHub has no ID token.
+*/
+func (provider *GithubProvider) Exchange(ctx context.Context, code, codeVerifier, nonce string) (OAuthIdentity, error) {
+	tokenResponse, err := exchangeAuthorizationCode(ctx, provider.HTTPClient, provider.TokenURL, provider.Config, code, codeVerifier)
+	if err != nil {
+		return OAuthIdentity{}, err
+	}
+
+	if tokenResponse.AccessToken == "" {
+		return OAuthIdentity{}, utils.NewCustomAppError(constants.InvalidData, "token response does not contain an access_token")
+	}
+
+	var account struct {
+		ID        int64  `json:"id"`
+		Login     string `json:"login"`
+		AvatarURL string `json:"avatar_url"`
+	}
+	err = provider.getAPI(ctx, "/user", tokenResponse.AccessToken, &account)
+	if err != nil {
+		return OAuthIdentity{}, err
+	}
+
+	if account.ID == 0 {
+		return OAuthIdentity{}, errors.New("github account does not have an id")
+	}
+
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	err = provider.getAPI(ctx, "/user/emails", tokenResponse.AccessToken, &emails)
+	if err != nil {
+		return OAuthIdentity{}, err
+	}
+
+	identity := OAuthIdentity{
+		Provider:  constants.OAuthProviderGithub,
+		Subject:   strconv.FormatInt(account.ID, 10),
+		Name:      account.Login,
+		ImageLink: account.AvatarURL,
+	}
+
+	for _, email := range emails {
+		if email.Primary {
+			identity.Email = email.Email
+			identity.EmailVerified = email.Verified
+			break
+		}
+	}
+
+	return identity, nil
+}
@@ -0,0 +1,88 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/utils"
+)
+
+type DBOAuthStore struct {
+	DB *sql.DB
+}
+
+func NewOAuthStore(db *sql.DB) *DBOAuthStore {
+	return &DBOAuthStore{
+		DB: db,
+	}
+}
+
+// OAuthState is a pending authorization request of a social login
+type OAuthState struct {
+	State        string
+	Provider     string
+	CodeVerifier string
+	Nonce        string
+}
+
+type OAuthStore interface {
+	AddOAuthState(state OAuthState) error
+	ConsumeOAuthState(state string, provider string) (OAuthState, error)
+	DeleteExpiredOAuthStates() (int, error)
+}
+
+func (oauthStore *DBOAuthStore) AddOAuthState(state OAuthState) error {
+	query := `
+		INSERT INTO oauth_state (state_hash, provider, code_verifier, nonce)
+		VALUES ($1, $2, $3, $4);
+	`
+
+	_, err := oauthStore.DB.Exec(query, utils.HashToken(state.State), state.Provider, state.CodeVerifier, state.Nonce)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+/*
+ConsumeOAuthState removes the pending request and returns it, a state can only
+be used once and expires after constants.OAuthStateTime.
+*/
+func (oauthStore *DBOAuthStore) ConsumeOAuthState(state string, provider string) (OAuthState, error) {
+	query := `
+		DELETE FROM oauth_state
+		WHERE state_hash = $1 AND provider = $2 AND created_at > $3
+		RETURNING provider, code_verifier, nonce;
+	`
+
+	cutoffTime := time.Now().Add(-constants.OAuthStateTime)
+
+	result := OAuthState{State: state}
+	err := oauthStore.DB.QueryRow(query, utils.HashToken(state), provider, cutoffTime).Scan(&result.Provider, &result.CodeVerifier, &result.Nonce)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return OAuthState{}, utils.NewCustomAppError(constants.ResourceNotFound, "login request is unknown or expired, please try again")
+		}
+		return OAuthState{}, err
+	}
+
+	return result, nil
+}
+
+func (oauthStore *DBOAuthStore) DeleteExpiredOAuthStates() (int, error) {
+	cutoffTime := time.Now().Add(-constants.OAuthStateTime)
+
+	result, err := oauthStore.DB.Exec(`DELETE FROM oauth_state WHERE created_at < $1;`, cutoffTime)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(rowsAffected), nil
+}
@@ -0,0 +1,210 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/utils"
+)
+
+type DBPersonalAccessTokenStore struct {
+	DB *sql.DB
+}
+
+func NewPersonalAccessTokenStore(db *sql.DB) *DBPersonalAccessTokenStore {
+	return &DBPersonalAccessTokenStore{
+		DB: db,
+	}
+}
+
+type PersonalAccessToken struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+}
+
+type CreatePersonalAccessTokenRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expiresInDays"`
+	UserID        string   `json:"-"`
+}
+
+// PersonalAccessTokenOwner is who a personal access token acts for, and what it may do
+type PersonalAccessTokenOwner struct {
+	UserID   string
+	UserName string
+	Scopes   []string
+}
+
+type PersonalAccessTokenStore interface {
+	CreatePersonalAccessToken(req CreatePersonalAccessTokenRequest) (token string, personalAccessToken PersonalAccessToken, err error)
+	GetPersonalAccessTokens(userID string) ([]PersonalAccessToken, error)
+	DeletePersonalAccessToken(userID string, tokenID string) error
+	AuthenticatePersonalAccessToken(token string) (PersonalAccessTokenOwner, error)
+	DeleteExpiredPersonalAccessTokens() (int, error)
+}
+
+/*
+CreatePersonalAccessToken stores the hash of a new token and returns the token
+itself, the only time it can be read.
+*/
+func (tokenStore *DBPersonalAccessTokenStore) CreatePersonalAccessToken(req CreatePersonalAccessTokenRequest) (token string, personalAccessToken PersonalAccessToken, err error) {
+	randomToken, err := utils.GenerateRandomToken(32)
+	if err != nil {
+		return "", PersonalAccessToken{}, err
+	}
+	token = constants.PersonalAccessTokenPrefix + randomToken
+
+	tx, err := tokenStore.DB.Begin()
+	if err != nil {
+		return "", PersonalAccessToken{}, err
+	}
+	defer tx.Rollback()
+
+	// serializes token creation per user so the limit holds
+	_, err = tx.Exec(`SELECT 1 FROM "user" WHERE id = $1 FOR UPDATE`, req.UserID)
+	if err != nil {
+		return "", PersonalAccessToken{}, err
+	}
+
+	var count int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM personal_access_token WHERE user_id = $1`, req.UserID).Scan(&count)
+	if err != nil {
+		return "", PersonalAccessToken{}, err
+	}
+	if count >= constants.MaxPersonalAccessTokens {
+		return "", PersonalAccessToken{}, utils.NewCustomAppError(constants.InvalidData, "you have reached the maximum number of access tokens, please revoke one first")
+	}
+
+	query := `
+		INSERT INTO personal_access_token (user_id, token_hash, name, scope, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, name, scope, created_at, expires_at, last_used_at;
+	`
+	expiresAt := time.Now().Add(time.Duration(req.ExpiresInDays) * 24 * time.Hour)
+
+	personalAccessToken, err = scanPersonalAccessToken(tx.QueryRow(query, req.UserID, utils.HashToken(token), req.Name, strings.Join(req.Scopes, " "), expiresAt))
+	if err != nil {
+		return "", PersonalAccessToken{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return "", PersonalAccessToken{}, err
+	}
+
+	return token, personalAccessToken, nil
+}
+
+func (tokenStore *DBPersonalAccessTokenStore) GetPersonalAccessTokens(userID string) ([]PersonalAccessToken, error) {
+	query := `
+		SELECT id, name, scope, created_at, expires_at, last_used_at
+		FROM personal_access_token
+		WHERE user_id = $1
+		ORDER BY created_at DESC;
+	`
+
+	rows, err := tokenStore.DB.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	personalAccessTokens := []PersonalAccessToken{}
+	for rows.Next() {
+		personalAccessToken, err := scanPersonalAccessToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		personalAccessTokens = append(personalAccessTokens, personalAccessToken)
+	}
+
+	return personalAccessTokens, rows.Err()
+}
+
+func (tokenStore *DBPersonalAccessTokenStore) DeletePersonalAccessToken(userID string, tokenID string) error {
+	result, err := tokenStore.DB.Exec(`DELETE FROM personal_access_token WHERE id = $1 AND user_id = $2`, tokenID, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return utils.NewCustomAppError(constants.ResourceNotFound, "access token not found")
+	}
+
+	return nil
+}
+
+/*
+AuthenticatePersonalAccessToken looks up the owner of an unexpired token and
+records that the token was used.
+*/
+func (tokenStore *DBPersonalAccessTokenStore) AuthenticatePersonalAccessToken(token string) (PersonalAccessTokenOwner, error) {
+	query := `
+		UPDATE personal_access_token t
+		SET last_used_at = now()
+		FROM "user" u
+		WHERE t.token_hash = $1 AND t.expires_at > now() AND u.id = t.user_id
+		RETURNING t.user_id, u.username, t.scope;
+	`
+
+	var (
+		owner PersonalAccessTokenOwner
+		scope string
+	)
+	err := tokenStore.DB.QueryRow(query, utils.HashToken(token)).Scan(&owner.UserID, &owner.UserName, &scope)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return PersonalAccessTokenOwner{}, utils.NewCustomAppError(constants.InvalidData, "access token is unknown, revoked or expired")
+		}
+		return PersonalAccessTokenOwner{}, err
+	}
+	owner.Scopes = strings.Fields(scope)
+
+	return owner, nil
+}
+
+func (tokenStore *DBPersonalAccessTokenStore) DeleteExpiredPersonalAccessTokens() (int, error) {
+	result, err := tokenStore.DB.Exec(`DELETE FROM personal_access_token WHERE expires_at < now()`)
+	if err != nil {
+		return 0, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(rowsAffected), nil
+}
+
+func scanPersonalAccessToken(row rowScanner) (PersonalAccessToken, error) {
+	var (
+		personalAccessToken PersonalAccessToken
+		scope               string
+		lastUsedAt          sql.NullTime
+	)
+
+	err := row.Scan(&personalAccessToken.ID, &personalAccessToken.Name, &scope, &personalAccessToken.CreatedAt, &personalAccessToken.ExpiresAt, &lastUsedAt)
+	if err != nil {
+		return personalAccessToken, err
+	}
+
+	personalAccessToken.Scopes = strings.Fields(scope)
+	if lastUsedAt.Valid {
+		personalAccessToken.LastUsedAt = &lastUsedAt.Time
+	}
+
+	return personalAccessToken, nil
+}
@@ -0,0 +1,81 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/utils"
+)
+
+// RateLimit is how many requests one IP may send to an endpoint within Window
+type RateLimit struct {
+	// Bucket names the endpoint, the counters of two endpoints never mix
+	Bucket string
+	Limit  int
+	Window time.Duration
+}
+
+type DBRateLimitStore struct {
+	DB *sql.DB
+}
+
+func NewRateLimitStore(db *sql.DB) *DBRateLimitStore {
+	return &DBRateLimitStore{
+		DB: db,
+	}
+}
+
+type RateLimitStore interface {
+	AllowRequest(limit RateLimit, ip string) (retryAfter time.Duration, err error)
+	DeleteStaleRateLimits() (int, error)
+}
+
+/*
+AllowRequest counts the request of the IP and refuses it with TooManyRequests
+once the IP sent more than the limit inside the current window. The counter
+lives in the database, so every instance of the server shares it.
+*/
+func (rateLimitStore *DBRateLimitStore) AllowRequest(limit RateLimit, ip string) (retryAfter time.Duration, err error) {
+	now := time.Now()
+
+	query := `
+		INSERT INTO request_rate_limit (bucket, ip_address, request_count, window_start)
+		VALUES ($1, $2, 1, $3)
+		ON CONFLICT (bucket, ip_address) DO UPDATE SET
+			request_count = CASE WHEN request_rate_limit.window_start <= $4 THEN 1 ELSE request_rate_limit.request_count + 1 END,
+			window_start = CASE WHEN request_rate_limit.window_start <= $4 THEN EXCLUDED.window_start ELSE request_rate_limit.window_start END
+		RETURNING request_count, window_start;
+	`
+
+	var (
+		requestCount int
+		windowStart  time.Time
+	)
+	err = rateLimitStore.DB.QueryRow(query, limit.Bucket, ip, now, now.Add(-limit.Window)).Scan(&requestCount, &windowStart)
+	if err != nil {
+		return 0, err
+	}
+
+	if requestCount > limit.Limit {
+		return time.Until(windowStart.Add(limit.Window)), utils.NewCustomAppError(constants.TooManyRequests, "too many requests from this IP, please wait before trying again")
+	}
+
+	return 0, nil
+}
+
+// DeleteStaleRateLimits removes the counters whose window is long over
+func (rateLimitStore *DBRateLimitStore) DeleteStaleRateLimits() (int, error) {
+	cutoffTime := time.Now().Add(-constants.MaxRateLimitWindow)
+
+	result, err := rateLimitStore.DB.Exec(`DELETE FROM request_rate_limit WHERE window_start < $1;`, cutoffTime)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(rowsAffected), nil
+}
@@ -0,0 +1,398 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/utils"
+)
+
+// Defines why content can be reported and where a report is in the moderator queue.
+const (
+	ReportReasonSpam          = "spam"
+	ReportReasonHarassment    = "harassment"
+	ReportReasonInappropriate = "inappropriate"
+	ReportReasonSpoiler       = "spoiler"
+	ReportReasonOther         = "other"
+
+	ReportStatusOpen      = "open"
+	ReportStatusActioned  = "actioned"
+	ReportStatusDismissed = "dismissed"
+)
+
+var ReportReasons = []string{ReportReasonSpam, ReportReasonHarassment, ReportReasonInappropriate, ReportReasonSpoiler, ReportReasonOther}
+
+var ReportStatuses = []string{ReportStatusOpen, ReportStatusActioned, ReportStatusDismissed}
+
+// reportTargetColumns maps a target type to its column in user_report, the names are static so they can go in a query
+var reportTargetColumns = map[string]string{
+	ModerationTargetChallenge:         "challenge_id",
+	ModerationTargetChallengeResponse: "challenge_response_id",
+	ModerationTargetComment:           "comment_id",
+}
+
+type DBReportStore struct {
+	DB *sql.DB
+}
+
+func NewReportStore(db *sql.DB) *DBReportStore {
+	return &DBReportStore{
+		DB: db,
+	}
+}
+
+type CreateReportRequest struct {
+	TargetType string  `json:"targetType"`
+	TargetID   string  `json:"targetID"`
+	Reason     string  `json:"reason"`
+	Details    *string `json:"details"`
+	UserID     string  `json:"-"`
+}
+
+type ResolveReportRequest struct {
+	Status      string `json:"status"`
+	ReportID    string `json:"-"`
+	ModeratorID string `json:"-"`
+}
+
+// Report is one entry of the moderator queue
+type Report struct {
+	ID           string  `json:"id"`
+	ReporterName string  `json:"reporterName"`
+	TargetType   string  `json:"targetType"`
+	TargetID     string  `json:"targetID"`
+	TargetTitle  string  `json:"targetTitle"`
+	TargetHidden bool    `json:"targetHidden"`
+	Reason       string  `json:"reason"`
+	Details      *string `json:"details"`
+	Status       string  `json:"status"`
+	// OpenReports counts the open reports on the same target, this one included while it is open
+	OpenReports    int        `json:"openReports"`
+	ResolvedByName *string    `json:"resolvedByName"`
+	ResolvedAt     *time.Time `json:"resolvedAt"`
+	CreatedAt      time.Time  `json:"createdAt"`
+}
+
+// ResolvedReport is what a reporter is told once a moderator looked at their report
+type ResolvedReport struct {
+	ReporterEmail string
+	TargetType    string
+	TargetTitle   string
+	Status        string
+}
+
+type GetReportsParams struct {
+	Status string
+	Page   int
+}
+
+type ReportStore interface {
+	CreateReport(req CreateReportRequest) (*ModerationAction, error)
+	GetReports(params GetReportsParams) ([]Report, error)
+	ResolveReport(req ResolveReportRequest) ([]ResolvedReport, *ModerationAction, error)
+}
+
+/*
+CreateReport files a report, the caller checks the policy first. Once the open
+reports on the target reach ReportAutoHideThreshold the content is hidden until
+a moderator looks at it, and the returned action tells the owner. Content of
+moderators is never hidden automatically. A dismissal only clears the reports
+made before it, so the count starts over and new reports can hide the content
+again.
+
+The transaction runs as the table owner, outside of row level security: the
+reporter is never the owner of the content that gets hidden.
+*/
+func (reportStore *DBReportStore) CreateReport(req CreateReportRequest) (*ModerationAction, error) {
+	column, ok := reportTargetColumns[req.TargetType]
+	if !ok {
+		return nil, utils.NewCustomAppError(constants.InvalidData, "targetType must be challenge, challenge_response or comment")
+	}
+
+	tx, err := reportStore.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var details any
+	if req.Details != nil && *req.Details != "" {
+		details = *req.Details
+	}
+
+	// nosemgrep
+	query := fmt.Sprintf(`INSERT INTO user_report (user_id, %s, reason, details) VALUES ($1, $2, $3, $4)`, column) // #nosec G201 - static column
+	_, err = tx.Exec(query, req.UserID, req.TargetID, req.Reason, details)
+	if err != nil {
+		return nil, err
+	}
+
+	var openReports int
+	// nosemgrep
+	query = fmt.Sprintf(`
+		SELECT COUNT(*) FROM user_report
+		WHERE %[1]s = $1 AND status = 'open'
+		AND created_at > COALESCE(
+			(SELECT max(resolved_at) FROM user_report WHERE %[1]s = $1 AND status = $2),
+			'-infinity'
+		)
+	`, column) // #nosec G201 - static column
+	err = tx.QueryRow(query, req.TargetID, ReportStatusDismissed).Scan(&openReports)
+	if err != nil {
+		return nil, err
+	}
+
+	if openReports < constants.ReportAutoHideThreshold {
+		return nil, tx.Commit()
+	}
+
+	content, err := lockModeratedContent(tx, req.TargetType, req.TargetID)
+	if err != nil {
+		return nil, err
+	}
+
+	var ownerIsModerator bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM "user" WHERE id = $1 AND role IN ($2, $3))`, content.ownerID, constants.RoleModerator, constants.RoleAdmin).Scan(&ownerIsModerator)
+	if err != nil {
+		return nil, err
+	}
+	if ownerIsModerator {
+		// the reports stay in the queue for a moderator to look at
+		return nil, tx.Commit()
+	}
+
+	// nosemgrep
+	result, err := tx.Exec(fmt.Sprintf(`UPDATE %s SET hidden_at = now() WHERE id = $1 AND hidden_at IS NULL`, moderationTargetTables[req.TargetType]), req.TargetID) // #nosec G201 - static table
+	if err != nil {
+		return nil, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rowsAffected == 0 {
+		// a moderator hid it in the meantime
+		return nil, tx.Commit()
+	}
+
+	reason := fmt.Sprintf("It was hidden automatically after %d reports, a moderator will review it.", openReports)
+	action, err := recordModerationAction(tx, "", content, ModerationActionHide, &reason)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return &action, nil
+}
+
+// GetReports lists the moderator queue, oldest first so nothing waits forever, an empty status lists every report
+func (reportStore *DBReportStore) GetReports(params GetReportsParams) ([]Report, error) {
+	query := `
+		SELECT
+			r.id,
+			reporter.username,
+			CASE
+				WHEN r.challenge_id IS NOT NULL THEN 'challenge'
+				WHEN r.challenge_response_id IS NOT NULL THEN 'challenge_response'
+				ELSE 'comment'
+			END,
+			COALESCE(r.challenge_id, r.challenge_response_id, r.comment_id),
+			COALESCE(c.name, cr.name, cm.content),
+			COALESCE(c.hidden_at, cr.hidden_at, cm.hidden_at) IS NOT NULL,
+			r.reason,
+			r.details,
+			r.status,
+			(
+				SELECT COUNT(*) FROM user_report other
+				WHERE other.status = 'open'
+				AND (other.challenge_id = r.challenge_id
+					OR other.challenge_response_id = r.challenge_response_id
+					OR other.comment_id = r.comment_id)
+			),
+			resolver.username,
+			r.resolved_at,
+			r.created_at
+		FROM user_report r
+		JOIN "user" reporter ON reporter.id = r.user_id
+		LEFT JOIN "user" resolver ON resolver.id = r.resolved_by
+		LEFT JOIN challenge c ON c.id = r.challenge_id
+		LEFT JOIN challenge_response cr ON cr.id = r.challenge_response_id
+		LEFT JOIN comment cm ON cm.id = r.comment_id
+		WHERE ($1 = '' OR r.status = $1)
+		ORDER BY r.created_at ASC, r.id ASC
+		LIMIT $2 OFFSET $3
+	`
+
+	page := params.Page
+	if page < 1 {
+		page = constants.DefaultPage
+	}
+
+	rows, err := reportStore.DB.Query(query, params.Status, constants.DefaultPageSize, (page-1)*constants.DefaultPageSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := []Report{}
+	for rows.Next() {
+		var (
+			report                  Report
+			details, resolvedByName sql.NullString
+			resolvedAt              sql.NullTime
+		)
+		err := rows.Scan(
+			&report.ID, &report.ReporterName, &report.TargetType, &report.TargetID, &report.TargetTitle, &report.TargetHidden,
+			&report.Reason, &details, &report.Status, &report.OpenReports, &resolvedByName, &resolvedAt, &report.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if details.Valid {
+			report.Details = &details.String
+		}
+		if resolvedByName.Valid {
+			report.ResolvedByName = &resolvedByName.String
+		}
+		if resolvedAt.Valid {
+			report.ResolvedAt = &resolvedAt.Time
+		}
+
+		reports = append(reports, report)
+	}
+
+	return reports, rows.Err()
+}
+
+/*
+ResolveReport closes a report together with every other open report on the same
+target, the decision is about the content rather than about who reported it.
+It returns the closed reports so their reporters can be told. Dismissing shows
+the content again when reports had hidden it, the returned action is then set
+so the owner can be told as well.
+*/
+func (reportStore *DBReportStore) ResolveReport(req ResolveReportRequest) ([]ResolvedReport, *ModerationAction, error) {
+	if req.Status != ReportStatusActioned && req.Status != ReportStatusDismissed {
+		return nil, nil, utils.NewCustomAppError(constants.InvalidData, "status must be actioned or dismissed")
+	}
+
+	tx, err := reportStore.DB.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	var (
+		status                                      string
+		challengeID, challengeResponseID, commentID sql.NullInt64
+	)
+	err = tx.QueryRow(`
+		SELECT status, challenge_id, challenge_response_id, comment_id
+		FROM user_report WHERE id = $1
+		FOR UPDATE
+	`, req.ReportID).Scan(&status, &challengeID, &challengeResponseID, &commentID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, utils.NewCustomAppError(constants.ResourceNotFound, "report not found")
+		}
+		return nil, nil, err
+	}
+	if status != ReportStatusOpen {
+		return nil, nil, utils.NewCustomAppError(constants.InvalidData, fmt.Sprintf("the report is already %s", status))
+	}
+
+	rows, err := tx.Query(`
+		UPDATE user_report r
+		SET status = $1, resolved_by = $2, resolved_at = now(), updated_at = now()
+		FROM "user" u
+		WHERE u.id = r.user_id
+		AND r.status = 'open'
+		AND (r.challenge_id = $3 OR r.challenge_response_id = $4 OR r.comment_id = $5)
+		RETURNING
+			u.email,
+			COALESCE(
+				(SELECT name FROM challenge WHERE id = r.challenge_id),
+				(SELECT name FROM challenge_response WHERE id = r.challenge_response_id),
+				(SELECT content FROM comment WHERE id = r.comment_id)
+			)
+	`, req.Status, req.ModeratorID, challengeID, challengeResponseID, commentID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	targetType, targetID := ModerationTargetComment, commentID.Int64
+	switch {
+	case challengeID.Valid:
+		targetType, targetID = ModerationTargetChallenge, challengeID.Int64
+	case challengeResponseID.Valid:
+		targetType, targetID = ModerationTargetChallengeResponse, challengeResponseID.Int64
+	}
+
+	resolved := []ResolvedReport{}
+	for rows.Next() {
+		report := ResolvedReport{TargetType: targetType, Status: req.Status}
+		err := rows.Scan(&report.ReporterEmail, &report.TargetTitle)
+		if err != nil {
+			return nil, nil, err
+		}
+		resolved = append(resolved, report)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	rows.Close()
+
+	var action *ModerationAction
+	if req.Status == ReportStatusDismissed {
+		action, err = showDismissedContent(tx, req.ModeratorID, targetType, strconv.FormatInt(targetID, 10))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return resolved, action, nil
+}
+
+// showDismissedContent undoes the automatic hiding of content whose reports were dismissed, it returns nil when the content was visible
+func showDismissedContent(tx *sql.Tx, moderatorID string, targetType string, targetID string) (*ModerationAction, error) {
+	content, err := lockModeratedContent(tx, targetType, targetID)
+	if err != nil {
+		return nil, err
+	}
+
+	// nosemgrep
+	result, err := tx.Exec(fmt.Sprintf(`UPDATE %s SET hidden_at = NULL WHERE id = $1 AND hidden_at IS NOT NULL`, moderationTargetTables[targetType]), targetID) // #nosec G201 - static table
+	if err != nil {
+		return nil, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rowsAffected == 0 {
+		return nil, nil
+	}
+
+	reason := "A moderator dismissed its reports, so it is visible again."
+	action, err := recordModerationAction(tx, moderatorID, content, ModerationActionUnhide, &reason)
+	if err != nil {
+		return nil, err
+	}
+
+	return &action, nil
+}
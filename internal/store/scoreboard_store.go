@@ -0,0 +1,183 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RichardHoa/hack-me/internal/constants"
+)
+
+type DBScoreboardStore struct {
+	DB *sql.DB
+}
+
+func NewScoreboardStore(db *sql.DB) *DBScoreboardStore {
+	return &DBScoreboardStore{DB: db}
+}
+
+type GetScoreboardParams struct {
+	Category *[]string
+	PageSize *int
+	Page     *int
+}
+
+type ScoreboardEntry struct {
+	Rank            string    `json:"rank"`
+	UserName        string    `json:"userName"`
+	ImageLink       string    `json:"imageLink"`
+	Score           string    `json:"score"`
+	SolveCount      string    `json:"solveCount"`
+	FirstBloodCount string    `json:"firstBloodCount"`
+	LastSolveAt     time.Time `json:"lastSolveAt"`
+}
+
+type Scoreboard []ScoreboardEntry
+
+type ScoreboardStore interface {
+	GetScoreboard(params GetScoreboardParams) (*Scoreboard, *MetaDataPage, error)
+}
+
+/*
+categoryCondition builds the category filter of the scoreboard queries, the
+placeholders start right after the arguments that are already in use.
+*/
+func categoryCondition(categories *[]string, args []any) (string, []any) {
+	if categories == nil || len(*categories) == 0 {
+		return "", args
+	}
+
+	placeholders := make([]string, len(*categories))
+	for i, cat := range *categories {
+		args = append(args, cat)
+		placeholders[i] = fmt.Sprintf("$%d", len(args))
+	}
+
+	return fmt.Sprintf("WHERE c.category IN (%s)", strings.Join(placeholders, ", ")), args
+}
+
+/*
+GetScoreboard ranks users by the sum of the current value of every challenge
+they solved plus the first blood bonus. The whole ranking is computed by
+Postgres, see challenge_points() in the scoring migration for the decay curve.
+Ties are broken by who reached the score first.
+*/
+func (store *DBScoreboardStore) GetScoreboard(params GetScoreboardParams) (*Scoreboard, *MetaDataPage, error) {
+	countCondition, countArgs := categoryCondition(params.Category, []any{})
+
+	// nosemgrep
+	countQuery := fmt.Sprintf(`
+		SELECT COUNT(DISTINCT s.user_id)
+		FROM challenge_solve s
+		JOIN challenge c ON c.id = s.challenge_id
+		%s
+	`, countCondition) // #nosec G201 - only placeholders are interpolated
+
+	pageSize := constants.DefaultPageSize
+	if params.PageSize != nil {
+		pageSize = *params.PageSize
+	}
+
+	page := constants.DefaultPage
+	if params.Page != nil {
+		page = *params.Page
+	}
+
+	var total int
+	err := store.DB.QueryRow(countQuery, countArgs...).Scan(&total)
+	if err != nil {
+		return &Scoreboard{}, &MetaDataPage{}, err
+	}
+
+	if total == 0 {
+		return &Scoreboard{}, &MetaDataPage{
+			MaxPage:     "0",
+			PageSize:    strconv.Itoa(pageSize),
+			CurrentPage: strconv.Itoa(page),
+		}, nil
+	}
+
+	maxPage := (total + pageSize - 1) / pageSize
+	if page > maxPage {
+		return &Scoreboard{}, &MetaDataPage{}, nil
+	}
+
+	metaPage := MetaDataPage{
+		MaxPage:     strconv.Itoa(maxPage),
+		PageSize:    strconv.Itoa(pageSize),
+		CurrentPage: strconv.Itoa(page),
+	}
+
+	// $1 is the first blood bonus
+	condition, args := categoryCondition(params.Category, []any{constants.FirstBloodBonusPoints})
+	offset := (page - 1) * pageSize
+
+	// nosemgrep
+	query := fmt.Sprintf(`
+		WITH challenge_value AS (
+			SELECT
+				c.id,
+				challenge_points(c.initial_points, c.minimum_points, c.decay, COUNT(s.user_id)) AS points
+			FROM challenge c
+			LEFT JOIN challenge_solve s ON s.challenge_id = c.id
+			%s
+			GROUP BY c.id
+		),
+		first_blood AS (
+			SELECT DISTINCT ON (s.challenge_id) s.challenge_id, s.user_id
+			FROM challenge_solve s
+			ORDER BY s.challenge_id, s.created_at ASC
+		),
+		user_score AS (
+			SELECT
+				s.user_id,
+				SUM(cv.points + CASE WHEN fb.user_id IS NULL THEN 0 ELSE $1::INT END) AS score,
+				COUNT(*) AS solve_count,
+				COUNT(fb.user_id) AS first_blood_count,
+				MAX(s.created_at) AS last_solve_at
+			FROM challenge_solve s
+			JOIN challenge_value cv ON cv.id = s.challenge_id
+			LEFT JOIN first_blood fb ON fb.challenge_id = s.challenge_id AND fb.user_id = s.user_id
+			GROUP BY s.user_id
+		)
+		SELECT
+			RANK() OVER (ORDER BY us.score DESC, us.last_solve_at ASC) AS rank,
+			u.username,
+			COALESCE(u.image_link, ''),
+			us.score,
+			us.solve_count,
+			us.first_blood_count,
+			us.last_solve_at
+		FROM user_score us
+		JOIN "user" u ON u.id = us.user_id
+		ORDER BY rank ASC, u.username ASC
+		LIMIT %d OFFSET %d
+	`, condition, pageSize, offset) // #nosec G201 - only placeholders and integers are interpolated
+
+	rows, err := store.DB.Query(query, args...)
+	if err != nil {
+		return &Scoreboard{}, &MetaDataPage{}, err
+	}
+	defer rows.Close()
+
+	scoreboard := make(Scoreboard, 0, pageSize)
+	for rows.Next() {
+		var entry ScoreboardEntry
+		err := rows.Scan(
+			&entry.Rank, &entry.UserName, &entry.ImageLink, &entry.Score,
+			&entry.SolveCount, &entry.FirstBloodCount, &entry.LastSolveAt,
+		)
+		if err != nil {
+			return &Scoreboard{}, &MetaDataPage{}, err
+		}
+		scoreboard = append(scoreboard, entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return &Scoreboard{}, &MetaDataPage{}, err
+	}
+
+	return &scoreboard, &metaPage, nil
+}
@@ -0,0 +1,192 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/utils"
+)
+
+// Defines what happens to an account that is worth keeping a record of.
+const (
+	SecurityEventLogin              = "login"
+	SecurityEventLoginFailed        = "login_failed"
+	SecurityEventAccountLocked      = "account_locked"
+	SecurityEventAccountUnlocked    = "account_unlocked"
+	SecurityEventLogout             = "logout"
+	SecurityEventPasswordChanged    = "password_changed"
+	SecurityEventPasswordReset      = "password_reset"
+	SecurityEventUsernameChanged    = "username_changed"
+	SecurityEventEmailVerified      = "email_verified"
+	SecurityEventTokenRotated       = "token_rotated"
+	SecurityEventRefreshTokenReused = "refresh_token_reused"
+	SecurityEventSessionRevoked     = "session_revoked"
+	SecurityEventAllSessionsRevoked = "all_sessions_revoked"
+	SecurityEventAccountDeleted     = "account_deleted"
+	SecurityEventCSRFRejected       = "csrf_rejected"
+	SecurityEventDataExported       = "data_export_requested"
+)
+
+// SecurityEventTypes lists every event type, the admin filter only accepts these
+var SecurityEventTypes = []string{
+	SecurityEventLogin,
+	SecurityEventLoginFailed,
+	SecurityEventAccountLocked,
+	SecurityEventAccountUnlocked,
+	SecurityEventLogout,
+	SecurityEventPasswordChanged,
+	SecurityEventPasswordReset,
+	SecurityEventUsernameChanged,
+	SecurityEventEmailVerified,
+	SecurityEventTokenRotated,
+	SecurityEventRefreshTokenReused,
+	SecurityEventSessionRevoked,
+	SecurityEventAllSessionsRevoked,
+	SecurityEventAccountDeleted,
+	SecurityEventCSRFRejected,
+	SecurityEventDataExported,
+}
+
+// maxSecurityEventUserAgentLength keeps a crafted user agent from filling the log
+const maxSecurityEventUserAgentLength = 500
+
+type DBSecurityEventStore struct {
+	DB *sql.DB
+}
+
+func NewSecurityEventStore(db *sql.DB) *DBSecurityEventStore {
+	return &DBSecurityEventStore{
+		DB: db,
+	}
+}
+
+// SecurityEvent is one entry of the security log
+type SecurityEvent struct {
+	ID string `json:"id"`
+	// UserID and UserName are empty for failed logins with an unknown email, and the name for deleted accounts
+	UserID    *string   `json:"userID"`
+	UserName  *string   `json:"userName"`
+	EventType string    `json:"eventType"`
+	IPAddress string    `json:"ipAddress"`
+	UserAgent string    `json:"userAgent"`
+	Detail    *string   `json:"detail"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type RecordSecurityEventRequest struct {
+	UserID string
+	// Email finds the user when only the login form is known, an unknown email records no user
+	Email     string
+	EventType string
+	IPAddress string
+	UserAgent string
+	Detail    string
+}
+
+// SecurityEventFilter narrows the log down, empty fields match everything
+type SecurityEventFilter struct {
+	UserID    string
+	EventType string
+	IPAddress string
+	From      *time.Time
+	To        *time.Time
+	Page      int
+}
+
+type SecurityEventStore interface {
+	RecordSecurityEvent(req RecordSecurityEventRequest) error
+	GetSecurityEvents(filter SecurityEventFilter) ([]SecurityEvent, error)
+}
+
+// RecordSecurityEvent appends an event to the log, the table refuses updates and deletes
+func (securityEventStore *DBSecurityEventStore) RecordSecurityEvent(req RecordSecurityEventRequest) error {
+	userAgent := req.UserAgent
+	if runes := []rune(userAgent); len(runes) > maxSecurityEventUserAgentLength {
+		userAgent = string(runes[:maxSecurityEventUserAgentLength])
+	}
+
+	_, err := securityEventStore.DB.Exec(`
+		INSERT INTO security_event (user_id, event_type, ip_address, user_agent, detail)
+		VALUES (COALESCE($1::UUID, (SELECT id FROM "user" WHERE email = $2)), $3, $4, $5, $6)
+	`, utils.NullIfEmpty(req.UserID), req.Email, req.EventType, req.IPAddress, userAgent, utils.NullIfEmpty(req.Detail))
+
+	return err
+}
+
+// GetSecurityEvents lists the events matching filter, newest first
+func (securityEventStore *DBSecurityEventStore) GetSecurityEvents(filter SecurityEventFilter) ([]SecurityEvent, error) {
+	conditions := []string{"TRUE"}
+	args := []any{}
+
+	addCondition := func(condition string, value any) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if filter.UserID != "" {
+		addCondition("se.user_id = $%d", filter.UserID)
+	}
+	if filter.EventType != "" {
+		addCondition("se.event_type = $%d", filter.EventType)
+	}
+	if filter.IPAddress != "" {
+		addCondition("se.ip_address = $%d", filter.IPAddress)
+	}
+	if filter.From != nil {
+		addCondition("se.created_at >= $%d", *filter.From)
+	}
+	if filter.To != nil {
+		addCondition("se.created_at < $%d", *filter.To)
+	}
+
+	page := filter.Page
+	if page < 1 {
+		page = constants.DefaultPage
+	}
+	args = append(args, constants.DefaultPageSize, (page-1)*constants.DefaultPageSize)
+
+	// nosemgrep
+	query := fmt.Sprintf(`
+		SELECT se.id, se.user_id, u.username, se.event_type, se.ip_address, se.user_agent, se.detail, se.created_at
+		FROM security_event se
+		LEFT JOIN "user" u ON u.id = se.user_id
+		WHERE %s
+		ORDER BY se.created_at DESC, se.id DESC
+		LIMIT $%d OFFSET $%d
+	`, strings.Join(conditions, " AND "), len(args)-1, len(args)) // #nosec G201 - conditions only hold placeholders
+
+	rows, err := securityEventStore.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []SecurityEvent{}
+	for rows.Next() {
+		var (
+			event                    SecurityEvent
+			userID, userName, detail sql.NullString
+		)
+		err := rows.Scan(&event.ID, &userID, &userName, &event.EventType, &event.IPAddress, &event.UserAgent, &detail, &event.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		if userID.Valid {
+			event.UserID = &userID.String
+		}
+		if userName.Valid {
+			event.UserName = &userName.String
+		}
+		if detail.Valid {
+			event.Detail = &detail.String
+		}
+
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
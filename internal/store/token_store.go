@@ -2,6 +2,7 @@ package store
 
 import (
 	"database/sql"
+	"errors"
 	"time"
 
 	"github.com/RichardHoa/hack-me/internal/constants"
@@ -18,60 +19,303 @@ func NewTokenStore(db *sql.DB) *DBTokenStore {
 	}
 }
 
+// RefreshToken is the session that currently owns a refresh token, ID is the token hash
 type RefreshToken struct {
 	ID        string
+	UserID    string
+	SessionID string
 	CreatedAt time.Time
 }
 
+// SessionMetadata describes the device that owns a session
+type SessionMetadata struct {
+	UserAgent string
+	IPAddress string
+}
+
+type Session struct {
+	ID         string    `json:"id"`
+	UserAgent  string    `json:"userAgent"`
+	IPAddress  string    `json:"ipAddress"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	IsCurrent  bool      `json:"isCurrent"`
+}
+
 type TokenStore interface {
-	AddRefreshToken(refreshToken string, userID string) error
-	DeleteRefreshToken(userID string) error
-	GetRefreshToken(userID string) (RefreshToken, error)
+	AddRefreshToken(refreshToken string, userID string, metadata SessionMetadata) error
+	IsSessionActive(userID string, sessionID string) (bool, error)
+	RotateRefreshToken(oldRefreshTokenID string, newRefreshToken string, metadata SessionMetadata) error
+	GetRefreshToken(refreshTokenID string) (RefreshToken, error)
+	GetSessions(userID string, currentRefreshTokenID string) ([]Session, error)
+	DeleteRefreshToken(userID string, refreshTokenID string) error
+	DeleteSession(userID string, sessionID string) error
+	RevokeReusedRefreshToken(refreshTokenID string) (revoked RefreshToken, userEmail string, err error)
+	DeleteAllRefreshTokens(userID string) error
 	DeleteExpiredTokens() (int, error)
 }
 
-func (tokenStore *DBTokenStore) AddRefreshToken(refreshToken string, userID string) error {
+/*
+truncateUserAgent keeps the user agent within the column limit, the header is
+controlled by the client so it can be arbitrarily long. It cuts on a rune
+boundary and replaces invalid bytes, Postgres rejects malformed UTF-8.
+*/
+func truncateUserAgent(userAgent string) string {
+	runes := []rune(userAgent)
+	if len(runes) > constants.MaxUserAgentLength {
+		runes = runes[:constants.MaxUserAgentLength]
+	}
+	return string(runes)
+}
+
+/*
+AddRefreshToken stores the refresh token of a new login as its own session, the
+session ID is the one the tokens were signed with. When the user has more than
+constants.MaxSessionsPerUser sessions, the oldest ones are removed.
+*/
+func (tokenStore *DBTokenStore) AddRefreshToken(refreshToken string, userID string, metadata SessionMetadata) error {
 
-	result, err := utils.ExtractClaimsFromJWT(refreshToken, []string{constants.JWTRefreshTokenID})
+	result, err := utils.ExtractClaimsFromJWT(refreshToken, []string{constants.JWTRefreshTokenID, constants.JWTSessionID})
 	if err != nil {
 		return err
 	}
 
-	refreshTokenID := result[0]
+	refreshTokenID, sessionID := result[0], result[1]
+
+	tx, err := tokenStore.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
 	query := `
-		INSERT INTO refresh_token (id, user_id)
-		VALUES ($1, $2)
-		ON CONFLICT (user_id) DO UPDATE SET id = EXCLUDED.id, updated_at = now();
+		INSERT INTO refresh_token (token_hash, user_id, session_id, user_agent, ip_address)
+		VALUES ($1, $2, $3, $4, $5);
 	`
 
-	_, err = tokenStore.DB.Exec(query, refreshTokenID, userID)
+	_, err = tx.Exec(query, utils.HashToken(refreshTokenID), userID, sessionID, utils.NullIfEmpty(truncateUserAgent(metadata.UserAgent)), utils.NullIfEmpty(metadata.IPAddress))
 	if err != nil {
 		return err
 	}
 
-	return nil
+	query = `
+		DELETE FROM refresh_token
+		WHERE user_id = $1 AND session_id NOT IN (
+			SELECT session_id
+			FROM refresh_token
+			WHERE user_id = $1
+			ORDER BY created_at DESC
+			LIMIT $2
+		);
+	`
+
+	_, err = tx.Exec(query, userID, constants.MaxSessionsPerUser)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// IsSessionActive tells whether the session still exists, a logout or a revocation deletes it
+func (tokenStore *DBTokenStore) IsSessionActive(userID string, sessionID string) (bool, error) {
+	var active bool
+	err := tokenStore.DB.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM refresh_token
+			WHERE user_id = $1 AND session_id = $2 AND created_at >= $3
+		)
+	`, userID, sessionID, time.Now().Add(-constants.RefreshTokenTime)).Scan(&active)
+
+	return active, err
+}
+
+/*
+RotateRefreshToken replaces the refresh token of a single session, every other
+session of the user is left untouched. The old token is remembered as part of
+the session's token family so that a replay of it can be detected.
+*/
+func (tokenStore *DBTokenStore) RotateRefreshToken(oldRefreshTokenID string, newRefreshToken string, metadata SessionMetadata) error {
+
+	result, err := utils.ExtractClaimsFromJWT(newRefreshToken, []string{constants.JWTRefreshTokenID})
+	if err != nil {
+		return err
+	}
+
+	newRefreshTokenID := result[0]
+	oldTokenHash := utils.HashToken(oldRefreshTokenID)
+
+	tx, err := tokenStore.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE refresh_token
+		SET token_hash = $1, user_agent = $2, ip_address = $3, last_used_at = now(), updated_at = now()
+		WHERE token_hash = $4
+		RETURNING session_id;
+	`
+
+	var sessionID string
+	err = tx.QueryRow(query, utils.HashToken(newRefreshTokenID), utils.NullIfEmpty(truncateUserAgent(metadata.UserAgent)), utils.NullIfEmpty(metadata.IPAddress), oldTokenHash).Scan(&sessionID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return utils.NewCustomAppError(constants.ResourceNotFound, "session not found")
+		}
+		return err
+	}
+
+	query = `
+		INSERT INTO refresh_token_rotated (token_hash, session_id)
+		VALUES ($1, $2);
+	`
+
+	_, err = tx.Exec(query, oldTokenHash, sessionID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (tokenStore *DBTokenStore) GetRefreshToken(userID string) (RefreshToken, error) {
-	ID := ""
-	var CreatedAt time.Time
+func (tokenStore *DBTokenStore) GetRefreshToken(refreshTokenID string) (RefreshToken, error) {
+	var token RefreshToken
 
 	query := `
-		SELECT id, created_at
+		SELECT token_hash, user_id, session_id, created_at
 		FROM refresh_token
-		WHERE user_id = $1;
+		WHERE token_hash = $1;
+	`
+
+	err := tokenStore.DB.QueryRow(query, utils.HashToken(refreshTokenID)).Scan(&token.ID, &token.UserID, &token.SessionID, &token.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return RefreshToken{}, utils.NewCustomAppError(constants.ResourceNotFound, "session not found")
+		}
+		return RefreshToken{}, err
+	}
+
+	return token, nil
+}
+
+/*
+GetSessions lists the active sessions of a user, most recently used first.
+The session owning currentRefreshTokenID is flagged so the client can tell
+which device it is.
+*/
+func (tokenStore *DBTokenStore) GetSessions(userID string, currentRefreshTokenID string) ([]Session, error) {
+	query := `
+		SELECT
+			session_id,
+			COALESCE(user_agent, ''),
+			COALESCE(ip_address, ''),
+			created_at,
+			last_used_at,
+			token_hash = $2 AS is_current
+		FROM refresh_token
+		WHERE user_id = $1 AND created_at >= $3
+		ORDER BY last_used_at DESC;
+	`
+
+	cutoffTime := time.Now().Add(-constants.RefreshTokenTime)
+
+	rows, err := tokenStore.DB.Query(query, userID, utils.HashToken(currentRefreshTokenID), cutoffTime)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(&session.ID, &session.UserAgent, &session.IPAddress, &session.CreatedAt, &session.LastUsedAt, &session.IsCurrent)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+func (tokenStore *DBTokenStore) DeleteRefreshToken(userID string, refreshTokenID string) error {
+	query := `
+		DELETE FROM refresh_token
+		WHERE user_id = $1 AND token_hash = $2;
+	`
+
+	_, err := tokenStore.DB.Exec(query, userID, utils.HashToken(refreshTokenID))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (tokenStore *DBTokenStore) DeleteSession(userID string, sessionID string) error {
+	query := `
+		DELETE FROM refresh_token
+		WHERE user_id = $1 AND session_id = $2;
+	`
+
+	result, err := tokenStore.DB.Exec(query, userID, sessionID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return utils.NewCustomAppError(constants.ResourceNotFound, "session not found")
+	}
+
+	return nil
+}
+
+/*
+RevokeReusedRefreshToken checks whether the token was already rotated. If so,
+the token has been replayed and the whole token family (the session) is revoked,
+the revoked session is returned with the email of its user so they can be
+warned. A token that never belonged to a live session returns ResourceNotFound.
+*/
+func (tokenStore *DBTokenStore) RevokeReusedRefreshToken(refreshTokenID string) (revoked RefreshToken, userEmail string, err error) {
+	query := `
+		WITH revoked AS (
+			DELETE FROM refresh_token
+			WHERE session_id = (
+				SELECT session_id
+				FROM refresh_token_rotated
+				WHERE token_hash = $1
+			)
+			RETURNING token_hash, user_id, session_id, created_at
+		)
+		SELECT revoked.token_hash, revoked.user_id, revoked.session_id, revoked.created_at, u.email
+		FROM revoked
+		JOIN "user" u ON u.id = revoked.user_id;
 	`
 
-	err := tokenStore.DB.QueryRow(query, userID).Scan(&ID, &CreatedAt)
+	err = tokenStore.DB.QueryRow(query, utils.HashToken(refreshTokenID)).Scan(&revoked.ID, &revoked.UserID, &revoked.SessionID, &revoked.CreatedAt, &userEmail)
 	if err != nil {
-		return RefreshToken{}, nil
+		if errors.Is(err, sql.ErrNoRows) {
+			return RefreshToken{}, "", utils.NewCustomAppError(constants.ResourceNotFound, "refresh token was not rotated")
+		}
+		return RefreshToken{}, "", err
 	}
 
-	return RefreshToken{ID: ID, CreatedAt: CreatedAt}, nil
+	return revoked, userEmail, nil
 }
 
-func (tokenStore *DBTokenStore) DeleteRefreshToken(userID string) error {
+// DeleteAllRefreshTokens ends every session of the user
+func (tokenStore *DBTokenStore) DeleteAllRefreshTokens(userID string) error {
 	query := `
 		DELETE FROM refresh_token
 		WHERE user_id = $1;
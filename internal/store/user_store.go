@@ -5,9 +5,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/policy"
 	"github.com/RichardHoa/hack-me/internal/utils"
 	"github.com/alexedwards/argon2id"
 	"github.com/google/uuid"
@@ -26,11 +29,22 @@ func NewUserStore(db *sql.DB) *DBUserStore {
 type UserStore interface {
 	CreateUser(user *User) (uuid.UUID, error)
 	LoginAndIssueTokens(user *User) (accessToken, refreshToken, csrfToken string, err error)
+	UpgradePasswordHash(userID, password string) error
+	LoginWithOAuthIdentity(identity *OAuthIdentity) (accessToken, refreshToken, csrfToken string, err error)
 	GetUserActivity(userID string) (*UserActivityData, error)
+	GetPublicProfile(userName string) (*PublicProfile, error)
 	ChangePassword(req ChangePasswordRequest) error
 	ChangeUsername(req ChangeUsernameRequest) error
-	DeleteUser(userID string) error
+	SetAvatar(req SetAvatarRequest) (previousKey string, err error)
+	DeleteUser(userID string) (avatarKey string, err error)
 	GetUserName(userID string) (userName string, err error)
+	CreateEmailVerificationToken(userID string) (token string, email string, err error)
+	VerifyEmail(token string) (userID string, err error)
+	GetSubject(userID string) (policy.Subject, error)
+	CreatePasswordResetToken(email string) (token string, userEmail string, err error)
+	ResetPassword(req ResetPasswordRequest) (userID string, err error)
+	GetPasswordHashReport() (PasswordHashReport, error)
+	SetUserRole(req SetUserRoleRequest) error
 }
 
 type Password struct {
@@ -72,9 +86,27 @@ type User struct {
 	GithubID  string   `json:"githubID"`
 }
 
+// PasswordHashReport tells how many password hashes still use outdated argon2id parameters
+type PasswordHashReport struct {
+	CurrentParams string                    `json:"currentParams"`
+	Total         int                       `json:"total"`
+	Outdated      int                       `json:"outdated"`
+	Params        []PasswordHashParamsCount `json:"params"`
+}
+
+type PasswordHashParamsCount struct {
+	// Params looks like "m=65536,t=1,p=4", empty for a hash that is not argon2id
+	Params   string `json:"params"`
+	Count    int    `json:"count"`
+	Outdated bool   `json:"outdated"`
+}
+
 type UserProfile struct {
-	Username  string `json:"userName"`
-	ImageLink string `json:"imageLink"`
+	Username      string `json:"userName"`
+	ImageLink     string `json:"imageLink"`
+	EmailVerified bool   `json:"emailVerified"`
+	TOTPEnabled   bool   `json:"totpEnabled"`
+	Role          string `json:"role"`
 }
 
 type UserChallengeSummary struct {
@@ -82,6 +114,7 @@ type UserChallengeSummary struct {
 	Category      string    `json:"category"`
 	CommentCount  string    `json:"commentCount"`
 	ResponseCount string    `json:"responseCount"`
+	SolveCount    string    `json:"solveCount"`
 	PopularScore  string    `json:"popularScore"`
 	UpdatedAt     time.Time `json:"updatedAt"`
 	CreatedAt     time.Time `json:"createdAt"`
@@ -96,10 +129,56 @@ type UserResponseSummary struct {
 	UpdatedAt time.Time `json:"updatedAt"`
 }
 
+type UserSolveSummary struct {
+	ChallengeID string    `json:"challengeID"`
+	Name        string    `json:"name"`
+	Category    string    `json:"category"`
+	SolvedAt    time.Time `json:"solvedAt"`
+}
+
 type UserActivityData struct {
 	User               UserProfile            `json:"user"`
 	Challenges         []UserChallengeSummary `json:"challenges"`
 	ChallengeResponses []UserResponseSummary  `json:"challengeResponses"`
+	Solves             []UserSolveSummary     `json:"solves"`
+}
+
+// PublicProfile only carries what the column comments of "user" classify as public, anyone can read it
+type PublicProfile struct {
+	Username           string                 `json:"userName"`
+	ImageLink          string                 `json:"imageLink"`
+	JoinedAt           time.Time              `json:"joinedAt"`
+	Stats              PublicProfileStats     `json:"stats"`
+	Challenges         []UserChallengeSummary `json:"challenges"`
+	ChallengeResponses []UserResponseSummary  `json:"challengeResponses"`
+}
+
+type PublicProfileStats struct {
+	ChallengeCount  string `json:"challengeCount"`
+	ResponseCount   string `json:"responseCount"`
+	UpVotes         string `json:"upVotes"`
+	DownVotes       string `json:"downVotes"`
+	SolveCount      string `json:"solveCount"`
+	FirstBloodCount string `json:"firstBloodCount"`
+	Score           string `json:"score"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"newPassword"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+type SetUserRoleRequest struct {
+	Role   string `json:"role"`
+	UserID string `json:"-"`
 }
 
 type ChangeUsernameRequest struct {
@@ -107,6 +186,33 @@ type ChangeUsernameRequest struct {
 	UserID      string `json:"-"`
 }
 
+type SetAvatarRequest struct {
+	UserID    string
+	AvatarKey string
+	ImageLink string
+}
+
+// SetAvatar points the user at a new uploaded avatar and returns the key of the previous one, empty when there was none
+func (userStore *DBUserStore) SetAvatar(req SetAvatarRequest) (previousKey string, err error) {
+	var previous sql.NullString
+	query := `
+		UPDATE "user" u
+		SET avatar_key = $1, image_link = $2, updated_at = now()
+		FROM (SELECT id, avatar_key FROM "user" WHERE id = $3 FOR UPDATE) old
+		WHERE u.id = old.id
+		RETURNING old.avatar_key
+	`
+	err = userStore.DB.QueryRow(query, req.AvatarKey, req.ImageLink, req.UserID).Scan(&previous)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", utils.NewCustomAppError(constants.ResourceNotFound, "user not found")
+		}
+		return "", err
+	}
+
+	return previous.String, nil
+}
+
 func (userStore *DBUserStore) ChangeUsername(req ChangeUsernameRequest) error {
 	query := `UPDATE "user" SET username = $1, updated_at = now() WHERE id = $2`
 	result, err := userStore.DB.Exec(query, req.NewUsername, req.UserID)
@@ -126,22 +232,18 @@ func (userStore *DBUserStore) ChangeUsername(req ChangeUsernameRequest) error {
 	return nil
 }
 
-func (userStore *DBUserStore) DeleteUser(userID string) error {
-	query := `DELETE FROM "user" WHERE id = $1`
-	result, err := userStore.DB.Exec(query, userID)
-	if err != nil {
-		return err
-	}
-
-	rowsAffected, err := result.RowsAffected()
+// DeleteUser removes the account and returns the key of its avatar, the caller deletes the blob
+func (userStore *DBUserStore) DeleteUser(userID string) (avatarKey string, err error) {
+	var key sql.NullString
+	err = userStore.DB.QueryRow(`DELETE FROM "user" WHERE id = $1 RETURNING avatar_key`, userID).Scan(&key)
 	if err != nil {
-		return err
-	}
-	if rowsAffected == 0 {
-		return utils.NewCustomAppError(constants.ResourceNotFound, "user not found")
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", utils.NewCustomAppError(constants.ResourceNotFound, "user not found")
+		}
+		return "", err
 	}
 
-	return nil
+	return key.String, nil
 }
 
 func (userStore *DBUserStore) ChangePassword(req ChangePasswordRequest) error {
@@ -178,7 +280,7 @@ func (userStore *DBUserStore) ChangePassword(req ChangePasswordRequest) error {
 		// Passwords match, proceed to update.
 	}
 
-	newHashedPassword, err := argon2id.CreateHash(req.NewPassword, argon2id.DefaultParams)
+	newHashedPassword, err := utils.HashPassword(req.NewPassword)
 	if err != nil {
 		return err
 	}
@@ -205,11 +307,12 @@ func (userStore *DBUserStore) GetUserActivity(userID string) (*UserActivityData,
 		User:               UserProfile{},
 		Challenges:         []UserChallengeSummary{},
 		ChallengeResponses: []UserResponseSummary{},
+		Solves:             []UserSolveSummary{},
 	}
 
 	// 1. Get user info
-	userQuery := `SELECT username, image_link FROM "user" WHERE id = $1`
-	err := userStore.DB.QueryRow(userQuery, userID).Scan(&activityData.User.Username, &activityData.User.ImageLink)
+	userQuery := `SELECT username, image_link, email_verified_at IS NOT NULL, totp_enabled_at IS NOT NULL, role FROM "user" WHERE id = $1`
+	err := userStore.DB.QueryRow(userQuery, userID).Scan(&activityData.User.Username, &activityData.User.ImageLink, &activityData.User.EmailVerified, &activityData.User.TOTPEnabled, &activityData.User.Role)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, utils.NewCustomAppError(constants.ResourceNotFound, "user not found")
@@ -222,7 +325,8 @@ func (userStore *DBUserStore) GetUserActivity(userID string) (*UserActivityData,
 		SELECT 
 			c.name, c.updated_at, c.created_at, c.category, c.popular_score,
 			(SELECT COUNT(*) FROM comment WHERE challenge_id = c.id) as comment_count,
-			(SELECT COUNT(*) FROM challenge_response WHERE challenge_id = c.id) as response_count
+			(SELECT COUNT(*) FROM challenge_response WHERE challenge_id = c.id) as response_count,
+			(SELECT COUNT(*) FROM challenge_solve WHERE challenge_id = c.id) as solve_count
 		FROM challenge c
 		WHERE c.user_id = $1
 		ORDER BY c.created_at DESC
@@ -237,7 +341,7 @@ func (userStore *DBUserStore) GetUserActivity(userID string) (*UserActivityData,
 		var summary UserChallengeSummary
 		err := rows.Scan(
 			&summary.Name, &summary.UpdatedAt, &summary.CreatedAt, &summary.Category,
-			&summary.PopularScore, &summary.CommentCount, &summary.ResponseCount,
+			&summary.PopularScore, &summary.CommentCount, &summary.ResponseCount, &summary.SolveCount,
 		)
 		if err != nil {
 			return nil, err
@@ -270,9 +374,148 @@ func (userStore *DBUserStore) GetUserActivity(userID string) (*UserActivityData,
 		activityData.ChallengeResponses = append(activityData.ChallengeResponses, summary)
 	}
 
+	// 4. Get challenges solved by the user
+	solvesQuery := `
+		SELECT c.id, c.name, c.category, s.created_at
+		FROM challenge_solve s
+		JOIN challenge c ON s.challenge_id = c.id
+		WHERE s.user_id = $1
+		ORDER BY s.created_at DESC
+	`
+	rows, err = userStore.DB.Query(solvesQuery, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var summary UserSolveSummary
+		err := rows.Scan(&summary.ChallengeID, &summary.Name, &summary.Category, &summary.SolvedAt)
+		if err != nil {
+			return nil, err
+		}
+		activityData.Solves = append(activityData.Solves, summary)
+	}
+
 	return &activityData, nil
 }
 
+/*
+GetPublicProfile is the profile other people see. Hidden challenges and
+responses are left out, and the score is computed the same way as on the
+scoreboard.
+*/
+func (userStore *DBUserStore) GetPublicProfile(userName string) (*PublicProfile, error) {
+	profile := PublicProfile{
+		Challenges:         []UserChallengeSummary{},
+		ChallengeResponses: []UserResponseSummary{},
+	}
+
+	var userID string
+	userQuery := `SELECT id, username, COALESCE(image_link, ''), created_at FROM "user" WHERE username = $1`
+	err := userStore.DB.QueryRow(userQuery, userName).Scan(&userID, &profile.Username, &profile.ImageLink, &profile.JoinedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, utils.NewCustomAppError(constants.ResourceNotFound, "user not found")
+		}
+		return nil, err
+	}
+
+	statsQuery := `
+		WITH challenge_value AS (
+			SELECT
+				c.id,
+				challenge_points(c.initial_points, c.minimum_points, c.decay, COUNT(s.user_id)) AS points
+			FROM challenge c
+			LEFT JOIN challenge_solve s ON s.challenge_id = c.id
+			WHERE c.id IN (SELECT challenge_id FROM challenge_solve WHERE user_id = $1)
+			GROUP BY c.id
+		),
+		first_blood AS (
+			SELECT DISTINCT ON (s.challenge_id) s.challenge_id, s.user_id
+			FROM challenge_solve s
+			WHERE s.challenge_id IN (SELECT challenge_id FROM challenge_solve WHERE user_id = $1)
+			ORDER BY s.challenge_id, s.created_at ASC
+		)
+		SELECT
+			(SELECT COUNT(*) FROM challenge WHERE user_id = $1 AND hidden_at IS NULL),
+			(SELECT COUNT(*) FROM challenge_response WHERE user_id = $1 AND hidden_at IS NULL),
+			(SELECT COALESCE(SUM(up_vote), 0) FROM challenge_response WHERE user_id = $1 AND hidden_at IS NULL),
+			(SELECT COALESCE(SUM(down_vote), 0) FROM challenge_response WHERE user_id = $1 AND hidden_at IS NULL),
+			COUNT(s.challenge_id),
+			COUNT(fb.user_id),
+			COALESCE(SUM(cv.points + CASE WHEN fb.user_id IS NULL THEN 0 ELSE $2::INT END), 0)
+		FROM challenge_solve s
+		JOIN challenge_value cv ON cv.id = s.challenge_id
+		LEFT JOIN first_blood fb ON fb.challenge_id = s.challenge_id AND fb.user_id = s.user_id
+		WHERE s.user_id = $1
+	`
+	stats := &profile.Stats
+	err = userStore.DB.QueryRow(statsQuery, userID, constants.FirstBloodBonusPoints).Scan(
+		&stats.ChallengeCount, &stats.ResponseCount, &stats.UpVotes, &stats.DownVotes,
+		&stats.SolveCount, &stats.FirstBloodCount, &stats.Score,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	challengesQuery := `
+		SELECT
+			c.name, c.updated_at, c.created_at, c.category, c.popular_score,
+			(SELECT COUNT(*) FROM comment WHERE challenge_id = c.id AND hidden_at IS NULL) as comment_count,
+			(SELECT COUNT(*) FROM challenge_response WHERE challenge_id = c.id AND hidden_at IS NULL) as response_count,
+			(SELECT COUNT(*) FROM challenge_solve WHERE challenge_id = c.id) as solve_count
+		FROM challenge c
+		WHERE c.user_id = $1 AND c.hidden_at IS NULL
+		ORDER BY c.created_at DESC
+	`
+	rows, err := userStore.DB.Query(challengesQuery, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var summary UserChallengeSummary
+		err := rows.Scan(
+			&summary.Name, &summary.UpdatedAt, &summary.CreatedAt, &summary.Category,
+			&summary.PopularScore, &summary.CommentCount, &summary.ResponseCount, &summary.SolveCount,
+		)
+		if err != nil {
+			return nil, err
+		}
+		profile.Challenges = append(profile.Challenges, summary)
+	}
+
+	// a writeup of a hidden challenge would give the challenge away
+	responsesQuery := `
+		SELECT cr.id, cr.name, cr.up_vote, cr.down_vote, cr.created_at, cr.updated_at
+		FROM challenge_response cr
+		JOIN challenge c ON c.id = cr.challenge_id
+		WHERE cr.user_id = $1 AND cr.hidden_at IS NULL AND c.hidden_at IS NULL
+		ORDER BY cr.created_at DESC
+	`
+	rows, err = userStore.DB.Query(responsesQuery, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var summary UserResponseSummary
+		err := rows.Scan(
+			&summary.ID, &summary.Name, &summary.UpVote, &summary.DownVote,
+			&summary.CreatedAt, &summary.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		profile.ChallengeResponses = append(profile.ChallengeResponses, summary)
+	}
+
+	return &profile, nil
+}
+
 func (userStore *DBUserStore) CreateUser(user *User) (uuid.UUID, error) {
 
 	var hashedPassword string
@@ -281,7 +524,7 @@ func (userStore *DBUserStore) CreateUser(user *User) (uuid.UUID, error) {
 
 	// Only hash the password if provided
 	if user.Password.PlainText != "" {
-		hashedPassword, err = argon2id.CreateHash(user.Password.PlainText, argon2id.DefaultParams)
+		hashedPassword, err = utils.HashPassword(user.Password.PlainText)
 		if err != nil {
 			return uuid.UUID{}, err
 		}
@@ -330,25 +573,39 @@ func (userStore *DBUserStore) GetUserName(userID string) (userName string, err e
 
 }
 
+// SetUserRole promotes or demotes a user, the new role applies to their next request
+func (userStore *DBUserStore) SetUserRole(req SetUserRoleRequest) error {
+	result, err := userStore.DB.Exec(`UPDATE "user" SET role = $1, updated_at = now() WHERE id = $2`, req.Role, req.UserID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return utils.NewCustomAppError(constants.ResourceNotFound, "user not found")
+	}
+
+	return nil
+}
+
 func (userStore *DBUserStore) LoginAndIssueTokens(user *User) (accessToken, refreshToken, csrfToken string, err error) {
 
 	var (
-		userID     string
-		userName   string
-		errMessage string
+		userID      string
+		userName    string
+		errMessage  string
+		totpEnabled bool
 	)
 
+	// google and github users log in through LoginWithOAuthIdentity, a provider ID alone proves nothing
 	switch {
-	case user.GoogleID != "":
-		err = userStore.DB.QueryRow(`SELECT id, username FROM "user" WHERE google_id = $1`, user.GoogleID).Scan(&userID, &userName)
-		errMessage = "Google Login > Cannot find user from database"
-	case user.GithubID != "":
-		err = userStore.DB.QueryRow(`SELECT id, username FROM "user" WHERE github_id = $1`, user.GithubID).Scan(&userID, &userName)
-		errMessage = "Github Login > Cannot find user from database"
 	case user.Email != "" && user.Password.PlainText != "":
 		var hashed sql.NullString
 
-		err = userStore.DB.QueryRow(`SELECT id, username, password FROM "user" WHERE email = $1`, user.Email).Scan(&userID, &userName, &hashed)
+		err = userStore.DB.QueryRow(`SELECT id, username, password, totp_enabled_at IS NOT NULL FROM "user" WHERE email = $1`, user.Email).Scan(&userID, &userName, &hashed, &totpEnabled)
 
 		errMessage = "Either password is not correct or user email is not found"
 
@@ -384,7 +641,101 @@ func (userStore *DBUserStore) LoginAndIssueTokens(user *User) (accessToken, refr
 
 	user.ID = userID
 
-	accessToken, refreshToken, err = utils.CreateTokens(userID, userName, 0)
+	// the password alone is not enough, the tokens are issued by LoginWithMFACode
+	if totpEnabled {
+		return "", "", "", utils.NewCustomAppError(constants.MFARequired, "two-factor authentication code required")
+	}
+
+	return issueTokens(userID, userName)
+}
+
+/*
+UpgradePasswordHash rehashes a just verified password when its stored hash uses
+weaker argon2id parameters than the configured ones. The caller checks the
+password first, the update is skipped when the password changed in the meantime.
+*/
+func (userStore *DBUserStore) UpgradePasswordHash(userID, password string) error {
+	var storedHash sql.NullString
+	err := userStore.DB.QueryRow(`SELECT password FROM "user" WHERE id = $1`, userID).Scan(&storedHash)
+	if err != nil || !storedHash.Valid {
+		return err
+	}
+
+	needsRehash, err := utils.PasswordNeedsRehash(storedHash.String)
+	if err != nil || !needsRehash {
+		return err
+	}
+
+	newHash, err := utils.HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	_, err = userStore.DB.Exec(`UPDATE "user" SET password = $1 WHERE id = $2 AND password = $3`, newHash, userID, storedHash.String)
+	return err
+}
+
+/*
+GetPasswordHashReport counts the password hashes per argon2id parameters, the
+outdated ones belong to users who have not logged in since the parameters were
+raised.
+*/
+func (userStore *DBUserStore) GetPasswordHashReport() (PasswordHashReport, error) {
+	report := PasswordHashReport{
+		CurrentParams: utils.FormatPasswordHashParams(utils.PasswordHashParams()),
+		Params:        []PasswordHashParamsCount{},
+	}
+
+	query := `
+		SELECT substring(password FROM '^\$argon2id\$v=[0-9]+\$([^$]+)\$') AS params, COUNT(*)
+		FROM "user"
+		WHERE password IS NOT NULL
+		GROUP BY params
+		ORDER BY COUNT(*) DESC;
+	`
+
+	rows, err := userStore.DB.Query(query)
+	if err != nil {
+		return report, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			params sql.NullString
+			count  PasswordHashParamsCount
+		)
+		err = rows.Scan(&params, &count.Count)
+		if err != nil {
+			return report, err
+		}
+
+		// a hash that is not argon2id cannot be upgraded in place either
+		count.Outdated = true
+		if params.Valid {
+			count.Params = params.String
+			parsed, err := utils.ParsePasswordHashParams(params.String)
+			if err == nil {
+				count.Outdated = utils.PasswordHashParamsOutdated(parsed)
+			}
+		}
+
+		report.Total += count.Count
+		if count.Outdated {
+			report.Outdated += count.Count
+		}
+		report.Params = append(report.Params, count)
+	}
+
+	return report, rows.Err()
+}
+
+// issueTokens creates the access, refresh and CSRF tokens of a new session
+func issueTokens(userID, userName string) (accessToken, refreshToken, csrfToken string, err error) {
+	accessToken, refreshToken, err = utils.CreateTokens(userID, userName, "", 0)
+	if err != nil {
+		return "", "", "", utils.NewCustomAppError(constants.InternalError, fmt.Sprintf("fail to create tokens %v", err))
+	}
 
 	result, err := utils.ExtractClaimsFromJWT(refreshToken, []string{constants.JWTRefreshTokenID})
 	if err != nil {
@@ -400,3 +751,421 @@ func (userStore *DBUserStore) LoginAndIssueTokens(user *User) (accessToken, refr
 
 	return accessToken, refreshToken, csrfToken, nil
 }
+
+/*
+LoginWithOAuthIdentity logs in the user owning a verified provider identity.
+An account whose owner verified the same email gets the provider linked to it,
+an account with that email still unverified is refused, otherwise a new account
+without password is created. The user ID is written back to the identity.
+*/
+func (userStore *DBUserStore) LoginWithOAuthIdentity(identity *OAuthIdentity) (accessToken, refreshToken, csrfToken string, err error) {
+	var providerColumn string
+	switch identity.Provider {
+	case constants.OAuthProviderGoogle:
+		providerColumn = "google_id"
+	case constants.OAuthProviderGithub:
+		providerColumn = "github_id"
+	default:
+		return "", "", "", utils.NewCustomAppError(constants.InvalidData, fmt.Sprintf("unknown provider %s", identity.Provider))
+	}
+
+	tx, err := userStore.DB.Begin()
+	if err != nil {
+		return "", "", "", err
+	}
+	defer tx.Rollback()
+
+	var userID, userName string
+
+	// nosemgrep
+	query := fmt.Sprintf(`SELECT id, username FROM "user" WHERE %s = $1`, providerColumn) // #nosec G201 - column comes from the switch above
+	err = tx.QueryRow(query, identity.Subject).Scan(&userID, &userName)
+
+	switch {
+	case err == nil:
+		// returning user
+
+	case errors.Is(err, sql.ErrNoRows):
+		if !identity.EmailVerified || identity.Email == "" {
+			return "", "", "", utils.NewCustomAppError(constants.InvalidData, "your provider account does not have a verified email")
+		}
+
+		var linkedID sql.NullString
+		var emailVerified bool
+
+		// nosemgrep
+		query = fmt.Sprintf(`SELECT id, username, %s, email_verified_at IS NOT NULL FROM "user" WHERE lower(email) = lower($1) FOR UPDATE`, providerColumn) // #nosec G201 - column comes from the switch above
+		err = tx.QueryRow(query, identity.Email).Scan(&userID, &userName, &linkedID, &emailVerified)
+
+		switch {
+		case err == nil:
+			if linkedID.Valid {
+				return "", "", "", utils.NewCustomAppError(constants.InvalidData, fmt.Sprintf("this email is already linked to another %s account", identity.Provider))
+			}
+
+			// anyone can sign up with an address they do not own, linking such an account would hand it over with the squatter's password still working
+			if !emailVerified {
+				return "", "", "", utils.NewCustomAppError(constants.InvalidData, fmt.Sprintf("an account with this email exists but the email is not verified, log in with its password and verify the email before using %s", identity.Provider))
+			}
+
+			// nosemgrep
+			query = fmt.Sprintf(`UPDATE "user" SET %s = $1, updated_at = now() WHERE id = $2`, providerColumn) // #nosec G201 - column comes from the switch above
+			_, err = tx.Exec(query, identity.Subject, userID)
+			if err != nil {
+				return "", "", "", err
+			}
+
+		case errors.Is(err, sql.ErrNoRows):
+			userName, err = availableUsername(tx, identity)
+			if err != nil {
+				return "", "", "", err
+			}
+
+			userID = uuid.New().String()
+
+			// nosemgrep
+			query = fmt.Sprintf(`INSERT INTO "user" (id, username, email, image_link, email_verified_at, %s) VALUES ($1, $2, $3, $4, now(), $5)`, providerColumn) // #nosec G201 - column comes from the switch above
+			_, err = tx.Exec(query, userID, userName, identity.Email, identity.ImageLink, identity.Subject)
+			if err != nil {
+				return "", "", "", err
+			}
+
+		default:
+			return "", "", "", err
+		}
+
+	default:
+		return "", "", "", err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return "", "", "", err
+	}
+
+	identity.UserID = userID
+
+	var totpEnabled bool
+	err = userStore.DB.QueryRow(`SELECT totp_enabled_at IS NOT NULL FROM "user" WHERE id = $1`, userID).Scan(&totpEnabled)
+	if err != nil {
+		return "", "", "", err
+	}
+	if totpEnabled {
+		return "", "", "", utils.NewCustomAppError(constants.MFARequired, "two-factor authentication code required")
+	}
+
+	return issueTokens(userID, userName)
+}
+
+/*
+availableUsername derives a username for a new social account from the provider
+profile, a random suffix is added when the name is already taken.
+*/
+func availableUsername(tx *sql.Tx, identity *OAuthIdentity) (string, error) {
+	base := strings.TrimSpace(identity.Name)
+	if base == "" {
+		base, _, _ = strings.Cut(identity.Email, "@")
+	}
+
+	runes := []rune(base)
+	if len(runes) > constants.MaxGeneratedUsernameLength {
+		base = strings.TrimSpace(string(runes[:constants.MaxGeneratedUsernameLength]))
+	}
+	if utf8.RuneCountInString(base) < 3 {
+		base = "user"
+	}
+
+	candidate := base
+	for range 5 {
+		var exists bool
+		err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM "user" WHERE username = $1)`, candidate).Scan(&exists)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return candidate, nil
+		}
+
+		suffix, err := utils.GenerateRandomToken(4)
+		if err != nil {
+			return "", err
+		}
+		candidate = base + "-" + suffix
+	}
+
+	return "", utils.NewCustomAppError(constants.InternalError, "could not find an available username")
+}
+
+/*
+CreateEmailVerificationToken issues a new verification token for the current
+email of the user, earlier tokens of the user stop working. Every token is an
+email sent, so a new one is refused while the user, or any account using the
+same address, got one less than constants.VerificationEmailCooldown ago.
+*/
+func (userStore *DBUserStore) CreateEmailVerificationToken(userID string) (token string, email string, err error) {
+	var verifiedAt sql.NullTime
+	err = userStore.DB.QueryRow(`SELECT email, email_verified_at FROM "user" WHERE id = $1`, userID).Scan(&email, &verifiedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", "", utils.NewCustomAppError(constants.ResourceNotFound, "user not found")
+		}
+		return "", "", err
+	}
+
+	if verifiedAt.Valid {
+		return "", "", utils.NewCustomAppError(constants.InvalidData, "email is already verified")
+	}
+
+	tokenID, err := utils.GenerateRandomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	token, err = utils.CreateEmailVerificationToken(userID, email, tokenID)
+	if err != nil {
+		return "", "", err
+	}
+
+	tx, err := userStore.DB.Begin()
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback()
+
+	// serialize requests for the same address so parallel ones cannot slip past the cooldown
+	_, err = tx.Exec(`SELECT pg_advisory_xact_lock(hashtext(lower($1)))`, email)
+	if err != nil {
+		return "", "", err
+	}
+
+	var recentlySent bool
+	err = tx.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM email_verification_token
+			WHERE (user_id = $1 OR lower(email) = lower($2)) AND created_at > $3
+		)
+	`, userID, email, time.Now().Add(-constants.VerificationEmailCooldown)).Scan(&recentlySent)
+	if err != nil {
+		return "", "", err
+	}
+	if recentlySent {
+		return "", "", utils.NewCustomAppError(constants.TooManyRequests, "a verification email was sent recently, please wait before asking for another one")
+	}
+
+	_, err = tx.Exec(`DELETE FROM email_verification_token WHERE user_id = $1`, userID)
+	if err != nil {
+		return "", "", err
+	}
+
+	query := `
+		INSERT INTO email_verification_token (token_hash, user_id, email, expires_at)
+		VALUES ($1, $2, $3, $4);
+	`
+	_, err = tx.Exec(query, utils.HashToken(tokenID), userID, email, time.Now().Add(constants.EmailVerificationTokenTime))
+	if err != nil {
+		return "", "", err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return "", "", err
+	}
+
+	return token, email, nil
+}
+
+/*
+VerifyEmail marks the email of the token as verified and returns whose it was.
+The token is consumed, and it only works while the account still uses the email
+it was sent to.
+*/
+func (userStore *DBUserStore) VerifyEmail(token string) (string, error) {
+	invalidTokenErr := utils.NewCustomAppError(constants.InvalidData, "verification token is invalid or expired")
+
+	userID, email, tokenID, err := utils.ParseEmailVerificationToken(token)
+	if err != nil {
+		return "", invalidTokenErr
+	}
+
+	tx, err := userStore.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	query := `
+		DELETE FROM email_verification_token
+		WHERE token_hash = $1 AND user_id = $2 AND email = $3 AND expires_at > now();
+	`
+	result, err := tx.Exec(query, utils.HashToken(tokenID), userID, email)
+	if err != nil {
+		return "", err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return "", err
+	}
+	if rowsAffected == 0 {
+		return "", invalidTokenErr
+	}
+
+	query = `
+		UPDATE "user"
+		SET email_verified_at = now(), updated_at = now()
+		WHERE id = $1 AND email = $2 AND email_verified_at IS NULL;
+	`
+	result, err = tx.Exec(query, userID, email)
+	if err != nil {
+		return "", err
+	}
+
+	rowsAffected, err = result.RowsAffected()
+	if err != nil {
+		return "", err
+	}
+	if rowsAffected == 0 {
+		return "", invalidTokenErr
+	}
+
+	return userID, tx.Commit()
+}
+
+// GetSubject reads the attributes the authorization policy needs about a user
+func (userStore *DBUserStore) GetSubject(userID string) (policy.Subject, error) {
+	subject := policy.Subject{UserID: userID}
+	err := userStore.DB.QueryRow(`SELECT role, email_verified_at IS NOT NULL, email_verified_grandfathered, created_at FROM "user" WHERE id = $1`, userID).Scan(&subject.Role, &subject.EmailVerified, &subject.EmailGrandfathered, &subject.JoinedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return policy.Subject{}, utils.NewCustomAppError(constants.ResourceNotFound, "user not found")
+		}
+		return policy.Subject{}, err
+	}
+
+	return subject, nil
+}
+
+/*
+CreatePasswordResetToken issues a reset token for the account with the email,
+only the hash of the token is stored. It returns the email as the account has
+it, the address the link goes to. Earlier tokens keep working until they expire
+or one of them is used, so asking again cannot cancel a link that is on its way.
+Every token is an email sent, so a new one is refused while the address got one
+less than constants.PasswordResetEmailCooldown ago.
+*/
+func (userStore *DBUserStore) CreatePasswordResetToken(email string) (token string, userEmail string, err error) {
+	var userID string
+	// emails are unique as written, an account that matches exactly wins over one in another case
+	err = userStore.DB.QueryRow(`SELECT id, email FROM "user" WHERE lower(email) = lower($1) ORDER BY email = $1 DESC LIMIT 1`, email).Scan(&userID, &userEmail)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", "", utils.NewCustomAppError(constants.ResourceNotFound, "user not found")
+		}
+		return "", "", err
+	}
+
+	token, err = utils.GenerateRandomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	tx, err := userStore.DB.Begin()
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback()
+
+	// serialize requests for the same address so parallel ones cannot slip past the cooldown
+	_, err = tx.Exec(`SELECT pg_advisory_xact_lock(hashtext(lower($1)))`, userEmail)
+	if err != nil {
+		return "", "", err
+	}
+
+	var recentlySent bool
+	err = tx.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM password_reset_token
+			WHERE user_id IN (SELECT id FROM "user" WHERE lower(email) = lower($1)) AND created_at > $2
+		)
+	`, userEmail, time.Now().Add(-constants.PasswordResetEmailCooldown)).Scan(&recentlySent)
+	if err != nil {
+		return "", "", err
+	}
+	if recentlySent {
+		return "", "", utils.NewCustomAppError(constants.TooManyRequests, "a password reset email was sent recently, please wait before asking for another one")
+	}
+
+	_, err = tx.Exec(`DELETE FROM password_reset_token WHERE user_id = $1 AND expires_at <= now()`, userID)
+	if err != nil {
+		return "", "", err
+	}
+
+	query := `
+		INSERT INTO password_reset_token (token_hash, user_id, expires_at)
+		VALUES ($1, $2, $3);
+	`
+	_, err = tx.Exec(query, utils.HashToken(token), userID, time.Now().Add(constants.PasswordResetTokenTime))
+	if err != nil {
+		return "", "", err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return "", "", err
+	}
+
+	return token, userEmail, nil
+}
+
+/*
+ResetPassword consumes the reset token and replaces the password. Opening the
+emailed link proves that the user owns the email, so the email is verified too.
+*/
+func (userStore *DBUserStore) ResetPassword(req ResetPasswordRequest) (userID string, err error) {
+	newHashedPassword, err := utils.HashPassword(req.NewPassword)
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := userStore.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	query := `
+		DELETE FROM password_reset_token
+		WHERE token_hash = $1 AND expires_at > now()
+		RETURNING user_id;
+	`
+	err = tx.QueryRow(query, utils.HashToken(req.Token)).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", utils.NewCustomAppError(constants.InvalidData, "reset token is invalid or expired")
+		}
+		return "", err
+	}
+
+	query = `
+		UPDATE "user"
+		SET password = $1, email_verified_at = COALESCE(email_verified_at, now()), updated_at = now()
+		WHERE id = $2;
+	`
+	_, err = tx.Exec(query, newHashedPassword, userID)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(`DELETE FROM password_reset_token WHERE user_id = $1`, userID)
+	if err != nil {
+		return "", err
+	}
+
+	// a reset through the mailbox also unlocks an account locked by failed logins
+	_, err = tx.Exec(`DELETE FROM login_throttle WHERE scope = 'account' AND subject = (SELECT lower(email) FROM "user" WHERE id = $1)`, userID)
+	if err != nil {
+		return "", err
+	}
+
+	return userID, tx.Commit()
+}
@@ -0,0 +1,303 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/RichardHoa/hack-me/internal/utils"
+)
+
+const (
+	WebAuthnRegistration   = "registration"
+	WebAuthnAuthentication = "authentication"
+)
+
+type DBWebAuthnStore struct {
+	DB *sql.DB
+}
+
+func NewWebAuthnStore(db *sql.DB) *DBWebAuthnStore {
+	return &DBWebAuthnStore{
+		DB: db,
+	}
+}
+
+type WebAuthnCredential struct {
+	// ID is the base64url credential ID
+	ID         string     `json:"id"`
+	UserID     string     `json:"-"`
+	PublicKey  []byte     `json:"-"`
+	SignCount  uint32     `json:"-"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+}
+
+/*
+WebAuthnRegistrationRequest is the PublicKeyCredential.toJSON() of a new passkey,
+binary fields are base64url encoded.
+*/
+type WebAuthnRegistrationRequest struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Name     string `json:"name"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+	} `json:"response"`
+}
+
+// WebAuthnLoginRequest is the PublicKeyCredential.toJSON() of an assertion
+type WebAuthnLoginRequest struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+type WebAuthnStore interface {
+	CreateWebAuthnChallenge(userID string, ceremony string) (challenge string, err error)
+	ConsumeWebAuthnChallenge(challenge string, ceremony string) (userID string, err error)
+	AddWebAuthnCredential(credential WebAuthnCredential) error
+	GetWebAuthnCredential(credentialID string) (WebAuthnCredential, error)
+	GetWebAuthnCredentials(userID string) ([]WebAuthnCredential, error)
+	DeleteWebAuthnCredential(userID string, credentialID string) error
+	LoginWithWebAuthnCredential(credentialID string, signCount uint32) (accessToken, refreshToken, csrfToken string, err error)
+	DeleteExpiredWebAuthnChallenges() (int, error)
+}
+
+/*
+CreateWebAuthnChallenge stores the hash of a new random challenge. Registration
+challenges are bound to the user, authentication ones are not because the user
+is only known once the passkey answers.
+*/
+func (webAuthnStore *DBWebAuthnStore) CreateWebAuthnChallenge(userID string, ceremony string) (challenge string, err error) {
+	challenge, err = utils.GenerateRandomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	query := `
+		INSERT INTO webauthn_challenge (challenge_hash, user_id, ceremony)
+		VALUES ($1, $2, $3);
+	`
+	_, err = webAuthnStore.DB.Exec(query, utils.HashToken(challenge), utils.NullIfEmpty(userID), ceremony)
+	if err != nil {
+		return "", err
+	}
+
+	return challenge, nil
+}
+
+// ConsumeWebAuthnChallenge deletes the challenge so it can only be answered once
+func (webAuthnStore *DBWebAuthnStore) ConsumeWebAuthnChallenge(challenge string, ceremony string) (userID string, err error) {
+	query := `
+		DELETE FROM webauthn_challenge
+		WHERE challenge_hash = $1 AND ceremony = $2 AND created_at > $3
+		RETURNING user_id;
+	`
+
+	cutoffTime := time.Now().Add(-constants.WebAuthnChallengeTime)
+
+	var owner sql.NullString
+	err = webAuthnStore.DB.QueryRow(query, utils.HashToken(challenge), ceremony, cutoffTime).Scan(&owner)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", utils.NewCustomAppError(constants.InvalidData, "passkey challenge is unknown or expired, please try again")
+		}
+		return "", err
+	}
+
+	return owner.String, nil
+}
+
+func (webAuthnStore *DBWebAuthnStore) AddWebAuthnCredential(credential WebAuthnCredential) error {
+	tx, err := webAuthnStore.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var count int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM webauthn_credential WHERE user_id = $1`, credential.UserID).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count >= constants.MaxWebAuthnCredentials {
+		return utils.NewCustomAppError(constants.InvalidData, "you have reached the maximum number of passkeys")
+	}
+
+	query := `
+		INSERT INTO webauthn_credential (id, user_id, public_key, sign_count, name)
+		VALUES ($1, $2, $3, $4, $5);
+	`
+	_, err = tx.Exec(query, credential.ID, credential.UserID, credential.PublicKey, int64(credential.SignCount), credential.Name)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (webAuthnStore *DBWebAuthnStore) GetWebAuthnCredential(credentialID string) (WebAuthnCredential, error) {
+	query := `
+		SELECT id, user_id, public_key, sign_count, name, created_at, last_used_at
+		FROM webauthn_credential
+		WHERE id = $1;
+	`
+
+	credential, err := scanWebAuthnCredential(webAuthnStore.DB.QueryRow(query, credentialID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return WebAuthnCredential{}, utils.NewCustomAppError(constants.ResourceNotFound, "passkey not found")
+		}
+		return WebAuthnCredential{}, err
+	}
+
+	return credential, nil
+}
+
+func (webAuthnStore *DBWebAuthnStore) GetWebAuthnCredentials(userID string) ([]WebAuthnCredential, error) {
+	query := `
+		SELECT id, user_id, public_key, sign_count, name, created_at, last_used_at
+		FROM webauthn_credential
+		WHERE user_id = $1
+		ORDER BY created_at;
+	`
+
+	rows, err := webAuthnStore.DB.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	credentials := []WebAuthnCredential{}
+	for rows.Next() {
+		credential, err := scanWebAuthnCredential(rows)
+		if err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, credential)
+	}
+
+	return credentials, rows.Err()
+}
+
+func (webAuthnStore *DBWebAuthnStore) DeleteWebAuthnCredential(userID string, credentialID string) error {
+	result, err := webAuthnStore.DB.Exec(`DELETE FROM webauthn_credential WHERE id = $1 AND user_id = $2`, credentialID, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return utils.NewCustomAppError(constants.ResourceNotFound, "passkey not found")
+	}
+
+	return nil
+}
+
+/*
+LoginWithWebAuthnCredential records the sign count of a verified assertion and
+issues the tokens. A counter that does not go up means two authenticators share
+the key, the login is refused as the passkey may have been cloned. Synced
+passkeys report 0 on every use and are not counted.
+*/
+func (webAuthnStore *DBWebAuthnStore) LoginWithWebAuthnCredential(credentialID string, signCount uint32) (accessToken, refreshToken, csrfToken string, err error) {
+	tx, err := webAuthnStore.DB.Begin()
+	if err != nil {
+		return "", "", "", err
+	}
+	defer tx.Rollback()
+
+	var (
+		userID      string
+		userName    string
+		storedCount int64
+	)
+	query := `
+		SELECT c.user_id, u.username, c.sign_count
+		FROM webauthn_credential c
+		JOIN "user" u ON u.id = c.user_id
+		WHERE c.id = $1
+		FOR UPDATE OF c;
+	`
+	err = tx.QueryRow(query, credentialID).Scan(&userID, &userName, &storedCount)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", "", "", utils.NewCustomAppError(constants.ResourceNotFound, "passkey not found")
+		}
+		return "", "", "", err
+	}
+
+	if (signCount != 0 || storedCount != 0) && int64(signCount) <= storedCount {
+		return "", "", "", utils.NewCustomAppError(constants.LackingPermission, "passkey sign count went backwards, it may have been cloned")
+	}
+
+	query = `
+		UPDATE webauthn_credential
+		SET sign_count = $1, last_used_at = now()
+		WHERE id = $2;
+	`
+	_, err = tx.Exec(query, int64(signCount), credentialID)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return "", "", "", err
+	}
+
+	return issueTokens(userID, userName)
+}
+
+func (webAuthnStore *DBWebAuthnStore) DeleteExpiredWebAuthnChallenges() (int, error) {
+	cutoffTime := time.Now().Add(-constants.WebAuthnChallengeTime)
+
+	result, err := webAuthnStore.DB.Exec(`DELETE FROM webauthn_challenge WHERE created_at < $1;`, cutoffTime)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(rowsAffected), nil
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanWebAuthnCredential(row rowScanner) (WebAuthnCredential, error) {
+	var (
+		credential WebAuthnCredential
+		signCount  int64
+		lastUsedAt sql.NullTime
+	)
+
+	err := row.Scan(&credential.ID, &credential.UserID, &credential.PublicKey, &signCount, &credential.Name, &credential.CreatedAt, &lastUsedAt)
+	if err != nil {
+		return credential, err
+	}
+
+	credential.SignCount = uint32(signCount) // #nosec G115 - the column only holds authenticator counters
+	if lastUsedAt.Valid {
+		credential.LastUsedAt = &lastUsedAt.Time
+	}
+
+	return credential, nil
+}
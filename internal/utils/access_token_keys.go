@@ -0,0 +1,240 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// AccessTokenKey is a public key access tokens can be verified with, Signer is only set on the signing key
+type AccessTokenKey struct {
+	ID        string
+	Algorithm string
+	PublicKey crypto.PublicKey
+	Signer    crypto.Signer
+}
+
+// JWK is the JSON Web Key (RFC 7517) of a public access token key
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	Y         string `json:"y,omitempty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+}
+
+/*
+AccessTokenKeys returns the asymmetric keys of the access tokens, the signing key
+first. It is empty when access tokens are signed with HS512 through the keyring.
+*/
+func AccessTokenKeys() ([]AccessTokenKey, error) {
+	if constants.AccessTokenAlgorithm == constants.AccessTokenAlgorithmHS512 {
+		return []AccessTokenKey{}, nil
+	}
+
+	signingKey, err := parseAccessTokenPEM(constants.AccessTokenPrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("ACCESS_TOKEN_PRIVATE_KEY: %w", err)
+	}
+	if len(signingKey) != 1 || signingKey[0].Signer == nil {
+		return nil, errors.New("ACCESS_TOKEN_PRIVATE_KEY must hold exactly one private key")
+	}
+	if signingKey[0].Algorithm != constants.AccessTokenAlgorithm {
+		return nil, fmt.Errorf("ACCESS_TOKEN_PRIVATE_KEY is a %s key, ACCESS_TOKEN_ALGORITHM is %s", signingKey[0].Algorithm, constants.AccessTokenAlgorithm)
+	}
+
+	// keys rotated out stay published until the tokens they signed expired
+	previousKeys, err := parseAccessTokenPEM(constants.AccessTokenPreviousPublicKeys)
+	if err != nil {
+		return nil, fmt.Errorf("ACCESS_TOKEN_PREVIOUS_PUBLIC_KEYS: %w", err)
+	}
+	for i := range previousKeys {
+		previousKeys[i].Signer = nil
+	}
+
+	return append(signingKey, previousKeys...), nil
+}
+
+// parseAccessTokenPEM reads every PKCS #8 private key or PKIX public key of a PEM bundle
+func parseAccessTokenPEM(bundle string) ([]AccessTokenKey, error) {
+	keys := []AccessTokenKey{}
+
+	rest := []byte(bundle)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+
+		var (
+			publicKey crypto.PublicKey
+			signer    crypto.Signer
+		)
+		switch block.Type {
+		case "PRIVATE KEY":
+			privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			var ok bool
+			signer, ok = privateKey.(crypto.Signer)
+			if !ok {
+				return nil, errors.New("private key cannot sign")
+			}
+			publicKey = signer.Public()
+		case "PUBLIC KEY":
+			var err error
+			publicKey, err = x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+		}
+
+		jwk, err := publicKeyJWK(publicKey)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, AccessTokenKey{
+			ID:        jwk.KeyID,
+			Algorithm: jwk.Algorithm,
+			PublicKey: publicKey,
+			Signer:    signer,
+		})
+	}
+
+	return keys, nil
+}
+
+// publicKeyJWK encodes an Ed25519 or P-256 public key, its kid is the RFC 7638 thumbprint
+func publicKeyJWK(publicKey crypto.PublicKey) (JWK, error) {
+	var (
+		jwk        JWK
+		thumbprint any
+	)
+
+	switch publicKey := publicKey.(type) {
+	case ed25519.PublicKey:
+		jwk = JWK{
+			KeyType:   "OKP",
+			Curve:     "Ed25519",
+			X:         base64.RawURLEncoding.EncodeToString(publicKey),
+			Algorithm: constants.AccessTokenAlgorithmEdDSA,
+		}
+		// the members required by the key type, in lexicographic order
+		thumbprint = struct {
+			Curve   string `json:"crv"`
+			KeyType string `json:"kty"`
+			X       string `json:"x"`
+		}{jwk.Curve, jwk.KeyType, jwk.X}
+	case *ecdsa.PublicKey:
+		if publicKey.Curve != elliptic.P256() {
+			return jwk, errors.New("only P-256 ECDSA keys are supported")
+		}
+		point, err := publicKey.Bytes()
+		if err != nil {
+			return jwk, err
+		}
+		jwk = JWK{
+			KeyType:   "EC",
+			Curve:     "P-256",
+			X:         base64.RawURLEncoding.EncodeToString(point[1:33]),
+			Y:         base64.RawURLEncoding.EncodeToString(point[33:]),
+			Algorithm: constants.AccessTokenAlgorithmES256,
+		}
+		thumbprint = struct {
+			Curve   string `json:"crv"`
+			KeyType string `json:"kty"`
+			X       string `json:"x"`
+			Y       string `json:"y"`
+		}{jwk.Curve, jwk.KeyType, jwk.X, jwk.Y}
+	default:
+		return jwk, fmt.Errorf("unsupported public key type %T", publicKey)
+	}
+
+	canonical, err := json.Marshal(thumbprint)
+	if err != nil {
+		return jwk, err
+	}
+	sum := sha256.Sum256(canonical)
+
+	jwk.KeyID = base64.RawURLEncoding.EncodeToString(sum[:])
+	jwk.Use = "sig"
+	return jwk, nil
+}
+
+// AccessTokenJWKS returns the public keys other services verify access tokens with
+func AccessTokenJWKS() ([]JWK, error) {
+	keys, err := AccessTokenKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	jwks := []JWK{}
+	for _, key := range keys {
+		jwk, err := publicKeyJWK(key.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		jwks = append(jwks, jwk)
+	}
+
+	return jwks, nil
+}
+
+// signAccessToken signs with the configured algorithm, HS512 goes through the keyring
+func signAccessToken(claims jwt.Claims) (string, error) {
+	keys, err := AccessTokenKeys()
+	if err != nil {
+		return "", err
+	}
+	if len(keys) == 0 {
+		return signJWT(accessTokenKeyring(), claims)
+	}
+
+	method := jwt.GetSigningMethod(keys[0].Algorithm)
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = keys[0].ID
+	return token.SignedString(keys[0].Signer)
+}
+
+/*
+accessTokenKeyFunc verifies HS512 tokens with the keyring and asymmetric ones with
+the published key named by their kid, the key type has to match the algorithm
+so a public key is never used as an HMAC secret.
+*/
+func accessTokenKeyFunc(token *jwt.Token) (any, error) {
+	if token.Method.Alg() == jwt.SigningMethodHS512.Alg() {
+		return accessTokenKeyring().jwtKeyFunc(token)
+	}
+
+	kid, _ := token.Header["kid"].(string)
+
+	keys, err := AccessTokenKeys()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if key.ID == kid && key.Algorithm == token.Method.Alg() {
+			return key.PublicKey, nil
+		}
+	}
+
+	return nil, fmt.Errorf("access token key %q is unknown", kid)
+}
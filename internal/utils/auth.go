@@ -1,14 +1,7 @@
 package utils
 
 import (
-	"bufio"
-	"crypto/sha1" // #nosec G505 - only used for api call and not encryption
-	"encoding/hex"
 	"fmt"
-	"io"
-	"net/http"
-	"strings"
-	"time"
 	"unicode/utf8"
 )
 
@@ -18,10 +11,10 @@ type PasswordCheckResult struct {
 }
 
 /*
-CheckPasswordValid checks a password against local format rules and the 'Have I
-Been Pwned' public breach database.
+CheckPasswordValid checks a password against local format rules and the breach
+database behind breachChecker.
 */
-func CheckPasswordValid(password string) PasswordCheckResult {
+func CheckPasswordValid(password string, breachChecker PasswordBreachChecker) PasswordCheckResult {
 	passwordLength := utf8.RuneCountInString(password)
 	if passwordLength < 15 {
 		return PasswordCheckResult{nil, fmt.Sprintf("Password length must be at least 15 characters, your password is currently only %d characters", passwordLength)}
@@ -32,51 +25,12 @@ func CheckPasswordValid(password string) PasswordCheckResult {
 		return PasswordCheckResult{nil, "Your password length is too long"}
 	}
 
-	// nosemgrep
-	hash := sha1.Sum([]byte(password)) // #nosec G401 - use only for API call
-	sha1Hex := strings.ToUpper(hex.EncodeToString(hash[:]))
-	prefix := sha1Hex[:5]
-	suffix := sha1Hex[5:]
-
-	url := fmt.Sprintf("https://api.pwnedpasswords.com/range/%s", prefix)
-
-	client := &http.Client{
-		Timeout: 5 * time.Second,
-	}
-
-	resp, err := client.Get(url)
-	if err != nil {
-		return PasswordCheckResult{err, ""}
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return PasswordCheckResult{err, ""}
-	}
-
-	//NOTE: Ensure the response is the correct format before using it
-
-	body, err := io.ReadAll(resp.Body)
+	breachCount, err := breachChecker.BreachCount(password)
 	if err != nil {
 		return PasswordCheckResult{err, ""}
 	}
-
-	// Search suffix in list
-	scanner := bufio.NewScanner(strings.NewReader(string(body)))
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Split(line, ":")
-		if len(parts) != 2 {
-			continue
-		}
-		// check with suffix
-		if strings.TrimSpace(parts[0]) == suffix {
-			return PasswordCheckResult{nil, fmt.Sprintf("Your password has been found in breach %v times, please change to a more secure password", parts[1])}
-		}
-	}
-
-	if err := scanner.Err(); err != nil {
-		return PasswordCheckResult{err, ""}
+	if breachCount > 0 {
+		return PasswordCheckResult{nil, fmt.Sprintf("Your password has been found in breach %v times, please change to a more secure password", breachCount)}
 	}
 
 	return PasswordCheckResult{nil, ""}
@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+
+	"github.com/RichardHoa/hack-me/internal/constants"
+)
+
+// AuthenticatedUser is the user the auth middleware put in the request context
+type AuthenticatedUser struct {
+	ID       string
+	UserName string
+	// SessionID is the refresh token ID of a cookie login, bearer requests have none
+	SessionID string
+	Method    string
+	// Scopes limit what a personal access token may do, other logins may do everything
+	Scopes []string
+	// ScopeChecked is set once the route confirmed the personal access token holds the scope it needs
+	ScopeChecked bool
+}
+
+// HasScope reports whether the user may use a route that needs scope
+func (user AuthenticatedUser) HasScope(scope string) bool {
+	if user.Method != constants.AuthMethodPersonalAccessToken {
+		return true
+	}
+	return slices.Contains(user.Scopes, scope)
+}
+
+type authenticatedUserKey struct{}
+
+// WithAuthenticatedUser returns a copy of ctx carrying the user
+func WithAuthenticatedUser(ctx context.Context, user AuthenticatedUser) context.Context {
+	return context.WithValue(ctx, authenticatedUserKey{}, user)
+}
+
+/*
+GetAuthenticatedUser returns the user of the request, or an error when nobody is
+logged in. Personal access tokens only count on routes that need a scope, every
+other route treats them as not logged in.
+*/
+func GetAuthenticatedUser(r *http.Request) (AuthenticatedUser, error) {
+	user, ok := LookupAuthenticatedUser(r)
+	if !ok {
+		return AuthenticatedUser{}, errors.New("request is not authenticated")
+	}
+	if user.Method == constants.AuthMethodPersonalAccessToken && !user.ScopeChecked {
+		return AuthenticatedUser{}, errors.New("personal access tokens cannot be used on this route")
+	}
+	return user, nil
+}
+
+// LookupAuthenticatedUser returns whoever authenticated the request, before any route checked their scopes
+func LookupAuthenticatedUser(r *http.Request) (AuthenticatedUser, bool) {
+	user, ok := r.Context().Value(authenticatedUserKey{}).(AuthenticatedUser)
+	if !ok || user.ID == "" {
+		return AuthenticatedUser{}, false
+	}
+	return user, true
+}
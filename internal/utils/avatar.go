@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+
+	"github.com/RichardHoa/hack-me/internal/constants"
+)
+
+// avatarDecoders maps a sniffed content type to its decoder, the extension or header the client sent is never trusted
+var avatarDecoders = map[string]struct {
+	decode       func(io.Reader) (image.Image, error)
+	decodeConfig func(io.Reader) (image.Config, error)
+}{
+	"image/jpeg": {jpeg.Decode, jpeg.DecodeConfig},
+	"image/png":  {png.Decode, png.DecodeConfig},
+	"image/gif":  {gif.Decode, gif.DecodeConfig},
+}
+
+/*
+ProcessAvatar turns an upload into the PNG we serve. The format comes from the
+magic bytes, the image is center cropped to a square of at most AvatarSize
+pixels and encoded again from the pixels alone, so EXIF data, comments and
+anything appended to the file are dropped.
+*/
+func ProcessAvatar(data []byte) ([]byte, error) {
+	contentType := http.DetectContentType(data)
+	decoder, ok := avatarDecoders[contentType]
+	if !ok {
+		return nil, NewCustomAppError(constants.InvalidData, "the avatar must be a JPEG, PNG or GIF image")
+	}
+
+	config, err := decoder.decodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, NewCustomAppError(constants.InvalidData, "the avatar is not a valid image")
+	}
+	if config.Width > constants.MaxAvatarSourceDimension || config.Height > constants.MaxAvatarSourceDimension {
+		return nil, NewCustomAppError(constants.InvalidData, fmt.Sprintf("the avatar can be at most %dx%d pixels", constants.MaxAvatarSourceDimension, constants.MaxAvatarSourceDimension))
+	}
+
+	img, err := decoder.decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, NewCustomAppError(constants.InvalidData, "the avatar is not a valid image")
+	}
+	if img.Bounds().Empty() {
+		return nil, NewCustomAppError(constants.InvalidData, "the avatar is empty")
+	}
+
+	var out bytes.Buffer
+	err = png.Encode(&out, cropAndResize(img, constants.AvatarSize))
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+// cropAndResize keeps the centered square of img and shrinks it to size by averaging the pixels, smaller images are not enlarged
+func cropAndResize(img image.Image, size int) *image.RGBA {
+	bounds := img.Bounds()
+	side := min(bounds.Dx(), bounds.Dy())
+	left := bounds.Min.X + (bounds.Dx()-side)/2
+	top := bounds.Min.Y + (bounds.Dy()-side)/2
+
+	outSide := min(side, size)
+	resized := image.NewRGBA(image.Rect(0, 0, outSide, outSide))
+
+	for y := range outSide {
+		fromY, toY := top+y*side/outSide, top+(y+1)*side/outSide
+		for x := range outSide {
+			fromX, toX := left+x*side/outSide, left+(x+1)*side/outSide
+
+			var r, g, b, a, count uint64
+			for sourceY := fromY; sourceY < toY; sourceY++ {
+				for sourceX := fromX; sourceX < toX; sourceX++ {
+					pr, pg, pb, pa := img.At(sourceX, sourceY).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					count++
+				}
+			}
+
+			resized.SetRGBA(x, y, color.RGBA{
+				R: uint8((r / count) >> 8),
+				G: uint8((g / count) >> 8),
+				B: uint8((b / count) >> 8),
+				A: uint8((a / count) >> 8),
+			})
+		}
+	}
+
+	return resized
+}
@@ -0,0 +1,170 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+/*
+maxCBORDepth bounds the nesting of decoded CBOR items, the data comes from the
+client so a deeply nested item must not exhaust the stack.
+*/
+const maxCBORDepth = 16
+
+var errCBORTruncated = errors.New("cbor: unexpected end of data")
+
+/*
+DecodeCBOR decodes the first CBOR item (RFC 8949) of data and returns it with the
+bytes that follow it. It covers what WebAuthn authenticators send: definite
+length integers, byte and text strings, arrays, maps, tags, booleans and null.
+
+Integers are returned as int64, byte strings as []byte, text as string, arrays as
+[]any and maps as map[any]any.
+*/
+func DecodeCBOR(data []byte) (item any, rest []byte, err error) {
+	decoder := cborDecoder{data: data}
+	item, err = decoder.decode(0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return item, decoder.data[decoder.offset:], nil
+}
+
+type cborDecoder struct {
+	data   []byte
+	offset int
+}
+
+func (decoder *cborDecoder) decode(depth int) (any, error) {
+	if depth > maxCBORDepth {
+		return nil, errors.New("cbor: item is nested too deeply")
+	}
+
+	if decoder.offset >= len(decoder.data) {
+		return nil, errCBORTruncated
+	}
+	initial := decoder.data[decoder.offset]
+	decoder.offset++
+
+	majorType := initial >> 5
+	info := initial & 0x1f
+
+	if majorType == 7 {
+		return decoder.decodeSimple(info)
+	}
+
+	argument, err := decoder.readArgument(info)
+	if err != nil {
+		return nil, err
+	}
+
+	switch majorType {
+	case 0:
+		if argument > math.MaxInt64 {
+			return nil, errors.New("cbor: integer overflows int64")
+		}
+		return int64(argument), nil // #nosec G115 - checked above
+	case 1:
+		if argument > math.MaxInt64 {
+			return nil, errors.New("cbor: integer overflows int64")
+		}
+		return -1 - int64(argument), nil // #nosec G115 - checked above
+	case 2:
+		return decoder.readBytes(argument)
+	case 3:
+		text, err := decoder.readBytes(argument)
+		if err != nil {
+			return nil, err
+		}
+		return string(text), nil
+	case 4:
+		// every item takes at least one byte, a larger count cannot be honest
+		if argument > uint64(len(decoder.data)-decoder.offset) {
+			return nil, errCBORTruncated
+		}
+		array := make([]any, 0, argument)
+		for range argument {
+			element, err := decoder.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, element)
+		}
+		return array, nil
+	case 5:
+		if argument > uint64(len(decoder.data)-decoder.offset)/2 {
+			return nil, errCBORTruncated
+		}
+		result := make(map[any]any, argument)
+		for range argument {
+			key, err := decoder.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, errors.New("cbor: map key must be an integer or a string")
+			}
+			if _, duplicate := result[key]; duplicate {
+				return nil, fmt.Errorf("cbor: duplicate map key %v", key)
+			}
+
+			value, err := decoder.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			result[key] = value
+		}
+		return result, nil
+	case 6:
+		// tags only annotate the item that follows
+		return decoder.decode(depth + 1)
+	}
+
+	return nil, fmt.Errorf("cbor: unsupported major type %d", majorType)
+}
+
+// readArgument reads the integer that follows the initial byte, indefinite lengths are refused
+func (decoder *cborDecoder) readArgument(info byte) (uint64, error) {
+	switch {
+	case info < 24:
+		return uint64(info), nil
+	case info <= 27:
+		size := 1 << (info - 24)
+		raw, err := decoder.readBytes(uint64(size))
+		if err != nil {
+			return 0, err
+		}
+		var padded [8]byte
+		copy(padded[8-size:], raw)
+		return binary.BigEndian.Uint64(padded[:]), nil
+	default:
+		return 0, fmt.Errorf("cbor: unsupported additional information %d", info)
+	}
+}
+
+func (decoder *cborDecoder) readBytes(length uint64) ([]byte, error) {
+	if length > uint64(len(decoder.data)-decoder.offset) {
+		return nil, errCBORTruncated
+	}
+	end := decoder.offset + int(length) // #nosec G115 - bounded by the data length above
+	raw := decoder.data[decoder.offset:end]
+	decoder.offset = end
+	return raw, nil
+}
+
+func (decoder *cborDecoder) decodeSimple(info byte) (any, error) {
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23:
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("cbor: unsupported simple value %d", info)
+}
@@ -0,0 +1,173 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+/*
+Keyring holds the secrets of one kind of token. The first secret signs new
+tokens, the others were rotated out and only verify the tokens they signed
+before, so a secret can be replaced without logging everyone out.
+
+On top of that the signing key rotates on schedule by itself: each secret
+derives one key per RotationPeriod and tokens carry a kid naming the secret and
+the period. Keys of periods older than MaxTokenAge are refused, so a leaked
+derived key stops working soon even if the secret stays the same.
+*/
+type Keyring struct {
+	Purpose        string
+	Secrets        []string
+	RotationPeriod time.Duration
+	MaxTokenAge    time.Duration
+}
+
+// SigningKey returns the key new tokens are signed with and its kid
+func (keyring Keyring) SigningKey() (kid string, key []byte, err error) {
+	if len(keyring.Secrets) == 0 || keyring.Secrets[0] == "" {
+		return "", nil, fmt.Errorf("%s keyring has no signing secret", keyring.Purpose)
+	}
+
+	period := keyring.period(time.Now())
+	return keyring.keyID(keyring.Secrets[0], period), keyring.deriveKey(keyring.Secrets[0], period), nil
+}
+
+// VerificationKey returns the key of a kid, as long as its secret is in the keyring and its period is recent enough
+func (keyring Keyring) VerificationKey(kid string) ([]byte, error) {
+	secretID, periodStr, found := strings.Cut(kid, "-")
+	if !found {
+		return nil, fmt.Errorf("malformed key ID %q", kid)
+	}
+
+	period, err := strconv.ParseInt(periodStr, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed key ID %q", kid)
+	}
+
+	// one period of slack in both directions for the clocks of other servers
+	currentPeriod := keyring.period(time.Now())
+	oldestPeriod := keyring.period(time.Now().Add(-keyring.MaxTokenAge)) - 1
+	if period > currentPeriod+1 || period < oldestPeriod {
+		return nil, fmt.Errorf("key %q has expired", kid)
+	}
+
+	for _, secret := range keyring.Secrets {
+		if secret != "" && hmac.Equal([]byte(secretKeyID(secret)), []byte(secretID)) {
+			return keyring.deriveKey(secret, period), nil
+		}
+	}
+
+	return nil, fmt.Errorf("key %q is not in the %s keyring", kid, keyring.Purpose)
+}
+
+/*
+LegacyKeys returns the raw secrets, which signed the tokens issued before the
+keyring added a kid. They are accepted until those tokens expired.
+*/
+func (keyring Keyring) LegacyKeys() [][]byte {
+	keys := [][]byte{}
+	for _, secret := range keyring.Secrets {
+		if secret != "" {
+			keys = append(keys, []byte(secret))
+		}
+	}
+	return keys
+}
+
+func (keyring Keyring) period(at time.Time) int64 {
+	rotationSeconds := max(int64(keyring.RotationPeriod.Seconds()), 1)
+	return at.Unix() / rotationSeconds
+}
+
+func (keyring Keyring) keyID(secret string, period int64) string {
+	return fmt.Sprintf("%s-%d", secretKeyID(secret), period)
+}
+
+// deriveKey binds the key to the keyring purpose so an access key never verifies a refresh token
+func (keyring Keyring) deriveKey(secret string, period int64) []byte {
+	mac := hmac.New(sha512.New, []byte(secret))
+	mac.Write([]byte(fmt.Sprintf("%s!%d", keyring.Purpose, period)))
+	return mac.Sum(nil)
+}
+
+// secretKeyID names a secret without revealing it
+func secretKeyID(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:6])
+}
+
+func accessTokenKeyring() Keyring {
+	return Keyring{
+		Purpose:        "access",
+		Secrets:        append([]string{constants.AccessTokenSecret}, constants.AccessTokenPreviousSecrets...),
+		RotationPeriod: constants.TokenKeyRotationPeriod,
+		MaxTokenAge:    constants.AccessTokenTime,
+	}
+}
+
+func refreshTokenKeyring() Keyring {
+	return Keyring{
+		Purpose:        "refresh",
+		Secrets:        append([]string{constants.RefreshTokenSecret}, constants.RefreshTokenPreviousSecrets...),
+		RotationPeriod: constants.TokenKeyRotationPeriod,
+		MaxTokenAge:    constants.RefreshTokenTime,
+	}
+}
+
+func csrfTokenKeyring() Keyring {
+	return Keyring{
+		Purpose:        "csrf",
+		Secrets:        append([]string{constants.CSRFTokenSecret}, constants.CSRFTokenPreviousSecrets...),
+		RotationPeriod: constants.TokenKeyRotationPeriod,
+		// a CSRF token lives as long as the access token it was issued with
+		MaxTokenAge: constants.AccessTokenTime,
+	}
+}
+
+func emailTokenKeyring() Keyring {
+	return Keyring{
+		Purpose:        "email",
+		Secrets:        append([]string{constants.EmailTokenSecret}, constants.EmailTokenPreviousSecrets...),
+		RotationPeriod: constants.TokenKeyRotationPeriod,
+		MaxTokenAge:    constants.EmailVerificationTokenTime,
+	}
+}
+
+// signJWT signs the claims with the signing key of the keyring and names it in the kid header
+func signJWT(keyring Keyring, claims jwt.Claims) (string, error) {
+	kid, key, err := keyring.SigningKey()
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS512, claims)
+	token.Header["kid"] = kid
+	return token.SignedString(key)
+}
+
+// jwtKeyFunc picks the verification key named by the kid header of a token
+func (keyring Keyring) jwtKeyFunc(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		keySet := jwt.VerificationKeySet{}
+		for _, key := range keyring.LegacyKeys() {
+			keySet.Keys = append(keySet.Keys, key)
+		}
+		if len(keySet.Keys) == 0 {
+			return nil, errors.New("keyring has no secret")
+		}
+		return keySet, nil
+	}
+
+	return keyring.VerificationKey(kid)
+}
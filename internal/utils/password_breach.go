@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/sha1" // #nosec G505 - only used to look up breached passwords, not for encryption
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PasswordBreachChecker tells how many times a password appears in known data breaches
+type PasswordBreachChecker interface {
+	BreachCount(password string) (int, error)
+}
+
+// passwordHashRange splits the uppercase SHA-1 of a password into the 5 characters range prefix and the rest
+func passwordHashRange(password string) (prefix string, suffix string) {
+	// nosemgrep
+	hash := sha1.Sum([]byte(password)) // #nosec G401 - the breach datasets are keyed by SHA-1
+	sha1Hex := strings.ToUpper(hex.EncodeToString(hash[:]))
+	return sha1Hex[:5], sha1Hex[5:]
+}
+
+/*
+findBreachCount searches a range in the 'Have I Been Pwned' format, one
+"SUFFIX:COUNT" per line, for the suffix of a password hash.
+*/
+func findBreachCount(rangeData io.Reader, suffix string) (int, error) {
+	scanner := bufio.NewScanner(rangeData)
+	for scanner.Scan() {
+		hashSuffix, count, found := strings.Cut(scanner.Text(), ":")
+		if !found || !strings.EqualFold(strings.TrimSpace(hashSuffix), suffix) {
+			continue
+		}
+
+		breachCount, err := strconv.Atoi(strings.TrimSpace(count))
+		if err != nil {
+			return 0, fmt.Errorf("malformed breach count %q: %w", count, err)
+		}
+		// padding entries of the range API have a count of 0
+		return breachCount, nil
+	}
+
+	return 0, scanner.Err()
+}
+
+/*
+HIBPBreachChecker uses the k-anonymity range API of 'Have I Been Pwned', only the
+first 5 characters of the password SHA-1 leave the server.
+*/
+type HIBPBreachChecker struct {
+	RangeURL string
+	Client   *http.Client
+}
+
+func NewHIBPBreachChecker() *HIBPBreachChecker {
+	return &HIBPBreachChecker{
+		RangeURL: "https://api.pwnedpasswords.com/range/",
+		Client: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+	}
+}
+
+func (checker *HIBPBreachChecker) BreachCount(password string) (int, error) {
+	prefix, suffix := passwordHashRange(password)
+
+	req, err := http.NewRequest(http.MethodGet, checker.RangeURL+prefix, nil)
+	if err != nil {
+		return 0, err
+	}
+	// hides the size of the answer, which could tell which prefix was asked for
+	req.Header.Set("Add-Padding", "true")
+
+	resp, err := checker.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("breach range API answered %s", resp.Status)
+	}
+
+	return findBreachCount(resp.Body, suffix)
+}
+
+/*
+LocalBreachChecker looks passwords up in a downloaded copy of the 'Have I Been
+Pwned' dataset, so no request leaves the server. Dir holds one file per hash
+prefix, named like "5BAA6.txt" and holding the lines the range API answers for
+it. A prefix without a file has no breached password.
+*/
+type LocalBreachChecker struct {
+	Dir string
+}
+
+// NewLocalBreachChecker fails when dir is missing, an empty dataset would let every password through
+func NewLocalBreachChecker(dir string) (*LocalBreachChecker, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("breach dataset: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("breach dataset %s is not a directory", dir)
+	}
+
+	return &LocalBreachChecker{
+		Dir: dir,
+	}, nil
+}
+
+func (checker *LocalBreachChecker) BreachCount(password string) (int, error) {
+	prefix, suffix := passwordHashRange(password)
+
+	file, err := os.Open(filepath.Join(checker.Dir, prefix+".txt"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer file.Close()
+
+	return findBreachCount(file, suffix)
+}
+
+/*
+FailOpenBreachChecker accepts a password when its checker cannot answer, the
+failure is only logged. Without it the check fails closed and the password is
+refused until the breach database is reachable again.
+*/
+type FailOpenBreachChecker struct {
+	Checker PasswordBreachChecker
+	Logger  *log.Logger
+}
+
+func NewFailOpenBreachChecker(checker PasswordBreachChecker, logger *log.Logger) *FailOpenBreachChecker {
+	return &FailOpenBreachChecker{
+		Checker: checker,
+		Logger:  logger,
+	}
+}
+
+func (checker *FailOpenBreachChecker) BreachCount(password string) (int, error) {
+	breachCount, err := checker.Checker.BreachCount(password)
+	if err != nil {
+		checker.Logger.Printf("ERROR: password breach check failed, the password is accepted unchecked: %v", err)
+		return 0, nil
+	}
+
+	return breachCount, nil
+}
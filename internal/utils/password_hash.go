@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"fmt"
+
+	"github.com/RichardHoa/hack-me/internal/constants"
+	"github.com/alexedwards/argon2id"
+)
+
+// PasswordHashParams returns the argon2id parameters new password hashes are created with
+func PasswordHashParams() *argon2id.Params {
+	return &argon2id.Params{
+		Memory:      constants.Argon2Memory,
+		Iterations:  constants.Argon2Iterations,
+		Parallelism: constants.Argon2Parallelism,
+		SaltLength:  16,
+		KeyLength:   32,
+	}
+}
+
+func HashPassword(password string) (string, error) {
+	return argon2id.CreateHash(password, PasswordHashParams())
+}
+
+/*
+PasswordHashParamsOutdated tells whether a hash made with params is cheaper to
+brute force than the configured parameters. Parallelism only spreads the same
+work over more threads, so a different value alone is not outdated.
+*/
+func PasswordHashParamsOutdated(params *argon2id.Params) bool {
+	current := PasswordHashParams()
+	return params.Memory < current.Memory || params.Iterations < current.Iterations
+}
+
+// PasswordNeedsRehash tells whether a stored hash should be replaced with one using the configured parameters
+func PasswordNeedsRehash(hash string) (bool, error) {
+	params, salt, key, err := argon2id.DecodeHash(hash)
+	if err != nil {
+		return false, err
+	}
+
+	current := PasswordHashParams()
+	if len(salt) < int(current.SaltLength) || len(key) < int(current.KeyLength) {
+		return true, nil
+	}
+
+	return PasswordHashParamsOutdated(params), nil
+}
+
+// FormatPasswordHashParams writes params the way they appear in a hash, like "m=65536,t=1,p=4"
+func FormatPasswordHashParams(params *argon2id.Params) string {
+	return fmt.Sprintf("m=%d,t=%d,p=%d", params.Memory, params.Iterations, params.Parallelism)
+}
+
+// ParsePasswordHashParams reads the "m=65536,t=1,p=4" part of a hash
+func ParsePasswordHashParams(value string) (*argon2id.Params, error) {
+	params := &argon2id.Params{}
+	_, err := fmt.Sscanf(value, "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil {
+		return nil, fmt.Errorf("malformed argon2id parameters %q: %w", value, err)
+	}
+
+	return params, nil
+}
@@ -4,16 +4,19 @@ import (
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/RichardHoa/hack-me/internal/constants"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 )
 
 /*
@@ -28,6 +31,35 @@ func generateSecureHexString(byteLength int) (string, error) {
 	return hex.EncodeToString(bytes), nil
 }
 
+/*
+GenerateRandomToken creates a cryptographically secure, URL safe random string
+from the given number of random bytes.
+*/
+func GenerateRandomToken(byteLength int) (string, error) {
+	bytes := make([]byte, byteLength)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+/*
+CreatePKCEChallenge derives the S256 code challenge of a PKCE code verifier (RFC 7636).
+*/
+func CreatePKCEChallenge(codeVerifier string) string {
+	sum := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+/*
+HashToken returns the hex encoded SHA-256 hash of a high entropy token. Tokens
+are random so a fast hash is enough, only the hash is ever written to the database.
+*/
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 /*
 SendEmptyTokens sends cookies to the client with past expiration dates.
 Effectively clean the tokens out of browser
@@ -200,39 +232,50 @@ func ExtractClaimsFromJWT(tokenStr string, keys []string) ([]string, error) {
 	return result, nil
 }
 
-// CheckCSRFToken validates a CSRF token using the HMAC-based token pattern.
+/*
+CheckCSRFToken validates a CSRF token using the HMAC-based token pattern. Tokens
+look like "kid.hmac.random", the kid names the key of the CSRF keyring that
+made the HMAC. Tokens made before the keyring have no kid.
+*/
 func CheckCSRFToken(csrfToken string, sessionID string) (bool, error) {
 	parts := strings.Split(csrfToken, ".")
-	if len(parts) != 2 {
-		return false, errors.New("invalid CSRF token format")
-	}
-
-	hmacFromRequest := parts[0]
-	randomValue := parts[1]
 
-	message := fmt.Sprintf(
-		"%d!%s!%d!%s",
-		len(sessionID),
-		sessionID,
-		len(randomValue),
-		randomValue,
+	var (
+		keys            [][]byte
+		hmacFromRequest string
+		randomValue     string
 	)
 
-	h := hmac.New(sha256.New, []byte(constants.CSRFTokenSecret))
-	h.Write([]byte(message))
-	expectedHmac := h.Sum(nil)
+	keyring := csrfTokenKeyring()
+	switch len(parts) {
+	case 3:
+		key, err := keyring.VerificationKey(parts[0])
+		if err != nil {
+			fmt.Printf("CSRF Error: %v for sessionID: %s\n", err, sessionID)
+			return false, nil
+		}
+		keys = [][]byte{key}
+		hmacFromRequest, randomValue = parts[1], parts[2]
+	case 2:
+		keys = keyring.LegacyKeys()
+		hmacFromRequest, randomValue = parts[0], parts[1]
+	default:
+		return false, errors.New("invalid CSRF token format")
+	}
 
 	hmacRequestBytes, err := hex.DecodeString(hmacFromRequest)
 	if err != nil {
 		return false, fmt.Errorf("invalid HMAC hex from request: %w", err)
 	}
 
-	if !hmac.Equal(hmacRequestBytes, expectedHmac) {
-		fmt.Printf("CSRF Error: Invalid HMAC for sessionID: %s\n", sessionID)
-		return false, nil
+	for _, key := range keys {
+		if hmac.Equal(hmacRequestBytes, csrfHMAC(key, sessionID, randomValue)) {
+			return true, nil
+		}
 	}
 
-	return true, nil
+	fmt.Printf("CSRF Error: Invalid HMAC for sessionID: %s\n", sessionID)
+	return false, nil
 }
 
 // CreateCSRFToken generates a new CSRF token
@@ -242,39 +285,56 @@ func CreateCSRFToken(sessionID string) (string, error) {
 		return "", err
 	}
 
+	kid, key, err := csrfTokenKeyring().SigningKey()
+	if err != nil {
+		return "", err
+	}
+
+	hmacHex := hex.EncodeToString(csrfHMAC(key, sessionID, randomValueHex))
+
+	csrfToken := fmt.Sprintf("%s.%s.%s", kid, hmacHex, randomValueHex)
+	return csrfToken, nil
+}
+
+// csrfHMAC binds the random value of a CSRF token to the session
+func csrfHMAC(key []byte, sessionID string, randomValue string) []byte {
 	message := fmt.Sprintf(
 		"%d!%s!%d!%s",
 		len(sessionID),
 		sessionID,
-		len(randomValueHex),
-		randomValueHex,
+		len(randomValue),
+		randomValue,
 	)
 
-	h := hmac.New(sha256.New, []byte(constants.CSRFTokenSecret))
+	h := hmac.New(sha256.New, key)
 	h.Write([]byte(message))
-	hmacSum := h.Sum(nil)
-	hmacHex := hex.EncodeToString(hmacSum)
-
-	csrfToken := fmt.Sprintf("%s.%s", hmacHex, randomValueHex)
-	return csrfToken, nil
+	return h.Sum(nil)
 }
 
 /*
 CreateTokens generates a new pair of signed JWTs for a user: a short-lived
-access token and a long-lived refresh token
+access token and a long-lived refresh token. Both name the session they belong
+to, an empty sessionID starts a new one.
 */
-func CreateTokens(userID, userName string, refreshTokenTime int64) (signedAccessToken string, signedRefreshToken string, err error) {
+func CreateTokens(userID, userName, sessionID string, refreshTokenTime int64) (signedAccessToken string, signedRefreshToken string, err error) {
 
 	if refreshTokenTime == 0 {
 		refreshTokenTime = time.Now().Add(constants.RefreshTokenTime).Unix()
 	}
+	if sessionID == "" {
+		sessionID = uuid.NewString()
+	}
 
 	accessClaims := jwt.MapClaims{
-		"exp": time.Now().Add(constants.AccessTokenTime).Unix(),
-		"iat": time.Now().Unix(),
+		"sub":                  userID,
+		constants.JWTUserName:  userName,
+		constants.JWTSessionID: sessionID,
+		"iss":                  constants.TokenIssuer,
+		"aud":                  constants.TokenAudience,
+		"exp":                  time.Now().Add(constants.AccessTokenTime).Unix(),
+		"iat":                  time.Now().Unix(),
 	}
-	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS512, accessClaims)
-	signedAccessToken, err = accessToken.SignedString([]byte(constants.AccessTokenSecret))
+	signedAccessToken, err = signAccessToken(accessClaims)
 	if err != nil {
 		return "", "", err
 	}
@@ -288,11 +348,11 @@ func CreateTokens(userID, userName string, refreshTokenTime int64) (signedAccess
 		constants.JWTRefreshTokenID: refreshID,
 		constants.JWTUserName:       userName,
 		constants.JWTUserID:         userID,
+		constants.JWTSessionID:      sessionID,
 		"exp":                       refreshTokenTime,
 		"iat":                       time.Now().Unix(),
 	}
-	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS512, refreshClaims)
-	signedRefreshToken, err = refreshToken.SignedString([]byte(constants.RefreshTokenSecret))
+	signedRefreshToken, err = signJWT(refreshTokenKeyring(), refreshClaims)
 	if err != nil {
 		return "", "", err
 	}
@@ -315,9 +375,7 @@ func GetValuesFromCookieWithoutAccessToken(r *http.Request, claimsList []string)
 		return []string{}, fmt.Errorf("refreshToken is not present")
 	}
 
-	refreshToken, err := jwt.Parse(refreshCookie.Value, func(token *jwt.Token) (interface{}, error) {
-		return []byte(constants.RefreshTokenSecret), nil
-	},
+	refreshToken, err := jwt.Parse(refreshCookie.Value, refreshTokenKeyring().jwtKeyFunc,
 		jwt.WithValidMethods([]string{jwt.SigningMethodHS512.Alg()}),
 		jwt.WithIssuedAt(),
 	)
@@ -351,13 +409,8 @@ func GetValuesFromCookie(r *http.Request, claimsList []string) (result []string,
 		return []string{}, fmt.Errorf("accessToken is not present")
 	}
 
-	accessToken, err := jwt.Parse(accessCookie.Value, func(token *jwt.Token) (any, error) {
-		return []byte(constants.AccessTokenSecret), nil
-	},
-		jwt.WithValidMethods([]string{jwt.SigningMethodHS512.Alg()}),
-		jwt.WithIssuedAt(),
-	)
-	if err != nil || !accessToken.Valid {
+	accessClaims, err := parseAccessToken(accessCookie.Value)
+	if err != nil {
 		return []string{}, err
 	}
 
@@ -367,9 +420,7 @@ func GetValuesFromCookie(r *http.Request, claimsList []string) (result []string,
 		return []string{}, fmt.Errorf("refreshToken is not present")
 	}
 
-	refreshToken, err := jwt.Parse(refreshCookie.Value, func(token *jwt.Token) (any, error) {
-		return []byte(constants.RefreshTokenSecret), nil
-	},
+	refreshToken, err := jwt.Parse(refreshCookie.Value, refreshTokenKeyring().jwtKeyFunc,
 		jwt.WithValidMethods([]string{jwt.SigningMethodHS512.Alg()}),
 		jwt.WithIssuedAt(),
 	)
@@ -377,6 +428,11 @@ func GetValuesFromCookie(r *http.Request, claimsList []string) (result []string,
 		return []string{}, err
 	}
 
+	err = checkAccessTokenIdentity(accessClaims, refreshCookie.Value)
+	if err != nil {
+		return []string{}, err
+	}
+
 	result, err = ExtractClaimsFromJWT(refreshCookie.Value, claimsList)
 	if err != nil {
 		return []string{}, err
@@ -389,3 +445,136 @@ func GetValuesFromCookie(r *http.Request, claimsList []string) (result []string,
 	return result, nil
 
 }
+
+// parseAccessToken checks the signature and expiry of an access token and returns its claims
+func parseAccessToken(tokenStr string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(tokenStr, claims, accessTokenKeyFunc,
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS512.Alg(), jwt.SigningMethodEdDSA.Alg(), jwt.SigningMethodES256.Alg()}),
+		jwt.WithIssuedAt(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("access token is invalid")
+	}
+	return claims, nil
+}
+
+/*
+ParseBearerToken validates an access token sent in the Authorization header and
+returns its user ID, username and session. Unlike cookies there is no refresh
+token to fall back on, so the token has to carry its full identity. The
+signature says nothing about a logout since, the caller checks that the session
+is still live.
+*/
+func ParseBearerToken(tokenStr string) (userID, userName, sessionID string, err error) {
+	claims, err := parseAccessToken(tokenStr)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	userID, _ = claims.GetSubject()
+	userName, _ = claims[constants.JWTUserName].(string)
+	sessionID, _ = claims[constants.JWTSessionID].(string)
+	if userID == "" || userName == "" || sessionID == "" {
+		return "", "", "", errors.New("access token is missing claims")
+	}
+
+	err = checkAccessTokenAudience(claims)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	return userID, userName, sessionID, nil
+}
+
+/*
+checkAccessTokenIdentity checks the issuer and audience of an access token and
+that it belongs to the user of the refresh token. Tokens signed before access
+tokens carried an identity have no subject and skip the check until they expire.
+*/
+func checkAccessTokenIdentity(accessClaims jwt.MapClaims, refreshToken string) error {
+	subject, _ := accessClaims.GetSubject()
+	if subject == "" {
+		return nil
+	}
+
+	err := checkAccessTokenAudience(accessClaims)
+	if err != nil {
+		return err
+	}
+
+	refreshUserID, err := ExtractClaimsFromJWT(refreshToken, []string{constants.JWTUserID})
+	if err != nil {
+		return err
+	}
+	if refreshUserID[0] != subject {
+		return errors.New("access token and refresh token belong to different users")
+	}
+
+	return nil
+}
+
+// checkAccessTokenAudience checks that an access token was issued by us, for us
+func checkAccessTokenAudience(accessClaims jwt.MapClaims) error {
+	issuer, _ := accessClaims.GetIssuer()
+	if issuer != constants.TokenIssuer {
+		return fmt.Errorf("access token issuer %q is not %q", issuer, constants.TokenIssuer)
+	}
+
+	audience, _ := accessClaims.GetAudience()
+	if !slices.Contains(audience, constants.TokenAudience) {
+		return fmt.Errorf("access token is not meant for %q", constants.TokenAudience)
+	}
+
+	return nil
+}
+
+/*
+CreateEmailVerificationToken signs a token proving that the user received an
+email at the given address. tokenID is stored hashed by the caller to make the
+token single-use.
+*/
+func CreateEmailVerificationToken(userID, email, tokenID string) (string, error) {
+	claims := jwt.MapClaims{
+		constants.JWTUserID:  userID,
+		constants.JWTEmail:   email,
+		constants.JWTPurpose: "verify-email",
+		"jti":                tokenID,
+		"exp":                time.Now().Add(constants.EmailVerificationTokenTime).Unix(),
+		"iat":                time.Now().Unix(),
+	}
+
+	return signJWT(emailTokenKeyring(), claims)
+}
+
+/*
+ParseEmailVerificationToken checks the signature, expiry and purpose of an
+email verification token and returns its user ID, email and token ID.
+*/
+func ParseEmailVerificationToken(tokenStr string) (userID, email, tokenID string, err error) {
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(tokenStr, claims, emailTokenKeyring().jwtKeyFunc,
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS512.Alg()}),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	if purpose, _ := claims[constants.JWTPurpose].(string); purpose != "verify-email" {
+		return "", "", "", errors.New("token is not an email verification token")
+	}
+
+	userID, _ = claims[constants.JWTUserID].(string)
+	email, _ = claims[constants.JWTEmail].(string)
+	tokenID, _ = claims["jti"].(string)
+	if userID == "" || email == "" || tokenID == "" {
+		return "", "", "", errors.New("email verification token is missing claims")
+	}
+
+	return userID, email, tokenID, nil
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"reflect"
 	"strings"
@@ -115,3 +116,16 @@ func NullIfEmpty(s string) any {
 	}
 	return s
 }
+
+/*
+ClientIP returns the IP address of the client without the port. The RealIP
+middleware already replaced RemoteAddr with the address from X-Forwarded-For
+or X-Real-IP when those headers are present.
+*/
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
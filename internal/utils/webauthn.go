@@ -0,0 +1,271 @@
+package utils
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/RichardHoa/hack-me/internal/constants"
+)
+
+// COSE algorithm identifiers of the keys we accept (https://www.iana.org/assignments/cose)
+const (
+	COSEAlgES256 = -7
+	COSEAlgEdDSA = -8
+	COSEAlgRS256 = -257
+)
+
+// authenticator data flags (https://www.w3.org/TR/webauthn-2/#authenticator-data)
+const (
+	authDataFlagUserPresent            = 0x01
+	authDataFlagUserVerified           = 0x04
+	authDataFlagAttestedCredentialData = 0x40
+)
+
+type AuthenticatorData struct {
+	Raw          []byte
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialID []byte
+	// CredentialPublicKey is the COSE encoded key, only set during registration
+	CredentialPublicKey []byte
+}
+
+type CollectedClientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+/*
+ParseClientData checks the client data of a ceremony: its type, that it was made
+on our origin and not inside a cross origin frame. The challenge is returned to
+the caller, which must match it against a stored one.
+*/
+func ParseClientData(clientDataJSON []byte, ceremonyType string) (CollectedClientData, error) {
+	var clientData CollectedClientData
+	err := json.Unmarshal(clientDataJSON, &clientData)
+	if err != nil {
+		return clientData, fmt.Errorf("client data is not valid JSON: %w", err)
+	}
+
+	if clientData.Type != ceremonyType {
+		return clientData, fmt.Errorf("client data type is %q, expected %q", clientData.Type, ceremonyType)
+	}
+	if clientData.Origin != constants.WebAuthnOrigin {
+		return clientData, fmt.Errorf("client data origin %q is not allowed", clientData.Origin)
+	}
+	if clientData.CrossOrigin {
+		return clientData, errors.New("cross origin ceremonies are not allowed")
+	}
+	if clientData.Challenge == "" {
+		return clientData, errors.New("client data has no challenge")
+	}
+
+	return clientData, nil
+}
+
+/*
+ParseAuthenticatorData decodes the authenticator data and checks that it was made
+for our relying party with the user present and verified.
+*/
+func ParseAuthenticatorData(raw []byte) (AuthenticatorData, error) {
+	authData := AuthenticatorData{Raw: raw}
+
+	if len(raw) < 37 {
+		return authData, errors.New("authenticator data is too short")
+	}
+
+	authData.RPIDHash = raw[:32]
+	authData.Flags = raw[32]
+	authData.SignCount = binary.BigEndian.Uint32(raw[33:37])
+
+	rpIDHash := sha256.Sum256([]byte(constants.WebAuthnRPID))
+	if subtle.ConstantTimeCompare(authData.RPIDHash, rpIDHash[:]) != 1 {
+		return authData, errors.New("authenticator data is for another relying party")
+	}
+	if authData.Flags&authDataFlagUserPresent == 0 {
+		return authData, errors.New("user was not present")
+	}
+	if authData.Flags&authDataFlagUserVerified == 0 {
+		return authData, errors.New("user was not verified")
+	}
+
+	if authData.Flags&authDataFlagAttestedCredentialData == 0 {
+		return authData, nil
+	}
+
+	// attested credential data: aaguid (16), credential ID length (2), credential ID, COSE key
+	rest := raw[37:]
+	if len(rest) < 18 {
+		return authData, errors.New("attested credential data is too short")
+	}
+	idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if idLength == 0 || len(rest) < idLength {
+		return authData, errors.New("credential ID is truncated")
+	}
+	authData.CredentialID = rest[:idLength]
+	rest = rest[idLength:]
+
+	// the COSE key is followed by the extensions, decoding it tells where it ends
+	_, extensions, err := DecodeCBOR(rest)
+	if err != nil {
+		return authData, fmt.Errorf("credential public key: %w", err)
+	}
+	authData.CredentialPublicKey = rest[:len(rest)-len(extensions)]
+
+	return authData, nil
+}
+
+/*
+ParseAttestationObject returns the authenticator data of a registration. We ask
+for "none" attestation, passkeys are trusted because the user enrolled them, so
+the attestation statement itself is not checked.
+*/
+func ParseAttestationObject(attestationObject []byte) (AuthenticatorData, error) {
+	item, _, err := DecodeCBOR(attestationObject)
+	if err != nil {
+		return AuthenticatorData{}, fmt.Errorf("attestation object: %w", err)
+	}
+
+	object, ok := item.(map[any]any)
+	if !ok {
+		return AuthenticatorData{}, errors.New("attestation object is not a map")
+	}
+
+	raw, ok := object["authData"].([]byte)
+	if !ok {
+		return AuthenticatorData{}, errors.New("attestation object has no authenticator data")
+	}
+
+	authData, err := ParseAuthenticatorData(raw)
+	if err != nil {
+		return authData, err
+	}
+
+	if authData.CredentialPublicKey == nil {
+		return authData, errors.New("attestation object has no credential")
+	}
+
+	_, _, err = ParseCOSEKey(authData.CredentialPublicKey)
+	if err != nil {
+		return authData, err
+	}
+
+	return authData, nil
+}
+
+// ParseCOSEKey turns a COSE encoded public key (RFC 9053) into a Go public key
+func ParseCOSEKey(coseKey []byte) (crypto.PublicKey, int64, error) {
+	item, rest, err := DecodeCBOR(coseKey)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cose key: %w", err)
+	}
+	if len(rest) != 0 {
+		return nil, 0, errors.New("cose key has trailing data")
+	}
+
+	key, ok := item.(map[any]any)
+	if !ok {
+		return nil, 0, errors.New("cose key is not a map")
+	}
+
+	keyType, _ := key[int64(1)].(int64)
+	alg, _ := key[int64(3)].(int64)
+
+	switch {
+	case keyType == 2 && alg == COSEAlgES256:
+		curve, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		y, _ := key[int64(-3)].([]byte)
+		if curve != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, errors.New("cose key is not a P-256 key")
+		}
+
+		point := append([]byte{0x04}, x...)
+		point = append(point, y...)
+		publicKey, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), point)
+		if err != nil {
+			return nil, 0, fmt.Errorf("cose key: %w", err)
+		}
+		return publicKey, alg, nil
+
+	case keyType == 1 && alg == COSEAlgEdDSA:
+		curve, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		if curve != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, 0, errors.New("cose key is not an Ed25519 key")
+		}
+		return ed25519.PublicKey(x), alg, nil
+
+	case keyType == 3 && alg == COSEAlgRS256:
+		n, _ := key[int64(-1)].([]byte)
+		e, _ := key[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, 0, errors.New("cose key is not an RSA key of at least 2048 bits")
+		}
+
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}, alg, nil
+	}
+
+	return nil, 0, fmt.Errorf("cose key type %d with algorithm %d is not supported", keyType, alg)
+}
+
+/*
+VerifyWebAuthnSignature checks an assertion signature, which covers the
+authenticator data followed by the SHA-256 of the client data JSON.
+*/
+func VerifyWebAuthnSignature(coseKey []byte, authenticatorData []byte, clientDataJSON []byte, signature []byte) error {
+	publicKey, _, err := ParseCOSEKey(coseKey)
+	if err != nil {
+		return err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(bytes.Clone(authenticatorData), clientDataHash[:]...)
+	digest := sha256.Sum256(signed)
+
+	switch publicKey := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(publicKey, digest[:], signature) {
+			return errors.New("signature is not valid")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(publicKey, signed, signature) {
+			return errors.New("signature is not valid")
+		}
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature)
+		if err != nil {
+			return errors.New("signature is not valid")
+		}
+	default:
+		return errors.New("unsupported public key")
+	}
+
+	return nil
+}
+
+// DecodeBase64URL decodes the base64url fields of WebAuthn JSON, with or without padding
+func DecodeBase64URL(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	// _ "net/http/pprof"
 	"time"
 
@@ -43,8 +48,27 @@ func main() {
 
 	application.Logger.Printf("Server is running on port: %d", constants.AppPort)
 
-	err = server.ListenAndServe()
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+	}()
+
+	// on a stop, finish the requests in flight and send the queued emails before exiting
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	ctx, cancel := context.WithTimeout(context.Background(), constants.ShutdownTimeout)
+	defer cancel()
+
+	err = server.Shutdown(ctx)
 	if err != nil {
-		panic(err)
+		application.Logger.Printf("ERROR: server shutdown: %v", err)
+	}
+	err = application.Shutdown(ctx)
+	if err != nil {
+		application.Logger.Printf("ERROR: application shutdown: %v", err)
 	}
 }
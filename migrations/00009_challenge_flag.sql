@@ -0,0 +1,78 @@
+-- +goose Up
+-- +goose StatementBegin
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'flag_match_mode') THEN
+        CREATE TYPE flag_match_mode AS ENUM (
+            'exact',
+            'case_insensitive',
+            'regex'
+        );
+    END IF;
+END$$;
+
+-- exact and case_insensitive flags are stored as argon2id hashes,
+-- regex flags cannot be hashed because they must be evaluated, so the pattern is stored instead
+CREATE TABLE IF NOT EXISTS challenge_flag (
+    id INT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    challenge_id INT NOT NULL REFERENCES challenge(id) ON DELETE CASCADE,
+    match_mode flag_match_mode NOT NULL DEFAULT 'exact',
+    flag_hash TEXT,
+    flag_pattern TEXT CHECK (char_length(flag_pattern) <= 256),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+
+    CONSTRAINT valid_flag_entry CHECK (
+        (match_mode = 'regex' AND flag_pattern IS NOT NULL AND flag_hash IS NULL) OR
+        (match_mode <> 'regex' AND flag_hash IS NOT NULL AND flag_pattern IS NULL)
+    )
+);
+
+COMMENT ON COLUMN challenge_flag.id IS '(confidentiality, n/a), (integrity, low), (availability, high), internal';
+COMMENT ON COLUMN challenge_flag.challenge_id IS '(confidentiality, n/a), (integrity, high), (availability, high), internal';
+COMMENT ON COLUMN challenge_flag.match_mode IS '(confidentiality, low), (integrity, high), (availability, high), internal';
+COMMENT ON COLUMN challenge_flag.flag_hash IS '(confidentiality, high), (integrity, high), (availability, high), restricted';
+COMMENT ON COLUMN challenge_flag.flag_pattern IS '(confidentiality, high), (integrity, high), (availability, high), restricted';
+
+CREATE INDEX IF NOT EXISTS idx_challenge_flag_challenge_id ON challenge_flag(challenge_id);
+
+-- every flag attempt is recorded so wrong guesses can be throttled per user
+CREATE TABLE IF NOT EXISTS challenge_submission (
+    id INT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    challenge_id INT NOT NULL REFERENCES challenge(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES "user"(id) ON DELETE CASCADE,
+    is_correct BOOLEAN NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+COMMENT ON COLUMN challenge_submission.id IS '(confidentiality, n/a), (integrity, low), (availability, low), internal';
+COMMENT ON COLUMN challenge_submission.challenge_id IS '(confidentiality, n/a), (integrity, moderate), (availability, low), internal';
+COMMENT ON COLUMN challenge_submission.user_id IS '(confidentiality, low), (integrity, moderate), (availability, low), internal';
+COMMENT ON COLUMN challenge_submission.is_correct IS '(confidentiality, low), (integrity, moderate), (availability, low), internal';
+
+CREATE INDEX IF NOT EXISTS idx_challenge_submission_user_created ON challenge_submission(user_id, created_at);
+
+CREATE TABLE IF NOT EXISTS challenge_solve (
+    challenge_id INT NOT NULL REFERENCES challenge(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES "user"(id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+
+    -- a user can only solve a challenge once
+    PRIMARY KEY (challenge_id, user_id)
+);
+
+COMMENT ON COLUMN challenge_solve.challenge_id IS '(confidentiality, n/a), (integrity, high), (availability, high), internal';
+COMMENT ON COLUMN challenge_solve.user_id IS '(confidentiality, low), (integrity, high), (availability, high), internal';
+COMMENT ON COLUMN challenge_solve.created_at IS '(confidentiality, n/a), (integrity, high), (availability, high), public';
+
+CREATE INDEX IF NOT EXISTS idx_challenge_solve_user_id ON challenge_solve(user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS challenge_solve;
+DROP TABLE IF EXISTS challenge_submission;
+DROP TABLE IF EXISTS challenge_flag;
+DROP TYPE IF EXISTS flag_match_mode;
+-- +goose StatementEnd
@@ -0,0 +1,49 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE challenge
+    ADD COLUMN IF NOT EXISTS initial_points INT NOT NULL DEFAULT 500,
+    ADD COLUMN IF NOT EXISTS minimum_points INT NOT NULL DEFAULT 100,
+    ADD COLUMN IF NOT EXISTS decay INT NOT NULL DEFAULT 20;
+
+ALTER TABLE challenge
+    ADD CONSTRAINT valid_challenge_points CHECK (
+        minimum_points >= 0 AND
+        initial_points >= minimum_points AND
+        initial_points <= 10000 AND
+        decay > 0
+    );
+
+COMMENT ON COLUMN challenge.initial_points IS '(confidentiality, n/a), (integrity, high), (availability, high), public';
+COMMENT ON COLUMN challenge.minimum_points IS '(confidentiality, n/a), (integrity, high), (availability, high), public';
+COMMENT ON COLUMN challenge.decay IS '(confidentiality, n/a), (integrity, high), (availability, high), public';
+
+/*
+Dynamic scoring (same curve as CTFd): the value starts at initial_points and decays
+quadratically with every solve until it reaches minimum_points after `decay` solves.
+The first solver does not lower the value, and every solver is awarded the current value.
+*/
+CREATE OR REPLACE FUNCTION challenge_points(initial_points INT, minimum_points INT, decay INT, solve_count BIGINT)
+RETURNS INT AS $$
+    SELECT GREATEST(
+        CEIL(
+            ((minimum_points - initial_points)::NUMERIC / (decay * decay)) * POWER(GREATEST(solve_count - 1, 0), 2)
+            + initial_points
+        )::INT,
+        minimum_points
+    );
+$$ LANGUAGE sql IMMUTABLE;
+
+-- speeds up the first blood lookup
+CREATE INDEX IF NOT EXISTS idx_challenge_solve_challenge_created ON challenge_solve(challenge_id, created_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS idx_challenge_solve_challenge_created;
+DROP FUNCTION IF EXISTS challenge_points(INT, INT, INT, BIGINT);
+ALTER TABLE challenge DROP CONSTRAINT IF EXISTS valid_challenge_points;
+ALTER TABLE challenge
+    DROP COLUMN IF EXISTS initial_points,
+    DROP COLUMN IF EXISTS minimum_points,
+    DROP COLUMN IF EXISTS decay;
+-- +goose StatementEnd
@@ -0,0 +1,33 @@
+-- +goose Up
+-- +goose StatementBegin
+-- every login creates its own session, so a user can now own many refresh tokens
+ALTER TABLE refresh_token DROP CONSTRAINT IF EXISTS refresh_token_user_id_key;
+
+ALTER TABLE refresh_token
+    ADD COLUMN IF NOT EXISTS session_id UUID NOT NULL UNIQUE DEFAULT gen_random_uuid(),
+    ADD COLUMN IF NOT EXISTS user_agent TEXT CHECK (char_length(user_agent) <= 512),
+    ADD COLUMN IF NOT EXISTS ip_address TEXT CHECK (char_length(ip_address) <= 64),
+    ADD COLUMN IF NOT EXISTS last_used_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+COMMENT ON COLUMN refresh_token.session_id IS '(confidentiality, low), (integrity, high), (availability, high), internal';
+COMMENT ON COLUMN refresh_token.user_agent IS '(confidentiality, moderate), (integrity, low), (availability, low), internal';
+COMMENT ON COLUMN refresh_token.ip_address IS '(confidentiality, moderate), (integrity, low), (availability, low), internal';
+COMMENT ON COLUMN refresh_token.last_used_at IS '(confidentiality, low), (integrity, low), (availability, low), internal';
+
+CREATE INDEX IF NOT EXISTS idx_refresh_token_user_id ON refresh_token(user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS idx_refresh_token_user_id;
+ALTER TABLE refresh_token
+    DROP COLUMN IF EXISTS session_id,
+    DROP COLUMN IF EXISTS user_agent,
+    DROP COLUMN IF EXISTS ip_address,
+    DROP COLUMN IF EXISTS last_used_at;
+-- keep only the newest session of every user before restoring the constraint
+DELETE FROM refresh_token r
+USING refresh_token newer
+WHERE r.user_id = newer.user_id AND r.created_at < newer.created_at;
+ALTER TABLE refresh_token ADD CONSTRAINT refresh_token_user_id_key UNIQUE (user_id);
+-- +goose StatementEnd
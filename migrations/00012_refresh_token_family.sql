@@ -0,0 +1,33 @@
+-- +goose Up
+-- +goose StatementBegin
+-- only the SHA-256 hash of the refresh token ID is stored, a database leak must not leak live sessions
+ALTER TABLE refresh_token RENAME COLUMN id TO token_hash;
+UPDATE refresh_token SET token_hash = encode(sha256(convert_to(token_hash, 'UTF8')), 'hex');
+
+COMMENT ON COLUMN refresh_token.token_hash IS '(confidentiality, high), (integrity, high), (availability, high), restricted';
+
+/*
+A session is a token family: every rotation replaces the token of the session and
+remembers the rotated one. Presenting a rotated token again means that the token was
+stolen, so the whole family is revoked (OAuth 2.0 Security BCP, refresh token rotation).
+*/
+CREATE TABLE IF NOT EXISTS refresh_token_rotated (
+    token_hash TEXT PRIMARY KEY CHECK (token_hash ~ '^[a-f0-9]{64}$'),
+    session_id UUID NOT NULL REFERENCES refresh_token(session_id) ON DELETE CASCADE,
+    rotated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+COMMENT ON COLUMN refresh_token_rotated.token_hash IS '(confidentiality, high), (integrity, high), (availability, moderate), restricted';
+COMMENT ON COLUMN refresh_token_rotated.session_id IS '(confidentiality, low), (integrity, high), (availability, moderate), internal';
+COMMENT ON COLUMN refresh_token_rotated.rotated_at IS '(confidentiality, low), (integrity, low), (availability, low), internal';
+
+CREATE INDEX IF NOT EXISTS idx_refresh_token_rotated_session_id ON refresh_token_rotated(session_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS refresh_token_rotated;
+-- hashes cannot be turned back into token IDs, every user has to log in again
+DELETE FROM refresh_token;
+ALTER TABLE refresh_token RENAME COLUMN token_hash TO id;
+-- +goose StatementEnd
@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+-- pending social logins, one row per authorization request, consumed by the callback
+CREATE TABLE IF NOT EXISTS oauth_state (
+    state_hash TEXT PRIMARY KEY CHECK (state_hash ~ '^[a-f0-9]{64}$'),
+    provider TEXT NOT NULL CHECK (provider IN ('google', 'github')),
+    code_verifier TEXT NOT NULL CHECK (char_length(code_verifier) BETWEEN 43 AND 128),
+    nonce TEXT NOT NULL CHECK (char_length(nonce) <= 128),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+COMMENT ON COLUMN oauth_state.state_hash IS '(confidentiality, moderate), (integrity, high), (availability, low), internal';
+COMMENT ON COLUMN oauth_state.provider IS '(confidentiality, n/a), (integrity, moderate), (availability, low), internal';
+COMMENT ON COLUMN oauth_state.code_verifier IS '(confidentiality, high), (integrity, high), (availability, low), restricted';
+COMMENT ON COLUMN oauth_state.nonce IS '(confidentiality, moderate), (integrity, high), (availability, low), internal';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS oauth_state;
+-- +goose StatementEnd
@@ -0,0 +1,27 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE "user" ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMPTZ;
+
+COMMENT ON COLUMN "user".email_verified_at IS '(confidentiality, low), (integrity, high), (availability, moderate), internal';
+
+-- the tokens themselves are signed JWTs, a row only exists while the token can still be used
+CREATE TABLE IF NOT EXISTS email_verification_token (
+    token_hash TEXT PRIMARY KEY CHECK (token_hash ~ '^[a-f0-9]{64}$'),
+    user_id UUID NOT NULL REFERENCES "user"(id) ON DELETE CASCADE,
+    email TEXT NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+COMMENT ON COLUMN email_verification_token.token_hash IS '(confidentiality, high), (integrity, high), (availability, low), restricted';
+COMMENT ON COLUMN email_verification_token.user_id IS '(confidentiality, low), (integrity, high), (availability, low), internal';
+COMMENT ON COLUMN email_verification_token.email IS '(confidentiality, moderate), (integrity, high), (availability, low), internal';
+
+CREATE INDEX IF NOT EXISTS idx_email_verification_token_user_id ON email_verification_token(user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS email_verification_token;
+ALTER TABLE "user" DROP COLUMN IF EXISTS email_verified_at;
+-- +goose StatementEnd
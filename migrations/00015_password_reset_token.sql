@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS password_reset_token (
+    token_hash TEXT PRIMARY KEY CHECK (token_hash ~ '^[a-f0-9]{64}$'),
+    user_id UUID NOT NULL REFERENCES "user"(id) ON DELETE CASCADE,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+COMMENT ON COLUMN password_reset_token.token_hash IS '(confidentiality, high), (integrity, high), (availability, low), restricted';
+COMMENT ON COLUMN password_reset_token.user_id IS '(confidentiality, low), (integrity, high), (availability, low), internal';
+COMMENT ON COLUMN password_reset_token.expires_at IS '(confidentiality, n/a), (integrity, high), (availability, low), internal';
+
+CREATE INDEX IF NOT EXISTS idx_password_reset_token_user_id ON password_reset_token(user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS password_reset_token;
+-- +goose StatementEnd
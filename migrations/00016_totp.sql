@@ -0,0 +1,48 @@
+-- +goose Up
+-- +goose StatementBegin
+-- totp_secret is set when the enrollment starts, 2FA is only on once totp_enabled_at is set
+ALTER TABLE "user" ADD COLUMN IF NOT EXISTS totp_secret TEXT CHECK (totp_secret ~ '^[A-Z2-7]{32}$');
+ALTER TABLE "user" ADD COLUMN IF NOT EXISTS totp_enabled_at TIMESTAMPTZ;
+ALTER TABLE "user" ADD COLUMN IF NOT EXISTS totp_last_used_step BIGINT;
+
+COMMENT ON COLUMN "user".totp_secret IS '(confidentiality, high), (integrity, high), (availability, moderate), restricted';
+COMMENT ON COLUMN "user".totp_enabled_at IS '(confidentiality, low), (integrity, high), (availability, moderate), internal';
+COMMENT ON COLUMN "user".totp_last_used_step IS '(confidentiality, low), (integrity, high), (availability, moderate), internal';
+
+CREATE TABLE IF NOT EXISTS mfa_recovery_code (
+    code_hash TEXT NOT NULL CHECK (code_hash ~ '^[a-f0-9]{64}$'),
+    user_id UUID NOT NULL REFERENCES "user"(id) ON DELETE CASCADE,
+    used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, code_hash)
+);
+
+COMMENT ON COLUMN mfa_recovery_code.code_hash IS '(confidentiality, high), (integrity, high), (availability, moderate), restricted';
+COMMENT ON COLUMN mfa_recovery_code.user_id IS '(confidentiality, low), (integrity, high), (availability, moderate), internal';
+COMMENT ON COLUMN mfa_recovery_code.used_at IS '(confidentiality, low), (integrity, high), (availability, moderate), internal';
+
+-- a login that passed the password check and waits for the second factor
+CREATE TABLE IF NOT EXISTS mfa_challenge (
+    token_hash TEXT PRIMARY KEY CHECK (token_hash ~ '^[a-f0-9]{64}$'),
+    user_id UUID NOT NULL REFERENCES "user"(id) ON DELETE CASCADE,
+    failed_attempts INT NOT NULL DEFAULT 0,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+COMMENT ON COLUMN mfa_challenge.token_hash IS '(confidentiality, high), (integrity, high), (availability, low), restricted';
+COMMENT ON COLUMN mfa_challenge.user_id IS '(confidentiality, low), (integrity, high), (availability, low), internal';
+COMMENT ON COLUMN mfa_challenge.failed_attempts IS '(confidentiality, low), (integrity, high), (availability, low), internal';
+COMMENT ON COLUMN mfa_challenge.expires_at IS '(confidentiality, n/a), (integrity, high), (availability, low), internal';
+
+CREATE INDEX IF NOT EXISTS idx_mfa_challenge_user_id ON mfa_challenge(user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS mfa_challenge;
+DROP TABLE IF EXISTS mfa_recovery_code;
+ALTER TABLE "user" DROP COLUMN IF EXISTS totp_last_used_step;
+ALTER TABLE "user" DROP COLUMN IF EXISTS totp_enabled_at;
+ALTER TABLE "user" DROP COLUMN IF EXISTS totp_secret;
+-- +goose StatementEnd
@@ -0,0 +1,39 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS webauthn_credential (
+    -- base64url credential ID chosen by the authenticator
+    id TEXT PRIMARY KEY CHECK (char_length(id) BETWEEN 1 AND 1366),
+    user_id UUID NOT NULL REFERENCES "user"(id) ON DELETE CASCADE,
+    public_key BYTEA NOT NULL,
+    sign_count BIGINT NOT NULL DEFAULT 0 CHECK (sign_count >= 0),
+    name TEXT NOT NULL CHECK (char_length(name) BETWEEN 1 AND 64),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_used_at TIMESTAMPTZ
+);
+
+COMMENT ON COLUMN webauthn_credential.id IS '(confidentiality, low), (integrity, high), (availability, high), internal';
+COMMENT ON COLUMN webauthn_credential.user_id IS '(confidentiality, low), (integrity, high), (availability, high), internal';
+COMMENT ON COLUMN webauthn_credential.public_key IS '(confidentiality, low), (integrity, high), (availability, high), internal';
+COMMENT ON COLUMN webauthn_credential.sign_count IS '(confidentiality, low), (integrity, high), (availability, high), internal';
+COMMENT ON COLUMN webauthn_credential.name IS '(confidentiality, low), (integrity, moderate), (availability, moderate), internal';
+
+CREATE INDEX IF NOT EXISTS idx_webauthn_credential_user_id ON webauthn_credential(user_id);
+
+-- registration challenges belong to a user, authentication challenges do not
+CREATE TABLE IF NOT EXISTS webauthn_challenge (
+    challenge_hash TEXT PRIMARY KEY CHECK (challenge_hash ~ '^[a-f0-9]{64}$'),
+    user_id UUID REFERENCES "user"(id) ON DELETE CASCADE,
+    ceremony TEXT NOT NULL CHECK (ceremony IN ('registration', 'authentication')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+COMMENT ON COLUMN webauthn_challenge.challenge_hash IS '(confidentiality, moderate), (integrity, high), (availability, low), internal';
+COMMENT ON COLUMN webauthn_challenge.user_id IS '(confidentiality, low), (integrity, high), (availability, low), internal';
+COMMENT ON COLUMN webauthn_challenge.ceremony IS '(confidentiality, n/a), (integrity, high), (availability, low), internal';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS webauthn_challenge;
+DROP TABLE IF EXISTS webauthn_credential;
+-- +goose StatementEnd
@@ -0,0 +1,37 @@
+-- +goose Up
+-- +goose StatementBegin
+-- failed logins per account (lower case email, known or not) and per client IP
+CREATE TABLE IF NOT EXISTS login_throttle (
+    scope TEXT NOT NULL CHECK (scope IN ('account', 'ip')),
+    subject TEXT NOT NULL CHECK (char_length(subject) BETWEEN 1 AND 320),
+    failed_count INT NOT NULL DEFAULT 0 CHECK (failed_count >= 0),
+    last_failed_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    locked_until TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (scope, subject)
+);
+
+COMMENT ON COLUMN login_throttle.scope IS '(confidentiality, n/a), (integrity, high), (availability, high), internal';
+COMMENT ON COLUMN login_throttle.subject IS '(confidentiality, moderate), (integrity, high), (availability, high), internal';
+COMMENT ON COLUMN login_throttle.failed_count IS '(confidentiality, low), (integrity, high), (availability, high), internal';
+COMMENT ON COLUMN login_throttle.last_failed_at IS '(confidentiality, low), (integrity, high), (availability, high), internal';
+COMMENT ON COLUMN login_throttle.locked_until IS '(confidentiality, low), (integrity, high), (availability, high), internal';
+
+CREATE TABLE IF NOT EXISTS account_unlock_token (
+    token_hash TEXT PRIMARY KEY CHECK (token_hash ~ '^[a-f0-9]{64}$'),
+    user_id UUID NOT NULL REFERENCES "user"(id) ON DELETE CASCADE,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+COMMENT ON COLUMN account_unlock_token.token_hash IS '(confidentiality, high), (integrity, high), (availability, low), restricted';
+COMMENT ON COLUMN account_unlock_token.user_id IS '(confidentiality, low), (integrity, high), (availability, low), internal';
+COMMENT ON COLUMN account_unlock_token.expires_at IS '(confidentiality, n/a), (integrity, high), (availability, low), internal';
+
+CREATE INDEX IF NOT EXISTS idx_account_unlock_token_user_id ON account_unlock_token(user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS account_unlock_token;
+DROP TABLE IF EXISTS login_throttle;
+-- +goose StatementEnd
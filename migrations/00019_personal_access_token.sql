@@ -0,0 +1,29 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS personal_access_token (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES "user"(id) ON DELETE CASCADE,
+    token_hash TEXT NOT NULL UNIQUE CHECK (token_hash ~ '^[a-f0-9]{64}$'),
+    name TEXT NOT NULL CHECK (char_length(name) BETWEEN 1 AND 64),
+    -- space separated, like the scope of OAuth
+    scope TEXT NOT NULL CHECK (scope ~ '^[a-z:]+( [a-z:]+)*$'),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    last_used_at TIMESTAMPTZ
+);
+
+COMMENT ON COLUMN personal_access_token.id IS '(confidentiality, low), (integrity, high), (availability, high), internal';
+COMMENT ON COLUMN personal_access_token.user_id IS '(confidentiality, low), (integrity, high), (availability, high), internal';
+COMMENT ON COLUMN personal_access_token.token_hash IS '(confidentiality, high), (integrity, high), (availability, high), restricted';
+COMMENT ON COLUMN personal_access_token.name IS '(confidentiality, low), (integrity, moderate), (availability, moderate), internal';
+COMMENT ON COLUMN personal_access_token.scope IS '(confidentiality, low), (integrity, high), (availability, high), internal';
+COMMENT ON COLUMN personal_access_token.expires_at IS '(confidentiality, n/a), (integrity, high), (availability, high), internal';
+COMMENT ON COLUMN personal_access_token.last_used_at IS '(confidentiality, low), (integrity, moderate), (availability, low), internal';
+
+CREATE INDEX IF NOT EXISTS idx_personal_access_token_user_id ON personal_access_token(user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS personal_access_token;
+-- +goose StatementEnd
@@ -0,0 +1,47 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE "user" ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'user' CHECK (role IN ('user', 'moderator', 'admin'));
+
+COMMENT ON COLUMN "user".role IS '(confidentiality, low), (integrity, high), (availability, high), internal';
+
+-- hidden content stays in the database but is left out of every listing
+ALTER TABLE challenge ADD COLUMN IF NOT EXISTS hidden_at TIMESTAMPTZ;
+ALTER TABLE challenge_response ADD COLUMN IF NOT EXISTS hidden_at TIMESTAMPTZ;
+ALTER TABLE comment ADD COLUMN IF NOT EXISTS hidden_at TIMESTAMPTZ;
+
+COMMENT ON COLUMN challenge.hidden_at IS '(confidentiality, n/a), (integrity, high), (availability, moderate), internal';
+COMMENT ON COLUMN challenge_response.hidden_at IS '(confidentiality, n/a), (integrity, high), (availability, moderate), internal';
+COMMENT ON COLUMN comment.hidden_at IS '(confidentiality, n/a), (integrity, high), (availability, moderate), internal';
+
+-- the log outlives the content and the accounts it names, so there are no foreign keys on the target
+CREATE TABLE IF NOT EXISTS moderation_action (
+    id INT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    moderator_id UUID REFERENCES "user"(id) ON DELETE SET NULL,
+    owner_id UUID REFERENCES "user"(id) ON DELETE SET NULL,
+    target_type TEXT NOT NULL CHECK (target_type IN ('challenge', 'challenge_response', 'comment')),
+    target_id INT NOT NULL,
+    target_title TEXT NOT NULL,
+    action TEXT NOT NULL CHECK (action IN ('edit', 'hide', 'unhide', 'delete')),
+    reason TEXT CHECK (char_length(reason) <= 1000),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+COMMENT ON COLUMN moderation_action.moderator_id IS '(confidentiality, low), (integrity, high), (availability, moderate), internal';
+COMMENT ON COLUMN moderation_action.owner_id IS '(confidentiality, low), (integrity, high), (availability, moderate), internal';
+COMMENT ON COLUMN moderation_action.target_type IS '(confidentiality, n/a), (integrity, high), (availability, moderate), internal';
+COMMENT ON COLUMN moderation_action.target_id IS '(confidentiality, n/a), (integrity, high), (availability, moderate), internal';
+COMMENT ON COLUMN moderation_action.target_title IS '(confidentiality, low), (integrity, moderate), (availability, moderate), internal';
+COMMENT ON COLUMN moderation_action.action IS '(confidentiality, n/a), (integrity, high), (availability, moderate), internal';
+COMMENT ON COLUMN moderation_action.reason IS '(confidentiality, low), (integrity, moderate), (availability, moderate), internal';
+
+CREATE INDEX IF NOT EXISTS idx_moderation_action_created_at ON moderation_action(created_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS moderation_action;
+ALTER TABLE comment DROP COLUMN IF EXISTS hidden_at;
+ALTER TABLE challenge_response DROP COLUMN IF EXISTS hidden_at;
+ALTER TABLE challenge DROP COLUMN IF EXISTS hidden_at;
+ALTER TABLE "user" DROP COLUMN IF EXISTS role;
+-- +goose StatementEnd
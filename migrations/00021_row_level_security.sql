@@ -0,0 +1,110 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- the server connects as the table owner, which skips row level security, so scoped transactions switch to this role
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'hackme_app') THEN
+        CREATE ROLE hackme_app NOLOGIN;
+    END IF;
+END$$;
+
+-- SET ROLE needs membership when the server does not connect as a superuser
+GRANT hackme_app TO CURRENT_USER;
+GRANT USAGE ON SCHEMA public TO hackme_app;
+GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA public TO hackme_app;
+GRANT USAGE, SELECT ON ALL SEQUENCES IN SCHEMA public TO hackme_app;
+ALTER DEFAULT PRIVILEGES IN SCHEMA public GRANT SELECT, INSERT, UPDATE, DELETE ON TABLES TO hackme_app;
+ALTER DEFAULT PRIVILEGES IN SCHEMA public GRANT USAGE, SELECT ON SEQUENCES TO hackme_app;
+
+-- app.user_id is set per transaction, outside of one it is empty and matches no owner
+CREATE OR REPLACE FUNCTION app_user_id()
+RETURNS UUID AS $$
+    SELECT NULLIF(current_setting('app.user_id', true), '')::UUID;
+$$ LANGUAGE sql STABLE;
+
+CREATE OR REPLACE FUNCTION app_user_is_moderator()
+RETURNS BOOLEAN AS $$
+    SELECT EXISTS (
+        SELECT 1 FROM "user" WHERE id = app_user_id() AND role IN ('moderator', 'admin')
+    );
+$$ LANGUAGE sql STABLE;
+
+-- votes update the counters on responses of other users, the trigger keeps doing so as the owner of the table
+ALTER FUNCTION sync_challenge_response_votes() SECURITY DEFINER SET search_path = public;
+
+-- content is public to read, only the owner or a moderator may change it
+ALTER TABLE challenge ENABLE ROW LEVEL SECURITY;
+
+CREATE POLICY challenge_select ON challenge FOR SELECT USING (true);
+CREATE POLICY challenge_insert ON challenge FOR INSERT WITH CHECK (user_id = app_user_id());
+CREATE POLICY challenge_update ON challenge FOR UPDATE
+    USING (user_id = app_user_id() OR app_user_is_moderator())
+    WITH CHECK (user_id = app_user_id() OR app_user_is_moderator());
+CREATE POLICY challenge_delete ON challenge FOR DELETE USING (user_id = app_user_id() OR app_user_is_moderator());
+
+ALTER TABLE challenge_response ENABLE ROW LEVEL SECURITY;
+
+CREATE POLICY challenge_response_select ON challenge_response FOR SELECT USING (true);
+CREATE POLICY challenge_response_insert ON challenge_response FOR INSERT WITH CHECK (user_id = app_user_id());
+CREATE POLICY challenge_response_update ON challenge_response FOR UPDATE
+    USING (user_id = app_user_id() OR app_user_is_moderator())
+    WITH CHECK (user_id = app_user_id() OR app_user_is_moderator());
+CREATE POLICY challenge_response_delete ON challenge_response FOR DELETE USING (user_id = app_user_id() OR app_user_is_moderator());
+
+ALTER TABLE comment ENABLE ROW LEVEL SECURITY;
+
+CREATE POLICY comment_select ON comment FOR SELECT USING (true);
+CREATE POLICY comment_insert ON comment FOR INSERT WITH CHECK (user_id = app_user_id());
+CREATE POLICY comment_update ON comment FOR UPDATE
+    USING (user_id = app_user_id() OR app_user_is_moderator())
+    WITH CHECK (user_id = app_user_id() OR app_user_is_moderator());
+CREATE POLICY comment_delete ON comment FOR DELETE USING (user_id = app_user_id() OR app_user_is_moderator());
+
+-- nobody casts or removes a vote for someone else, moderators included
+ALTER TABLE challenge_response_votes ENABLE ROW LEVEL SECURITY;
+
+CREATE POLICY challenge_response_votes_select ON challenge_response_votes FOR SELECT USING (true);
+CREATE POLICY challenge_response_votes_insert ON challenge_response_votes FOR INSERT WITH CHECK (user_id = app_user_id());
+CREATE POLICY challenge_response_votes_update ON challenge_response_votes FOR UPDATE
+    USING (user_id = app_user_id())
+    WITH CHECK (user_id = app_user_id());
+CREATE POLICY challenge_response_votes_delete ON challenge_response_votes FOR DELETE USING (user_id = app_user_id());
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP POLICY IF EXISTS challenge_response_votes_delete ON challenge_response_votes;
+DROP POLICY IF EXISTS challenge_response_votes_update ON challenge_response_votes;
+DROP POLICY IF EXISTS challenge_response_votes_insert ON challenge_response_votes;
+DROP POLICY IF EXISTS challenge_response_votes_select ON challenge_response_votes;
+ALTER TABLE challenge_response_votes DISABLE ROW LEVEL SECURITY;
+
+DROP POLICY IF EXISTS comment_delete ON comment;
+DROP POLICY IF EXISTS comment_update ON comment;
+DROP POLICY IF EXISTS comment_insert ON comment;
+DROP POLICY IF EXISTS comment_select ON comment;
+ALTER TABLE comment DISABLE ROW LEVEL SECURITY;
+
+DROP POLICY IF EXISTS challenge_response_delete ON challenge_response;
+DROP POLICY IF EXISTS challenge_response_update ON challenge_response;
+DROP POLICY IF EXISTS challenge_response_insert ON challenge_response;
+DROP POLICY IF EXISTS challenge_response_select ON challenge_response;
+ALTER TABLE challenge_response DISABLE ROW LEVEL SECURITY;
+
+DROP POLICY IF EXISTS challenge_delete ON challenge;
+DROP POLICY IF EXISTS challenge_update ON challenge;
+DROP POLICY IF EXISTS challenge_insert ON challenge;
+DROP POLICY IF EXISTS challenge_select ON challenge;
+ALTER TABLE challenge DISABLE ROW LEVEL SECURITY;
+
+ALTER FUNCTION sync_challenge_response_votes() SECURITY INVOKER RESET search_path;
+
+DROP FUNCTION IF EXISTS app_user_is_moderator();
+DROP FUNCTION IF EXISTS app_user_id();
+
+ALTER DEFAULT PRIVILEGES IN SCHEMA public REVOKE USAGE, SELECT ON SEQUENCES FROM hackme_app;
+ALTER DEFAULT PRIVILEGES IN SCHEMA public REVOKE SELECT, INSERT, UPDATE, DELETE ON TABLES FROM hackme_app;
+DROP OWNED BY hackme_app;
+DROP ROLE IF EXISTS hackme_app;
+-- +goose StatementEnd
@@ -0,0 +1,61 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- the log outlives the accounts it names, so there is no foreign key on the user
+CREATE TABLE IF NOT EXISTS security_event (
+    id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    user_id UUID,
+    event_type TEXT NOT NULL CHECK (event_type IN (
+        'login',
+        'login_failed',
+        'account_locked',
+        'account_unlocked',
+        'logout',
+        'password_changed',
+        'password_reset',
+        'username_changed',
+        'email_verified',
+        'token_rotated',
+        'refresh_token_reused',
+        'session_revoked',
+        'all_sessions_revoked',
+        'account_deleted',
+        'csrf_rejected'
+    )),
+    ip_address TEXT NOT NULL,
+    user_agent TEXT NOT NULL,
+    detail TEXT CHECK (char_length(detail) <= 500),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+COMMENT ON COLUMN security_event.user_id IS '(confidentiality, low), (integrity, high), (availability, moderate), internal';
+COMMENT ON COLUMN security_event.event_type IS '(confidentiality, low), (integrity, high), (availability, moderate), internal';
+COMMENT ON COLUMN security_event.ip_address IS '(confidentiality, moderate), (integrity, high), (availability, moderate), internal';
+COMMENT ON COLUMN security_event.user_agent IS '(confidentiality, low), (integrity, high), (availability, moderate), internal';
+COMMENT ON COLUMN security_event.detail IS '(confidentiality, low), (integrity, high), (availability, moderate), internal';
+COMMENT ON COLUMN security_event.created_at IS '(confidentiality, low), (integrity, high), (availability, moderate), internal';
+
+CREATE INDEX IF NOT EXISTS security_event_user_id_idx ON security_event (user_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS security_event_created_at_idx ON security_event (created_at DESC);
+
+-- events are only ever added, a row that changed afterwards would prove nothing
+CREATE OR REPLACE FUNCTION reject_security_event_change()
+RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'security_event is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER trg_security_event_append_only
+BEFORE UPDATE OR DELETE ON security_event
+FOR EACH ROW
+EXECUTE FUNCTION reject_security_event_change();
+
+REVOKE UPDATE, DELETE ON security_event FROM hackme_app;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS security_event;
+DROP FUNCTION IF EXISTS reject_security_event_change();
+-- +goose StatementEnd
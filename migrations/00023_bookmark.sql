@@ -0,0 +1,32 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- a bookmark points at a challenge or at a response, never at both or neither
+ALTER TABLE user_bookmark ADD CONSTRAINT user_bookmark_one_target CHECK (num_nonnulls(challenge_id, challenge_response_id) = 1);
+
+COMMENT ON COLUMN user_bookmark.user_id IS '(confidentiality, moderate), (integrity, moderate), (availability, low), internal';
+COMMENT ON COLUMN user_bookmark.challenge_id IS '(confidentiality, moderate), (integrity, moderate), (availability, low), internal';
+COMMENT ON COLUMN user_bookmark.challenge_response_id IS '(confidentiality, moderate), (integrity, moderate), (availability, low), internal';
+COMMENT ON COLUMN user_bookmark.created_at IS '(confidentiality, low), (integrity, low), (availability, low), internal';
+COMMENT ON COLUMN user_bookmark.updated_at IS '(confidentiality, low), (integrity, low), (availability, low), internal';
+
+CREATE INDEX IF NOT EXISTS user_bookmark_user_id_idx ON user_bookmark (user_id, created_at DESC);
+
+-- what someone saved is private, unlike the content it points at
+ALTER TABLE user_bookmark ENABLE ROW LEVEL SECURITY;
+
+CREATE POLICY user_bookmark_select ON user_bookmark FOR SELECT USING (user_id = app_user_id());
+CREATE POLICY user_bookmark_insert ON user_bookmark FOR INSERT WITH CHECK (user_id = app_user_id());
+CREATE POLICY user_bookmark_delete ON user_bookmark FOR DELETE USING (user_id = app_user_id());
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP POLICY IF EXISTS user_bookmark_delete ON user_bookmark;
+DROP POLICY IF EXISTS user_bookmark_insert ON user_bookmark;
+DROP POLICY IF EXISTS user_bookmark_select ON user_bookmark;
+ALTER TABLE user_bookmark DISABLE ROW LEVEL SECURITY;
+
+DROP INDEX IF EXISTS user_bookmark_user_id_idx;
+ALTER TABLE user_bookmark DROP CONSTRAINT IF EXISTS user_bookmark_one_target;
+-- +goose StatementEnd
@@ -0,0 +1,39 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- reason becomes a category, what the reporter writes goes in details
+ALTER TABLE user_report ADD CONSTRAINT user_report_reason_category CHECK (reason IN ('spam', 'harassment', 'inappropriate', 'spoiler', 'other'));
+ALTER TABLE user_report ADD COLUMN IF NOT EXISTS details TEXT CHECK (char_length(details) <= 1000);
+
+ALTER TABLE user_report ADD COLUMN IF NOT EXISTS comment_id INT REFERENCES comment(id) ON DELETE CASCADE;
+ALTER TABLE user_report ADD CONSTRAINT user_report_user_id_comment_id_key UNIQUE (user_id, comment_id);
+ALTER TABLE user_report ADD CONSTRAINT user_report_one_target CHECK (num_nonnulls(challenge_id, challenge_response_id, comment_id) = 1);
+
+ALTER TABLE user_report ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'actioned', 'dismissed'));
+ALTER TABLE user_report ADD COLUMN IF NOT EXISTS resolved_by UUID REFERENCES "user"(id) ON DELETE SET NULL;
+ALTER TABLE user_report ADD COLUMN IF NOT EXISTS resolved_at TIMESTAMPTZ;
+
+COMMENT ON COLUMN user_report.user_id IS '(confidentiality, moderate), (integrity, moderate), (availability, moderate), internal';
+COMMENT ON COLUMN user_report.reason IS '(confidentiality, low), (integrity, moderate), (availability, moderate), internal';
+COMMENT ON COLUMN user_report.details IS '(confidentiality, moderate), (integrity, moderate), (availability, moderate), internal';
+COMMENT ON COLUMN user_report.challenge_id IS '(confidentiality, low), (integrity, moderate), (availability, moderate), internal';
+COMMENT ON COLUMN user_report.challenge_response_id IS '(confidentiality, low), (integrity, moderate), (availability, moderate), internal';
+COMMENT ON COLUMN user_report.comment_id IS '(confidentiality, low), (integrity, moderate), (availability, moderate), internal';
+COMMENT ON COLUMN user_report.status IS '(confidentiality, low), (integrity, high), (availability, moderate), internal';
+COMMENT ON COLUMN user_report.resolved_by IS '(confidentiality, low), (integrity, high), (availability, moderate), internal';
+COMMENT ON COLUMN user_report.resolved_at IS '(confidentiality, low), (integrity, moderate), (availability, moderate), internal';
+
+CREATE INDEX IF NOT EXISTS user_report_status_idx ON user_report (status, created_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS user_report_status_idx;
+ALTER TABLE user_report DROP COLUMN IF EXISTS resolved_at;
+ALTER TABLE user_report DROP COLUMN IF EXISTS resolved_by;
+ALTER TABLE user_report DROP COLUMN IF EXISTS status;
+ALTER TABLE user_report DROP CONSTRAINT IF EXISTS user_report_one_target;
+ALTER TABLE user_report DROP COLUMN IF EXISTS comment_id;
+ALTER TABLE user_report DROP COLUMN IF EXISTS details;
+ALTER TABLE user_report DROP CONSTRAINT IF EXISTS user_report_reason_category;
+-- +goose StatementEnd
@@ -0,0 +1,12 @@
+-- +goose Up
+-- +goose StatementBegin
+-- the join date is shown on public profiles
+COMMENT ON COLUMN "user".created_at IS '(confidentiality, n/a), (integrity, low), (availability, low), public';
+COMMENT ON COLUMN "user".updated_at IS '(confidentiality, low), (integrity, low), (availability, low), internal';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+COMMENT ON COLUMN "user".created_at IS NULL;
+COMMENT ON COLUMN "user".updated_at IS NULL;
+-- +goose StatementEnd
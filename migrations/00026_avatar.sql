@@ -0,0 +1,12 @@
+-- +goose Up
+-- +goose StatementBegin
+-- key of the uploaded avatar in the blob storage, image_link then points at our own avatar route
+ALTER TABLE "user" ADD COLUMN IF NOT EXISTS avatar_key TEXT;
+
+COMMENT ON COLUMN "user".avatar_key IS '(confidentiality, n/a), (integrity, moderate), (availability, low), internal';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE "user" DROP COLUMN IF EXISTS avatar_key;
+-- +goose StatementEnd
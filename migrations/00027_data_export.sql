@@ -0,0 +1,70 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- user_id is cleared rather than cascaded when the account is deleted, the cleanup job still needs blob_key to remove the archive
+CREATE TABLE IF NOT EXISTS data_export (
+    id UUID PRIMARY KEY,
+    user_id UUID REFERENCES "user"(id) ON DELETE SET NULL,
+    status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'ready', 'failed')),
+    blob_key TEXT,
+    expires_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    completed_at TIMESTAMPTZ
+);
+
+COMMENT ON COLUMN data_export.id IS '(confidentiality, moderate), (integrity, high), (availability, low), internal';
+COMMENT ON COLUMN data_export.user_id IS '(confidentiality, low), (integrity, high), (availability, low), internal';
+COMMENT ON COLUMN data_export.status IS '(confidentiality, n/a), (integrity, moderate), (availability, low), internal';
+COMMENT ON COLUMN data_export.blob_key IS '(confidentiality, moderate), (integrity, high), (availability, low), internal';
+COMMENT ON COLUMN data_export.expires_at IS '(confidentiality, n/a), (integrity, high), (availability, low), internal';
+COMMENT ON COLUMN data_export.created_at IS '(confidentiality, n/a), (integrity, low), (availability, low), internal';
+COMMENT ON COLUMN data_export.completed_at IS '(confidentiality, n/a), (integrity, low), (availability, low), internal';
+
+-- one archive is built at a time per user
+CREATE UNIQUE INDEX IF NOT EXISTS data_export_one_pending_idx ON data_export (user_id) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS data_export_user_id_idx ON data_export (user_id, created_at DESC);
+
+ALTER TABLE security_event DROP CONSTRAINT IF EXISTS security_event_event_type_check;
+ALTER TABLE security_event ADD CONSTRAINT security_event_event_type_check CHECK (event_type IN (
+    'login',
+    'login_failed',
+    'account_locked',
+    'account_unlocked',
+    'logout',
+    'password_changed',
+    'password_reset',
+    'username_changed',
+    'email_verified',
+    'token_rotated',
+    'refresh_token_reused',
+    'session_revoked',
+    'all_sessions_revoked',
+    'account_deleted',
+    'csrf_rejected',
+    'data_export_requested'
+));
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+-- the log is append-only, rows of the dropped type stay and are only exempt from the check
+ALTER TABLE security_event DROP CONSTRAINT IF EXISTS security_event_event_type_check;
+ALTER TABLE security_event ADD CONSTRAINT security_event_event_type_check CHECK (event_type IN (
+    'login',
+    'login_failed',
+    'account_locked',
+    'account_unlocked',
+    'logout',
+    'password_changed',
+    'password_reset',
+    'username_changed',
+    'email_verified',
+    'token_rotated',
+    'refresh_token_reused',
+    'session_revoked',
+    'all_sessions_revoked',
+    'account_deleted',
+    'csrf_rejected'
+)) NOT VALID;
+DROP TABLE IF EXISTS data_export;
+-- +goose StatementEnd
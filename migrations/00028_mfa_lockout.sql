@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+-- every two-factor code check of the user counts, a correct code starts over
+ALTER TABLE "user" ADD COLUMN IF NOT EXISTS mfa_failed_attempts INT NOT NULL DEFAULT 0 CHECK (mfa_failed_attempts >= 0);
+ALTER TABLE "user" ADD COLUMN IF NOT EXISTS mfa_locked_until TIMESTAMPTZ;
+
+COMMENT ON COLUMN "user".mfa_failed_attempts IS '(confidentiality, low), (integrity, high), (availability, moderate), internal';
+COMMENT ON COLUMN "user".mfa_locked_until IS '(confidentiality, low), (integrity, high), (availability, moderate), internal';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE "user" DROP COLUMN IF EXISTS mfa_locked_until;
+ALTER TABLE "user" DROP COLUMN IF EXISTS mfa_failed_attempts;
+-- +goose StatementEnd
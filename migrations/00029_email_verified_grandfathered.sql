@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+-- accounts created before verification existed never got a link. They are marked so
+-- REQUIRE_VERIFIED_EMAIL does not lock them out, but email_verified_at stays NULL
+-- because nobody proved they own the address, and OAuth logins never link to them
+ALTER TABLE "user" ADD COLUMN IF NOT EXISTS email_verified_grandfathered BOOLEAN NOT NULL DEFAULT false;
+
+COMMENT ON COLUMN "user".email_verified_grandfathered IS '(confidentiality, low), (integrity, high), (availability, moderate), internal';
+
+UPDATE "user" SET email_verified_grandfathered = true
+WHERE email_verified_at IS NULL
+  AND created_at < (SELECT min(tstamp) FROM goose_db_version WHERE version_id = 14 AND is_applied);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE "user" DROP COLUMN IF EXISTS email_verified_grandfathered;
+-- +goose StatementEnd
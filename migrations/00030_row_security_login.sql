@@ -0,0 +1,118 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- BeginAsUser used SET ROLE, which an injected RESET ROLE undoes. The server now logs in as
+-- hackme_app on its own connections, so the role must not lead back to the owner. The
+-- password is set outside of migrations, see the README
+REVOKE hackme_app FROM CURRENT_USER;
+ALTER ROLE hackme_app LOGIN NOINHERIT NOCREATEDB NOCREATEROLE;
+
+-- an injected set_config('app.user_id', ...) could act as anyone, so the transaction only
+-- carries a random grant. The owner connection writes the grant before the transaction
+-- starts, and hackme_app can neither read nor write this table
+CREATE TABLE IF NOT EXISTS row_security_grant (
+    grant_hash TEXT PRIMARY KEY CHECK (grant_hash ~ '^[a-f0-9]{64}$'),
+    user_id UUID NOT NULL REFERENCES "user"(id) ON DELETE CASCADE,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+COMMENT ON COLUMN row_security_grant.grant_hash IS '(confidentiality, high), (integrity, high), (availability, moderate), restricted';
+COMMENT ON COLUMN row_security_grant.user_id IS '(confidentiality, low), (integrity, high), (availability, moderate), internal';
+COMMENT ON COLUMN row_security_grant.expires_at IS '(confidentiality, low), (integrity, high), (availability, moderate), internal';
+
+CREATE INDEX IF NOT EXISTS idx_row_security_grant_expires_at ON row_security_grant(expires_at);
+
+-- both functions run as the owner, so hackme_app needs no access to the grants or to "user".role
+CREATE OR REPLACE FUNCTION app_user_id()
+RETURNS UUID AS $$
+    SELECT user_id FROM row_security_grant
+    WHERE grant_hash = encode(sha256(convert_to(current_setting('app.row_security_grant', true), 'UTF8')), 'hex')
+      AND expires_at > now();
+$$ LANGUAGE sql STABLE SECURITY DEFINER SET search_path = public;
+
+ALTER FUNCTION app_user_is_moderator() SECURITY DEFINER SET search_path = public;
+
+-- every table used to be writable, "user".role included. Only what the scoped transactions
+-- need is granted again, column by column
+REVOKE ALL ON ALL TABLES IN SCHEMA public FROM hackme_app;
+ALTER DEFAULT PRIVILEGES IN SCHEMA public REVOKE SELECT, INSERT, UPDATE, DELETE ON TABLES FROM hackme_app;
+
+GRANT SELECT, DELETE ON challenge, challenge_response, comment, challenge_response_votes, user_bookmark TO hackme_app;
+GRANT INSERT (name, content, user_id, category, initial_points, minimum_points, decay) ON challenge TO hackme_app;
+GRANT UPDATE (name, content, category, initial_points, minimum_points, decay, updated_at, hidden_at) ON challenge TO hackme_app;
+GRANT INSERT (challenge_id, user_id, name, content) ON challenge_response TO hackme_app;
+GRANT UPDATE (name, content, updated_at, hidden_at) ON challenge_response TO hackme_app;
+GRANT INSERT (parent_id, challenge_id, challenge_response_id, user_id, content) ON comment TO hackme_app;
+GRANT UPDATE (content, updated_at, hidden_at) ON comment TO hackme_app;
+GRANT INSERT (user_id, challenge_response_id, vote_type) ON challenge_response_votes TO hackme_app;
+GRANT UPDATE (vote_type, updated_at) ON challenge_response_votes TO hackme_app;
+GRANT INSERT (user_id, challenge_id, challenge_response_id) ON user_bookmark TO hackme_app;
+GRANT SELECT (id, challenge_id), INSERT (challenge_id, match_mode, flag_hash, flag_pattern), DELETE ON challenge_flag TO hackme_app;
+GRANT SELECT (id, moderator_id, created_at), INSERT (moderator_id, owner_id, target_type, target_id, target_title, action, reason) ON moderation_action TO hackme_app;
+-- the moderation log names the moderator and the owner, and mails the owner
+GRANT SELECT (id, username, email) ON "user" TO hackme_app;
+
+-- hidden_at is granted for moderators, the owner of a row must not show what a moderator hid
+CREATE OR REPLACE FUNCTION reject_hidden_at_change()
+RETURNS TRIGGER AS $$
+BEGIN
+    IF NEW.hidden_at IS DISTINCT FROM OLD.hidden_at AND current_user = 'hackme_app' AND NOT app_user_is_moderator() THEN
+        RAISE EXCEPTION 'only moderators can hide or show content' USING ERRCODE = 'insufficient_privilege';
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER trg_challenge_hidden_at BEFORE UPDATE ON challenge FOR EACH ROW EXECUTE FUNCTION reject_hidden_at_change();
+CREATE TRIGGER trg_challenge_response_hidden_at BEFORE UPDATE ON challenge_response FOR EACH ROW EXECUTE FUNCTION reject_hidden_at_change();
+CREATE TRIGGER trg_comment_hidden_at BEFORE UPDATE ON comment FOR EACH ROW EXECUTE FUNCTION reject_hidden_at_change();
+
+-- flags follow their challenge, the log entries follow the moderator who wrote them
+ALTER TABLE challenge_flag ENABLE ROW LEVEL SECURITY;
+
+CREATE POLICY challenge_flag_insert ON challenge_flag FOR INSERT WITH CHECK (
+    EXISTS (SELECT 1 FROM challenge c WHERE c.id = challenge_id AND (c.user_id = app_user_id() OR app_user_is_moderator()))
+);
+CREATE POLICY challenge_flag_delete ON challenge_flag FOR DELETE USING (
+    EXISTS (SELECT 1 FROM challenge c WHERE c.id = challenge_id AND (c.user_id = app_user_id() OR app_user_is_moderator()))
+);
+
+ALTER TABLE moderation_action ENABLE ROW LEVEL SECURITY;
+
+CREATE POLICY moderation_action_select ON moderation_action FOR SELECT USING (moderator_id = app_user_id());
+CREATE POLICY moderation_action_insert ON moderation_action FOR INSERT WITH CHECK (moderator_id = app_user_id() AND app_user_is_moderator());
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP POLICY IF EXISTS moderation_action_insert ON moderation_action;
+DROP POLICY IF EXISTS moderation_action_select ON moderation_action;
+ALTER TABLE moderation_action DISABLE ROW LEVEL SECURITY;
+
+DROP POLICY IF EXISTS challenge_flag_delete ON challenge_flag;
+DROP POLICY IF EXISTS challenge_flag_insert ON challenge_flag;
+ALTER TABLE challenge_flag DISABLE ROW LEVEL SECURITY;
+
+DROP TRIGGER IF EXISTS trg_comment_hidden_at ON comment;
+DROP TRIGGER IF EXISTS trg_challenge_response_hidden_at ON challenge_response;
+DROP TRIGGER IF EXISTS trg_challenge_hidden_at ON challenge;
+DROP FUNCTION IF EXISTS reject_hidden_at_change();
+
+REVOKE ALL ON ALL TABLES IN SCHEMA public FROM hackme_app;
+GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA public TO hackme_app;
+REVOKE UPDATE, DELETE ON security_event FROM hackme_app;
+ALTER DEFAULT PRIVILEGES IN SCHEMA public GRANT SELECT, INSERT, UPDATE, DELETE ON TABLES TO hackme_app;
+
+ALTER FUNCTION app_user_is_moderator() SECURITY INVOKER RESET search_path;
+
+CREATE OR REPLACE FUNCTION app_user_id()
+RETURNS UUID AS $$
+    SELECT NULLIF(current_setting('app.user_id', true), '')::UUID;
+$$ LANGUAGE sql STABLE;
+
+DROP TABLE IF EXISTS row_security_grant;
+
+ALTER ROLE hackme_app NOLOGIN PASSWORD NULL;
+GRANT hackme_app TO CURRENT_USER;
+-- +goose StatementEnd
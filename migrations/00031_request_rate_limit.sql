@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+-- requests per client IP to the endpoints that send emails or take tokens, one row per endpoint and IP
+CREATE TABLE IF NOT EXISTS request_rate_limit (
+    bucket TEXT NOT NULL CHECK (char_length(bucket) BETWEEN 1 AND 64),
+    ip_address TEXT NOT NULL CHECK (char_length(ip_address) BETWEEN 1 AND 64),
+    request_count INT NOT NULL DEFAULT 0 CHECK (request_count >= 0),
+    window_start TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (bucket, ip_address)
+);
+
+COMMENT ON COLUMN request_rate_limit.bucket IS '(confidentiality, n/a), (integrity, high), (availability, high), internal';
+COMMENT ON COLUMN request_rate_limit.ip_address IS '(confidentiality, moderate), (integrity, high), (availability, high), internal';
+COMMENT ON COLUMN request_rate_limit.request_count IS '(confidentiality, low), (integrity, high), (availability, high), internal';
+COMMENT ON COLUMN request_rate_limit.window_start IS '(confidentiality, low), (integrity, high), (availability, high), internal';
+
+CREATE INDEX IF NOT EXISTS idx_request_rate_limit_window_start ON request_rate_limit(window_start);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS request_rate_limit;
+-- +goose StatementEnd